@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// An admissionLane bounds how many requests of one kind may run at
+// once.  Requests that can't get a slot in time are turned away so
+// they can't pile up behind each other and starve ingestion.
+type admissionLane struct {
+	name  string
+	slots chan bool
+	// Whether per-client rate limits of this name apply.
+	rated bool
+}
+
+var heavyLane = &admissionLane{name: "query", rated: true}
+var fastLane = &admissionLane{name: "document"}
+var adminLane = &admissionLane{name: "admin"}
+var ingestLane = &admissionLane{name: "ingest", rated: true}
+
+var admissionLanes = []*admissionLane{heavyLane, fastLane, adminLane, ingestLane}
+
+func (l *admissionLane) setLimit(n int) {
+	if n > 0 {
+		l.slots = make(chan bool, n)
+	}
+}
+
+func (l *admissionLane) acquire() bool {
+	select {
+	case l.slots <- true:
+		return true
+	default:
+	}
+	if *admissionWait <= 0 {
+		return false
+	}
+	t := time.NewTimer(*admissionWait)
+	defer t.Stop()
+	select {
+	case l.slots <- true:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (l *admissionLane) release() {
+	<-l.slots
+}
+
+func (l *admissionLane) admit(h routeHandler) routeHandler {
+	return func(parts []string, w http.ResponseWriter, req *http.Request) {
+		if l.rated && !checkRate(l.name, w, req) {
+			return
+		}
+		if l.slots != nil {
+			if !l.acquire() {
+				w.Header().Set("Retry-After", strconv.Itoa(*admissionRetry))
+				emitError(503, w, "Service Unavailable",
+					fmt.Sprintf("too many concurrent %v requests", l.name))
+				return
+			}
+			defer l.release()
+		}
+		h(parts, w, req)
+	}
+}
+
+// laneStats reports how many slots of each bounded lane are in use.
+func laneStats() map[string]interface{} {
+	rv := map[string]interface{}{}
+	for _, l := range admissionLanes {
+		if l.slots != nil {
+			rv[l.name] = map[string]int{
+				"active": len(l.slots),
+				"limit":  cap(l.slots),
+			}
+		}
+	}
+	return rv
+}
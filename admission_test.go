@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdmissionLane(t *testing.T) {
+	l := &admissionLane{name: "test"}
+	l.setLimit(1)
+
+	inside := make(chan bool)
+	proceed := make(chan bool)
+	h := l.admit(func(parts []string, w http.ResponseWriter,
+		req *http.Request) {
+		inside <- true
+		<-proceed
+		w.WriteHeader(200)
+	})
+
+	req, _ := http.NewRequest("GET", "/x/_query", nil)
+	first := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		h(nil, first, req)
+		close(done)
+	}()
+	<-inside
+
+	second := httptest.NewRecorder()
+	h(nil, second, req)
+	if second.Code != 503 {
+		t.Fatalf("Expected 503 when saturated, got %v", second.Code)
+	}
+	if second.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected a Retry-After header")
+	}
+
+	close(proceed)
+	<-done
+	go func() { <-inside }()
+	third := httptest.NewRecorder()
+	h(nil, third, req)
+	if third.Code != 200 {
+		t.Fatalf("Expected 200 once a slot freed, got %v", third.Code)
+	}
+}
+
+func TestLaneStats(t *testing.T) {
+	defer func() { adminLane.slots = nil }()
+	adminLane.setLimit(2)
+	adminLane.acquire()
+	defer adminLane.release()
+
+	st, ok := laneStats()["admin"].(map[string]int)
+	if !ok {
+		t.Fatalf("Expected admin lane stats, got %v", laneStats())
+	}
+	if st["active"] != 1 || st["limit"] != 2 {
+		t.Errorf("Expected 1 of 2 active, got %v", st)
+	}
+}
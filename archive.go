@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shards that are done being written to can be moved to object
+// storage.  Archived shards stay listed on their database and are
+// fetched back into a local cache when a read needs them.
+
+var archive *objectStore
+
+func archiveObjectName(shard string) string {
+	return shard + dbExt
+}
+
+func isArchived(dbname, shard string) bool {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return false
+	}
+	for _, a := range m.Archived {
+		if a == shard {
+			return true
+		}
+	}
+	return false
+}
+
+func setArchived(dbname, shard string, archived bool) error {
+	return updateMeta(dbname, func(m *dbMeta) {
+		rv := []string{}
+		for _, a := range m.Archived {
+			if a != shard {
+				rv = append(rv, a)
+			}
+		}
+		if archived {
+			rv = append(rv, shard)
+			sort.Strings(rv)
+		}
+		m.Archived = rv
+	})
+}
+
+// archiveCache tracks archived shards that have been fetched back,
+// so the least recently used can be removed again.
+type archiveCache struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+var fetchedShards = &archiveCache{used: map[string]time.Time{}}
+
+// ensureLocal makes sure an archived shard is on local disk.
+func (c *archiveCache) ensureLocal(dbname, shard string) error {
+	name := dbname + "/" + shard
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.used[name] = time.Now()
+	if _, err := os.Stat(dbPath(name)); err == nil {
+		return nil
+	}
+	if archive == nil {
+		return os.ErrNotExist
+	}
+	log.Printf("Fetching archived shard %v", name)
+	if err := archive.download(archiveObjectName(name), dbPath(name)); err != nil {
+		delete(c.used, name)
+		return err
+	}
+	c.evict()
+	return nil
+}
+
+func (c *archiveCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.used, name)
+}
+
+// evict drops local copies beyond the cache size, oldest use first.
+// Readers that already have a shard open keep reading the unlinked
+// file.  The caller must hold the lock.
+func (c *archiveCache) evict() {
+	for len(c.used) > *archiveCacheSize {
+		oldest := ""
+		for n, t := range c.used {
+			if oldest == "" || t.Before(c.used[oldest]) {
+				oldest = n
+			}
+		}
+		dbRemoveConn(oldest)
+		os.Remove(dbPath(oldest))
+		delete(c.used, oldest)
+	}
+}
+
+// archiveShard uploads a shard and removes the local file.
+func archiveShard(dbname, shard string) error {
+	name := dbname + "/" + shard
+	if err := archive.upload(archiveObjectName(name), dbPath(name)); err != nil {
+		return err
+	}
+	if err := setArchived(dbname, shard, true); err != nil {
+		return err
+	}
+	forgetShard(name)
+	return os.Remove(dbPath(name))
+}
+
+// unarchive brings a shard back for writing.  It'll be archived
+// again once it's idle and old enough.
+func unarchive(dbname, shard string) error {
+	if err := fetchedShards.ensureLocal(dbname, shard); err != nil {
+		return err
+	}
+	fetchedShards.forget(dbname + "/" + shard)
+	return setArchived(dbname, shard, false)
+}
+
+func writerOpen(dbname string) bool {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	return dbConns[dbname] != nil
+}
+
+func archiveOnce() {
+	for _, dbname := range dblist(*dbRoot) {
+		period := dbShardPeriod(dbname)
+		if period == "" || dbReadOnly(dbname) {
+			continue
+		}
+		cutoff := time.Now().Add(-*archiveAfter)
+		for _, shard := range dbShards(dbname) {
+			start, err := time.Parse(shardLayout, shard)
+			if err != nil || isArchived(dbname, shard) ||
+				!shardEnd(period, start).Before(cutoff) ||
+				writerOpen(dbname+"/"+shard) {
+				continue
+			}
+			if err := archiveShard(dbname, shard); err != nil {
+				log.Printf("Error archiving %v/%v: %v", dbname, shard, err)
+				continue
+			}
+			log.Printf("Archived %v/%v", dbname, shard)
+		}
+	}
+}
+
+func archiver() {
+	for {
+		archiveOnce()
+		time.Sleep(*archiveInterval)
+	}
+}
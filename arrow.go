@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/dustin/gojson"
+)
+
+// Query results as an Arrow IPC stream, for format=arrow.  Each row
+// is a group: its timestamp, its groupby value (null without
+// groupby), and a column per pointer and reducer.  A value column is
+// a double if every value in it is a number, otherwise it's text,
+// with anything that isn't a string as JSON.  Since the types depend
+// on every value, results are held until the end and sent as a single
+// record batch.
+//
+// The stream's flatbuffer metadata is small and fixed in shape, so
+// it's built by hand here rather than through generated code.
+
+const arrowType = "application/vnd.apache.arrow.stream"
+
+// Metadata constants from Message.fbs and Schema.fbs.
+const (
+	arrowV5 = 4
+
+	arrowSchema      = 1
+	arrowRecordBatch = 3
+
+	arrowFloatingPoint = 3
+	arrowUtf8          = 5
+	arrowTimestamp     = 10
+
+	arrowDouble      = 2
+	arrowMillisecond = 1
+)
+
+// fbTable is a flatbuffer table, its fields indexed by slot.  A field
+// is one of nil (absent), bool, uint8, int16, int64, string, fbTable,
+// []fbTable or fbStructs.
+type fbTable []interface{}
+
+// fbStructs is a vector of structs of two longs, which is the shape
+// of both FieldNode and Buffer.
+type fbStructs [][2]int64
+
+func fbSize(v interface{}) int {
+	switch v.(type) {
+	case bool, uint8:
+		return 1
+	case int16:
+		return 2
+	case int64:
+		return 8
+	}
+	return 4
+}
+
+// fbBuilder lays a flatbuffer out front to back: a table's vtable
+// comes before it, and everything it refers to after it, so offsets
+// always point forward as the format requires.
+type fbBuilder struct {
+	buf []byte
+}
+
+// pad aligns the position of the next byte plus skew to n.
+func (b *fbBuilder) pad(n, skew int) {
+	for (len(b.buf)+skew)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) u32(v uint32) {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	b.buf = append(b.buf, tmp[:]...)
+}
+
+// ref patches the offset at pos to refer to target.
+func (b *fbBuilder) ref(pos, target int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target-pos))
+}
+
+func (b *fbBuilder) table(t fbTable) int {
+	// Largest fields first.  With the table itself at 4 mod 8,
+	// just after its vtable offset, that keeps everything aligned.
+	offs := make([]int, len(t))
+	size := 4
+	for _, want := range []int{8, 4, 2, 1} {
+		for i, v := range t {
+			if v != nil && fbSize(v) == want {
+				offs[i] = size
+				size += want
+			}
+		}
+	}
+
+	b.pad(2, 0)
+	vt := len(b.buf)
+	vtable := make([]byte, 4+2*len(t))
+	binary.LittleEndian.PutUint16(vtable, uint16(len(vtable)))
+	binary.LittleEndian.PutUint16(vtable[2:], uint16(size))
+	for i, o := range offs {
+		binary.LittleEndian.PutUint16(vtable[4+2*i:], uint16(o))
+	}
+	b.buf = append(b.buf, vtable...)
+
+	b.pad(8, 4)
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(pos-vt))
+	for i, v := range t {
+		at := b.buf[pos+offs[i]:]
+		switch x := v.(type) {
+		case bool:
+			if x {
+				at[0] = 1
+			}
+		case uint8:
+			at[0] = x
+		case int16:
+			binary.LittleEndian.PutUint16(at, uint16(x))
+		case int64:
+			binary.LittleEndian.PutUint64(at, uint64(x))
+		}
+	}
+	for i, v := range t {
+		if v != nil && fbSize(v) == 4 {
+			b.ref(pos+offs[i], b.object(v))
+		}
+	}
+	return pos
+}
+
+func (b *fbBuilder) object(v interface{}) int {
+	switch x := v.(type) {
+	case string:
+		b.pad(4, 0)
+		pos := len(b.buf)
+		b.u32(uint32(len(x)))
+		b.buf = append(b.buf, x...)
+		b.buf = append(b.buf, 0)
+		return pos
+	case fbTable:
+		return b.table(x)
+	case []fbTable:
+		b.pad(4, 0)
+		pos := len(b.buf)
+		b.u32(uint32(len(x)))
+		b.buf = append(b.buf, make([]byte, 4*len(x))...)
+		for i, t := range x {
+			b.ref(pos+4+4*i, b.table(t))
+		}
+		return pos
+	case fbStructs:
+		b.pad(8, 4)
+		pos := len(b.buf)
+		b.u32(uint32(len(x)))
+		for _, s := range x {
+			var tmp [16]byte
+			binary.LittleEndian.PutUint64(tmp[:], uint64(s[0]))
+			binary.LittleEndian.PutUint64(tmp[8:], uint64(s[1]))
+			b.buf = append(b.buf, tmp[:]...)
+		}
+		return pos
+	}
+	panic("unhandled flatbuffer field")
+}
+
+// fbBuild encodes a root table, padded to 8 bytes.
+func fbBuild(root fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	b.ref(0, b.table(root))
+	b.pad(8, 0)
+	return b.buf
+}
+
+// writeArrowMessage writes an encapsulated IPC message.
+func writeArrowMessage(w io.Writer, header uint8, t fbTable, body []byte) error {
+	meta := fbBuild(fbTable{int16(arrowV5), header, t, int64(len(body))})
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prefix, 0xffffffff)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	for _, b := range [][]byte{prefix, meta, body} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arrowColumn is a column's schema field and its buffers.
+type arrowColumn struct {
+	name     string
+	nullable bool
+	kind     uint8
+	typ      fbTable
+	nulls    int
+	buffers  [][]byte
+}
+
+func (c *arrowColumn) field() fbTable {
+	return fbTable{c.name, c.nullable, c.kind, c.typ, nil, []fbTable{}}
+}
+
+// arrowValidity builds a validity bitmap, or nothing when there are
+// no nulls.
+func arrowValidity(vals []interface{}) ([]byte, int) {
+	bits := make([]byte, (len(vals)+7)/8)
+	nulls := 0
+	for i, v := range vals {
+		if v == nil {
+			nulls++
+		} else {
+			bits[i/8] |= 1 << uint(i%8)
+		}
+	}
+	if nulls == 0 {
+		return nil, 0
+	}
+	return bits, nulls
+}
+
+func arrowNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// arrowValues builds a nullable column, of doubles if every value is
+// a number and of text otherwise.
+func arrowValues(name string, vals []interface{}) *arrowColumn {
+	validity, nulls := arrowValidity(vals)
+	numeric := true
+	for _, v := range vals {
+		if _, ok := arrowNumber(v); v != nil && !ok {
+			numeric = false
+			break
+		}
+	}
+	if !numeric {
+		return arrowText(name, vals)
+	}
+	data := make([]byte, 8*len(vals))
+	for i, v := range vals {
+		f, _ := arrowNumber(v)
+		binary.LittleEndian.PutUint64(data[8*i:], math.Float64bits(f))
+	}
+	return &arrowColumn{name, true, arrowFloatingPoint,
+		fbTable{int16(arrowDouble)}, nulls, [][]byte{validity, data}}
+}
+
+func arrowText(name string, vals []interface{}) *arrowColumn {
+	validity, nulls := arrowValidity(vals)
+	offsets := make([]byte, 4*(len(vals)+1))
+	data := []byte{}
+	for i, v := range vals {
+		switch x := v.(type) {
+		case nil:
+		case string:
+			data = append(data, x...)
+		default:
+			j, err := json.Marshal(x)
+			if err != nil {
+				j = []byte("null")
+			}
+			data = append(data, j...)
+		}
+		binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(data)))
+	}
+	return &arrowColumn{name, true, arrowUtf8, fbTable{}, nulls,
+		[][]byte{validity, offsets, data}}
+}
+
+func arrowTimestamps(keys []int64) *arrowColumn {
+	data := make([]byte, 8*len(keys))
+	for i, k := range keys {
+		binary.LittleEndian.PutUint64(data[8*i:], uint64(k))
+	}
+	return &arrowColumn{"timestamp", false, arrowTimestamp,
+		fbTable{int16(arrowMillisecond), "UTC"}, 0, [][]byte{nil, data}}
+}
+
+// arrowColumnNames names value columns after their reductions, as
+// reducer(ptr).
+func arrowColumnNames(req *http.Request) []string {
+	ptrs, reds := req.Form["ptr"], req.Form["reducer"]
+	rv := []string{}
+	for i := 0; i < len(ptrs) && i < len(reds); i++ {
+		rv = append(rv, reds[i]+"("+ptrs[i]+")")
+	}
+	return rv
+}
+
+// arrowWriter collects results as rows and emits them on finish.
+type arrowWriter struct {
+	out    io.Writer
+	names  []string
+	keys   []int64
+	groups []interface{}
+	rows   [][]interface{}
+}
+
+func (a *arrowWriter) write(po *processOut) error {
+	if po.groups == nil {
+		a.row(po.key/1e6, nil, po.value)
+		return nil
+	}
+	keys := make([]string, 0, len(po.groups))
+	for k := range po.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		a.row(po.key/1e6, k, po.groups[k])
+	}
+	return nil
+}
+
+func (a *arrowWriter) row(ts int64, group interface{}, vals []interface{}) {
+	a.keys = append(a.keys, ts)
+	a.groups = append(a.groups, group)
+	a.rows = append(a.rows, vals)
+}
+
+func (a *arrowWriter) columns() []*arrowColumn {
+	cols := []*arrowColumn{arrowTimestamps(a.keys),
+		arrowText("group", a.groups)}
+	for i, name := range a.names {
+		vals := make([]interface{}, len(a.rows))
+		for j, row := range a.rows {
+			if i < len(row) {
+				vals[j] = row[i]
+			}
+		}
+		cols = append(cols, arrowValues(name, vals))
+	}
+	return cols
+}
+
+func (a *arrowWriter) finish() error {
+	cols := a.columns()
+	fields := []fbTable{}
+	for _, c := range cols {
+		fields = append(fields, c.field())
+	}
+	err := writeArrowMessage(a.out, arrowSchema, fbTable{nil, fields}, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(a.rows) > 0 {
+		n := int64(len(a.rows))
+		nodes, buffers := fbStructs{}, fbStructs{}
+		body := []byte{}
+		for _, c := range cols {
+			nodes = append(nodes, [2]int64{n, int64(c.nulls)})
+			for _, b := range c.buffers {
+				buffers = append(buffers,
+					[2]int64{int64(len(body)), int64(len(b))})
+				body = append(body, b...)
+				for len(body)%8 != 0 {
+					body = append(body, 0)
+				}
+			}
+		}
+		err = writeArrowMessage(a.out, arrowRecordBatch,
+			fbTable{n, nodes, buffers}, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = a.out.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	return err
+}
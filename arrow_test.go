@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fbField finds a field of the table at pos, or 0 if it's absent.
+func fbField(b []byte, pos, slot int) int {
+	vt := pos - int(int32(binary.LittleEndian.Uint32(b[pos:])))
+	if 4+2*slot >= int(binary.LittleEndian.Uint16(b[vt:])) {
+		return 0
+	}
+	o := int(binary.LittleEndian.Uint16(b[vt+4+2*slot:]))
+	if o == 0 {
+		return 0
+	}
+	return pos + o
+}
+
+func fbDeref(b []byte, pos int) int {
+	return pos + int(binary.LittleEndian.Uint32(b[pos:]))
+}
+
+func fbString(b []byte, pos int) string {
+	pos = fbDeref(b, pos)
+	n := int(binary.LittleEndian.Uint32(b[pos:]))
+	return string(b[pos+4 : pos+4+n])
+}
+
+// readArrowMessages splits a stream into message metadata and bodies.
+func readArrowMessages(t *testing.T, b []byte) (metas, bodies [][]byte) {
+	for {
+		if len(b) < 8 || binary.LittleEndian.Uint32(b) != 0xffffffff {
+			t.Fatalf("Expected a continuation marker at % x", b)
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if n == 0 {
+			if len(b) != 8 {
+				t.Fatalf("Expected nothing after EOS, got % x", b[8:])
+			}
+			return
+		}
+		if n%8 != 0 {
+			t.Fatalf("Metadata length %v isn't padded", n)
+		}
+		meta := b[8 : 8+n]
+		msg := fbDeref(meta, 0)
+		bodyLen := int(binary.LittleEndian.Uint64(meta[fbField(meta, msg, 3):]))
+		metas = append(metas, meta)
+		bodies = append(bodies, b[8+n:8+n+bodyLen])
+		b = b[8+n+bodyLen:]
+	}
+}
+
+func TestArrowStream(t *testing.T) {
+	buf := &bytes.Buffer{}
+	aw := &arrowWriter{out: buf, names: []string{"avg(/t)", "any(/s)"}}
+	aw.write(&processOut{key: 2000 * 1e6, value: []interface{}{1.5, "up"}})
+	aw.write(&processOut{key: 3000 * 1e6,
+		groups: map[string][]interface{}{"b": {nil, 1.0}, "a": {2, nil}}})
+	if err := aw.finish(); err != nil {
+		t.Fatalf("Error finishing: %v", err)
+	}
+
+	metas, bodies := readArrowMessages(t, buf.Bytes())
+	if len(metas) != 2 {
+		t.Fatalf("Expected a schema and a batch, got %v messages", len(metas))
+	}
+
+	schema := metas[0]
+	msg := fbDeref(schema, 0)
+	if h := schema[fbField(schema, msg, 1)]; h != arrowSchema {
+		t.Fatalf("Expected a schema first, got header type %v", h)
+	}
+	fields := fbDeref(schema, fbField(schema, fbDeref(schema, fbField(schema, msg, 2)), 1))
+	exp := []struct {
+		name string
+		kind uint8
+	}{
+		{"timestamp", arrowTimestamp},
+		{"group", arrowUtf8},
+		{"avg(/t)", arrowFloatingPoint},
+		{"any(/s)", arrowUtf8},
+	}
+	if n := int(binary.LittleEndian.Uint32(schema[fields:])); n != len(exp) {
+		t.Fatalf("Expected %v fields, got %v", len(exp), n)
+	}
+	for i, e := range exp {
+		f := fbDeref(schema, fields+4+4*i)
+		name := fbString(schema, fbField(schema, f, 0))
+		kind := schema[fbField(schema, f, 2)]
+		if name != e.name || kind != e.kind {
+			t.Errorf("Expected field %v to be %v/%v, got %v/%v",
+				i, e.name, e.kind, name, kind)
+		}
+		if fbField(schema, f, 5) == 0 {
+			t.Errorf("Expected children on %v", name)
+		}
+	}
+
+	batch, body := metas[1], bodies[1]
+	rb := fbDeref(batch, fbField(batch, fbDeref(batch, 0), 2))
+	if n := binary.LittleEndian.Uint64(batch[fbField(batch, rb, 0):]); n != 3 {
+		t.Errorf("Expected 3 rows, got %v", n)
+	}
+	buffers := fbDeref(batch, fbField(batch, rb, 2))
+	if n := binary.LittleEndian.Uint32(batch[buffers:]); n != 2+3+2+3 {
+		t.Fatalf("Expected 10 buffers, got %v", n)
+	}
+	buffer := func(i int) []byte {
+		at := buffers + 4 + 16*i
+		off := binary.LittleEndian.Uint64(batch[at:])
+		n := binary.LittleEndian.Uint64(batch[at+8:])
+		return body[off : off+n]
+	}
+
+	ts := buffer(1)
+	for i, e := range []int64{2000, 3000, 3000} {
+		if got := int64(binary.LittleEndian.Uint64(ts[8*i:])); got != e {
+			t.Errorf("Expected timestamp %v at %v, got %v", e, i, got)
+		}
+	}
+	if got := buffer(4); string(got) != "ab" {
+		t.Errorf("Expected groups ab, got %q", got)
+	}
+	if got := buffer(5); !bytes.Equal(got, []byte{0x3}) {
+		t.Errorf("Expected avg validity 011, got % x", got)
+	}
+	avg := buffer(6)
+	for i, e := range []float64{1.5, 2} {
+		got := math.Float64frombits(binary.LittleEndian.Uint64(avg[8*i:]))
+		if got != e {
+			t.Errorf("Expected %v at %v, got %v", e, i, got)
+		}
+	}
+	if got := buffer(9); string(got) != "up1" {
+		t.Errorf("Expected text values up1, got %q", got)
+	}
+}
+
+func TestArrowEmpty(t *testing.T) {
+	req, _ := http.NewRequest("GET",
+		"/db/_query?format=arrow&ptr=/t&reducer=max", nil)
+	w := httptest.NewRecorder()
+	emptyResults(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != arrowType {
+		t.Errorf("Expected %v, got %v", arrowType, ct)
+	}
+	metas, _ := readArrowMessages(t, w.Body.Bytes())
+	if len(metas) != 1 {
+		t.Errorf("Expected just a schema, got %v messages", len(metas))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// With -audit, administrative requests -- creating, deleting,
+// compacting and reconfiguring databases, and managing tenants and
+// limits -- are recorded along with any request refused for its
+// credentials.  Records are JSON lines appended to the named file,
+// or, with -audit=_audit, documents in the _audit database, which
+// admins may read like any other.
+//
+// Records name who made the request without repeating credentials:
+// the user of basic auth, the tenant or "admin" for those
+// credentials, and otherwise a hash of the Authorization header.
+
+const auditDB = "_audit"
+
+var auditLog = flag.String("audit", "",
+	"File to append the audit log to, or "+auditDB+" to keep it in a database")
+
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Client    string    `json:"client"`
+	Principal string    `json:"principal,omitempty"`
+}
+
+var auditedRoutes = []struct {
+	methods string
+	path    *regexp.Regexp
+	action  string
+}{
+	{"PUT", regexp.MustCompile("^/[^/_][^/]*/?$"), "create_db"},
+	{"DELETE", regexp.MustCompile("^/[^/_][^/]*/?$"), "delete_db"},
+	{"POST", regexp.MustCompile("^/[^/]+/_compact$"), "compact"},
+	{"POST", regexp.MustCompile("^/[^/]+/_migrate$"), "migrate"},
+	{"POST", regexp.MustCompile("^/[^/]+/_clone$"), "clone"},
+	{"POST", regexp.MustCompile("^/[^/]+/_undelete$"), "undelete"},
+	{"POST", regexp.MustCompile("^/[^/]+/_rename$"), "rename"},
+	{"POST", regexp.MustCompile("^/[^/]+/_copy$"), "copy"},
+	{"DELETE", regexp.MustCompile("^/[^/]+/_(range|bulk)$"), "delete_range"},
+	{"POST", regexp.MustCompile("^/[^/]+/_delete_by_query$"), "delete_by_query"},
+	{"DELETE", regexp.MustCompile("^/[^/]+/_shards/"), "delete_shard"},
+	{"PUT", regexp.MustCompile(
+		"^/[^/]+/_(config|schema|quota|rollups|exclusions|federation)$"),
+		"configure"},
+	{"PUT DELETE", regexp.MustCompile("^/[^/]+/_(views|schedules)/"),
+		"configure"},
+	{"PUT DELETE", regexp.MustCompile("^/_tenants/"), "tenant"},
+	{"PUT", regexp.MustCompile("^/_ratelimits$"), "rate_limits"},
+	{"POST", regexp.MustCompile("^/_config/reload$"), "reload"},
+}
+
+// auditAction names what a request does, if it's audited.
+func auditAction(method, path string, status int) string {
+	for _, r := range auditedRoutes {
+		if strings.Contains(r.methods, method) && r.path.MatchString(path) {
+			return r.action
+		}
+	}
+	if status == 401 || status == 403 {
+		return "denied"
+	}
+	return ""
+}
+
+func auditPrincipal(req *http.Request) string {
+	a := req.Header.Get("Authorization")
+	switch {
+	case a == "":
+		return ""
+	case *adminAuth != "" && a == *adminAuth:
+		return "admin"
+	case requestTenant(req) != "":
+		return "tenant:" + requestTenant(req)
+	}
+	if user, _, ok := req.BasicAuth(); ok {
+		return user
+	}
+	h := sha256.Sum256([]byte(a))
+	return "key:" + hex.EncodeToString(h[:6])
+}
+
+func auditClient(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+var auditLock = sync.Mutex{}
+var auditFile *os.File
+
+func writeAudit(r auditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if *auditLog == auditDB {
+		if err := ensureDB(auditDB); err != nil {
+			return err
+		}
+		return dbstore(auditDB, r.Time.Format(time.RFC3339Nano), b)
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditFile == nil {
+		auditFile, err = os.OpenFile(*auditLog,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = auditFile.Write(append(b, '\n'))
+	return err
+}
+
+// auditRequest records a finished request if it's audited.
+func auditRequest(req *http.Request, status int) {
+	action := auditAction(req.Method, req.URL.Path, status)
+	if action == "" {
+		return
+	}
+	err := writeAudit(auditRecord{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Status:    status,
+		Client:    auditClient(req),
+		Principal: auditPrincipal(req),
+	})
+	if err != nil {
+		log.Printf("Error writing audit record: %v", err)
+	}
+}
+
+// auditWriter notes a response's status.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (a *auditWriter) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditWriter) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = 200
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+func (a *auditWriter) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (a *auditWriter) CloseNotify() <-chan bool {
+	if cn, ok := a.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+func isAuditPath(path string) bool {
+	return *auditLog == auditDB &&
+		(path == "/"+auditDB || strings.HasPrefix(path, "/"+auditDB+"/"))
+}
+
+// checkAuditAccess lets only admins read the audit database, and
+// nobody change it.
+func checkAuditAccess(w http.ResponseWriter, req *http.Request) bool {
+	if !isAuditPath(req.URL.Path) {
+		return true
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		emitError(403, w, "Forbidden", "the audit log is read-only")
+		return false
+	}
+	return checkAdmin(w, req)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gojson"
+)
+
+func TestAuditAction(t *testing.T) {
+	tests := []struct {
+		method, path string
+		status       int
+		exp          string
+	}{
+		{"PUT", "/db", 201, "create_db"},
+		{"DELETE", "/team:db/", 200, "delete_db"},
+		{"PUT", "/db/2012-08-10T00:00:00Z", 201, ""},
+		{"POST", "/db", 201, ""},
+		{"POST", "/db/_compact", 200, "compact"},
+		{"PUT", "/db/_config", 200, "configure"},
+		{"DELETE", "/db/_views/v", 200, "configure"},
+		{"PUT", "/_tenants/team", 200, "tenant"},
+		{"GET", "/db/_query", 200, ""},
+		{"GET", "/db/_query", 401, "denied"},
+		{"POST", "/db", 403, "denied"},
+	}
+
+	for _, test := range tests {
+		got := auditAction(test.method, test.path, test.status)
+		if got != test.exp {
+			t.Errorf("%v %v (%v): expected %q, got %q", test.method,
+				test.path, test.status, test.exp, got)
+		}
+	}
+}
+
+func TestAuditPrincipal(t *testing.T) {
+	defer func(a string) { *adminAuth = a }(*adminAuth)
+	*adminAuth = "Bearer root"
+
+	tests := []struct {
+		auth, exp string
+	}{
+		{"", ""},
+		{"Bearer root", "admin"},
+		{"Basic dXNlcjpwYXNz", "user"},
+		{"Bearer other", "key:"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		got := auditPrincipal(req)
+		if test.exp == "key:" {
+			if !strings.HasPrefix(got, "key:") || len(got) != 16 {
+				t.Errorf("Expected a hashed key, got %q", got)
+			}
+			continue
+		}
+		if got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.auth, got)
+		}
+	}
+}
+
+func TestAuditFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(a string) {
+		*auditLog = a
+		auditFile.Close()
+		auditFile = nil
+	}(*auditLog)
+	*auditLog = filepath.Join(dir, "audit.log")
+
+	req, _ := http.NewRequest("POST", "/db/_compact", nil)
+	req.RemoteAddr = "10.1.2.3:4567"
+	auditRequest(req, 200)
+	req, _ = http.NewRequest("GET", "/db/_query", nil)
+	auditRequest(req, 200)
+
+	f, err := os.Open(*auditLog)
+	if err != nil {
+		t.Fatalf("Error opening audit log: %v", err)
+	}
+	defer f.Close()
+	recs := []auditRecord{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		r := auditRecord{}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("Error parsing %s: %v", s.Bytes(), err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 1 || recs[0].Action != "compact" ||
+		recs[0].Client != "10.1.2.3" || recs[0].Status != 200 {
+		t.Errorf("Expected one compact record, got %+v", recs)
+	}
+}
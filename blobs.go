@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/dustin/gojson"
+)
+
+// A database created with type=blobs stores bodies of any content
+// type, such as protobuf encoded traces, alongside metrics.  Each is
+// stored as a document holding the body, its type, and a small JSON
+// object of metadata given in an X-Seriesly-Meta header or meta=
+// parameter:
+//
+//	{"content_type": "application/x-protobuf", "size": 1234,
+//	 "meta": {"trace": "abc"}, "blob": "<base64>"}
+//
+// so queries can reduce and filter on the metadata like any other
+// document.  Getting a document returns the body as it was stored,
+// with its content type and the metadata in X-Seriesly-Meta, or with
+// meta=true, the document without the body.
+
+const dbTypeBlobs = "blobs"
+
+// The most metadata stored with a blob.
+const maxBlobMeta = 4 << 10
+
+var maxBlobKB = intFlag("maxBlobKB", 1024,
+	"Largest body a blobs database accepts")
+
+type blobDoc struct {
+	ContentType string          `json:"content_type"`
+	Size        int             `json:"size"`
+	Meta        json.RawMessage `json:"meta,omitempty"`
+	Blob        []byte          `json:"blob,omitempty"`
+}
+
+func isBlobDB(dbname string) bool {
+	m, err := loadMeta(ownerDB(dbname))
+	return err == nil && m.Type == dbTypeBlobs
+}
+
+// parseBlobMeta checks blob metadata is a small JSON object.
+func parseBlobMeta(s string) (json.RawMessage, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if len(s) > maxBlobMeta {
+		return nil, fmt.Errorf("metadata is over %v bytes", maxBlobMeta)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return nil, fmt.Errorf("metadata must be a JSON object: %v", err)
+	}
+	return json.RawMessage(s), nil
+}
+
+// readBlob reads a request body to store in a blobs database,
+// reporting any problem to the client.
+func readBlob(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	defer req.Body.Close()
+	meta := req.Header.Get("X-Seriesly-Meta")
+	if meta == "" {
+		meta = req.URL.Query().Get("meta")
+	}
+	m, err := parseBlobMeta(meta)
+	if err != nil {
+		emitError(400, w, "Bad metadata", err.Error())
+		return nil, false
+	}
+
+	r, err := requestBody(req)
+	if err != nil {
+		emitBodyError(w, err)
+		return nil, false
+	}
+	defer r.Close()
+	max := int64(maxBlobKB.get()) << 10
+	body, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		emitBodyError(w, err)
+		return nil, false
+	}
+	if int64(len(body)) > max {
+		emitError(413, w, "Request Entity Too Large",
+			fmt.Sprintf("blobs are limited to %vKB", maxBlobKB.get()))
+		return nil, false
+	}
+
+	ct := req.Header.Get("Content-Type")
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	doc, err := json.Marshal(&blobDoc{ct, len(body), m, body})
+	if err != nil {
+		emitError(500, w, "Error encoding blob", err.Error())
+		return nil, false
+	}
+	return doc, true
+}
+
+// writeBlob sends a stored blob back as it was given.
+func writeBlob(w http.ResponseWriter, req *http.Request, doc []byte) {
+	b := blobDoc{}
+	if err := json.Unmarshal(doc, &b); err != nil {
+		emitError(500, w, "Error decoding blob", err.Error())
+		return
+	}
+	if req.FormValue("meta") == "true" {
+		b.Blob = nil
+		mustEncode(200, w, &b)
+		return
+	}
+	if jsonpCallbackParam(req) != "" {
+		emitError(400, w, "Bad callback value",
+			"blobs can't be sent to a callback")
+		return
+	}
+	// Reencoded to fit on one line.
+	var m interface{}
+	if len(b.Meta) > 0 && json.Unmarshal(b.Meta, &m) == nil {
+		if d, err := json.Marshal(m); err == nil {
+			w.Header().Set("X-Seriesly-Meta", string(d))
+		}
+	}
+	// The type is whatever the client stored, so browsers mustn't
+	// render it as if the server sent it.
+	w.Header().Set("Content-Type", b.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", "attachment")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b.Blob)))
+	w.WriteHeader(200)
+	w.Write(b.Blob)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gojson"
+)
+
+func TestBlobRoundTrip(t *testing.T) {
+	payload := []byte{0x0a, 0x03, 'a', 'b', 'c', 0x00, 0xff}
+	req, _ := http.NewRequest("POST", "/traces?meta=%7B%22trace%22%3A%22abc%22%7D",
+		bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	doc, ok := readBlob(w, req)
+	if !ok {
+		t.Fatalf("Error reading blob: %v", w.Body.String())
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(doc, &m); err != nil {
+		t.Fatalf("Error decoding the stored document: %v", err)
+	}
+	if m["size"] != 7.0 || m["meta"].(map[string]interface{})["trace"] != "abc" {
+		t.Errorf("Expected the size and metadata stored, got %v", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/traces/k", nil)
+	w = httptest.NewRecorder()
+	writeBlob(w, req, doc)
+	if !bytes.Equal(w.Body.Bytes(), payload) {
+		t.Errorf("Expected %v back, got %v", payload, w.Body.Bytes())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-protobuf" {
+		t.Errorf("Expected the original content type, got %q", ct)
+	}
+	if meta := w.Header().Get("X-Seriesly-Meta"); meta != `{"trace":"abc"}` {
+		t.Errorf("Expected the metadata in a header, got %q", meta)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" ||
+		w.Header().Get("Content-Disposition") != "attachment" {
+		t.Errorf("Expected the blob as an unsniffed attachment, got %v",
+			w.Header())
+	}
+
+	req, _ = http.NewRequest("GET", "/traces/k?callback=f", nil)
+	w = httptest.NewRecorder()
+	writeBlob(w, req, doc)
+	if w.Code != 400 || bytes.Contains(w.Body.Bytes(), payload) {
+		t.Errorf("Expected 400 for a callback, got %v: %q", w.Code, w.Body)
+	}
+
+	req, _ = http.NewRequest("GET", "/traces/k?meta=true", nil)
+	w = httptest.NewRecorder()
+	writeBlob(w, req, doc)
+	if strings.Contains(w.Body.String(), "blob") {
+		t.Errorf("Expected the metadata without the blob, got %s", w.Body)
+	}
+}
+
+func TestBlobLimits(t *testing.T) {
+	defer func(n int) { maxBlobKB.set(n) }(maxBlobKB.get())
+	maxBlobKB.set(1)
+
+	tests := []struct {
+		body   string
+		meta   string
+		status int
+	}{
+		{strings.Repeat("x", 1024), "", 0},
+		{strings.Repeat("x", 1025), "", 413},
+		{"x", "[1]", 400},
+		{"x", `{"a": "` + strings.Repeat("y", maxBlobMeta) + `"}`, 400},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/blobs", strings.NewReader(test.body))
+		req.Header.Set("X-Seriesly-Meta", test.meta)
+		w := httptest.NewRecorder()
+		_, ok := readBlob(w, req)
+		if ok != (test.status == 0) || (!ok && w.Code != test.status) {
+			t.Errorf("%d byte body with %.10q: expected %v, got %v/%v",
+				len(test.body), test.meta, test.status, ok, w.Code)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/dustin/gojson"
+)
+
+// POST /db/_bulk_get fetches many documents at once.  The body is an
+// array of timestamps, and ranges of them:
+//
+//	["2012-08-10T12:00:00Z", {"from": "2012-08-11", "to": "2012-08-12"}]
+//
+// where a range includes from but not to, like _all_docs.  The
+// response has the documents found by key, those for single
+// timestamps first, and the timestamps that weren't found:
+//
+//	{"docs": {"2012-08-10T12:00:00Z": {...}, ...}, "missing": [...]}
+//
+// With limit, at most that many documents are returned, and
+// "truncated" is true if there were more.
+
+type bulkGetRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// parseBulkGet reads a _bulk_get body into keys and ranges.
+func parseBulkGet(dbname string, r io.Reader) ([]string, []bulkGetRange, error) {
+	items := []json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, nil, err
+	}
+	keys := []string{}
+	ranges := []bulkGetRange{}
+	for i, item := range items {
+		s := ""
+		if json.Unmarshal(item, &s) == nil {
+			k, err := cleanupRangeParam(dbname, s, "")
+			if err != nil {
+				return nil, nil, fmt.Errorf("item %v: %v", i, err)
+			}
+			keys = append(keys, k)
+			continue
+		}
+		rg := bulkGetRange{}
+		if err := json.Unmarshal(item, &rg); err != nil {
+			return nil, nil, fmt.Errorf(
+				"item %v: expected a timestamp or a range", i)
+		}
+		from, err := cleanupRangeParam(dbname, rg.From, "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("item %v: bad from: %v", i, err)
+		}
+		to, err := cleanupRangeParam(dbname, rg.To, "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("item %v: bad to: %v", i, err)
+		}
+		ranges = append(ranges, bulkGetRange{from, to})
+	}
+	return keys, ranges, nil
+}
+
+func bulkGet(args []string, w http.ResponseWriter, req *http.Request) {
+	keys, ranges, err := parseBulkGet(args[0], req.Body)
+	if err != nil {
+		emitError(400, w, "Bad bulk_get request", err.Error())
+		return
+	}
+	limit := -1
+	if s := req.FormValue("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			emitError(400, w, "Bad limit value", s)
+			return
+		}
+	}
+
+	output, closer := responseOutput(w, req)
+	defer closer()
+	w.WriteHeader(200)
+	output.Write([]byte(`{"docs": {`))
+
+	gone := closeNotify(w)
+	seen := map[string]bool{}
+	truncated := false
+	emit := func(k string, v []byte) error {
+		if seen[k] {
+			return nil
+		}
+		if len(seen) == limit {
+			truncated = true
+			return io.EOF
+		}
+		if isClosed(gone) {
+			return errCanceled
+		}
+		if len(seen) > 0 {
+			output.Write([]byte(",\n"))
+		}
+		seen[k] = true
+		kb, _ := json.Marshal(k)
+		output.Write(kb)
+		output.Write([]byte{':', ' '})
+		_, err := output.Write(v)
+		return err
+	}
+
+	missing, err := dbGetDocs(args[0], keys, emit)
+	for _, rg := range ranges {
+		if err != nil {
+			break
+		}
+		err = dbwalk(args[0], rg.From, rg.To, emit)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+
+	output.Write([]byte("},\n"))
+	mb, _ := json.Marshal(missing)
+	fmt.Fprintf(output, `"missing": %s`, mb)
+	if truncated {
+		output.Write([]byte(`, "truncated": true`))
+	}
+	if err != nil {
+		// Too late for an error status.
+		eb, _ := json.Marshal(err.Error())
+		fmt.Fprintf(output, `, "error": %s`, eb)
+	}
+	output.Write([]byte("}\n"))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
+)
+
+func TestBulkGet(t *testing.T) {
+	createMemDatabase("bulkget", memOptions{})
+	defer dropMemDatabase("bulkget")
+	defer dbRemoveConn("bulkget")
+	b := memDatabase("bulkget").Bulk()
+	for i, k := range []string{"2012-08-10T00:00:00Z", "2012-08-11T00:00:00Z",
+		"2012-08-11T12:00:00Z", "2012-08-12T00:00:00Z"} {
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k,
+			[]byte(`{"n":`+string(rune('0'+i))+`}`)))
+	}
+	b.Commit()
+
+	body := `["2012-08-10", "2012-08-10T06:00:00Z",
+		{"from": "2012-08-11", "to": "2012-08-12"},
+		"2012-08-11T00:00:00Z"]`
+	req, _ := http.NewRequest("POST", "/bulkget/_bulk_get", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	bulkGet([]string{"bulkget"}, w, req)
+	got := struct {
+		Docs      map[string]map[string]int `json:"docs"`
+		Missing   []string                  `json:"missing"`
+		Truncated bool                      `json:"truncated"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	exp := map[string]map[string]int{
+		"2012-08-10T00:00:00Z": {"n": 0},
+		"2012-08-11T00:00:00Z": {"n": 1},
+		"2012-08-11T12:00:00Z": {"n": 2},
+	}
+	if !reflect.DeepEqual(got.Docs, exp) || got.Truncated ||
+		!reflect.DeepEqual(got.Missing, []string{"2012-08-10T06:00:00Z"}) {
+		t.Errorf("Unexpected bulk get result: %s", w.Body)
+	}
+
+	req, _ = http.NewRequest("POST", "/bulkget/_bulk_get?limit=2",
+		strings.NewReader(`[{"from": "2012-08-10"}]`))
+	w = httptest.NewRecorder()
+	bulkGet([]string{"bulkget"}, w, req)
+	got.Docs = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	if len(got.Docs) != 2 || !got.Truncated {
+		t.Errorf("Expected 2 docs, truncated, got %s", w.Body)
+	}
+
+	for _, body := range []string{`{}`, `[1]`, `["yesterday-ish"]`,
+		`[{"from": "never"}]`} {
+		req, _ = http.NewRequest("POST", "/bulkget/_bulk_get",
+			strings.NewReader(body))
+		w = httptest.NewRecorder()
+		bulkGet([]string{"bulkget"}, w, req)
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for %s, got %v", body, w.Code)
+		}
+	}
+}
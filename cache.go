@@ -5,6 +5,7 @@ import (
 	"log"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dustin/gojson"
@@ -26,10 +27,13 @@ func cacheReceiveLoop(client *memcached.Client, out chan *processOut) {
 		po := processOut{cacheOpaque: res.Opaque}
 
 		if res.Opcode == gomemcached.GET && res.Status == gomemcached.SUCCESS {
-			rv := map[string][]interface{}{}
+			rv := struct {
+				V []interface{}            `json:"v"`
+				G map[string][]interface{} `json:"g"`
+			}{}
 			err = json.Unmarshal(res.Body, &rv)
 			if err == nil {
-				po.value = rv["v"]
+				po.value, po.groups = rv.V, rv.G
 			} else {
 				log.Printf("Decoding error:  %v\n%s", err, res.Body)
 				po.err = err
@@ -105,7 +109,7 @@ func cacheProcessor(ch <-chan *processIn, chset <-chan *processOut) {
 				}
 			default:
 				// Too old.
-				pi.out <- &processOut{"", pi.key, nil, errTimeout, 0}
+				pi.out <- &processOut{"", pi.key, nil, errTimeout, 0, nil}
 			}
 		case po := <-out:
 			pi, ok := omap[po.cacheOpaque]
@@ -162,11 +166,17 @@ func cacheKey(p *processIn) string {
 	for i := range p.ptrs {
 		h.Write([]byte(p.ptrs[i]))
 		h.Write([]byte(p.reds[i]))
+		if strings.HasPrefix(p.reds[i], jsReducerPrefix) {
+			h.Write([]byte(p.funcs[p.reds[i][len(jsReducerPrefix):]]))
+		}
 	}
 	for i := range p.filters {
 		h.Write([]byte(p.filters[i]))
 		h.Write([]byte(p.filtervals[i]))
 	}
+	if p.groupby != "" {
+		h.Write([]byte("groupby" + p.groupby))
+	}
 	return p.dbname + "#" + strconv.FormatInt(p.key, 10) +
 		"#" + strconv.FormatUint(h.Sum64(), 10)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Besides milliseconds, group may be given with a unit: ms, s, m and
+// h are fixed lengths, while d, w (starting Mondays), mo and y follow
+// the calendar in the time zone named by tz (UTC by default), so days
+// start at local midnight whatever the offset or daylight saving.
+
+var groupUnitPattern = regexp.MustCompile(`^([0-9]+)(ms|s|m|h|d|w|mo|y)$`)
+
+var fixedGroupUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// A calendarGroup groups by a number of calendar units.
+type calendarGroup struct {
+	n    int
+	unit string
+	loc  *time.Location
+}
+
+// parseGroup parses a group parameter, returning either a fixed
+// group in milliseconds or a calendar group.
+func parseGroup(s, tz string) (int, *calendarGroup, error) {
+	if ms, err := strconv.Atoi(s); err == nil {
+		return ms, nil, nil
+	}
+	m := groupUnitPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, nil, fmt.Errorf("expected milliseconds or a count and unit: %q", s)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n < 1 {
+		return 0, nil, fmt.Errorf("bad group count: %q", s)
+	}
+	if d, ok := fixedGroupUnits[m[2]]; ok {
+		return n * int(d/time.Millisecond), nil, nil
+	}
+	loc := time.UTC
+	if tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return 0, nil, err
+		}
+	}
+	return 0, &calendarGroup{n, m[2], loc}, nil
+}
+
+// epochMonday is the first Monday after the epoch, which week groups
+// are counted from.
+var epochMonday = time.Date(1970, 1, 5, 0, 0, 0, 0, time.UTC)
+
+// floorDiv divides rounding toward negative infinity, so groups
+// before the epoch line up too.
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// start returns the start of the group containing t.
+func (c *calendarGroup) start(t time.Time) time.Time {
+	lt := t.In(c.loc)
+	y, m, d := lt.Date()
+	switch c.unit {
+	case "y":
+		return time.Date(floorDiv(y, c.n)*c.n, 1, 1, 0, 0, 0, 0, c.loc)
+	case "mo":
+		i := floorDiv(y*12+int(m)-1, c.n) * c.n
+		return time.Date(floorDiv(i, 12), time.Month(i-floorDiv(i, 12)*12+1),
+			1, 0, 0, 0, 0, c.loc)
+	}
+	// Count days in the local calendar, free of offsets.
+	days := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(epochMonday).Hours() / 24)
+	per := c.n
+	if c.unit == "w" {
+		per *= 7
+	}
+	days = floorDiv(days, per) * per
+	ed := epochMonday.AddDate(0, 0, days)
+	return time.Date(ed.Year(), ed.Month(), ed.Day(), 0, 0, 0, 0, c.loc)
+}
+
+// next returns the start of the group after the one starting at s.
+func (c *calendarGroup) next(s time.Time) time.Time {
+	switch c.unit {
+	case "y":
+		return s.AddDate(c.n, 0, 0)
+	case "mo":
+		return s.AddDate(0, c.n, 0)
+	case "w":
+		return s.AddDate(0, 0, 7*c.n)
+	}
+	return s.AddDate(0, 0, c.n)
+}
+
+// bucket returns the bounds of the group containing a key's time, in
+// nanoseconds.
+func (c *calendarGroup) bucket(k int64) (int64, int64) {
+	s := c.start(time.Unix(0, k))
+	return s.UnixNano(), c.next(s).UnixNano()
+}
+
+func (c *calendarGroup) String() string {
+	return strconv.Itoa(c.n) + c.unit
+}
+
+// queryGroup is a group in a JSON query, which may be given as
+// milliseconds or with a unit.
+type queryGroup string
+
+func (g *queryGroup) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case float64:
+		*g = queryGroup(strconv.FormatInt(int64(x), 10))
+	case string:
+		*g = queryGroup(x)
+	default:
+		return fmt.Errorf("expected a number or string group: %s", b)
+	}
+	return nil
+}
+
+// MarshalJSON keeps plain milliseconds numeric, as they always were.
+func (g queryGroup) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.Atoi(string(g)); err == nil {
+		return []byte(g), nil
+	}
+	return json.Marshal(string(g))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+func TestParseGroup(t *testing.T) {
+	tests := []struct {
+		in  string
+		ms  int
+		cal string
+	}{
+		{"60000", 60000, ""},
+		{"5m", 300000, ""},
+		{"1d", 0, "1d"},
+		{"3mo", 0, "3mo"},
+	}
+	for _, test := range tests {
+		ms, cal, err := parseGroup(test.in, "")
+		if err != nil {
+			t.Errorf("Error parsing %v: %v", test.in, err)
+			continue
+		}
+		calstr := ""
+		if cal != nil {
+			calstr = cal.String()
+		}
+		if ms != test.ms || calstr != test.cal {
+			t.Errorf("Expected %v to parse as %v %q, got %v %q",
+				test.in, test.ms, test.cal, ms, calstr)
+		}
+	}
+
+	for _, bad := range []string{"", "d", "0d", "1x"} {
+		if _, _, err := parseGroup(bad, ""); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+	if _, _, err := parseGroup("1d", "Nowhere/Special"); err == nil {
+		t.Errorf("Expected an error for an unknown time zone")
+	}
+}
+
+func TestCalendarBuckets(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No zone info: %v", err)
+	}
+	// 2013-03-10 is the start of daylight saving time in New York.
+	at := time.Date(2013, 3, 10, 12, 0, 0, 0, ny)
+	tests := []struct {
+		c          calendarGroup
+		start, end time.Time
+	}{
+		{calendarGroup{1, "d", ny},
+			time.Date(2013, 3, 10, 0, 0, 0, 0, ny),
+			time.Date(2013, 3, 11, 0, 0, 0, 0, ny)},
+		{calendarGroup{1, "w", ny},
+			time.Date(2013, 3, 4, 0, 0, 0, 0, ny),
+			time.Date(2013, 3, 11, 0, 0, 0, 0, ny)},
+		{calendarGroup{1, "mo", ny},
+			time.Date(2013, 3, 1, 0, 0, 0, 0, ny),
+			time.Date(2013, 4, 1, 0, 0, 0, 0, ny)},
+		{calendarGroup{6, "mo", time.UTC},
+			time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{calendarGroup{1, "y", time.UTC},
+			time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		s, e := test.c.bucket(at.UnixNano())
+		if s != test.start.UnixNano() || e != test.end.UnixNano() {
+			t.Errorf("Expected %v to bucket %v in %v - %v, got %v - %v",
+				test.c.String(), at, test.start, test.end,
+				time.Unix(0, s).In(ny), time.Unix(0, e).In(ny))
+		}
+	}
+}
+
+func TestQueryGroupJSON(t *testing.T) {
+	b := queryBody{}
+	if err := json.Unmarshal([]byte(`{"group": 60000}`), &b); err != nil ||
+		b.Group != "60000" {
+		t.Errorf("Expected numeric group, got %q, %v", b.Group, err)
+	}
+	if err := json.Unmarshal([]byte(`{"group": "1mo"}`), &b); err != nil ||
+		b.Group != "1mo" {
+		t.Errorf("Expected unit group, got %q, %v", b.Group, err)
+	}
+	if d, _ := json.Marshal(queryGroup("60000")); string(d) != "60000" {
+		t.Errorf("Expected numeric output, got %s", d)
+	}
+}
@@ -0,0 +1,268 @@
+// Package client is a Go client for seriesly.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A Client talks to one seriesly server.
+type Client struct {
+	u url.URL
+	// HTTP is the client used for requests.
+	HTTP *http.Client
+}
+
+// New returns a client for the server at the given URL, e.g.
+// http://localhost:3133/
+func New(server string) (*Client, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{u: *u, HTTP: http.DefaultClient}, nil
+}
+
+// An Error is an unsuccessful response from the server.
+type Error struct {
+	StatusCode int
+	// RetryAfter is how long the server asked us to wait before
+	// trying again, if it did.
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("HTTP error %v: %v", e.StatusCode, e.Body)
+}
+
+func (c *Client) url(path string, q url.Values) string {
+	u := c.u
+	u.Path = path
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (c *Client) do(method, path string, q url.Values,
+	body []byte) (*http.Response, error) {
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.url(path, q), r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		e := &Error{StatusCode: res.StatusCode, Body: string(b)}
+		if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(s) * time.Second
+		}
+		return nil, e
+	}
+	return res, nil
+}
+
+func (c *Client) discard(res *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func timeKey(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// CreateDB creates a database.  It's not an error if it exists.
+func (c *Client) CreateDB(db string) error {
+	return c.discard(c.do("PUT", "/"+db, nil, nil))
+}
+
+// DeleteDB deletes a database.
+func (c *Client) DeleteDB(db string) error {
+	return c.discard(c.do("DELETE", "/"+db, nil, nil))
+}
+
+// Store stores a single document at the given time.
+func (c *Client) Store(db string, t time.Time, doc interface{}) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return c.discard(c.do("PUT", "/"+db+"/"+timeKey(t), nil, b))
+}
+
+// StoreMany stores documents keyed by time in a single request.
+func (c *Client) StoreMany(db string, docs map[time.Time]interface{}) error {
+	m := make(map[string]interface{}, len(docs))
+	for t, d := range docs {
+		m[timeKey(t)] = d
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.discard(c.do("POST", "/"+db+"/_bulk", nil, b))
+}
+
+// A Batch collects documents and stores them in bulk requests of up
+// to Size documents.  It's not safe for concurrent use.
+type Batch struct {
+	c    *Client
+	db   string
+	Size int
+	docs map[time.Time]interface{}
+}
+
+// NewBatch starts a batch of documents for a database.
+func (c *Client) NewBatch(db string, size int) *Batch {
+	return &Batch{c: c, db: db, Size: size, docs: map[time.Time]interface{}{}}
+}
+
+// Add adds a document, storing the batch if it's full.
+func (b *Batch) Add(t time.Time, doc interface{}) error {
+	b.docs[t] = doc
+	if len(b.docs) >= b.Size {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush stores any documents not yet stored.
+func (b *Batch) Flush() error {
+	if len(b.docs) == 0 {
+		return nil
+	}
+	if err := b.c.StoreMany(b.db, b.docs); err != nil {
+		return err
+	}
+	b.docs = map[time.Time]interface{}{}
+	return nil
+}
+
+// A Reduction extracts a field from each document with a JSON pointer
+// and reduces it within each group, e.g. {"/temp", "avg"}.
+type Reduction struct {
+	Pointer string
+	Reducer string
+}
+
+// A Filter limits a query to documents with the given value at a
+// JSON pointer.
+type Filter struct {
+	Pointer string
+	Value   string
+}
+
+// A Window is a period of time, including From but not To.
+type Window struct {
+	From, To time.Time
+}
+
+// A Query describes a grouped reduction over a time range.  Zero
+// times leave the range open.  Documents in Exclude are left out, as
+// are those in windows stored on the database.
+type Query struct {
+	From, To   time.Time
+	Group      time.Duration
+	Reductions []Reduction
+	Filters    []Filter
+	Exclude    []Window
+}
+
+func (q Query) values() url.Values {
+	v := url.Values{"group": {strconv.FormatInt(
+		int64(q.Group/time.Millisecond), 10)}}
+	if !q.From.IsZero() {
+		v.Set("from", timeKey(q.From))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", timeKey(q.To))
+	}
+	for _, r := range q.Reductions {
+		v.Add("ptr", r.Pointer)
+		v.Add("reducer", r.Reducer)
+	}
+	for _, f := range q.Filters {
+		v.Add("f", f.Pointer)
+		v.Add("fv", f.Value)
+	}
+	for _, x := range q.Exclude {
+		v.Add("exclude", timeKey(x.From)+","+timeKey(x.To))
+	}
+	return v
+}
+
+// A Row is one group of query results, with a value per reduction.
+type Row struct {
+	Time   time.Time
+	Values []interface{}
+}
+
+// Query runs a query, returning its groups in time order.
+func (c *Client) Query(db string, q Query) ([]Row, error) {
+	res, err := c.do("GET", "/"+db+"/_query", q.values(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	m := map[string][]interface{}{}
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	rv := make([]Row, 0, len(m))
+	for k, vals := range m {
+		ms, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad group key %q: %v", k, err)
+		}
+		rv = append(rv, Row{time.Unix(0, ms*int64(time.Millisecond)).UTC(), vals})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Time.Before(rv[j].Time) })
+	return rv, nil
+}
+
+// Dump calls f with every document in a database in key order.
+func (c *Client) Dump(db string, f func(k string, doc json.RawMessage) error) error {
+	res, err := c.do("GET", "/"+db+"/_dump", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	s := bufio.NewScanner(res.Body)
+	s.Buffer(nil, 64*1024*1024)
+	for s.Scan() {
+		line := map[string]json.RawMessage{}
+		if err := json.Unmarshal(s.Bytes(), &line); err != nil {
+			return err
+		}
+		for k, doc := range line {
+			if err := f(k, doc); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
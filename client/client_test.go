@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T, h http.HandlerFunc) *Client {
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	c, err := New(s.URL)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	return c
+}
+
+func TestBatch(t *testing.T) {
+	posts := []map[string]interface{}{}
+	c := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/db/_bulk" {
+			t.Errorf("Unexpected request: %v %v", req.Method, req.URL)
+		}
+		m := map[string]interface{}{}
+		b, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(b, &m)
+		posts = append(posts, m)
+		w.WriteHeader(201)
+	})
+
+	b := c.NewBatch("db", 2)
+	start := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if err := b.Add(start.Add(time.Duration(i)*time.Second),
+			map[string]int{"i": i}); err != nil {
+			t.Fatalf("Error adding: %v", err)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	if len(posts) != 2 || len(posts[0]) != 2 || len(posts[1]) != 1 {
+		t.Errorf("Expected batches of 2 and 1, got %v", posts)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("group") != "60000" || q.Get("ptr") != "/t" ||
+			q.Get("reducer") != "max" {
+			t.Errorf("Unexpected query: %v", q)
+		}
+		fmt.Fprintf(w, `{"120000": [2], "60000": [1]}`)
+	})
+
+	rows, err := c.Query("db", Query{Group: time.Minute,
+		Reductions: []Reduction{{"/t", "max"}}})
+	if err != nil {
+		t.Fatalf("Error querying: %v", err)
+	}
+	if len(rows) != 2 || rows[0].Time.Unix() != 60 || rows[0].Values[0] != 1.0 {
+		t.Errorf("Unexpected rows: %v", rows)
+	}
+}
+
+func TestError(t *testing.T) {
+	c := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(503)
+	})
+
+	err := c.Store("db", time.Now(), 1)
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != 503 || e.RetryAfter != 3*time.Second {
+		t.Errorf("Expected a 503 with Retry-After, got %v", err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	c := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "{\"a\": 1}\n{\"b\": {\"x\": 2}}\n")
+	})
+
+	keys := []string{}
+	err := c.Dump("db", func(k string, doc json.RawMessage) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil || len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("Unexpected dump: %v, %v", keys, err)
+	}
+}
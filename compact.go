@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compaction and migration write a new file next to the database and
+// rename it into place.  The new file and its directory are synced
+// first, so after a crash the database is either the old file or the
+// complete new one.  A leftover rewrite is removed at startup, unless
+// it's all that's left, in which case it's put in place.
+
+const rewriteExt = ".compact"
+
+// syncPath fsyncs a file or directory.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// swapInRewrite durably replaces a database file with its rewrite.
+// On error, the rewrite is removed and the database left as it was.
+func swapInRewrite(dbn string) error {
+	tmp := dbn + rewriteExt
+	dir := filepath.Dir(dbn)
+	err := syncPath(tmp)
+	if err == nil {
+		err = syncPath(dir)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dbn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The rename has happened, but may not survive a crash until
+	// the directory is synced.  Either way, the file is complete.
+	if err := syncPath(dir); err != nil {
+		log.Printf("Error syncing %v after replacing %v: %v", dir, dbn, err)
+	}
+	return nil
+}
+
+// cleanupRewrites deals with rewrites interrupted by a crash.
+func cleanupRewrites(root string) {
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() ||
+			!strings.HasSuffix(p, dbExt+rewriteExt) {
+			return nil
+		}
+		dbn := strings.TrimSuffix(p, rewriteExt)
+		if _, err := os.Stat(dbn); os.IsNotExist(err) {
+			log.Printf("Restoring %v from an interrupted rewrite", dbn)
+			if err := os.Rename(p, dbn); err != nil {
+				log.Printf("Error restoring %v: %v", dbn, err)
+			}
+			return nil
+		}
+		log.Printf("Removing interrupted rewrite %v", p)
+		if err := os.Remove(p); err != nil {
+			log.Printf("Error removing %v: %v", p, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapInRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbn := filepath.Join(dir, "x"+dbExt)
+	ioutil.WriteFile(dbn, []byte("old"), 0666)
+	ioutil.WriteFile(dbn+rewriteExt, []byte("new"), 0666)
+	if err := swapInRewrite(dbn); err != nil {
+		t.Fatalf("Error swapping: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(dbn); string(b) != "new" {
+		t.Errorf("Expected the rewrite in place, got %q", b)
+	}
+
+	if err := swapInRewrite(dbn); err == nil {
+		t.Errorf("Expected an error with no rewrite")
+	}
+	if b, _ := ioutil.ReadFile(dbn); string(b) != "new" {
+		t.Errorf("Expected a failed swap to leave the db, got %q", b)
+	}
+}
+
+func TestCleanupRewrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sharded"), 0777)
+
+	stale := filepath.Join(dir, "sharded", "2012-08-10"+dbExt)
+	ioutil.WriteFile(stale, []byte("live"), 0666)
+	ioutil.WriteFile(stale+rewriteExt, []byte("partial"), 0666)
+	orphan := filepath.Join(dir, "orphan"+dbExt)
+	ioutil.WriteFile(orphan+rewriteExt, []byte("only copy"), 0666)
+
+	cleanupRewrites(dir)
+
+	if _, err := os.Stat(stale + rewriteExt); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale rewrite removed, got %v", err)
+	}
+	if b, _ := ioutil.ReadFile(stale); string(b) != "live" {
+		t.Errorf("Expected the live db untouched, got %q", b)
+	}
+	if b, _ := ioutil.ReadFile(orphan); string(b) != "only copy" {
+		t.Errorf("Expected the orphaned rewrite restored, got %q", b)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Conditional reducers only reduce documents where a condition on
+// another pointer holds, e.g. reducer=countif:/status>=500 counts
+// errors, and reducer=sumif:/bytes:/status==200 totals the bytes of
+// successful requests.  As with pair reducers, without a value
+// pointer, the query's pointer in the same position is used.
+//
+// Conditions compare a pointer with ==, !=, <, <=, > or >= to a
+// number, or with == and != to a string, which may be quoted.
+// Documents missing the pointer never match.
+
+var condReducerNames = map[string]bool{"countif": true, "sumif": true}
+
+var condOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+type condReducer struct {
+	name, value string
+	ptr, op     string
+	str         string
+	num         float64
+	isNum       bool
+}
+
+// parseCondReducer parses a conditional reducer.  ok is false if it
+// isn't one; err is set if it is, but is malformed.
+func parseCondReducer(s string) (c condReducer, ok bool, err error) {
+	i := strings.Index(s, ":/")
+	if i < 0 || !condReducerNames[s[:i]] {
+		return c, false, nil
+	}
+	c.name = s[:i]
+	rest := s[i+1:]
+
+	opAt := strings.IndexAny(rest, "=!<>")
+	if opAt < 0 {
+		return c, true, fmt.Errorf("%v needs a condition, as in %v:/status>=500",
+			c.name, c.name)
+	}
+	if j := strings.Index(rest, ":/"); j >= 0 && j < opAt {
+		c.value, rest = rest[:j], rest[j+1:]
+		opAt -= j + 1
+	}
+	c.ptr = rest[:opAt]
+	for _, op := range condOps {
+		if strings.HasPrefix(rest[opAt:], op) {
+			c.op = op
+			break
+		}
+	}
+	if c.op == "" {
+		return c, true, fmt.Errorf("bad operator in %q", rest)
+	}
+	lit := rest[opAt+len(c.op):]
+
+	if f, err := strconv.ParseFloat(lit, 64); err == nil {
+		c.num, c.isNum = f, true
+		return c, true, nil
+	}
+	if c.op != "==" && c.op != "!=" {
+		return c, true, fmt.Errorf("%v needs a number, got %q", c.op, lit)
+	}
+	if uq, err := strconv.Unquote(lit); err == nil {
+		lit = uq
+	}
+	c.str = lit
+	return c, true, nil
+}
+
+// isCondReducer reports whether a reducer is a well formed conditional
+// one.
+func isCondReducer(s string) bool {
+	_, ok, err := parseCondReducer(s)
+	return ok && err == nil
+}
+
+// matches evaluates the condition against a document's value.
+func (c condReducer) matches(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	if c.isNum {
+		f, ok := ptrFloat(v)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "==":
+			return f == c.num
+		case "!=":
+			return f != c.num
+		case "<":
+			return f < c.num
+		case "<=":
+			return f <= c.num
+		case ">":
+			return f > c.num
+		}
+		return f >= c.num
+	}
+	eq := fmt.Sprintf("%v", v) == c.str
+	if c.op == "!=" {
+		return !eq
+	}
+	return eq
+}
+
+func (c condReducer) reducer() reducer {
+	return func(input chan ptrval) interface{} {
+		count, sum := 0, float64(0)
+		for v := range input {
+			p, ok := v.val.(ptrpair)
+			if !v.included || !ok || !c.matches(p.b) {
+				continue
+			}
+			if c.name == "countif" {
+				count++
+			} else if f, ok := ptrFloat(p.a); ok {
+				sum += f
+			}
+		}
+		if c.name == "countif" {
+			return count
+		}
+		return sum
+	}
+}
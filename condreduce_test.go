@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCondReducer(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp condReducer
+		ok  bool
+		err bool
+	}{
+		{"countif:/status>=500",
+			condReducer{name: "countif", ptr: "/status", op: ">=",
+				num: 500, isNum: true}, true, false},
+		{"sumif:/bytes:/status==200",
+			condReducer{name: "sumif", value: "/bytes", ptr: "/status",
+				op: "==", num: 200, isNum: true}, true, false},
+		{`countif:/method!="GET"`,
+			condReducer{name: "countif", ptr: "/method", op: "!=",
+				str: "GET"}, true, false},
+		{"countif:/host==a:/b",
+			condReducer{name: "countif", ptr: "/host", op: "==",
+				str: "a:/b"}, true, false},
+		{"sum", condReducer{}, false, false},
+		{"covariance:/a:/b", condReducer{}, false, false},
+		{"countif:/status", condReducer{}, true, true},
+		{"countif:/status=>5", condReducer{}, true, true},
+		{"countif:/host<abc", condReducer{}, true, true},
+	}
+	for _, test := range tests {
+		c, ok, err := parseCondReducer(test.in)
+		if ok != test.ok || (err != nil) != test.err {
+			t.Errorf("Expected %q to parse %v with error %v, got %v, %v",
+				test.in, test.ok, test.err, ok, err)
+			continue
+		}
+		if ok && err == nil && !reflect.DeepEqual(c, test.exp) {
+			t.Errorf("Expected %q to parse as %+v, got %+v",
+				test.in, test.exp, c)
+		}
+	}
+
+	ptrs, pairs := pairPointers([]string{"/x", "/y"},
+		[]string{"countif:/status>=500", "sumif:/bytes:/status==200"})
+	if !reflect.DeepEqual(ptrs, []string{"/x", "/bytes"}) ||
+		!reflect.DeepEqual(pairs, []string{"/status", "/status"}) {
+		t.Errorf("Unexpected pointers %v and pairs %v", ptrs, pairs)
+	}
+}
+
+func TestCondReducers(t *testing.T) {
+	form := url.Values{
+		"group": {"1000"},
+		"ptr":   {"/bytes", "/bytes", "/bytes"},
+		"reducer": {"countif:/status>=500", "sumif:/status==200",
+			`countif:/method=="GET"`},
+	}
+	p, err := parseQueryParams(form)
+	if err != nil {
+		t.Fatalf("Error parsing params: %v", err)
+	}
+
+	exp := []interface{}{2, 10.0, 1}
+	for i, r := range p.reds {
+		ch := make(chan ptrval)
+		second := []interface{}{"200", "500", "503", nil, "500"}
+		if i == 2 {
+			second = []interface{}{"GET", "PUT", "POST", nil, "GET"}
+		}
+		go func() {
+			defer close(ch)
+			ch <- ptrval{nil, ptrpair{"10", second[0]}, true}
+			ch <- ptrval{nil, ptrpair{"20", second[1]}, true}
+			ch <- ptrval{nil, ptrpair{"x", second[2]}, true}
+			ch <- ptrval{nil, ptrpair{"40", second[3]}, true}
+			ch <- ptrval{nil, ptrpair{"50", second[4]}, false}
+		}()
+		got := lookupReducer(r, p.funcs, time.Now().Add(time.Minute))(ch)
+		if !reflect.DeepEqual(got, exp[i]) {
+			t.Errorf("Expected %v for %v, got %v", exp[i], r, got)
+		}
+	}
+
+	form["reducer"][0] = "countif:/status<"
+	if _, err := parseQueryParams(form); err == nil {
+		t.Errorf("Expected an error for a bad condition")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Settings that otherwise come from server flags may be given for a
+// single database with PUT /db/_config, e.g.
+//
+//	{"retention": "720h", "conflicts": "reject", "flush_delay": "1s",
+//	 "compact_threshold": 0.5,
+//	 "auth": {"read": ["Bearer r3ad"], "write": ["Bearer wr1te"]}}
+//
+// The document replaces any earlier one and is kept in the database's
+// metadata, so it survives restarts.  Shards follow their parent.
+//
+// Every -maintenanceInterval, documents older than the retention
+// period are deleted, and files whose fragmentation has reached the
+// compaction threshold are compacted.  Auth rules list the
+// Authorization headers allowed to read or write the database over
+// HTTP; writers may also read, and an empty list leaves that access
+// open.
+
+type authRules struct {
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+}
+
+type dbConfig struct {
+	Retention        string     `json:"retention,omitempty"`
+	Conflicts        string     `json:"conflicts,omitempty"`
+	FlushDelay       string     `json:"flush_delay,omitempty"`
+	CompactThreshold float64    `json:"compact_threshold,omitempty"`
+	Auth             *authRules `json:"auth,omitempty"`
+	ReadOnly         bool       `json:"read_only,omitempty"`
+
+	// Where each document came from, kept alongside it.
+	Provenance *provenanceSpec `json:"provenance,omitempty"`
+}
+
+func (c dbConfig) validate() error {
+	for _, d := range []string{c.Retention, c.FlushDelay} {
+		if d == "" {
+			continue
+		}
+		if t, err := time.ParseDuration(d); err != nil || t <= 0 {
+			return fmt.Errorf("invalid duration: %q", d)
+		}
+	}
+	if err := validConflictPolicy(c.Conflicts); err != nil {
+		return err
+	}
+	if c.CompactThreshold < 0 || c.CompactThreshold >= 1 {
+		return fmt.Errorf("compact_threshold out of range: %v",
+			c.CompactThreshold)
+	}
+	return nil
+}
+
+// ownerDB is the database whose settings apply to dbname; shards
+// follow their parent.
+func ownerDB(dbname string) string {
+	if i := strings.IndexByte(dbname, '/'); i > 0 {
+		return dbname[:i]
+	}
+	return dbname
+}
+
+// dbConfigFor returns a database's settings.  The conflict policy was
+// metadata before there was a config document, so it stays there.
+func dbConfigFor(dbname string) dbConfig {
+	c := dbConfig{}
+	m, err := loadMeta(ownerDB(dbname))
+	if err != nil {
+		return c
+	}
+	if m.Config != nil {
+		c = *m.Config
+	}
+	c.Conflicts = m.Conflicts
+	return c
+}
+
+// configDuration parses a validated duration, with zero for none.
+func configDuration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+func dbFlushDelay(dbname string) time.Duration {
+	if d := configDuration(dbConfigFor(dbname).FlushDelay); d > 0 {
+		return d
+	}
+	return flushTime.get()
+}
+
+// closeWriters closes the open writers of a database and its shards
+// so they're reopened with its current settings.
+func closeWriters(dbname string) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	for n, w := range dbConns {
+		if n == dbname || strings.HasPrefix(n, dbname+"/") {
+			w.Close()
+		}
+	}
+}
+
+func getConfig(parts []string, w http.ResponseWriter, req *http.Request) {
+	mustEncode(200, w, dbConfigFor(parts[0]))
+}
+
+func putConfig(parts []string, w http.ResponseWriter, req *http.Request) {
+	c := dbConfig{}
+	err := json.NewDecoder(req.Body).Decode(&c)
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		emitError(400, w, "Bad config", err.Error())
+		return
+	}
+
+	err = updateMeta(parts[0], func(m *dbMeta) {
+		m.Conflicts = c.Conflicts
+		c.Conflicts = ""
+		m.Config = &c
+		if c == (dbConfig{}) {
+			m.Config = nil
+		}
+	})
+	if err != nil {
+		emitError(500, w, "Error storing config", err.Error())
+		return
+	}
+	closeWriters(parts[0])
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+// requestDB is the database a request path is for, if any.
+func requestDB(path string) string {
+	name := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if name == "" || strings.HasPrefix(name, "_") {
+		return ""
+	}
+	return name
+}
+
+// authorize checks a request against its database's auth rules,
+// reporting a refusal to the client.  Reading the config counts as
+// writing, since it includes the rules.
+func authorize(w http.ResponseWriter, req *http.Request) bool {
+	dbname := requestDB(req.URL.Path)
+	if dbname == "" || req.Method == "OPTIONS" {
+		return true
+	}
+	read := (req.Method == "GET" || req.Method == "HEAD") &&
+		!strings.HasSuffix(req.URL.Path, "/_config")
+	return authorizeDB(w, req, dbname, read)
+}
+
+// authorizeDB checks a request reading or writing a database against
+// its auth rules, reporting a refusal to the client.
+func authorizeDB(w http.ResponseWriter, req *http.Request,
+	dbname string, read bool) bool {
+	rules := dbConfigFor(dbname).Auth
+	if rules == nil {
+		return true
+	}
+
+	allowed := rules.Write
+	if read {
+		if len(rules.Read) == 0 {
+			return true
+		}
+		allowed = append(append([]string{}, rules.Read...),
+			rules.Write...)
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+
+	token := req.Header.Get("Authorization")
+	for _, a := range allowed {
+		if token == a {
+			return true
+		}
+	}
+	if token == "" {
+		emitError(401, w, "Unauthorized", "credentials required")
+	} else {
+		emitError(403, w, "Forbidden", "not allowed for "+dbname)
+	}
+	return false
+}
+
+// dbFragmentation is the fraction of a database file no longer in
+// use.
+func dbFragmentation(dbname string) (float64, error) {
+	st, err := os.Stat(dbPath(dbname))
+	if err != nil || st.Size() == 0 {
+		return 0, err
+	}
+	db, err := dbopen(dbname)
+	if err != nil {
+		return 0, err
+	}
+	defer closeDBConn(db)
+	inf, err := db.Info()
+	if err != nil {
+		return 0, err
+	}
+	return 1 - float64(inf.SpaceUsed)/float64(st.Size()), nil
+}
+
+// maintainOnce applies each database's retention period and
+// compaction threshold.
+func maintainOnce(now time.Time) {
+	purgeTrash(now)
+	for _, dbname := range dblist(*dbRoot) {
+		if memDatabase(dbname) != nil || dbReadOnly(dbname) {
+			continue
+		}
+		c := dbConfigFor(dbname)
+		if r := configDuration(c.Retention); r > 0 {
+			cutoff := dbFormat(dbname).formatKey(now.Add(-r))
+			n, err := dbdeleteMatching(dbname, "", cutoff, nil, nil, false)
+			if err != nil {
+				log.Printf("Error applying retention to %v: %v", dbname, err)
+				notify(hookRetention, dbname,
+					map[string]interface{}{"error": err.Error()})
+			} else if n > 0 {
+				log.Printf("Deleted %v documents from %v older than %v",
+					n, dbname, c.Retention)
+				notify(hookRetention, dbname, map[string]interface{}{
+					"deleted": n, "before": cutoff})
+			}
+		}
+		if c.CompactThreshold > 0 {
+			maybeCompact(dbname, c.CompactThreshold)
+		}
+	}
+}
+
+func maybeCompact(dbname string, threshold float64) {
+	names := []string{dbname}
+	if dbShardPeriod(dbname) != "" {
+		names = nil
+		for _, s := range dbShards(dbname) {
+			names = append(names, dbname+"/"+s)
+		}
+	}
+	for _, n := range names {
+		frag, err := dbFragmentation(n)
+		if err != nil || frag < threshold {
+			continue
+		}
+		log.Printf("Compacting %v at %.0f%% fragmentation", n, frag*100)
+		if err := dbcompact(n); err != nil {
+			log.Printf("Error compacting %v: %v", n, err)
+		}
+	}
+}
+
+func maintainer() {
+	for now := range time.Tick(*maintenanceInterval) {
+		maintainOnce(now)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		c  dbConfig
+		ok bool
+	}{
+		{dbConfig{}, true},
+		{dbConfig{Retention: "720h", FlushDelay: "1s",
+			Conflicts: conflictReject, CompactThreshold: 0.5}, true},
+		{dbConfig{Retention: "a while"}, false},
+		{dbConfig{FlushDelay: "-1s"}, false},
+		{dbConfig{Conflicts: "maybe"}, false},
+		{dbConfig{CompactThreshold: 1}, false},
+	}
+
+	for _, test := range tests {
+		err := test.c.validate()
+		if (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %+v, got %v", test.ok, test.c, err)
+		}
+	}
+}
+
+func TestConfigInherited(t *testing.T) {
+	metaCache["configured"] = dbMeta{Format: 1, Conflicts: conflictMerge,
+		Config: &dbConfig{FlushDelay: "250ms"}}
+	defer delete(metaCache, "configured")
+
+	c := dbConfigFor("configured/2012-08-10")
+	if c.Conflicts != conflictMerge || c.FlushDelay != "250ms" {
+		t.Errorf("Expected shard to follow its parent, got %+v", c)
+	}
+	if d := dbFlushDelay("configured"); d.String() != "250ms" {
+		t.Errorf("Expected 250ms flush delay, got %v", d)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	metaCache["guarded"] = dbMeta{Format: 1, Config: &dbConfig{
+		Auth: &authRules{Read: []string{"r"}, Write: []string{"w"}}}}
+	defer delete(metaCache, "guarded")
+	metaCache["readable"] = dbMeta{Format: 1, Config: &dbConfig{
+		Auth: &authRules{Write: []string{"w"}}}}
+	defer delete(metaCache, "readable")
+
+	tests := []struct {
+		method, path, token string
+		exp                 int
+	}{
+		{"GET", "/_stats", "", 0},
+		{"GET", "/open/_query", "", 0},
+		{"GET", "/guarded/_query", "", 401},
+		{"GET", "/guarded/_query", "x", 403},
+		{"GET", "/guarded/_query", "r", 0},
+		{"GET", "/guarded/_query", "w", 0},
+		{"POST", "/guarded", "r", 403},
+		{"POST", "/guarded", "w", 0},
+		{"GET", "/guarded/_config", "r", 403},
+		{"OPTIONS", "/guarded", "", 0},
+		{"GET", "/readable/_all_docs", "", 0},
+		{"PUT", "/readable/_config", "", 401},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", test.token)
+		}
+		w := httptest.NewRecorder()
+		ok := authorize(w, req)
+		if ok != (test.exp == 0) || (!ok && w.Code != test.exp) {
+			t.Errorf("%v %v with %q: expected %v, got %v/%v",
+				test.method, test.path, test.token, test.exp, ok, w.Code)
+		}
+	}
+}
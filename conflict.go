@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/dustin/gojson"
+)
+
+// What a database's writer does with a document stored at a time
+// that already has one.  The policy is chosen with conflicts= when
+// the database is created.
+const (
+	conflictOverwrite = "overwrite" // the newer document wins
+	conflictReject    = "reject"    // the newer document fails with 409
+	conflictSuffix    = "suffix"    // the newer document is stored at time#n
+	conflictMerge     = "merge"     // fields are merged, the newer winning
+)
+
+var errKeyConflict = errors.New("a document is already stored at that time")
+
+func validConflictPolicy(p string) error {
+	switch p {
+	case "", conflictOverwrite, conflictReject, conflictSuffix, conflictMerge:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy: %v", p)
+}
+
+func dbConflictPolicy(dbname string) string {
+	m, err := loadMeta(ownerDB(dbname))
+	if err != nil || m.Conflicts == "" {
+		return conflictOverwrite
+	}
+	return m.Conflicts
+}
+
+// existing finds the document at a key, including writes not yet
+// committed.
+func (dq *dbWriter) existing(k string) ([]byte, bool) {
+	if v, ok := dq.pending[k]; ok {
+		return v, true
+	}
+	doc, _, err := dq.db.Get(k)
+	if err != nil {
+		return nil, false
+	}
+	return doc.Value(), true
+}
+
+// tracksPending reports whether uncommitted writes are remembered,
+// which they only need to be when the policy looks at what's stored.
+func (dq *dbWriter) tracksPending() bool {
+	return dq.conflicts != "" && dq.conflicts != conflictOverwrite
+}
+
+// track remembers an uncommitted write for conflict checks.
+func (dq *dbWriter) track(k string, data []byte) {
+	if !dq.tracksPending() {
+		return
+	}
+	if dq.pending == nil {
+		dq.pending = map[string][]byte{}
+	}
+	dq.pending[k] = data
+}
+
+// resolveConflict returns the key and document to actually store for
+// a write, according to the database's policy.
+func (dq *dbWriter) resolveConflict(k string, data []byte) (string, []byte, error) {
+	if !dq.tracksPending() {
+		return k, data, nil
+	}
+	old, exists := dq.existing(k)
+	if !exists {
+		return k, data, nil
+	}
+	switch dq.conflicts {
+	case conflictReject:
+		return k, nil, errKeyConflict
+	case conflictSuffix:
+		for n := 2; ; n++ {
+			sk := k + "#" + strconv.Itoa(n)
+			if _, taken := dq.existing(sk); !taken {
+				return sk, data, nil
+			}
+		}
+	case conflictMerge:
+		return k, mergeDocs(old, data), nil
+	}
+	return k, data, nil
+}
+
+// mergeDocs merges the top level fields of two objects.  Anything
+// else is replaced by the newer document.
+func mergeDocs(old, data []byte) []byte {
+	om := map[string]json.RawMessage{}
+	nm := map[string]json.RawMessage{}
+	if json.Unmarshal(old, &om) != nil || json.Unmarshal(data, &nm) != nil {
+		return data
+	}
+	for k, v := range nm {
+		om[k] = v
+	}
+	return encodeRawObject(om)
+}
+
+// encodeRawObject writes out an object of fields already encoded.
+// json.Marshal can't be given the map itself, as it only uses
+// RawMessage's MarshalJSON for addressable values, and would encode
+// each of these as base64.
+func encodeRawObject(m map[string]json.RawMessage) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(bytes.TrimSpace(m[k]))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
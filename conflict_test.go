@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolveConflict(t *testing.T) {
+	dq := &dbWriter{db: &memHandle{testMemStore("a")}}
+
+	tests := []struct {
+		policy string
+		k      string
+		data   string
+		err    error
+	}{
+		{conflictOverwrite, "a", `{"n":2}`, nil},
+		{conflictReject, "a", "", errKeyConflict},
+		{conflictSuffix, "a#2", `{"n":2}`, nil},
+		{conflictMerge, "a", `{"n":2}`, nil},
+	}
+	for _, test := range tests {
+		dq.conflicts = test.policy
+		k, data, err := dq.resolveConflict("a", []byte(`{"n":2}`))
+		if k != test.k || string(data) != test.data || err != test.err {
+			t.Errorf("Expected %v to give %v %s %v, got %v %s %v",
+				test.policy, test.k, test.data, test.err, k, data, err)
+		}
+	}
+
+	// Uncommitted writes count too.
+	dq.conflicts = conflictSuffix
+	dq.track("a#2", []byte(`{}`))
+	if k, _, _ := dq.resolveConflict("a", []byte(`{}`)); k != "a#3" {
+		t.Errorf("Expected the next free suffix, got %v", k)
+	}
+	dq.committed(nil)
+	if k, _, _ := dq.resolveConflict("b", []byte(`{}`)); k != "b" {
+		t.Errorf("Expected a free key to be kept, got %v", k)
+	}
+}
+
+func TestMergeDocs(t *testing.T) {
+	got := string(mergeDocs([]byte(`{"a":1,"b":1}`), []byte(`{"b":2,"c":2}`)))
+	if got != `{"a":1,"b":2,"c":2}` {
+		t.Errorf("Unexpected merge: %v", got)
+	}
+	if got := string(mergeDocs([]byte(`1`), []byte(`{"b":2}`))); got != `{"b":2}` {
+		t.Errorf("Expected a non-object to be replaced, got %v", got)
+	}
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"errors"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-couchstore"
@@ -18,6 +21,15 @@ const (
 	opStoreItem = dbOperation(iota)
 	opDeleteItem
 	opCompact
+	opMigrate
+	opStoreBatch
+	opFlush
+	opCopy
+	opRename
+	opReplace
+	opPatch
+	opReindex
+	opIndexFields
 )
 
 const dbExt = ".couch"
@@ -27,14 +39,68 @@ type dbqitem struct {
 	k      string
 	data   []byte
 	op     dbOperation
-	cherr  chan error
+	format storageFormat
+	batch  []dbqitem
+	// The new name to copy or rename to.
+	dest  string
+	cherr chan error
+	// Told whether the write was accepted, before it's committed.
+	accepted chan error
+	// Where the write came from, for databases keeping provenance.
+	prov []byte
 }
 
 type dbWriter struct {
-	dbname string
-	ch     chan dbqitem
-	quit   chan bool
-	db     *couchstore.Couchstore
+	dbname  string
+	ch      chan dbqitem
+	quit    chan bool
+	db      dbStore
+	format  storageFormat
+	recent  *memDB
+	rollups []*rollup
+	values  *valueIndexer
+	index   *fieldIndexer
+	prov    *provenanceLog
+	schema  *schemaTracker
+	flush   *flushController
+
+	// Position of the last write handed to the writer.  It starts
+	// from the last committed sequence, so it keeps increasing
+	// across reopens.
+	seqLock sync.Mutex
+	seq     uint64
+	// The latest time handed out by issueKey or stored, in
+	// nanoseconds.  Kept apart from seqLock, which is held while
+	// sending to the write loop.
+	keyLock    sync.Mutex
+	lastIssued int64
+
+	// Writes whose senders are waiting for them to be committed.
+	// Only touched by the write loop.
+	waiting []chan error
+
+	// The conflict policy, and uncommitted writes to check it
+	// against.  Only touched by the write loop.
+	conflicts string
+	pending   map[string][]byte
+
+	// When the writer was opened, and when it last took an item off
+	// its queue, in nanoseconds.
+	opened     time.Time
+	lastActive int64
+}
+
+// A dbStore is an open database.  *couchstore.Couchstore is the
+// usual implementation, but memory databases provide their own.
+type dbStore interface {
+	Bulk() couchstore.BulkWriter
+	Get(id string) (*couchstore.Document, *couchstore.DocInfo, error)
+	GetFromDocInfo(di *couchstore.DocInfo) (*couchstore.Document, error)
+	Walk(from string, f couchstore.WalkFun) error
+	WalkDocs(from string, f couchstore.DocWalkFun) error
+	Info() (couchstore.DBInfo, error)
+	CompactTo(dest string) error
+	Close() error
 }
 
 var errClosed = errors.New("closed")
@@ -71,7 +137,12 @@ func dbBase(n string) string {
 	return n[left:right]
 }
 
-func dbopen(name string) (*couchstore.Couchstore, error) {
+func dbopen(name string) (dbStore, error) {
+	if m := memDatabase(name); m != nil {
+		h := &memHandle{m}
+		recordDBConn("memory:"+name, h)
+		return h, nil
+	}
 	path := dbPath(name)
 	db, err := couchstore.Open(dbPath(name), false)
 	if err == nil {
@@ -80,6 +151,40 @@ func dbopen(name string) (*couchstore.Couchstore, error) {
 	return db, err
 }
 
+// dbopenRead opens a database for reading, including any recently
+// written documents that haven't necessarily been committed yet.
+func dbopenRead(name string) (dbStore, error) {
+	db, err := readPool.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if r := recentDocs(name); r != nil {
+		return &hybridStore{db, r}, nil
+	}
+	return db, nil
+}
+
+// dbopenRange opens a database for reading keys from the given key
+// onward.  If the recent buffer holds everything in that range, the
+// file isn't opened at all.
+func dbopenRange(name, from string) (dbStore, error) {
+	if r := recentDocs(name); r != nil && r.covers(from) {
+		h := &memHandle{r}
+		recordDBConn("recent:"+name, h)
+		return h, nil
+	}
+	return dbopenRead(name)
+}
+
+func recentDocs(dbname string) *memDB {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if writer := dbConns[dbname]; writer != nil {
+		return writer.recent
+	}
+	return nil
+}
+
 func dbcreate(path string) error {
 	db, err := couchstore.Open(path, true)
 	if err != nil {
@@ -102,18 +207,37 @@ func dbRemoveConn(dbname string) {
 }
 
 func dbdelete(dbname string) error {
-	return os.Remove(dbPath(dbname))
+	dropQuota(dbname)
+	dropSchema(dbname)
+	if dropMemDatabase(dbname) {
+		return nil
+	}
+	if dbShardPeriod(dbname) != "" {
+		if err := dropShards(dbname); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(dbPath(dbname)); err != nil {
+		return err
+	}
+	os.Remove(valuesPath(dbname))
+	os.Remove(indexPath(dbname))
+	os.Remove(provenancePath(dbname))
+	readPool.invalidate(dbname)
+	return dropMeta(dbname)
 }
 
 func dblist(root string) []string {
-	rv := []string{}
+	rv := memDatabaseNames()
 	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
 		if err == nil {
-			if !info.IsDir() && strings.HasSuffix(p, dbExt) {
+			// Shards live in subdirectories and aren't listed.
+			if !info.IsDir() && strings.HasSuffix(p, dbExt) &&
+				!strings.Contains(dbBase(p), "/") {
 				rv = append(rv, dbBase(p))
 			}
 		} else {
-			log.Printf("Error on %#v: %v", p, err)
+			dbLog.Warn("error listing databases", "path", p, "err", err)
 		}
 		return nil
 	})
@@ -122,46 +246,123 @@ func dblist(root string) []string {
 
 func dbCompact(dq *dbWriter, bulk couchstore.BulkWriter, queued int,
 	qi dbqitem) (couchstore.BulkWriter, error) {
+	return dbRewrite(dq, bulk, queued, "compaction", dq.db.CompactTo)
+}
+
+func dbMigrate(dq *dbWriter, bulk couchstore.BulkWriter, queued int,
+	qi dbqitem) (couchstore.BulkWriter, error) {
+	if qi.format.Version == dq.format.Version {
+		return bulk, nil
+	}
+	if _, ok := dq.db.(*memHandle); ok {
+		return bulk, errNotOnDisk
+	}
+	bulk, err := dbRewrite(dq, bulk, queued, "migration",
+		func(dest string) error {
+			return migrateTo(dq.db, dest, qi.format)
+		})
+	if err != nil {
+		return bulk, err
+	}
+	dbLog.Info("migrated", "db", dq.dbname, "from", dq.format.Version,
+		"to", qi.format.Version)
+	dq.format = qi.format
+	err = updateMeta(dq.dbname, func(m *dbMeta) {
+		m.Format = qi.format.Version
+	})
+	if err == nil && dq.index != nil {
+		// The index is by key, and keys have changed.
+		bulk, err = dbIndexFields(dq, bulk, 0)
+	}
+	return bulk, err
+}
+
+// dbRewrite flushes anything pending, produces a new file with the
+// given rewrite function and swaps it in place of the live database.
+func dbRewrite(dq *dbWriter, bulk couchstore.BulkWriter, queued int,
+	what string, rewrite func(dest string) error) (couchstore.BulkWriter, error) {
 	start := time.Now()
 	if queued > 0 {
-		bulk.Commit()
-		if *verbose {
-			log.Printf("Flushed %d items in %v for pre-compact",
-				queued, time.Since(start))
-		}
+		dq.committed(bulk.Commit())
+		flushRollups(dq.rollups, dq.db)
+		dq.values.flush(dq.db)
+		dq.index.flush(dq.db)
+		dq.prov.flush()
+		dbLog.Debug("flushed", "db", dq.dbname, "items", queued,
+			"took", time.Since(start), "before", what)
 		bulk.Close()
 	}
 	dbn := dbPath(dq.dbname)
-	queued = 0
+	os.Remove(dbn + rewriteExt)
 	start = time.Now()
-	err := dq.db.CompactTo(dbn + ".compact")
+	err := rewrite(dbn + rewriteExt)
 	if err != nil {
-		log.Printf("Error compacting: %v", err)
+		dbLog.Error("rewrite failed", "db", dq.dbname, "op", what,
+			"err", err)
+		os.Remove(dbn + rewriteExt)
 		return dq.db.Bulk(), err
 	}
-	log.Printf("Finished compaction of %v in %v", dq.dbname,
-		time.Since(start))
-	err = os.Rename(dbn+".compact", dbn)
+	dbLog.Info("rewrite finished", "db", dq.dbname, "op", what,
+		"took", time.Since(start))
+	// Until the swap, the old file is still the database.
+	err = swapInRewrite(dbn)
 	if err != nil {
-		log.Printf("Error putting compacted data back")
+		dbLog.Error("error swapping in rewrite", "db", dq.dbname,
+			"op", what, "err", err)
 		return dq.db.Bulk(), err
 	}
+	readPool.invalidate(dq.dbname)
 
-	log.Printf("Reopening post-compact")
+	dbLog.Debug("reopening", "db", dq.dbname, "after", what)
 	closeDBConn(dq.db)
 
 	dq.db, err = dbopen(dq.dbname)
 	if err != nil {
-		log.Fatalf("Error reopening DB after compaction: %v", err)
+		dbLog.Fatal("error reopening", "db", dq.dbname, "after", what,
+			"err", err)
 	}
+	dq.values.skipTo(dq.db)
 	return dq.db.Bulk(), nil
 }
 
+// commit commits the n queued writes and everything that follows
+// from them.
+func (dq *dbWriter) commit(bulk couchstore.BulkWriter, n int, why string) {
+	start := time.Now()
+	err := bulk.Commit()
+	took := time.Since(start)
+	dq.committed(err)
+	serverStatsCollector.flushed(took)
+	dq.flush.committed(n, took, time.Now())
+	flushRollups(dq.rollups, dq.db)
+	dq.values.flush(dq.db)
+	dq.index.flush(dq.db)
+	dq.prov.flush()
+	dq.schema.flush()
+	checkQuota(dq.dbname, dq.db)
+	dbLog.Debug("flushed", "db", dq.dbname, "items", n, "why", strings.TrimSpace(why),
+		"took", took)
+}
+
+// committed tells everyone waiting on queued writes how the commit
+// of those writes went.
+func (dq *dbWriter) committed(err error) {
+	for _, ch := range dq.waiting {
+		ch <- err
+	}
+	dq.waiting = nil
+	dq.pending = nil
+	if err == nil && dq.recent != nil {
+		dq.recent.clearTombstones()
+	}
+}
+
 func dbWriteLoop(dq *dbWriter) {
+	pinWriter(dq.dbname)
 	queued := 0
 	bulk := dq.db.Bulk()
 
-	t := time.NewTimer(*flushTime)
+	t := time.NewTimer(dq.flush.wait())
 	defer t.Stop()
 	liveTracker := time.NewTicker(*liveTime)
 	defer liveTracker.Stop()
@@ -171,74 +372,268 @@ func dbWriteLoop(dq *dbWriter) {
 		select {
 		case <-dq.quit:
 			bulk.Close()
-			bulk.Commit()
+			dq.committed(bulk.Commit())
+			flushRollups(dq.rollups, dq.db)
+			dq.values.flush(dq.db)
+			dq.index.flush(dq.db)
+			dq.prov.flush()
+			dq.schema.flush()
 			closeDBConn(dq.db)
 			dbRemoveConn(dq.dbname)
-			log.Printf("Closed %v", dq.dbname)
+			dbLog.Info("closed", "db", dq.dbname)
 			return
 		case <-liveTracker.C:
 			if queued == 0 && liveOps == 0 {
-				log.Printf("Closing idle DB: %v", dq.dbname)
+				dbLog.Info("closing idle", "db", dq.dbname)
 				close(dq.quit)
 			}
 			liveOps = 0
 		case qi := <-dq.ch:
 			liveOps++
+			atomic.StoreInt64(&dq.lastActive, time.Now().UnixNano())
 			switch qi.op {
-			case opStoreItem:
-				bulk.Set(couchstore.NewDocInfo(qi.k,
+			case opStoreItem, opReplace, opPatch:
+				if qi.op == opPatch && queued > 0 && !dq.tracksPending() {
+					// The patch has to see what's queued.
+					dq.commit(bulk, queued, " before a patch")
+					queued = 0
+				}
+				var k string
+				var data []byte
+				var err error
+				if qi.op == opStoreItem {
+					k, data, err = dq.resolveConflict(
+						dq.format.normalizeKey(qi.k), qi.data)
+				} else {
+					k, data, err = dq.modify(qi)
+				}
+				if qi.accepted != nil {
+					qi.accepted <- err
+				}
+				if err != nil {
+					break
+				}
+				qi.data = data
+				dq.noteStored(k)
+				dq.retractRollups(k)
+				dq.track(k, data)
+				bulk.Set(couchstore.NewDocInfo(k,
 					couchstore.DocIsCompressed),
-					couchstore.NewDocument(qi.k, qi.data))
+					couchstore.NewDocument(k, qi.data))
+				if dq.recent != nil {
+					dq.recent.commit([]memOp{{k, qi.data, false}})
+				}
+				for _, r := range dq.rollups {
+					r.add(k, qi.data)
+				}
+				dq.values.add(k, qi.data)
+				dq.index.add(k, qi.data)
+				dq.prov.add(k, qi.prov)
+				dq.schema.add(k, qi.data)
+				if qi.cherr != nil {
+					dq.waiting = append(dq.waiting, qi.cherr)
+				}
 				queued++
 			case opDeleteItem:
 				queued++
-				bulk.Delete(couchstore.NewDocInfo(qi.k, 0))
+				k := dq.format.normalizeKey(qi.k)
+				bulk.Delete(couchstore.NewDocInfo(k, 0))
+				if dq.recent != nil {
+					dq.recent.commit([]memOp{{k, nil, true}})
+				}
+				for _, r := range dq.rollups {
+					r.retract(k)
+				}
+				dq.values.remove(k)
+				dq.index.remove(k)
+				dq.prov.add(k, nil)
 			case opCompact:
 				var err error
 				bulk, err = dbCompact(dq, bulk, queued, qi)
+				checkQuota(dq.dbname, dq.db)
+				qi.cherr <- err
+				queued = 0
+			case opMigrate:
+				var err error
+				bulk, err = dbMigrate(dq, bulk, queued, qi)
+				checkQuota(dq.dbname, dq.db)
 				qi.cherr <- err
 				queued = 0
+			case opReindex:
+				var err error
+				bulk, err = dbReindex(dq, bulk, queued)
+				qi.cherr <- err
+				queued = 0
+			case opIndexFields:
+				var err error
+				bulk, err = dbIndexFields(dq, bulk, queued)
+				qi.cherr <- err
+				queued = 0
+			case opCopy:
+				var err error
+				bulk, err = dbCopyTo(dq, bulk, queued, qi)
+				qi.cherr <- err
+				queued = 0
+			case opRename:
+				var err error
+				bulk, err = dbRenameTo(dq, bulk, queued, qi)
+				if err == nil {
+					closeDBConn(dq.db)
+					dbRemoveConn(dq.dbname)
+					qi.cherr <- nil
+					return
+				}
+				qi.cherr <- err
+				queued = 0
+			case opStoreBatch:
+				qi.cherr <- dbStoreBatch(dq, bulk, qi)
+				queued = 0
+				t.Reset(dq.flush.wait())
+			case opFlush:
+				if queued > 0 {
+					dq.commit(bulk, queued, " on request")
+					queued = 0
+				}
+				qi.cherr <- nil
+				t.Reset(dq.flush.wait())
 			default:
 				log.Panicf("Unhandled case: %v", qi.op)
 			}
-			if queued >= *maxOpQueue {
-				start := time.Now()
-				bulk.Commit()
-				if *verbose {
-					log.Printf("Flush of %d items took %v",
-						queued, time.Since(start))
-				}
+			if queued >= dq.flush.limit() {
+				dq.commit(bulk, queued, "")
 				queued = 0
-				t.Reset(*flushTime)
+				t.Reset(dq.flush.wait())
+			} else if queued == 1 && maxDurability.get() > 0 {
+				// Bound how long the first write of a batch waits.
+				t.Reset(dq.flush.wait())
 			}
-		case <-t.C:
+		case fired := <-t.C:
+			writerDelays.record(time.Since(fired))
 			if queued > 0 {
-				start := time.Now()
-				bulk.Commit()
-				if *verbose {
-					log.Printf("Flush of %d items from timer took %v",
-						queued, time.Since(start))
-				}
+				dq.commit(bulk, queued, " from timer")
 				queued = 0
 			}
-			t.Reset(*flushTime)
+			t.Reset(dq.flush.wait())
 		}
 	}
 }
 
+// dbStoreBatch commits a batch of stores and deletes (along with
+// anything else queued) in a single commit so either all or none are
+// applied.
+func dbStoreBatch(dq *dbWriter, bulk couchstore.BulkWriter,
+	qi dbqitem) error {
+
+	ops := make([]memOp, 0, len(qi.batch))
+	for _, item := range qi.batch {
+		k := dq.format.normalizeKey(item.k)
+		if item.op == opDeleteItem {
+			ops = append(ops, memOp{k, nil, true})
+			continue
+		}
+		k, data, err := dq.resolveConflict(k, item.data)
+		if err != nil {
+			// Nothing in the batch is stored, but whatever was
+			// queued before it still is.
+			dq.commit(bulk, 0, " before a conflicting batch")
+			return err
+		}
+		dq.noteStored(k)
+		dq.retractRollups(k)
+		ops = append(ops, memOp{k, data, false})
+	}
+	for _, op := range ops {
+		if op.deleted {
+			bulk.Delete(couchstore.NewDocInfo(op.k, 0))
+			continue
+		}
+		bulk.Set(couchstore.NewDocInfo(op.k, couchstore.DocIsCompressed),
+			couchstore.NewDocument(op.k, op.v))
+	}
+	start := time.Now()
+	err := bulk.Commit()
+	dq.committed(err)
+	if err != nil {
+		return err
+	}
+	took := time.Since(start)
+	serverStatsCollector.flushed(took)
+	dq.flush.committed(len(ops), took, time.Now())
+
+	if dq.recent != nil {
+		dq.recent.commit(ops)
+	}
+	for _, op := range ops {
+		if op.deleted {
+			for _, r := range dq.rollups {
+				r.retract(op.k)
+			}
+			dq.values.remove(op.k)
+			dq.index.remove(op.k)
+			dq.prov.add(op.k, nil)
+			continue
+		}
+		for _, r := range dq.rollups {
+			r.add(op.k, op.v)
+		}
+		dq.values.add(op.k, op.v)
+		dq.index.add(op.k, op.v)
+		dq.prov.add(op.k, nil)
+		dq.schema.add(op.k, op.v)
+	}
+	flushRollups(dq.rollups, dq.db)
+	dq.values.flush(dq.db)
+	dq.index.flush(dq.db)
+	dq.prov.flush()
+	dq.schema.flush()
+	checkQuota(dq.dbname, dq.db)
+	return nil
+}
+
 func dbWriteFun(dbname string) (*dbWriter, error) {
 	db, err := dbopen(dbname)
 	if err != nil {
 		return nil, err
 	}
 
+	inf, err := db.Info()
+	if err != nil {
+		closeDBConn(db)
+		return nil, err
+	}
+
+	_, newest := keyRange(db, dbFormat(dbname))
+
 	writer := &dbWriter{
-		dbname,
-		make(chan dbqitem, *maxOpQueue),
-		make(chan bool),
-		db,
+		dbname:  dbname,
+		ch:      make(chan dbqitem, maxOpQueue.get()),
+		quit:    make(chan bool),
+		db:      db,
+		format:  dbFormat(dbname),
+		rollups: newRollups(dbname),
+		values:  newValueIndexer(dbname, db),
+		index:   newFieldIndexer(dbname, db),
+		prov:    newProvenanceLog(dbname, db),
+		flush:   newFlushController(dbFlushDelay(dbname)),
+		seq:     inf.LastSeq,
+
+		lastIssued: parseKey(newest),
+		conflicts:  dbConflictPolicy(dbname),
+		opened:     time.Now(),
+	}
+	_, inMemory := db.(*memHandle)
+	if *recentBuffer > 0 && !inMemory {
+		writer.recent = &memDB{name: dbname,
+			opts:       memOptions{TTL: *recentBuffer, Policy: memEvict},
+			docs:       map[string][]byte{},
+			since:      dbFormat(dbname).formatKey(time.Now()),
+			tombstones: map[string]bool{}}
+	}
+	if *trackSchema && !inMemory {
+		writer.schema = dbSchema(dbname)
 	}
 
+	checkQuota(dbname, db)
 	go dbWriteLoop(writer)
 
 	return writer, nil
@@ -263,55 +658,418 @@ func getOrCreateDB(dbname string) (*dbWriter, bool, error) {
 }
 
 func dbstore(dbname string, k string, body []byte) error {
+	_, err := dbstoreSeq(dbname, k, body, false)
+	return err
+}
+
+// dbstoreSeq stores a document, returning its position in the
+// database's write order.  With wait set, it returns only once the
+// document is committed.
+func dbstoreSeq(dbname string, k string, body []byte,
+	wait bool) (uint64, error) {
+	return dbstoreOp(dbname, k, body, opStoreItem, wait, nil)
+}
+
+// dbmodify replaces (opReplace) or patches (opPatch) the document at
+// a key, returning once the result is committed.
+func dbmodify(dbname, k string, body []byte, op dbOperation,
+	prov []byte) (uint64, error) {
+	return dbstoreOp(dbname, k, body, op, true, prov)
+}
+
+// dbstoreOp queues a write, with where it came from, if that's kept.
+func dbstoreOp(dbname string, k string, body []byte, op dbOperation,
+	wait bool, prov []byte) (uint64, error) {
+
+	if err := writeRefused(dbname); err != nil {
+		return 0, err
+	}
+	if err := tenantAdmit(dbname, 1, time.Now()); err != nil {
+		return 0, err
+	}
+	if m := memDatabase(dbname); m != nil && m.full() {
+		return 0, errMemoryFull
+	}
+
+	// Patches are checked once they're applied.
+	var err error
+	if op != opPatch {
+		body, err = applyFieldSchema(dbFieldSchema(dbname), body)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkEvent(dbname, k, body); err != nil {
+			return 0, err
+		}
+	}
+
+	shard, err := shardFor(dbname, k, op != opPatch)
+	if err != nil {
+		return 0, err
+	}
+	if shard != "" {
+		if _, err := os.Stat(dbPath(shard)); op == opPatch && err != nil {
+			return 0, errNotFound
+		}
+		dbname = shard
+	}
+
 	writer, _, err := getOrCreateDB(dbname)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if quotaReached(dbname) {
+		return 0, errQuotaExceeded
 	}
 
-	writer.ch <- dbqitem{dbname, k, body, opStoreItem, nil}
+	qi := dbqitem{dbname: dbname, k: k, data: body, op: op, prov: prov}
+	if wait {
+		qi.cherr = make(chan error, 1)
+	}
+	if writer.conflicts == conflictReject || op != opStoreItem {
+		qi.accepted = make(chan error, 1)
+	}
+	seq, err := writer.enqueue(qi)
+	if err == nil && qi.accepted != nil {
+		err = writer.waitCommitted(qi.accepted)
+	}
+	if err == nil && wait {
+		err = writer.waitCommitted(qi.cherr)
+	}
+	return seq, err
+}
+
+// issueKey returns a key for now that's later than every key issued
+// before it or already stored, even within a nanosecond or when the
+// clock steps back.
+func (w *dbWriter) issueKey(now time.Time) string {
+	w.keyLock.Lock()
+	defer w.keyLock.Unlock()
+	n := now.UnixNano()
+	if n <= w.lastIssued {
+		n = w.lastIssued + 1
+	}
+	w.lastIssued = n
+	return time.Unix(0, n).UTC().Format(time.RFC3339Nano)
+}
+
+// noteStored records a key the write loop stores, so keys issued
+// after it sort later, however it was chosen.
+func (w *dbWriter) noteStored(k string) {
+	n := parseKey(k)
+	w.keyLock.Lock()
+	defer w.keyLock.Unlock()
+	if n > w.lastIssued {
+		w.lastIssued = n
+	}
+}
+
+// dbstoreNow stores a document at a server issued time (see
+// issueKey), returning the key used and its position in the write
+// order.
+func dbstoreNow(dbname string, body []byte, wait bool,
+	prov []byte) (string, uint64, error) {
+	if err := writeRefused(dbname); err != nil {
+		return "", 0, err
+	}
+	now := time.Now()
+	shard, err := shardFor(dbname, now.UTC().Format(time.RFC3339Nano), true)
+	if err != nil {
+		return "", 0, err
+	}
+	target := dbname
+	if shard != "" {
+		target = shard
+	}
+	writer, _, err := getOrCreateDB(target)
+	if err != nil {
+		return "", 0, err
+	}
+	k := writer.issueKey(now)
+	seq, err := dbstoreOp(dbname, k, body, opStoreItem, wait, prov)
+	return dbFormat(target).normalizeKey(k), seq, err
+}
+
+// dbstoreBatch stores all of the given documents in one commit,
+// returning once they're committed.
+func dbstoreBatch(dbname string, items []dbqitem) (uint64, error) {
+	cherr := make(chan error, 1)
+	writer, seq, err := dbqueueBatch(dbname, items, cherr)
+	if err != nil {
+		return 0, err
+	}
+	return seq, writer.waitCommitted(cherr)
+}
+
+// dbqueueBatch queues a batch without waiting for it.  The batch's
+// commit error is sent on cherr, which must be buffered, by the
+// returned writer.
+func dbqueueBatch(dbname string, items []dbqitem,
+	cherr chan error) (*dbWriter, uint64, error) {
+
+	if err := writeRefused(dbname); err != nil {
+		return nil, 0, err
+	}
+	if err := tenantAdmit(dbname, len(items), time.Now()); err != nil {
+		return nil, 0, err
+	}
+	if m := memDatabase(dbname); m != nil && m.full() {
+		return nil, 0, errMemoryFull
+	}
+
+	schema := dbFieldSchema(dbname)
+	target := ""
+	for i, item := range items {
+		if item.op != opDeleteItem {
+			data, err := applyFieldSchema(schema, item.data)
+			if err != nil {
+				return nil, 0, err
+			}
+			if err := checkEvent(dbname, item.k, data); err != nil {
+				return nil, 0, err
+			}
+			items[i].data = data
+		}
+		shard, err := shardFor(dbname, item.k, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		if i > 0 && shard != target {
+			return nil, 0, errBatchSpansShards
+		}
+		target = shard
+	}
+	if target != "" {
+		dbname = target
+	}
+
+	writer, _, err := getOrCreateDB(dbname)
+	if err != nil {
+		return nil, 0, err
+	}
+	if quotaReached(dbname) {
+		return nil, 0, errQuotaExceeded
+	}
+
+	seq, err := writer.enqueue(dbqitem{dbname: dbname, op: opStoreBatch,
+		batch: items, cherr: cherr})
+	if err != nil {
+		return nil, 0, err
+	}
+	return writer, seq, nil
+}
+
+// dbflush commits anything queued for a database (or its shards)
+// and returns once it's committed.
+func dbflush(dbname string) error {
+	dbLock.Lock()
+	writers := []*dbWriter{}
+	for n, w := range dbConns {
+		if n == dbname || strings.HasPrefix(n, dbname+"/") {
+			writers = append(writers, w)
+		}
+	}
+	dbLock.Unlock()
 
+	for _, w := range writers {
+		cherr := make(chan error, 1)
+		select {
+		case w.ch <- dbqitem{dbname: w.dbname, op: opFlush, cherr: cherr}:
+		case <-w.quit:
+			// Closing commits everything.
+			continue
+		}
+		select {
+		case err := <-cherr:
+			if err != nil {
+				return err
+			}
+		case <-w.quit:
+		}
+	}
 	return nil
 }
 
 func dbcompact(dbname string) error {
+	start := time.Now()
+	err := dbrewrite(dbqitem{dbname: dbname, op: opCompact})
+	if err == nil {
+		notify(hookCompacted, dbname, map[string]interface{}{
+			"took_ms": int64(time.Since(start) / time.Millisecond)})
+	}
+	return err
+}
+
+func dbmigrate(dbname string, to storageFormat) error {
+	return dbrewrite(dbqitem{dbname: dbname, op: opMigrate, format: to})
+}
+
+func dbrewrite(qi dbqitem) error {
+	dbname := qi.dbname
 	writer, opened, err := getOrCreateDB(dbname)
 	if err != nil {
 		return err
 	}
 	if opened {
-		log.Printf("Requesting post-compaction close of %v", dbname)
+		dbLog.Debug("closing after rewrite", "db", dbname)
 		defer writer.Close()
 	}
 
 	cherr := make(chan error)
 	defer close(cherr)
-	writer.ch <- dbqitem{dbname: dbname,
-		op:    opCompact,
-		cherr: cherr,
-	}
+	qi.cherr = cherr
+	writer.ch <- qi
 
 	return <-cherr
 }
 
+// dbclone copies the documents in [from, to) into a new database
+// with the same format, a batch at a time through its writer,
+// returning how many were copied.
+func dbclone(src, dest, from, to string) (int, error) {
+	if err := createClone(src, dest); err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	var batch []dbqitem
+	store := func() error {
+		_, err := dbstoreBatch(dest, batch)
+		if err == nil {
+			copied += len(batch)
+		}
+		batch = nil
+		return err
+	}
+	err := dbwalk(src, from, to, func(k string, v []byte) error {
+		batch = append(batch, dbqitem{k: k, data: v, op: opStoreItem})
+		if len(batch) >= maxOpQueue.get() {
+			return store()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = store()
+	}
+	if err != nil {
+		dbRemoveConn(dest)
+		dbdelete(dest)
+	}
+	return copied, err
+}
+
+// createClone creates the database a clone is copied into and opens
+// its writer, with dbLock held so nothing else creates it between.
+func createClone(src, dest string) error {
+	format := dbFormat(src)
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	path := dbPath(dest)
+	if _, err := os.Stat(path); err == nil || dbConns[dest] != nil ||
+		memDatabase(dest) != nil {
+		return os.ErrExist
+	}
+	if err := dbcreate(path); err != nil {
+		return err
+	}
+	err := storeMeta(dest, dbMeta{Format: format.Version})
+	if err == nil {
+		var writer *dbWriter
+		if writer, err = dbWriteFun(dest); err == nil {
+			dbConns[dest] = writer
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		dropMeta(dest)
+	}
+	return err
+}
+
 func dbGetDoc(dbname, id string) ([]byte, error) {
-	db, err := dbopen(dbname)
+	if shard, _ := shardFor(dbname, id, false); shard != "" {
+		dbname = shard
+	}
+	db, err := dbopenRead(dbname)
 	if err != nil {
-		log.Printf("Error opening db: %v - %v", dbname, err)
+		dbLog.Error("error opening", "db", dbname, "err", err)
 		return nil, err
 	}
 	defer closeDBConn(db)
 
-	doc, _, err := db.Get(id)
+	doc, _, err := db.Get(dbFormat(dbname).normalizeKey(id))
 	if err != nil {
 		return nil, err
 	}
 	return doc.Value(), err
 }
 
+// dbGetDocs gets several documents, opening each file they're in once.
+// f is called for each document found, in key order, and the ids not
+// found are returned.
+func dbGetDocs(dbname string, ids []string,
+	f func(k string, v []byte) error) ([]string, error) {
+
+	ids = append([]string{}, ids...)
+	sort.Strings(ids)
+	byFile := map[string][]string{}
+	files := []string{}
+	for _, id := range ids {
+		target := dbname
+		if shard, _ := shardFor(dbname, id, false); shard != "" {
+			target = shard
+		}
+		if byFile[target] == nil {
+			files = append(files, target)
+		}
+		byFile[target] = append(byFile[target], id)
+	}
+
+	missing := []string{}
+	for _, target := range files {
+		if _, err := os.Stat(dbPath(target)); target != dbname &&
+			os.IsNotExist(err) {
+			// No shard, so none of its documents.
+			missing = append(missing, byFile[target]...)
+			continue
+		}
+		db, err := dbopenRead(target)
+		if err != nil {
+			dbLog.Error("error opening", "db", target, "err", err)
+			return missing, err
+		}
+		format := dbFormat(target)
+		for _, id := range byFile[target] {
+			doc, _, err := db.Get(format.normalizeKey(id))
+			if err != nil {
+				missing = append(missing, id)
+				continue
+			}
+			if err := f(id, doc.Value()); err != nil {
+				closeDBConn(db)
+				return missing, err
+			}
+		}
+		closeDBConn(db)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
 func dbwalk(dbname, from, to string, f func(k string, v []byte) error) error {
-	db, err := dbopen(dbname)
+	if dbShardPeriod(dbname) != "" {
+		for _, shard := range shardsInRange(dbname, from, to) {
+			if err := dbwalk(shard, from, to, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	db, err := dbopenRange(dbname, from)
 	if err != nil {
-		log.Printf("Error opening db: %v - %v", dbname, err)
+		dbLog.Error("error opening", "db", dbname, "err", err)
 		return err
 	}
 	defer closeDBConn(db)
@@ -326,10 +1084,268 @@ func dbwalk(dbname, from, to string, f func(k string, v []byte) error) error {
 	})
 }
 
-func dbwalkKeys(dbname, from, to string, f func(k string) error) error {
+// A forwardWalk walks documents from..to (exclusive) in key order.
+type forwardWalk func(dbname, from, to string,
+	f func(k string, v []byte) error) error
+
+// dbwalkReverse is dbwalk from newest to oldest.
+func dbwalkReverse(dbname, from, to string, f func(k string, v []byte) error) error {
+	return walkReverse(dbname, from, to, dbwalk, f)
+}
+
+// dbwalkKeysReverse is dbwalkKeys from newest to oldest.
+func dbwalkKeysReverse(dbname, from, to string, f func(k string) error) error {
+	keys := func(dbname, from, to string, g func(string, []byte) error) error {
+		return dbwalkKeys(dbname, from, to, func(k string) error {
+			return g(k, nil)
+		})
+	}
+	return walkReverse(dbname, from, to, keys, func(k string, v []byte) error {
+		return f(k)
+	})
+}
+
+// walkReverse walks a range newest first.  Walks only go forward, so
+// it steps back in time a window at a time, reversing each.  Windows
+// start at a minute, doubling while they're sparse and halving when
+// they're crowded, so the newest documents are found without reading
+// from the beginning.
+//
+// Keys with fractional seconds don't sort quite in time order (.5Z is
+// before Z), so window bounds are kept from going back up, making the
+// windows cover the range exactly in key order.
+func walkReverse(dbname, from, to string, walk forwardWalk,
+	f func(k string, v []byte) error) error {
+
+	if dbShardPeriod(dbname) != "" {
+		shards := shardsInRange(dbname, from, to)
+		for i := len(shards) - 1; i >= 0; i-- {
+			if err := walkReverse(shards[i], from, to, walk, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	db, err := dbopenRead(dbname)
+	if err != nil {
+		dbLog.Error("error opening", "db", dbname, "err", err)
+		return err
+	}
+	format := dbFormat(dbname)
+	oldest, newest := keyRange(db, format)
+	closeDBConn(db)
+	if oldest == "" {
+		return nil
+	}
+
+	type doc struct {
+		k string
+		v []byte
+	}
+	batch := []doc{}
+	collect := func(k string, v []byte) error {
+		batch = append(batch, doc{k, v})
+		return nil
+	}
+	emit := func() error {
+		for i := len(batch) - 1; i >= 0; i-- {
+			if err := f(batch[i].k, batch[i].v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	lo, end := parseKey(oldest), parseKey(newest)
+	if lo < 0 || end < 0 {
+		// Not all timestamps, so there's no stepping back by time.
+		if err := walk(dbname, from, to, collect); err != nil {
+			return err
+		}
+		return emit()
+	}
+	if t := parseKey(from); from != "" && t > lo {
+		lo = t
+	}
+	end++
+	if t := parseKey(to); to != "" && t >= 0 && t < end {
+		end = t
+		// to may have a suffix, and be after keys at that time.
+		if format.formatKey(time.Unix(0, t)) < to {
+			end++
+		}
+	}
+	if end <= lo {
+		// Not where keys are expected; one window covers it.
+		end = lo + 1
+	}
+
+	d := int64(time.Minute)
+	upper := to
+	for end > lo {
+		start := end - d
+		lower := ""
+		if start <= lo {
+			start, lower = lo, from
+		} else {
+			lower = format.formatKey(time.Unix(0, start))
+			if lower < from {
+				lower = from
+			}
+			if upper != "" && lower > upper {
+				lower = upper
+			}
+		}
+
+		batch = batch[:0]
+		if err := walk(dbname, lower, upper, collect); err != nil {
+			return err
+		}
+		if err := emit(); err != nil {
+			return err
+		}
+		switch {
+		case len(batch) < 100 && d < math.MaxInt64/4:
+			d *= 2
+		case len(batch) > 10000 && d > 1:
+			d /= 2
+		}
+		end, upper = start, lower
+	}
+	return nil
+}
+
+// A rangeDeleter deletes keys through the writer a batch at a time,
+// keeping each batch within a shard.
+type rangeDeleter struct {
+	dbname  string
+	batch   []dbqitem
+	shard   string
+	deleted int
+	// The databases (or shards) anything was deleted from.
+	touched []string
+}
+
+func (d *rangeDeleter) add(k string) error {
+	shard, err := shardFor(d.dbname, k, false)
+	if err != nil {
+		return err
+	}
+	if shard != d.shard || len(d.batch) >= maxOpQueue.get() {
+		if err := d.flush(); err != nil {
+			return err
+		}
+		d.shard = shard
+	}
+	d.batch = append(d.batch, dbqitem{dbname: d.dbname, k: k,
+		op: opDeleteItem})
+	return nil
+}
+
+func (d *rangeDeleter) flush() error {
+	if len(d.batch) == 0 {
+		return nil
+	}
+	_, err := dbstoreBatch(d.dbname, d.batch)
+	if err != nil {
+		return err
+	}
+	d.deleted += len(d.batch)
+	d.batch = []dbqitem{}
+	target := d.dbname
+	if d.shard != "" {
+		target = d.shard
+	}
+	if n := len(d.touched); n == 0 || d.touched[n-1] != target {
+		d.touched = append(d.touched, target)
+	}
+	return nil
+}
+
+// dbdeleteRange deletes every document in [from, to), returning the
+// deleter for what it deleted and where.
+func dbdeleteRange(dbname, from, to string) (*rangeDeleter, error) {
+	d := &rangeDeleter{dbname: dbname}
+	err := dbwalkKeys(dbname, from, to, d.add)
+	if err == nil {
+		err = d.flush()
+	}
+	return d, err
+}
+
+// dbdeleteMatching deletes documents in range whose filter pointers
+// have the given values, a batch at a time through the writer.  With
+// dryRun, matches are only counted.
+func dbdeleteMatching(dbname, from, to string, filters, filtervals []string,
+	dryRun bool) (int, error) {
+
+	matched := 0
+	d := &rangeDeleter{dbname: dbname}
+	err := dbwalk(dbname, from, to, func(k string, v []byte) error {
+		if !matchesFilters(resolveFetch(v, filters), filters, filtervals) {
+			return nil
+		}
+		matched++
+		if dryRun {
+			return nil
+		}
+		return d.add(k)
+	})
+	if err == nil {
+		err = d.flush()
+	}
+	return matched, err
+}
+
+// changeSource is implemented by stores that can walk documents in
+// commit order.
+type changeSource interface {
+	Changes(since uint64, f couchstore.WalkFun) error
+}
+
+// dbchanges walks committed changes after the given sequence in
+// commit order.  Deleted documents are passed with a nil value.
+func dbchanges(dbname string, since uint64,
+	f func(di *couchstore.DocInfo, v []byte) error) error {
+
 	db, err := dbopen(dbname)
 	if err != nil {
-		log.Printf("Error opening db: %v - %v", dbname, err)
+		dbLog.Error("error opening", "db", dbname, "err", err)
+		return err
+	}
+	defer closeDBConn(db)
+
+	src, ok := db.(changeSource)
+	if !ok {
+		return errNotOnDisk
+	}
+	return src.Changes(since, func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		if di.Deleted() {
+			return f(di, nil)
+		}
+		doc, err := db.GetFromDocInfo(di)
+		if err != nil {
+			return err
+		}
+		return f(di, doc.Value())
+	})
+}
+
+func dbwalkKeys(dbname, from, to string, f func(k string) error) error {
+	if dbShardPeriod(dbname) != "" {
+		for _, shard := range shardsInRange(dbname, from, to) {
+			if err := dbwalkKeys(shard, from, to, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	db, err := dbopenRead(dbname)
+	if err != nil {
+		dbLog.Error("error opening", "db", dbname, "err", err)
 		return err
 	}
 	defer closeDBConn(db)
@@ -344,10 +1360,51 @@ func dbwalkKeys(dbname, from, to string, f func(k string) error) error {
 	})
 }
 
+// firstKeyFrom returns the first key at or after from, or "" if
+// there isn't one.
+func firstKeyFrom(db dbStore, from string) string {
+	rv := ""
+	db.Walk(from, func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		rv = di.ID()
+		return couchstore.StopIteration
+	})
+	return rv
+}
+
+// keyRange finds the oldest and newest timestamp keys in a database.
+// Walks only go forward, so the newest is found by searching for the
+// latest time that still has a key at or after it.
+func keyRange(db dbStore, f storageFormat) (oldest, newest string) {
+	oldest = firstKeyFrom(db, "")
+	lo := parseKey(oldest)
+	if lo < 0 {
+		return oldest, ""
+	}
+	hi := int64(math.MaxInt64)
+	for lo < hi {
+		mid := lo + (hi-lo)/2 + 1
+		k := firstKeyFrom(db, f.formatKey(time.Unix(0, mid)))
+		if ts := parseKey(k); ts >= mid {
+			lo = ts
+		} else {
+			hi = mid - 1
+		}
+	}
+	return oldest, firstKeyFrom(db, f.formatKey(time.Unix(0, lo)))
+}
+
 func parseKey(s string) int64 {
 	t, err := parseCanonicalTime(s)
 	if err != nil {
-		return -1
+		// Keys may carry a disambiguating suffix.
+		ts, suffix := splitKey(s)
+		if suffix == "" {
+			return -1
+		}
+		if t, err = parseCanonicalTime(ts); err != nil {
+			return -1
+		}
 	}
 	return t.UnixNano()
 }
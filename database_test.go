@@ -1,7 +1,17 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
 )
 
 func TestKeyParsing(t *testing.T) {
@@ -21,3 +31,306 @@ func BenchmarkKeyParsing(b *testing.B) {
 		parseKey(input)
 	}
 }
+
+func TestStoreBatch(t *testing.T) {
+	m := testMemStore()
+	dq := &dbWriter{dbname: "batch-test", db: &memHandle{m},
+		format: storageFormats[1], recent: testMemStore(),
+		flush: newFlushController(flushTime.get())}
+
+	bulk := dq.db.Bulk()
+	bulk.Set(couchstore.NewDocInfo("a", 0), couchstore.NewDocument("a", []byte(`1`)))
+
+	err := dbStoreBatch(dq, bulk, dbqitem{op: opStoreBatch,
+		batch: []dbqitem{{k: "b", data: []byte(`2`)},
+			{k: "c", data: []byte(`3`)}}})
+	if err != nil {
+		t.Fatalf("Error storing batch: %v", err)
+	}
+
+	for _, k := range []string{"a", "b", "c"} {
+		if _, _, err := m.Get(k); err != nil {
+			t.Errorf("Expected %v to be committed: %v", k, err)
+		}
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, _, err := dq.recent.Get(k); err != nil {
+			t.Errorf("Expected %v in the recent buffer: %v", k, err)
+		}
+	}
+}
+
+func TestKeyRange(t *testing.T) {
+	keys := []string{
+		"2012-08-26T20:46:01.000000000Z",
+		"2012-08-26T20:46:01.911627314Z",
+		"2013-01-01T00:00:00.000000000Z",
+		"2013-01-01T00:00:00.000000001Z",
+	}
+	db := &memHandle{testMemStore(keys...)}
+	oldest, newest := keyRange(db, storageFormats[2])
+	if oldest != keys[0] || newest != keys[3] {
+		t.Errorf("Expected %v - %v, got %v - %v",
+			keys[0], keys[3], oldest, newest)
+	}
+
+	oldest, newest = keyRange(&memHandle{testMemStore()}, storageFormats[2])
+	if oldest != "" || newest != "" {
+		t.Errorf("Expected no range for an empty db, got %v - %v",
+			oldest, newest)
+	}
+}
+
+func TestIssueKey(t *testing.T) {
+	now := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := &dbWriter{lastIssued: now.Add(time.Second).UnixNano()}
+
+	prev := ""
+	for i := 0; i < 3; i++ {
+		k := w.issueKey(now)
+		if k <= prev {
+			t.Fatalf("Expected %v to sort after %v", k, prev)
+		}
+		prev = k
+	}
+	if exp := "2013-01-01T00:00:01.000000003Z"; prev != exp {
+		t.Errorf("Expected keys to continue past the newest, got %v", prev)
+	}
+}
+
+func TestIssueKeyAfterStores(t *testing.T) {
+	createMemDatabase("mono", memOptions{})
+	defer dropMemDatabase("mono")
+	defer dbRemoveConn("mono")
+
+	// Stored at a given time, ahead of the clock.
+	ahead := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	if err := dbstore("mono", ahead, []byte(`{"v": 1}`)); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	if err := dbflush("mono"); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	k, _, err := dbstoreNow("mono", []byte(`{"v": 2}`), false, nil)
+	if err != nil {
+		t.Fatalf("Error storing now: %v", err)
+	}
+	if parseKey(k) <= parseKey(ahead) {
+		t.Errorf("Expected %v to be later than %v", k, ahead)
+	}
+}
+
+func TestNormalizedReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	for _, version := range []int{1, 2} {
+		dbname := fmt.Sprintf("v%v", version)
+		if err := dbcreate(dbPath(dbname)); err != nil {
+			t.Fatalf("Error creating: %v", err)
+		}
+		defer forgetDB(dbname)
+		if err := storeMeta(dbname, dbMeta{Format: version}); err != nil {
+			t.Fatalf("Error storing meta: %v", err)
+		}
+
+		k := "2012-08-10T00:00:00.000Z"
+		if err := dbstore(dbname, k, []byte(`{"v": 1}`)); err != nil {
+			t.Fatalf("Error storing: %v", err)
+		}
+		issued, _, err := dbstoreNow(dbname, []byte(`{"v": 2}`), false, nil)
+		if err != nil {
+			t.Fatalf("Error storing now: %v", err)
+		}
+		if err := dbflush(dbname); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+
+		for _, id := range []string{k, "2012-08-10T00:00:00Z",
+			"2012-08-10T00:00:00.000000000Z"} {
+			if _, err := dbGetDoc(dbname, id); err != nil {
+				t.Errorf("Expected %v in %v: %v", id, dbname, err)
+			}
+		}
+		missing, err := dbGetDocs(dbname, []string{k, issued},
+			func(string, []byte) error { return nil })
+		if err != nil || len(missing) != 0 {
+			t.Errorf("Expected both documents in %v, missing %v: %v",
+				dbname, missing, err)
+		}
+		found := false
+		dbwalk(dbname, "", "", func(stored string, _ []byte) error {
+			found = found || stored == issued
+			return nil
+		})
+		if !found {
+			t.Errorf("Expected %v to be a key stored in %v", issued, dbname)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+	defer func(n int) { maxOpQueue.set(n) }(maxOpQueue.get())
+	maxOpQueue.set(2)
+
+	if err := dbcreate(dbPath("orig")); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	defer forgetDB("orig")
+	if err := storeMeta("orig", dbMeta{Format: 2}); err != nil {
+		t.Fatalf("Error storing meta: %v", err)
+	}
+	keys := []string{"2012-08-10T00:00:00Z", "2012-08-11T00:00:00Z",
+		"2012-08-12T00:00:00Z", "2012-08-13T00:00:00Z"}
+	for _, k := range keys {
+		if err := dbstore("orig", k, []byte(`{}`)); err != nil {
+			t.Fatalf("Error storing %v: %v", k, err)
+		}
+	}
+	if err := dbflush("orig"); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	f := storageFormats[2]
+	n, err := dbclone("orig", "copy", f.normalizeKey(keys[0]),
+		f.normalizeKey(keys[3]))
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 documents cloned, got %v: %v", n, err)
+	}
+	defer forgetDB("copy")
+	if v := dbFormat("copy").Version; v != 2 {
+		t.Errorf("Expected the clone in format 2, got %v", v)
+	}
+	// Later writes go through the writer the clone was copied with.
+	if _, opened, err := getOrCreateDB("copy"); err != nil || opened {
+		t.Errorf("Expected the clone's writer to be open, got %v/%v",
+			opened, err)
+	}
+	if err := dbstore("copy", keys[3], []byte(`{}`)); err != nil {
+		t.Fatalf("Error storing into the clone: %v", err)
+	}
+	if err := dbflush("copy"); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	got := []string{}
+	dbwalkKeys("copy", "", "", func(k string) error {
+		got = append(got, k)
+		return nil
+	})
+	exp := []string{}
+	for _, k := range keys {
+		exp = append(exp, f.normalizeKey(k))
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v in the clone, got %v", exp, got)
+	}
+
+	if _, err := dbclone("orig", "copy", "", ""); !os.IsExist(err) {
+		t.Errorf("Expected cloning over a database to fail, got %v", err)
+	}
+}
+
+func TestExportChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	if err := dbcreate(dbPath("src")); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	defer forgetDB("src")
+	_, err = dbstoreBatch("src", []dbqitem{
+		{k: "2012-08-10T00:00:00Z", data: []byte(`{"v": 1}`)},
+		{k: "odd\x01\"key", data: []byte(`{"v": 2}`)},
+		{k: "2012-08-11T00:00:00Z", data: []byte(`{"v": 3}`)},
+	})
+	if err == nil {
+		_, err = dbstoreBatch("src", []dbqitem{
+			{k: "2012-08-11T00:00:00Z", op: opDeleteItem}})
+	}
+	if err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/src/_export_changes?since_seq=1", nil)
+	w := httptest.NewRecorder()
+	exportChanges([]string{"src"}, w, req)
+	got := struct {
+		Results []struct {
+			ID      string          `json:"id"`
+			Deleted bool            `json:"deleted"`
+			Doc     json.RawMessage `json:"doc"`
+		} `json:"results"`
+		NextSeq uint64 `json:"next_seq"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	if len(got.Results) != 2 || got.Results[0].ID != "odd\x01\"key" ||
+		!got.Results[1].Deleted || got.NextSeq != 4 {
+		t.Errorf("Expected the last two changes, got %s", w.Body)
+	}
+	if e := w.Result().Trailer.Get(queryErrorTrailer); e != "" {
+		t.Errorf("Expected no error, got %v", e)
+	}
+
+	if err := storeMeta("src", dbMeta{Format: 1, Shard: shardDay}); err != nil {
+		t.Fatalf("Error storing meta: %v", err)
+	}
+	w = httptest.NewRecorder()
+	exportChanges([]string{"src"}, w, req)
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for a sharded database, got %v", w.Code)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	createMemDatabase("purge", memOptions{})
+	defer dropMemDatabase("purge")
+	defer dbRemoveConn("purge")
+	b := memDatabase("purge").Bulk()
+	for _, k := range []string{"2012-08-10T00:00:00Z", "2012-08-11T00:00:00Z",
+		"2012-08-12T00:00:00Z"} {
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, []byte("{}")))
+	}
+	b.Commit()
+
+	tests := []struct {
+		query string
+		exp   int
+	}{
+		{"", 400},
+		{"?from=bogus", 400},
+		{"?from=2012-08-11&to=2012-08-12", 200},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("DELETE", "/purge/_range"+test.query, nil)
+		w := httptest.NewRecorder()
+		deleteRange([]string{"purge"}, w, req)
+		if w.Code != test.exp {
+			t.Errorf("Expected %v for %q, got %v: %s",
+				test.exp, test.query, w.Code, w.Body)
+		}
+	}
+
+	exp := []string{"2012-08-10T00:00:00Z", "2012-08-12T00:00:00Z"}
+	if got := memKeys(t, memDatabase("purge")); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v left, got %v", exp, got)
+	}
+}
@@ -5,12 +5,25 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/http/pprof"
 	"runtime"
+	rpprof "runtime/pprof"
+	"sort"
+	"strconv"
 	"sync"
-
-	"github.com/dustin/go-couchstore"
+	"sync/atomic"
+	"time"
 )
 
+// The /_debug endpoints are for working out why a server is stuck or
+// slow, and with -adminAuth, need that credential:
+//
+//	/_debug/open        open database handles and who opened them
+//	/_debug/dbconns     open writers, their queues and last activity
+//	/_debug/goroutines  every goroutine's stack (?debug=1 to group them)
+//	/_debug/readpool    how the read handle pool is doing
+//	/_debug/pprof/      the net/http/pprof profiles
+
 type frameSnap []uintptr
 
 func (f frameSnap) MarshalJSON() ([]byte, error) {
@@ -30,9 +43,9 @@ type dbOpenState struct {
 }
 
 var openConnLock = sync.Mutex{}
-var openConns = map[*couchstore.Couchstore]dbOpenState{}
+var openConns = map[dbStore]dbOpenState{}
 
-func recordDBConn(path string, db *couchstore.Couchstore) {
+func recordDBConn(path string, db dbStore) {
 	callers := make([]uintptr, 32)
 	n := runtime.Callers(2, callers)
 	openConnLock.Lock()
@@ -40,7 +53,14 @@ func recordDBConn(path string, db *couchstore.Couchstore) {
 	openConnLock.Unlock()
 }
 
-func closeDBConn(db *couchstore.Couchstore) {
+func closeDBConn(db dbStore) {
+	if h, ok := db.(*hybridStore); ok {
+		db = h.dbStore
+	}
+	if h, ok := db.(*pooledHandle); ok {
+		readPool.put(h)
+		return
+	}
 	db.Close()
 	openConnLock.Lock()
 	_, ok := openConns[db]
@@ -52,6 +72,9 @@ func closeDBConn(db *couchstore.Couchstore) {
 }
 
 func debugListOpenDBs(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
 	openConnLock.Lock()
 	snap := map[string][]frameSnap{}
 	for _, st := range openConns {
@@ -61,3 +84,81 @@ func debugListOpenDBs(parts []string, w http.ResponseWriter, req *http.Request)
 
 	mustEncode(200, w, snap)
 }
+
+type writerInfo struct {
+	DB         string                 `json:"db"`
+	Queued     int                    `json:"queued"`
+	Capacity   int                    `json:"capacity"`
+	Opened     time.Time              `json:"opened"`
+	LastActive *time.Time             `json:"last_active"`
+	IdleMS     float64                `json:"idle_ms"`
+	Flush      map[string]interface{} `json:"flush"`
+}
+
+// debugListWriters lists the open writers, longest idle first, as a
+// writer stuck on one item stops taking more off its queue.
+func debugListWriters(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	now := time.Now()
+	rv := []writerInfo{}
+	dbLock.Lock()
+	for n, dq := range dbConns {
+		wi := writerInfo{
+			DB:       n,
+			Queued:   len(dq.ch),
+			Capacity: cap(dq.ch),
+			Opened:   dq.opened,
+			IdleMS:   millis(now.Sub(dq.opened)),
+			Flush:    dq.flush.stats(),
+		}
+		if ns := atomic.LoadInt64(&dq.lastActive); ns != 0 {
+			t := time.Unix(0, ns)
+			wi.LastActive = &t
+			wi.IdleMS = millis(now.Sub(t))
+		}
+		rv = append(rv, wi)
+	}
+	dbLock.Unlock()
+	sort.Slice(rv, func(i, j int) bool { return rv[i].IdleMS > rv[j].IdleMS })
+
+	mustEncode(200, w, map[string]interface{}{
+		"writers":    rv,
+		"goroutines": runtime.NumGoroutine(),
+	})
+}
+
+func debugGoroutines(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	debug := 2
+	if d, err := strconv.Atoi(req.FormValue("debug")); err == nil {
+		debug = d
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	rpprof.Lookup("goroutine").WriteTo(w, debug)
+}
+
+// debugPprof serves the net/http/pprof handlers under /_debug/pprof/.
+func debugPprof(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	switch parts[0] {
+	case "":
+		pprof.Index(w, req)
+	case "cmdline":
+		pprof.Cmdline(w, req)
+	case "profile":
+		pprof.Profile(w, req)
+	case "symbol":
+		pprof.Symbol(w, req)
+	case "trace":
+		pprof.Trace(w, req)
+	default:
+		pprof.Handler(parts[0]).ServeHTTP(w, req)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+func TestDebugWriters(t *testing.T) {
+	idle := &dbWriter{dbname: "idle", ch: make(chan dbqitem, 10),
+		flush: newFlushController(time.Second), opened: time.Now()}
+	busy := &dbWriter{dbname: "busy", ch: make(chan dbqitem, 10),
+		flush: newFlushController(time.Second), opened: time.Now()}
+	busy.ch <- dbqitem{}
+	atomic.StoreInt64(&idle.lastActive, time.Now().Add(-time.Hour).UnixNano())
+	atomic.StoreInt64(&busy.lastActive, time.Now().UnixNano())
+	dbLock.Lock()
+	dbConns["idle"], dbConns["busy"] = idle, busy
+	dbLock.Unlock()
+	defer dbRemoveConn("idle")
+	defer dbRemoveConn("busy")
+
+	req, _ := http.NewRequest("GET", "/_debug/dbconns", nil)
+	w := httptest.NewRecorder()
+	debugListWriters(nil, w, req)
+	got := struct {
+		Writers []writerInfo `json:"writers"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	if len(got.Writers) < 2 || got.Writers[0].DB != "idle" ||
+		got.Writers[0].IdleMS < 3600000 || got.Writers[0].LastActive == nil {
+		t.Fatalf("Expected the idle writer first, got %s", w.Body)
+	}
+	for _, wi := range got.Writers {
+		if wi.DB == "busy" && (wi.Queued != 1 || wi.Capacity != 10) {
+			t.Errorf("Expected 1 of 10 queued for busy, got %+v", wi)
+		}
+	}
+}
+
+func TestDebugNeedsAdmin(t *testing.T) {
+	defer func(a string) { *adminAuth = a }(*adminAuth)
+	*adminAuth = "sekrit"
+
+	tests := []struct {
+		path    string
+		handler func([]string, http.ResponseWriter, *http.Request)
+		parts   []string
+	}{
+		{"/_debug/open", debugListOpenDBs, nil},
+		{"/_debug/dbconns", debugListWriters, nil},
+		{"/_debug/goroutines", debugGoroutines, nil},
+		{"/_debug/pprof/heap", debugPprof, []string{"heap"}},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		w := httptest.NewRecorder()
+		test.handler(test.parts, w, req)
+		if w.Code != 401 {
+			t.Errorf("Expected 401 for %v, got %v", test.path, w.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/_debug/goroutines?debug=1", nil)
+	req.Header.Set("Authorization", "sekrit")
+	w := httptest.NewRecorder()
+	debugGoroutines(nil, w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Errorf("Expected goroutines, got %v: %.100s", w.Code, w.Body)
+	}
+}
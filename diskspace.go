@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync/atomic"
+	"time"
+)
+
+// Rather than let couchstore writes fail partway through when the disk
+// fills, the server watches the free space under -root, and below
+// -diskFullMB refuses writes to databases on disk with 507 until
+// there's at least a tenth more than that again.  Queries still work,
+// as do deleting databases and changing their config, so space can be
+// reclaimed.
+
+var diskFullMB = flag.Int64("diskFullMB", 100,
+	"Refuse writes with less free space than this under -root (0 to not check)")
+var diskCheck = flag.Duration("diskCheck", 10*time.Second,
+	"How often to check the free space under -root")
+
+var errDiskFull = errors.New("insufficient disk space")
+
+// diskProtected is nonzero while writes are refused.
+var diskProtected int32
+
+func diskIsFull() bool {
+	return atomic.LoadInt32(&diskProtected) != 0
+}
+
+// checkDiskSpace turns write protection on or off for the given free
+// space.
+func checkDiskSpace(free uint64) {
+	limit := uint64(*diskFullMB) << 20
+	switch {
+	case limit == 0 || free >= limit+limit/10:
+		if atomic.CompareAndSwapInt32(&diskProtected, 1, 0) {
+			dbLog.Warn("disk space reclaimed, accepting writes",
+				"free_mb", free>>20)
+		}
+	case free < limit:
+		if atomic.CompareAndSwapInt32(&diskProtected, 0, 1) {
+			dbLog.Error("disk nearly full, refusing writes",
+				"free_mb", free>>20, "min_mb", *diskFullMB)
+		}
+	}
+}
+
+func diskWatchdog() {
+	for {
+		if *diskFullMB <= 0 {
+			checkDiskSpace(0)
+		} else if free, err := diskFree(*dbRoot); err != nil {
+			dbLog.Warn("error checking disk space", "root", *dbRoot,
+				"err", err)
+		} else {
+			checkDiskSpace(free)
+		}
+		time.Sleep(*diskCheck)
+	}
+}
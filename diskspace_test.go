@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiskWatchdog(t *testing.T) {
+	defer func(mb int64) {
+		*diskFullMB = mb
+		diskProtected = 0
+	}(*diskFullMB)
+	*diskFullMB = 100
+
+	tests := []struct {
+		freeMB uint64
+		full   bool
+	}{
+		{500, false},
+		{99, true},
+		// Not enough back to resume.
+		{105, true},
+		{110, false},
+		{101, false},
+	}
+	for _, test := range tests {
+		checkDiskSpace(test.freeMB << 20)
+		if diskIsFull() != test.full {
+			t.Errorf("Expected full=%v at %vMB", test.full, test.freeMB)
+		}
+	}
+
+	checkDiskSpace(0)
+	if !diskIsFull() {
+		t.Fatalf("Expected writes refused with no space")
+	}
+	if _, err := dbstoreSeq("anydb", "2012-08-10T00:00:00Z", []byte(`{}`),
+		false); err != errDiskFull {
+		t.Errorf("Expected errDiskFull, got %v", err)
+	}
+
+	for _, test := range []struct {
+		method, path string
+		ok           bool
+	}{
+		{"POST", "/anydb", false},
+		{"PUT", "/anydb/_bulk", false},
+		{"DELETE", "/anydb/2012-08-10", false},
+		{"DELETE", "/anydb", true},
+		{"PUT", "/anydb/_config", true},
+		{"POST", "/anydb/_query", true},
+		{"GET", "/anydb/_all_docs", true},
+	} {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		w := httptest.NewRecorder()
+		if ok := checkWritable(w, req); ok != test.ok ||
+			(!ok && w.Code != 507) {
+			t.Errorf("Expected %v for %v %v, got %v (%v)", test.ok,
+				test.method, test.path, ok, w.Code)
+		}
+	}
+
+	*diskFullMB = 0
+	checkDiskSpace(0)
+	if diskIsFull() {
+		t.Errorf("Expected no protection with the check off")
+	}
+}
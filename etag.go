@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// Document and query responses carry a weak ETag made from the
+// update sequences of whatever they read, so a poller asking again
+// for something unchanged gets a 304 instead of the same results.
+// Everything else a query depends on (its resolved range, its
+// parameters and the database's settings) goes into the tag too.
+// Memory and federated databases don't get tags, since they can
+// change without a write here.
+
+// dbUpdateSeq returns the position of the latest write handed to a
+// database, including writes not yet committed.
+func dbUpdateSeq(dbname string) (uint64, error) {
+	dbLock.Lock()
+	writer := dbConns[dbname]
+	dbLock.Unlock()
+	if writer != nil {
+		writer.seqLock.Lock()
+		defer writer.seqLock.Unlock()
+		return writer.seq, nil
+	}
+
+	db, err := dbopen(dbname)
+	if err != nil {
+		return 0, err
+	}
+	defer closeDBConn(db)
+	inf, err := db.Info()
+	return inf.LastSeq, err
+}
+
+func etagged(dbname string) bool {
+	return memDatabase(dbname) == nil &&
+		len(federationMembers(dbname)) == 0
+}
+
+// writeSeqs adds the update sequences of the given databases to h.
+// Archived shards can't change, so they're only named.
+func writeSeqs(h io.Writer, dbnames []string) error {
+	for _, n := range dbnames {
+		if parts := strings.SplitN(n, "/", 2); len(parts) == 2 &&
+			isArchived(parts[0], parts[1]) {
+			fmt.Fprintf(h, "%s=archived\n", n)
+			continue
+		}
+		seq, err := dbUpdateSeq(n)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s=%d\n", n, seq)
+	}
+	return nil
+}
+
+// docETag returns the ETag for a document, or "" if it has none.
+func docETag(dbname, id string) string {
+	if !etagged(dbname) {
+		return ""
+	}
+	shard, err := shardFor(dbname, id, false)
+	if err != nil {
+		return ""
+	}
+	if shard != "" {
+		dbname = shard
+	}
+	h := fnv.New64a()
+	if writeSeqs(h, []string{dbname}) != nil {
+		return ""
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// queryETag returns the ETag for a query, or "" if it has none.
+func queryETag(dbname string, p queryParams, req *http.Request) string {
+	if !etagged(dbname) {
+		return ""
+	}
+	from, err := cleanupRangeParam(dbname, p.from, "")
+	if err != nil {
+		return ""
+	}
+	to, err := cleanupRangeParam(dbname, p.to, "")
+	if err != nil {
+		return ""
+	}
+
+	dbnames := []string{dbname}
+	if dbShardPeriod(dbname) != "" {
+		scanned, _ := partitionShards(dbname, from, to)
+		for _, s := range scanned {
+			dbnames = append(dbnames, dbname+"/"+s)
+		}
+	}
+	h := fnv.New64a()
+	if writeSeqs(h, dbnames) != nil {
+		return ""
+	}
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return ""
+	}
+	meta, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	h.Write(meta)
+	fmt.Fprintf(h, "\n%s\n%s\n%s\n%s\n", from, to, req.Form.Encode(),
+		req.Header.Get("Accept"))
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// notModified sets the ETag on a response and reports whether the
+// client already has it, in which case a 304 has been sent.
+func notModified(w http.ResponseWriter, req *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	for _, t := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(304)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		header string
+		exp    bool
+	}{
+		{"", false},
+		{`W/"other"`, false},
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`W/"other", W/"abc"`, true},
+		{"*", true},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/db/_query", nil)
+		if test.header != "" {
+			req.Header.Set("If-None-Match", test.header)
+		}
+		w := httptest.NewRecorder()
+		if got := notModified(w, req, `W/"abc"`); got != test.exp {
+			t.Errorf("Expected %v for %q, got %v", test.exp, test.header, got)
+		}
+		if w.Header().Get("ETag") != `W/"abc"` {
+			t.Errorf("Expected the ETag set, got %v", w.Header())
+		}
+		if test.exp && w.Code != 304 {
+			t.Errorf("Expected a 304 for %q, got %v", test.header, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/db/_query", nil)
+	req.Header.Set("If-None-Match", "*")
+	if notModified(w, req, "") || w.Header().Get("ETag") != "" {
+		t.Errorf("Expected no tag to mean no ETag and no 304")
+	}
+}
+
+func TestETagsFollowWrites(t *testing.T) {
+	writer := &dbWriter{dbname: "tagged", seq: 5}
+	dbLock.Lock()
+	dbConns["tagged"] = writer
+	dbLock.Unlock()
+	defer dbRemoveConn("tagged")
+	metaCache["tagged"] = dbMeta{Format: 1}
+	defer delete(metaCache, "tagged")
+
+	req, _ := http.NewRequest("GET", "/tagged/_query?group=1000", nil)
+	req.ParseForm()
+	p, _ := parseQueryParams(req.Form)
+
+	doc, query := docETag("tagged", "x"), queryETag("tagged", p, req)
+	if doc == "" || query == "" || doc == query {
+		t.Fatalf("Expected distinct tags, got %q and %q", doc, query)
+	}
+	if docETag("tagged", "x") != doc || queryETag("tagged", p, req) != query {
+		t.Errorf("Expected the same tags without writes")
+	}
+
+	req.Form = url.Values{"group": {"60000"}}
+	if queryETag("tagged", p, req) == query {
+		t.Errorf("Expected a different query to get a different tag")
+	}
+	req.Form = url.Values{"group": {"1000"}}
+
+	writer.seq++
+	if docETag("tagged", "x") == doc || queryETag("tagged", p, req) == query {
+		t.Errorf("Expected a write to change the tags")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// A database created with type=events holds annotations, like deploy
+// markers, to show alongside metrics.  Each document is an event
+// stored at its start:
+//
+//	{"text": "deployed 1.2", "tags": ["deploy", "web"], "end": "..."}
+//
+// text is required.  tags and end, for events that last a while, are
+// optional.  GET /db/_events lists the events overlapping from..to,
+// narrowed to those whose text contains q (ignoring case) and that
+// have every tag given.
+
+const dbTypeEvents = "events"
+
+// How many events a listing returns unless limit says otherwise.
+const defaultEventLimit = 1000
+
+type eventDoc struct {
+	Text string   `json:"text"`
+	Tags []string `json:"tags,omitempty"`
+	End  string   `json:"end,omitempty"`
+}
+
+// An eventError is a write to an events database that isn't an event.
+type eventError struct {
+	reason string
+}
+
+func (e *eventError) Error() string {
+	return "bad event: " + e.reason
+}
+
+func isEventDB(dbname string) bool {
+	m, err := loadMeta(ownerDB(dbname))
+	return err == nil && m.Type == dbTypeEvents
+}
+
+// parseEvent decodes the event stored at k, along with when it starts
+// and ends.
+func parseEvent(k string, doc []byte) (eventDoc, time.Time, time.Time, error) {
+	e := eventDoc{}
+	start, err := parseCanonicalTime(k)
+	if err != nil {
+		return e, start, start, &eventError{"events are stored at a time"}
+	}
+	if err := json.Unmarshal(doc, &e); err != nil {
+		return e, start, start, &eventError{err.Error()}
+	}
+	if e.Text == "" {
+		return e, start, start, &eventError{"text is required"}
+	}
+	end := start
+	if e.End != "" {
+		end, err = parseTime(e.End)
+		if err != nil {
+			return e, start, start, &eventError{"bad end: " + err.Error()}
+		}
+		if end.Before(start) {
+			return e, start, start, &eventError{"end is before the start"}
+		}
+	}
+	return e, start, end, nil
+}
+
+// checkEvent rejects documents that aren't events from an events
+// database, and keeps track of the longest event so listings know
+// how far back to look for events still going.
+func checkEvent(dbname, k string, doc []byte) error {
+	if !isEventDB(dbname) {
+		return nil
+	}
+	_, start, end, err := parseEvent(k, doc)
+	if err != nil {
+		return err
+	}
+	span := int64(end.Sub(start) / time.Millisecond)
+	m, err := loadMeta(ownerDB(dbname))
+	if err != nil || span <= m.LongestEvent {
+		return err
+	}
+	return updateMeta(ownerDB(dbname), func(m *dbMeta) {
+		if span > m.LongestEvent {
+			m.LongestEvent = span
+		}
+	})
+}
+
+// matches checks an event against a search: text containing q, which
+// should already be lowercase, and all of tags.
+func (e eventDoc) matches(q string, tags []string) bool {
+	if !strings.Contains(strings.ToLower(e.Text), q) {
+		return false
+	}
+	for _, want := range tags {
+		found := false
+		for _, t := range e.Tags {
+			if t == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type eventResult struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Text  string    `json:"text"`
+	Tags  []string  `json:"tags"`
+}
+
+// findEvents lists the events overlapping from..to (either may be
+// zero for no bound) that match a search.
+func findEvents(dbname string, from, to time.Time, q string, tags []string,
+	limit int) ([]eventResult, error) {
+
+	m, err := loadMeta(ownerDB(dbname))
+	if err != nil {
+		return nil, err
+	}
+	format := dbFormat(dbname)
+	walkFrom, walkTo := "", ""
+	if !from.IsZero() {
+		span := time.Duration(m.LongestEvent) * time.Millisecond
+		walkFrom = format.formatKey(from.Add(-span))
+	}
+	if !to.IsZero() {
+		walkTo = format.formatKey(to)
+	}
+
+	q = strings.ToLower(q)
+	rv := []eventResult{}
+	err = dbwalk(dbname, walkFrom, walkTo, func(k string, v []byte) error {
+		if len(rv) >= limit {
+			return errCanceled
+		}
+		e, start, end, err := parseEvent(k, v)
+		if err != nil || end.Before(from) || !e.matches(q, tags) {
+			return nil
+		}
+		if e.Tags == nil {
+			e.Tags = []string{}
+		}
+		rv = append(rv, eventResult{start, end, e.Text, e.Tags})
+		return nil
+	})
+	if err == errCanceled {
+		err = nil
+	}
+	return rv, err
+}
+
+func listEvents(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	if _, err := os.Stat(dbPath(args[0])); err != nil {
+		emitError(404, w, "not_found", err.Error())
+		return
+	}
+	if !isEventDB(args[0]) {
+		emitError(400, w, "Bad Request", "not an events database")
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	if s := req.FormValue("from"); s != "" {
+		if from, err = parseTime(s); err != nil {
+			emitError(400, w, "Bad from value", err.Error())
+			return
+		}
+	}
+	if s := req.FormValue("to"); s != "" {
+		if to, err = parseTime(s); err != nil {
+			emitError(400, w, "Bad to value", err.Error())
+			return
+		}
+	}
+	limit := defaultEventLimit
+	if s := req.FormValue("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			emitError(400, w, "Bad limit value", s)
+			return
+		}
+	}
+
+	events, err := findEvents(args[0], from, to, req.FormValue("q"),
+		req.Form["tag"], limit)
+	if err != nil {
+		emitError(500, w, "Error reading events", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"events": events})
+}
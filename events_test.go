@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		k, doc string
+		ok     bool
+	}{
+		{"2013-01-01T00:00:00Z", `{"text":"deploy","tags":["web"]}`, true},
+		{"2013-01-01T00:00:00Z", `{"text":"outage","end":"2013-01-01T01:00:00Z"}`, true},
+		{"2013-01-01T00:00:00Z", `{"tags":["web"]}`, false},
+		{"2013-01-01T00:00:00Z", `{"text":5}`, false},
+		{"2013-01-01T00:00:00Z", `{"text":"x","tags":"web"}`, false},
+		{"2013-01-01T00:00:00Z", `{"text":"x","end":"2012-12-31T00:00:00Z"}`, false},
+		{"2013-01-01T00:00:00Z", `{"text":"x","end":"whenever"}`, false},
+		{"later", `{"text":"x"}`, false},
+	}
+	for _, test := range tests {
+		_, _, _, err := parseEvent(test.k, []byte(test.doc))
+		if (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %s at %v, got %v",
+				test.ok, test.doc, test.k, err)
+		}
+		if _, isEvent := err.(*eventError); err != nil && !isEvent {
+			t.Errorf("Expected an eventError for %s, got %T", test.doc, err)
+		}
+	}
+}
+
+func TestCheckEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	if err := checkEvent("plain", "2013-01-01T00:00:00Z", []byte(`{}`)); err != nil {
+		t.Errorf("Expected anything to go in other databases, got %v", err)
+	}
+
+	metaCache["ev"] = dbMeta{Format: 1, Type: dbTypeEvents}
+	defer delete(metaCache, "ev")
+	if err := checkEvent("ev", "2013-01-01T00:00:00Z", []byte(`{}`)); err == nil {
+		t.Errorf("Expected an error for an event without text")
+	}
+	err = checkEvent("ev", "2013-01-01T00:00:00Z",
+		[]byte(`{"text":"outage","end":"2013-01-01T00:01:00Z"}`))
+	if err != nil {
+		t.Fatalf("Error checking an event: %v", err)
+	}
+	checkEvent("ev", "2013-01-02T00:00:00Z", []byte(`{"text":"blip"}`))
+	if m, _ := loadMeta("ev"); m.LongestEvent != 60000 {
+		t.Errorf("Expected the longest event to be 60000ms, got %v",
+			m.LongestEvent)
+	}
+}
+
+func TestFindEvents(t *testing.T) {
+	createMemDatabase("ev", memOptions{})
+	defer dropMemDatabase("ev")
+	defer dbRemoveConn("ev")
+	metaCache["ev"] = dbMeta{Format: 1, Type: dbTypeEvents, LongestEvent: 3600000}
+	defer delete(metaCache, "ev")
+
+	b := memDatabase("ev").Bulk()
+	for k, v := range map[string]string{
+		"2013-01-01T00:00:00Z": `{"text":"Deployed 1.2","tags":["deploy","web"]}`,
+		"2013-01-01T05:00:00Z": `{"text":"Outage","end":"2013-01-01T06:00:00Z"}`,
+		"2013-01-01T08:00:00Z": `{"text":"Deployed 1.3","tags":["deploy"]}`,
+	} {
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, []byte(v)))
+	}
+	b.Commit()
+
+	at := func(s string) time.Time {
+		tm, err := parseTime(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		from, to time.Time
+		q        string
+		tags     []string
+		exp      []string
+	}{
+		{time.Time{}, time.Time{}, "", nil,
+			[]string{"Deployed 1.2", "Outage", "Deployed 1.3"}},
+		// The outage started before from, but is still going.
+		{at("2013-01-01T05:30:00Z"), at("2013-01-01T09:00:00Z"), "", nil,
+			[]string{"Outage", "Deployed 1.3"}},
+		{time.Time{}, time.Time{}, "deployed", []string{"web"},
+			[]string{"Deployed 1.2"}},
+		{time.Time{}, at("2013-01-01T05:00:00Z"), "", nil,
+			[]string{"Deployed 1.2"}},
+	}
+	for _, test := range tests {
+		events, err := findEvents("ev", test.from, test.to, test.q, test.tags, 10)
+		if err != nil {
+			t.Fatalf("Error finding events: %v", err)
+		}
+		got := []string{}
+		for _, e := range events {
+			got = append(got, e.Text)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v, got %v", test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An exclusionWindow is a period (e.g. a maintenance blackout) whose
+// documents queries leave out of their reductions.  Windows stored on
+// a database apply to all of its queries; more can be given inline
+// with exclude=from,to.
+type exclusionWindow struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason,omitempty"`
+
+	from, to int64
+}
+
+// parse validates a window's range and normalizes its times.
+func (e *exclusionWindow) parse() error {
+	from, err := parseTime(e.From)
+	if err != nil {
+		return fmt.Errorf("bad from %q: %v", e.From, err)
+	}
+	to, err := parseTime(e.To)
+	if err != nil {
+		return fmt.Errorf("bad to %q: %v", e.To, err)
+	}
+	if !to.After(from) {
+		return fmt.Errorf("window %v - %v is empty", e.From, e.To)
+	}
+	e.From = from.UTC().Format(time.RFC3339Nano)
+	e.To = to.UTC().Format(time.RFC3339Nano)
+	e.from, e.to = from.UnixNano(), to.UnixNano()
+	return nil
+}
+
+func parseExclusionParam(s string) (exclusionWindow, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return exclusionWindow{}, fmt.Errorf("expected from,to: %q", s)
+	}
+	e := exclusionWindow{From: parts[0], To: parts[1]}
+	return e, e.parse()
+}
+
+func validateExclusions(ws []exclusionWindow) error {
+	for i := range ws {
+		if err := ws[i].parse(); err != nil {
+			return err
+		}
+	}
+	sort.Slice(ws, func(i, j int) bool { return ws[i].from < ws[j].from })
+	return nil
+}
+
+// dbExclusions returns the windows stored for a database.
+func dbExclusions(dbname string) ([]exclusionWindow, error) {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return nil, err
+	}
+	rv := append([]exclusionWindow{}, m.Exclusions...)
+	return rv, validateExclusions(rv)
+}
+
+// excluded reports whether a key's time (in nanoseconds) falls in
+// any of the windows.  Windows include their start but not their end.
+func excluded(ws []exclusionWindow, t int64) bool {
+	for _, e := range ws {
+		if t >= e.from && t < e.to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExclusionWindows(t *testing.T) {
+	e, err := parseExclusionParam("2013-01-01T00:00:00Z,2013-01-01T02:00:00Z")
+	if err != nil {
+		t.Fatalf("Error parsing window: %v", err)
+	}
+	ws := []exclusionWindow{e}
+
+	tests := []struct {
+		k   string
+		exp bool
+	}{
+		{"2012-12-31T23:59:59.999999999Z", false},
+		{"2013-01-01T00:00:00Z", true},
+		{"2013-01-01T01:30:00.5Z", true},
+		{"2013-01-01T02:00:00Z", false},
+	}
+	for _, test := range tests {
+		if got := excluded(ws, parseKey(test.k)); got != test.exp {
+			t.Errorf("Expected excluded(%v) = %v", test.k, test.exp)
+		}
+	}
+
+	for _, bad := range []string{"2013-01-01T00:00:00Z",
+		"2013-01-01T02:00:00Z,2013-01-01T00:00:00Z", "x,y"} {
+		if _, err := parseExclusionParam(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A query with explain=true (or sent to /db/_explain) describes how it
+// would run instead of running: which files it reads and about how
+// many of their documents fall in range, how it's cut into chunks,
+// the reducers each chunk goes through, and whether chunk results can
+// come from the cache.  explain=analyze runs it as well, throwing
+// away the results, and reports where the time went for each file.
+
+type explainFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Docs     uint64 `json:"docs"`
+	Oldest   string `json:"oldest"`
+	Newest   string `json:"newest"`
+	InRange  uint64 `json:"estimated_in_range"`
+	Archived bool   `json:"archived,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	oldest, newest int64
+}
+
+// explainRun is what running a query against one file took.
+type explainRun struct {
+	DB          string  `json:"db"`
+	TotalMS     float64 `json:"total_ms"`
+	WalkMS      float64 `json:"walk_ms"`
+	FirstMS     float64 `json:"first_result_ms"`
+	KeysScanned int32   `json:"keys_scanned"`
+	Chunks      int32   `json:"chunks"`
+	CacheHits   int     `json:"cache_hits"`
+	Error       string  `json:"error,omitempty"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// describeFile looks at a file a query would read, estimating how
+// many of its documents are in from..to by assuming they're spread
+// evenly between its oldest and newest.
+func describeFile(name, from, to string) explainFile {
+	f := explainFile{Name: name}
+	if st, err := os.Stat(dbPath(name)); err == nil {
+		f.Size = st.Size()
+	}
+	db, err := dbopen(name)
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	defer closeDBConn(db)
+	inf, err := db.Info()
+	if err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	f.Docs = inf.DocCount
+	f.Oldest, f.Newest = keyRange(db, dbFormat(name))
+	f.oldest, f.newest = parseKey(f.Oldest), parseKey(f.Newest)
+	if f.oldest < 0 || f.newest < 0 {
+		return f
+	}
+
+	lo, hi := f.oldest, f.newest
+	if from != "" && parseKey(from) > lo {
+		lo = parseKey(from)
+	}
+	if to != "" && parseKey(to) >= 0 && parseKey(to) < hi {
+		hi = parseKey(to)
+	}
+	switch {
+	case lo > hi:
+	case f.newest == f.oldest:
+		f.InRange = f.Docs
+	default:
+		f.InRange = uint64(float64(f.Docs) *
+			float64(hi-lo) / float64(f.newest-f.oldest))
+	}
+	return f
+}
+
+func describePipeline(p queryParams) []map[string]string {
+	rv := []map[string]string{}
+	for i, ptr := range p.ptrs {
+		kind := "builtin"
+		switch _, _, _, pair := parsePairReducer(p.reds[i]); {
+		case strings.HasPrefix(p.reds[i], jsReducerPrefix):
+			kind = "javascript"
+		case pair:
+			kind = "pair"
+		case isCondReducer(p.reds[i]):
+			kind = "conditional"
+		case isPtrExpr(ptr):
+			kind = "expression"
+		}
+		rv = append(rv, map[string]string{
+			"ptr": ptr, "reducer": p.reds[i], "kind": kind})
+	}
+	return rv
+}
+
+// analyzeQuery runs a query against a single file, timing it.
+func analyzeQuery(dbname string, p queryParams) explainRun {
+	rv := explainRun{DB: dbname}
+	start := time.Now()
+	q, err := p.start(dbname)
+	if err != nil {
+		rv.Error = err.Error()
+		return rv
+	}
+	defer close(q.out)
+	defer close(q.cherr)
+
+	walkComplete := false
+	for !walkComplete || q.started-rv.Chunks > 0 {
+		select {
+		case po := <-q.out:
+			if rv.Chunks == 0 {
+				rv.FirstMS = millis(time.Since(start))
+			}
+			rv.Chunks++
+			if po.err != nil && rv.Error == "" {
+				rv.Error = po.err.Error()
+				q.cancel()
+			}
+			// Results from memcached carry the opaque of the get.
+			if po.cacheOpaque != 0 {
+				rv.CacheHits++
+			}
+		case err := <-q.cherr:
+			walkComplete = true
+			rv.WalkMS = millis(time.Since(start))
+			if err != nil && rv.Error == "" {
+				rv.Error = err.Error()
+				q.cancel()
+			}
+		}
+	}
+	rv.KeysScanned = atomic.LoadInt32(&q.totalKeys)
+	rv.TotalMS = millis(time.Since(start))
+	return rv
+}
+
+// explainQuery describes how a query would run, and with analyze,
+// how it did.
+func explainQuery(dbname string, p queryParams, analyze bool,
+	w http.ResponseWriter) {
+
+	started := time.Now()
+	cache := map[string]interface{}{"enabled": *cacheAddr != ""}
+	from, err := cleanupRangeParam(dbname, p.from, "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(dbname, p.to, "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+
+	rv := map[string]interface{}{
+		"db":         dbname,
+		"from":       from,
+		"to":         to,
+		"group":      p.group,
+		"pointers":   p.ptrs,
+		"reducers":   p.reds,
+		"exclusions": len(p.exclude),
+		"pipeline":   describePipeline(p),
+		"filters":    len(p.filters),
+		"cache":      cache,
+	}
+	if p.groupby != "" {
+		rv["groupby"] = p.groupby
+	}
+	if p.calendar != nil {
+		rv["group"] = p.calendar.String()
+		rv["tz"] = p.calendar.loc.String()
+	}
+
+	files := []explainFile{}
+	switch {
+	case len(federationMembers(dbname)) > 0:
+		rv["plan"] = "federated"
+		rv["members"] = federationMembers(dbname)
+	case dbShardPeriod(dbname) != "":
+		scanned, pruned := partitionShards(dbname, from, to)
+		rv["plan"] = "sharded"
+		rv["partitions"] = map[string]interface{}{
+			"period":  dbShardPeriod(dbname),
+			"scanned": scanned,
+			"pruned":  pruned,
+		}
+		for _, s := range scanned {
+			if isArchived(dbname, s) {
+				// Not worth fetching just to describe.
+				files = append(files, explainFile{Name: dbname + "/" + s,
+					Archived: true})
+				continue
+			}
+			files = append(files, describeFile(dbname+"/"+s, from, to))
+		}
+	default:
+		rv["plan"] = "scan"
+		files = append(files, describeFile(dbname, from, to))
+	}
+
+	// Chunks cover the part of the range that has documents.
+	estimated := uint64(0)
+	lo, hi := int64(-1), int64(-1)
+	for _, f := range files {
+		estimated += f.InRange
+		if f.Docs == 0 || f.oldest < 0 || f.newest < 0 {
+			continue
+		}
+		if lo < 0 || f.oldest < lo {
+			lo = f.oldest
+		}
+		if f.newest > hi {
+			hi = f.newest
+		}
+	}
+	if from != "" && parseKey(from) > lo {
+		lo = parseKey(from)
+	}
+	if to != "" && parseKey(to) >= 0 && parseKey(to) <= hi {
+		// to itself isn't included.
+		hi = parseKey(to) - 1
+	}
+	chunking := map[string]interface{}{
+		"slide":         p.slide,
+		"query_workers": queryWorkers.get(),
+		"doc_workers":   docWorkers.get(),
+	}
+	if p.calendar == nil && p.group > 0 && lo >= 0 && hi >= lo {
+		group := int64(p.group) * int64(time.Millisecond)
+		chunking["estimated_chunks"] = (hi/group - lo/group) + 1
+	}
+	if rv["plan"] != "federated" {
+		rv["files"] = files
+		rv["estimated_docs"] = estimated
+		rv["chunking"] = chunking
+	}
+	timing := map[string]interface{}{"planning_ms": millis(time.Since(started))}
+	rv["timing"] = timing
+
+	if analyze {
+		runStarted := time.Now()
+		switch rv["plan"] {
+		case "federated":
+			if _, err := queryResultsFor(dbname, p); err != nil {
+				rv["error"] = err.Error()
+			}
+		default:
+			runs := []explainRun{}
+			hits := 0
+			for _, f := range files {
+				if f.Archived {
+					fetchedShards.ensureLocal(dbname,
+						strings.TrimPrefix(f.Name, dbname+"/"))
+				}
+				run := analyzeQuery(f.Name, p)
+				hits += run.CacheHits
+				runs = append(runs, run)
+			}
+			rv["runs"] = runs
+			cache["hits"] = hits
+		}
+		timing["execution_ms"] = millis(time.Since(runStarted))
+	}
+	timing["total_ms"] = millis(time.Since(started))
+	mustEncode(200, w, rv)
+}
+
+// explain describes a query given the same way as to _query.
+func explain(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	if req.Form.Get("explain") == "" {
+		req.Form.Set("explain", "true")
+	}
+	query(args, w, req)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
+)
+
+func TestExplain(t *testing.T) {
+	createMemDatabase("explained", memOptions{})
+	defer dropMemDatabase("explained")
+	defer dbRemoveConn("explained")
+	b := memDatabase("explained").Bulk()
+	for _, k := range []string{"2012-08-10T00:00:00Z", "2012-08-11T00:00:00Z",
+		"2012-08-12T00:00:00Z", "2012-08-14T00:00:00Z"} {
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, []byte("{}")))
+	}
+	b.Commit()
+
+	f := describeFile("explained", "2012-08-11T00:00:00Z", "2012-08-13T00:00:00Z")
+	if f.Docs != 4 || f.Oldest != "2012-08-10T00:00:00Z" ||
+		f.Newest != "2012-08-14T00:00:00Z" || f.InRange != 2 {
+		t.Errorf("Expected 4 docs, about 2 in range, got %+v", f)
+	}
+
+	req, _ := http.NewRequest("GET", "/explained/_explain?ptr=/a&reducer=avg"+
+		"&ptr=/b&reducer=js:f&function=f=function(v){return 1}"+
+		"&group=86400000&from=2012-08-11&to=2012-08-13", nil)
+	w := httptest.NewRecorder()
+	explain([]string{"explained"}, w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %v: %s", w.Code, w.Body)
+	}
+	got := struct {
+		Plan     string              `json:"plan"`
+		Pipeline []map[string]string `json:"pipeline"`
+		Docs     int                 `json:"estimated_docs"`
+		Chunking map[string]float64  `json:"chunking"`
+		Timing   map[string]float64  `json:"timing"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	kinds := []string{}
+	for _, s := range got.Pipeline {
+		kinds = append(kinds, s["kind"])
+	}
+	if got.Plan != "scan" || got.Docs != 2 ||
+		!reflect.DeepEqual(kinds, []string{"builtin", "javascript"}) {
+		t.Errorf("Expected a scan of about 2 docs, got %s", w.Body)
+	}
+	if n := got.Chunking["estimated_chunks"]; n != 2 {
+		t.Errorf("Expected 2 chunks, got %v", n)
+	}
+	if _, ok := got.Timing["total_ms"]; !ok {
+		t.Errorf("Expected timing, got %s", w.Body)
+	}
+}
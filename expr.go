@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A pointer in a query may instead be arithmetic over pointers, e.g.
+// (/bytes_out)/(/duration), computed for each document before it's
+// reduced.  Pointers in an expression are always parenthesized; any
+// pointer starting with ( is taken as an expression.  Documents
+// missing a value, or dividing by zero, contribute nothing.
+
+type ptrExpr interface {
+	eval(vals map[string]interface{}) (float64, bool)
+	pointers() []string
+}
+
+type numExpr float64
+
+func (n numExpr) eval(map[string]interface{}) (float64, bool) { return float64(n), true }
+func (n numExpr) pointers() []string                          { return nil }
+
+type ptrRef string
+
+func (p ptrRef) eval(vals map[string]interface{}) (float64, bool) {
+	switch v := vals[string(p)].(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (p ptrRef) pointers() []string { return []string{string(p)} }
+
+type binExpr struct {
+	op   byte
+	l, r ptrExpr
+}
+
+func (b binExpr) eval(vals map[string]interface{}) (float64, bool) {
+	l, ok := b.l.eval(vals)
+	if !ok {
+		return 0, false
+	}
+	r, ok := b.r.eval(vals)
+	if !ok {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	}
+	if r == 0 {
+		return 0, false
+	}
+	return l / r, true
+}
+
+func (b binExpr) pointers() []string {
+	return append(b.l.pointers(), b.r.pointers()...)
+}
+
+func isPtrExpr(s string) bool {
+	return strings.HasPrefix(s, "(")
+}
+
+type exprParser struct {
+	s   string
+	pos int
+	// Other names, besides pointers, that may be parenthesized.
+	refs map[string]bool
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d in %q: %v", p.pos, p.s, fmt.Sprintf(format, args...))
+}
+
+// expr := term (('+'|'-') term)*
+func (p *exprParser) expr() (ptrExpr, error) {
+	l, err := p.term()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.s[p.pos]
+		p.pos++
+		var r ptrExpr
+		r, err = p.term()
+		l = binExpr{op, l, r}
+	}
+	return l, err
+}
+
+// term := factor (('*'|'/') factor)*
+func (p *exprParser) term() (ptrExpr, error) {
+	l, err := p.factor()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.s[p.pos]
+		p.pos++
+		var r ptrExpr
+		r, err = p.factor()
+		l = binExpr{op, l, r}
+	}
+	return l, err
+}
+
+// factor := number | '-' factor | '(' ref ')' | '(' pointer ')' | '(' expr ')'
+func (p *exprParser) factor() (ptrExpr, error) {
+	switch c := p.peek(); {
+	case c == '-':
+		p.pos++
+		f, err := p.factor()
+		return binExpr{'-', numExpr(0), f}, err
+	case c == '(':
+		p.pos++
+		if end := strings.IndexByte(p.s[p.pos:], ')'); end >= 0 &&
+			p.refs[p.s[p.pos:p.pos+end]] {
+			ref := p.s[p.pos : p.pos+end]
+			p.pos += end + 1
+			return ptrRef(ref), nil
+		}
+		if p.peek() == '/' || p.peek() == ')' {
+			end := strings.IndexByte(p.s[p.pos:], ')')
+			if end < 0 {
+				return nil, p.errorf("unterminated pointer")
+			}
+			ptr := p.s[p.pos : p.pos+end]
+			p.pos += end + 1
+			return ptrRef(ptr), nil
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return e, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] == '.' ||
+			(p.s[p.pos] >= '0' && p.s[p.pos] <= '9')) {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("bad number")
+		}
+		return numExpr(f), nil
+	}
+	return nil, p.errorf("unexpected input")
+}
+
+func parsePtrExpr(s string) (ptrExpr, error) {
+	return (&exprParser{s: s}).parse()
+}
+
+func (p *exprParser) parse() (ptrExpr, error) {
+	e, err := p.expr()
+	if err == nil && p.peek() != 0 {
+		err = p.errorf("unexpected input")
+	}
+	return e, err
+}
+
+var exprCacheLock = sync.Mutex{}
+var exprCache = map[string]ptrExpr{}
+
+// cachedPtrExpr parses an expression that's already been validated,
+// remembering it for the following documents.
+func cachedPtrExpr(s string) ptrExpr {
+	exprCacheLock.Lock()
+	defer exprCacheLock.Unlock()
+	e, ok := exprCache[s]
+	if !ok {
+		var err error
+		if e, err = parsePtrExpr(s); err != nil {
+			e = numExpr(0)
+		}
+		if len(exprCache) > 1000 {
+			exprCache = map[string]ptrExpr{}
+		}
+		exprCache[s] = e
+	}
+	return e
+}
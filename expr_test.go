@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPtrExpr(t *testing.T) {
+	vals := map[string]interface{}{
+		"/bytes_out": 300.0,
+		"/duration":  "2",
+		"/zero":      0.0,
+		"/name":      "x",
+	}
+	tests := []struct {
+		expr string
+		exp  float64
+		ok   bool
+	}{
+		{"(/bytes_out)/(/duration)", 150, true},
+		{"((/bytes_out) - 100) * 2 + 1", 401, true},
+		{"(-(/duration))", -2, true},
+		{"(/bytes_out)/(/zero)", 0, false},
+		{"(/bytes_out)+(/name)", 0, false},
+		{"(/missing)*2", 0, false},
+	}
+	for _, test := range tests {
+		e, err := parsePtrExpr(test.expr)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.expr, err)
+			continue
+		}
+		got, ok := e.eval(vals)
+		if ok != test.ok || (ok && got != test.exp) {
+			t.Errorf("For %q expected %v, %v; got %v, %v",
+				test.expr, test.exp, test.ok, got, ok)
+		}
+	}
+
+	for _, bad := range []string{"(/a", "(/a)+", "((/a)", "(/a) (/b)", "(/a)%2"} {
+		if _, err := parsePtrExpr(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
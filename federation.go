@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/gojson"
+)
+
+// A federated (virtual) database has no storage of its own.  Queries
+// against it are run against each member -- local database names or
+// remote seriesly database URLs -- and the results merged.
+
+var localDBName = regexp.MustCompile("^" + dbMatch + "$")
+
+var errAllMembersFailed = errors.New("all federation members failed")
+
+func isRemoteMember(m string) bool {
+	return strings.HasPrefix(m, "http://") || strings.HasPrefix(m, "https://")
+}
+
+func validateMembers(dbname string, members []string) error {
+	if len(members) == 0 {
+		return errors.New("at least one member is required")
+	}
+	for _, m := range members {
+		switch {
+		case isRemoteMember(m):
+		case m == dbname:
+			return errors.New("a federation can't include itself")
+		case !localDBName.MatchString(m):
+			return fmt.Errorf("invalid member: %q", m)
+		}
+	}
+	return nil
+}
+
+func federationMembers(dbname string) []string {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return nil
+	}
+	return m.Members
+}
+
+// queryResults maps group timestamps (in ms) to reduced values.
+// JSON can only key objects with strings, so they're converted, as
+// in query output, on the way in and out.
+type queryResults map[int64][]interface{}
+
+func (r queryResults) encode() ([]byte, error) {
+	m := make(map[string][]interface{}, len(r))
+	for ts, v := range r {
+		m[strconv.FormatInt(ts, 10)] = v
+	}
+	return json.Marshal(m)
+}
+
+func decodeQueryResults(d []byte) (queryResults, error) {
+	m := map[string][]interface{}{}
+	if err := json.Unmarshal(d, &m); err != nil {
+		return nil, err
+	}
+	rv := make(queryResults, len(m))
+	for k, v := range m {
+		ts, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad result key: %q", k)
+		}
+		rv[ts] = v
+	}
+	return rv, nil
+}
+
+// collectQuery gathers all of a running query's results.
+func collectQuery(q *queryIn) (queryResults, error) {
+	defer close(q.out)
+	defer close(q.cherr)
+
+	rv := queryResults{}
+	var err error
+	finished := int32(0)
+	walkComplete := false
+	for !walkComplete || q.started-finished > 0 {
+		select {
+		case po := <-q.out:
+			finished++
+			if po.err != nil {
+				err = po.err
+				q.cancel()
+				continue
+			}
+			rv[po.key/1e6] = po.value
+		case e := <-q.cherr:
+			walkComplete = true
+			if e != nil {
+				err = e
+				q.cancel()
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize to the types a remote member would return.
+	d, err := rv.encode()
+	if err != nil {
+		return nil, err
+	}
+	return decodeQueryResults(d)
+}
+
+func localMemberQuery(dbname string, p queryParams) (queryResults, error) {
+	q, err := p.start(dbname)
+	if err != nil {
+		return nil, err
+	}
+	return collectQuery(q)
+}
+
+func remoteMemberQuery(u string, p queryParams) (queryResults, error) {
+	client := &http.Client{Timeout: p.timeout}
+	res, err := client.Get(strings.TrimRight(u, "/") + "/_query?" +
+		p.form().Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP error from %v: %v", u, res.Status)
+	}
+	d, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if e := res.Trailer.Get(queryErrorTrailer); e != "" {
+		return nil, fmt.Errorf("incomplete results from %v: %v", u, e)
+	}
+	return decodeQueryResults(d)
+}
+
+// expandForMerge rewrites reducers that can't be merged from member
+// results into ones that can.  The returned slice maps each original
+// reducer to the positions of its expanded reducers.
+func expandForMerge(p queryParams) (queryParams, [][]int) {
+	x := p
+	x.ptrs, x.reds = nil, nil
+	positions := make([][]int, len(p.reds))
+	for i, r := range p.reds {
+		parts := []string{r}
+		switch r {
+		case "avg":
+			parts = []string{"sum", "count_numeric"}
+		case "c_avg":
+			parts = []string{"c", "c_count"}
+		case "cardinality":
+			parts = []string{"cardinality_sketch"}
+		}
+		for _, part := range parts {
+			positions[i] = append(positions[i], len(x.reds))
+			x.ptrs = append(x.ptrs, p.ptrs[i])
+			x.reds = append(x.reds, part)
+		}
+	}
+	return x, positions
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// mergeValue combines the results of one reducer from two members.
+func mergeValue(reducer string, a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if isCondReducer(reducer) {
+		// countif and sumif both add up.
+		reducer = "sum"
+	}
+	switch reducer {
+	case "sum", "sumsq", "count", "count_numeric", "c", "c_count":
+		if aok && bok {
+			return af + bf
+		}
+	case "min", "c_min":
+		if aok && bok {
+			return math.Min(af, bf)
+		}
+	case "max", "c_max":
+		if aok && bok {
+			return math.Max(af, bf)
+		}
+	case "cardinality_sketch":
+		as, aok := parseHLL(a)
+		bs, bok := parseHLL(b)
+		if aok && bok {
+			as.merge(bs)
+			return as.String()
+		}
+	case "first", "last":
+		am, aok := a.(map[string]interface{})
+		bm, bok := b.(map[string]interface{})
+		if !aok {
+			return b
+		}
+		if !bok {
+			return a
+		}
+		at, _ := am["t"].(string)
+		bt, _ := bm["t"].(string)
+		if (bt < at) == (reducer == "first") {
+			return b
+		}
+		return a
+	case "identity", "obj_keys":
+		al, _ := a.([]interface{})
+		bl, _ := b.([]interface{})
+		return append(append([]interface{}{}, al...), bl...)
+	case "distinct", "obj_distinct_keys":
+		seen := map[interface{}]bool{}
+		rv := []interface{}{}
+		for _, l := range []interface{}{a, b} {
+			vals, _ := l.([]interface{})
+			for _, v := range vals {
+				if !seen[v] {
+					seen[v] = true
+					rv = append(rv, v)
+				}
+			}
+		}
+		return rv
+	}
+	return a
+}
+
+func mergeResults(p queryParams, positions [][]int,
+	members []queryResults) queryResults {
+
+	expanded, _ := expandForMerge(p)
+	merged := queryResults{}
+	for _, res := range members {
+		for ts, vals := range res {
+			cur, ok := merged[ts]
+			if !ok {
+				cur = make([]interface{}, len(expanded.reds))
+				merged[ts] = cur
+			}
+			for i := range cur {
+				if i < len(vals) {
+					cur[i] = mergeValue(expanded.reds[i], cur[i], vals[i])
+				}
+			}
+		}
+	}
+
+	rv := queryResults{}
+	for ts, vals := range merged {
+		out := make([]interface{}, len(p.reds))
+		for i, r := range p.reds {
+			pos := positions[i]
+			if r == "avg" || r == "c_avg" {
+				sum, sok := toFloat(vals[pos[0]])
+				count, cok := toFloat(vals[pos[1]])
+				if sok && cok && count > 0 {
+					out[i] = sum / count
+				}
+				continue
+			}
+			if r == "cardinality" {
+				if s, ok := parseHLL(vals[pos[0]]); ok {
+					out[i] = s.estimate()
+				}
+				continue
+			}
+			out[i] = vals[pos[0]]
+		}
+		rv[ts] = out
+	}
+	return rv
+}
+
+// federatedResults queries every member and merges their results.
+// It only fails if every member does, reporting how many failed.
+func federatedResults(members []string, p queryParams) (queryResults, int, error) {
+	expanded, positions := expandForMerge(p)
+
+	results := make([]queryResults, len(members))
+	errs := make([]error, len(members))
+	wg := sync.WaitGroup{}
+	for i, m := range members {
+		wg.Add(1)
+		go func(i int, m string) {
+			defer wg.Done()
+			if isRemoteMember(m) {
+				results[i], errs[i] = remoteMemberQuery(m, expanded)
+			} else {
+				results[i], errs[i] = localMemberQuery(m, expanded)
+			}
+		}(i, m)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Error querying federation member %v: %v",
+				members[i], err)
+			failed++
+		}
+	}
+	if failed == len(members) {
+		return nil, failed, errAllMembersFailed
+	}
+	return mergeResults(p, positions, results), failed, nil
+}
+
+func federatedQuery(members []string, p queryParams,
+	w http.ResponseWriter, req *http.Request) {
+
+	merged, failed, err := federatedResults(members, p)
+	if err != nil {
+		emitError(502, w, "Bad Gateway", err.Error())
+		return
+	}
+	if failed > 0 {
+		w.Header().Set("X-Seriesly-Failed-Members", fmt.Sprint(failed))
+	}
+
+	keys := make([]int64, 0, len(merged))
+	for ts := range merged {
+		keys = append(keys, ts)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	output, closer := responseOutput(w, req)
+	defer closer()
+	rw := newResultWriter(w, req, output)
+	w.WriteHeader(200)
+
+	for _, ts := range keys {
+		if err := rw.write(&processOut{key: ts * 1e6,
+			value: merged[ts]}); err != nil {
+			log.Printf("Error sending item: %v", err)
+			return
+		}
+	}
+	rw.finish()
+}
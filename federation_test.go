@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var startQueryWorkers sync.Once
+
+// startTestQueries starts the workers queries are run by, as main
+// does.
+func startTestQueries() {
+	startQueryWorkers.Do(func() {
+		processorInput = make(chan *processIn, *docBacklog)
+		cacheInput = processorInput
+		docPool.resize(2)
+		queryInput = make(chan *queryIn, *queryBacklog)
+		queryPool.resize(2)
+	})
+}
+
+func TestFederationMerge(t *testing.T) {
+	p := queryParams{
+		ptrs: []string{"/v", "/v", "/v", "/h", "/v", "/v"},
+		reds: []string{"avg", "max", "count", "distinct", "c_avg", "last"},
+	}
+	expanded, positions := expandForMerge(p)
+	expReds := []string{"sum", "count_numeric", "max", "count", "distinct",
+		"c", "c_count", "last"}
+	if !reflect.DeepEqual(expanded.reds, expReds) {
+		t.Fatalf("Expected expansion %v, got %v", expReds, expanded.reds)
+	}
+
+	last := map[string]interface{}{"t": "b", "v": 1.0}
+	members := []queryResults{
+		{1000: {30.0, 3.0, 20.0, 3.0, []interface{}{"a"}, 9.0, 3.0, last}},
+		// A malformed last from a remote member is ignored.
+		{1000: {10.0, 1.0, 50.0, 1.0, []interface{}{"a", "b"}, 2.0, 2.0, "x"},
+			2000: {4.0, 2.0, 3.0, 2.0, []interface{}{"c"}, 3.0, 1.0, nil}},
+	}
+	got := mergeResults(p, positions, members)
+	exp := queryResults{
+		1000: {10.0, 50.0, 4.0, []interface{}{"a", "b"}, 2.2, last},
+		2000: {2.0, 3.0, 2.0, []interface{}{"c"}, 3.0, nil},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+
+	// Values that aren't numbers count, but aren't averaged.
+	in := []interface{}{2.0, "x", 4.0}
+	if got := reducers["count"](streamCollection(in)); got != 3 {
+		t.Errorf("Expected a count of 3, got %v", got)
+	}
+	if got := reducers["count_numeric"](streamCollection(in)); got != 2 {
+		t.Errorf("Expected a numeric count of 2, got %v", got)
+	}
+}
+
+func TestValidateMembers(t *testing.T) {
+	if err := validateMembers("all", []string{"a", "http://x:3133/b"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, bad := range [][]string{nil, {"all"}, {"a/b c"}} {
+		if err := validateMembers("all", bad); err == nil {
+			t.Errorf("Expected error on %v", bad)
+		}
+	}
+}
+
+func TestMemberQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-federation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+	startTestQueries()
+
+	const dbname = "member"
+	if err := dbcreate(dbPath(dbname)); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	defer forgetDB(dbname)
+	for k, doc := range map[string]string{
+		"2012-08-10T00:00:00Z": `{"v": 1}`,
+		"2012-08-10T00:00:30Z": `{"v": 3}`,
+		"2012-08-10T00:01:00Z": `{"v": 5}`,
+	} {
+		if err := dbstore(dbname, k, []byte(doc)); err != nil {
+			t.Fatalf("Error storing %v: %v", k, err)
+		}
+	}
+	if err := dbflush(dbname); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	p := queryParams{group: 60000, ptrs: []string{"/v", "/v"},
+		reds: []string{"sum", "count"}, timeout: 5 * time.Second}
+	exp := queryResults{
+		1344556800000: {4.0, 2.0},
+		1344556860000: {5.0, 1.0},
+	}
+
+	got, err := localMemberQuery(dbname, p)
+	if err != nil {
+		t.Fatalf("Error querying locally: %v", err)
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v locally, got %v", exp, got)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+	got, err = remoteMemberQuery(srv.URL+"/"+dbname, p)
+	if err != nil {
+		t.Fatalf("Error querying remotely: %v", err)
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v remotely, got %v", exp, got)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
+)
+
+// Indexed fields, such as /host, have the keys of the documents with
+// each of their values kept in a sidecar file.  A query filtering on
+// an indexed field reads just the documents with the value it wants,
+// rather than every document in its range.
+//
+// The index records the last sequence of the database it's caught up
+// with, so a query also reads whatever changed after that, as well as
+// anything recently written and not yet committed.  Those, like
+// everything else, are still checked against the query's filters.
+
+const indexExt = ".index"
+
+// Keys no document has, for the fields the index was built for, the
+// sequence it's caught up to, and the index keys of each document.
+const (
+	fieldIndexFieldsKey = "\x00fields"
+	fieldIndexSeqKey    = "\x00seq"
+	fieldIndexDocPrefix = "\x01"
+)
+
+type fieldIndexSpec struct {
+	Fields []string `json:"fields"`
+}
+
+func indexPath(dbname string) string {
+	return dbPath(dbname) + indexExt
+}
+
+func (spec *fieldIndexSpec) validate() error {
+	if len(spec.Fields) == 0 {
+		return errors.New("at least one field is required")
+	}
+	for _, f := range spec.Fields {
+		if !strings.HasPrefix(f, "/") {
+			return fmt.Errorf("invalid pointer: %q", f)
+		}
+	}
+	return nil
+}
+
+func fieldIndexKey(field, val, k string) string {
+	return field + "\x00" + val + "\x00" + k
+}
+
+// fieldIndexKeys are the index keys of a document.
+func fieldIndexKeys(fields []string, k string, doc []byte) []string {
+	rv := []string{}
+	for f, v := range resolveFetch(doc, fields) {
+		if s, ok := filterString(v); ok {
+			rv = append(rv, fieldIndexKey(f, s, k))
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// openFieldIndex opens a database's field index, along with the
+// fields it's built for and the sequence it's caught up to.
+func openFieldIndex(dbname string) (*couchstore.Couchstore, []string, uint64, error) {
+	path := indexPath(dbname)
+	idx, err := couchstore.Open(path, false)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	recordDBConn(path, idx)
+	var fields []string
+	var seq uint64
+	doc, _, err := idx.Get(fieldIndexFieldsKey)
+	if err == nil {
+		err = json.Unmarshal(doc.Value(), &fields)
+	}
+	if err == nil {
+		doc, _, err = idx.Get(fieldIndexSeqKey)
+	}
+	if err == nil {
+		err = json.Unmarshal(doc.Value(), &seq)
+	}
+	if err != nil {
+		closeDBConn(idx)
+		return nil, nil, 0, err
+	}
+	return idx, fields, seq, nil
+}
+
+func setIndexDoc(bulk couchstore.BulkWriter, k string, v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	bulk.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, d))
+	return nil
+}
+
+// A fieldIndexer keeps a database's field index up to date as its
+// writer commits.  Only touched by the write loop.
+type fieldIndexer struct {
+	dbname string
+	fields []string
+	// Index keys of documents written since the last flush.  nil
+	// for those deleted.
+	pending map[string][]string
+}
+
+// newFieldIndexer returns the indexer for a database, or nil if it
+// has no indexed fields.
+func newFieldIndexer(dbname string, db dbStore) *fieldIndexer {
+	if _, ok := db.(*memHandle); ok {
+		return nil
+	}
+	idx, fields, _, err := openFieldIndex(dbname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dbLog.Warn("error opening field index", "db", dbname, "err", err)
+		}
+		return nil
+	}
+	closeDBConn(idx)
+	return &fieldIndexer{dbname: dbname, fields: fields,
+		pending: map[string][]string{}}
+}
+
+func (x *fieldIndexer) add(k string, doc []byte) {
+	if x != nil {
+		x.pending[k] = fieldIndexKeys(x.fields, k, doc)
+	}
+}
+
+func (x *fieldIndexer) remove(k string) {
+	if x != nil {
+		x.pending[k] = nil
+	}
+}
+
+// flush indexes everything the database has committed since the
+// index last caught up.  Documents written through this writer are
+// indexed from what was written; anything else, such as writes a
+// previous writer didn't get to index, is read back.
+func (x *fieldIndexer) flush(db dbStore) {
+	if x == nil || len(x.pending) == 0 {
+		return
+	}
+	pending := x.pending
+	x.pending = map[string][]string{}
+	cs, ok := db.(changeSource)
+	if !ok {
+		return
+	}
+	idx, _, since, err := openFieldIndex(x.dbname)
+	if err != nil {
+		dbLog.Error("error opening field index", "db", x.dbname, "err", err)
+		return
+	}
+	defer closeDBConn(idx)
+
+	bulk := idx.Bulk()
+	defer bulk.Close()
+	last := since
+	err = cs.Changes(since, func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		if di.Seq() > last {
+			last = di.Seq()
+		}
+		keys, ok := pending[di.ID()]
+		if !ok && !di.Deleted() {
+			doc, err := db.GetFromDocInfo(di)
+			if err != nil {
+				return err
+			}
+			keys = fieldIndexKeys(x.fields, di.ID(), doc.Value())
+		}
+		if di.Deleted() {
+			keys = nil
+		}
+		return x.update(idx, bulk, di.ID(), keys)
+	})
+	if err == nil {
+		err = setIndexDoc(bulk, fieldIndexSeqKey, last)
+	}
+	if err == nil {
+		err = bulk.Commit()
+	}
+	if err != nil {
+		dbLog.Error("error updating field index", "db", x.dbname, "err", err)
+	}
+}
+
+// update replaces a document's index keys.
+func (x *fieldIndexer) update(idx *couchstore.Couchstore,
+	bulk couchstore.BulkWriter, k string, keys []string) error {
+	var old []string
+	if doc, _, err := idx.Get(fieldIndexDocPrefix + k); err == nil {
+		json.Unmarshal(doc.Value(), &old)
+	}
+	keep := map[string]bool{}
+	for _, ik := range keys {
+		keep[ik] = true
+	}
+	for _, ik := range old {
+		if !keep[ik] {
+			bulk.Delete(couchstore.NewDocInfo(ik, 0))
+		}
+	}
+	if len(keys) == 0 {
+		if old != nil {
+			bulk.Delete(couchstore.NewDocInfo(fieldIndexDocPrefix+k, 0))
+		}
+		return nil
+	}
+	return setIndexEntries(bulk, k, keys)
+}
+
+func setIndexEntries(bulk couchstore.BulkWriter, k string, keys []string) error {
+	for _, ik := range keys {
+		bulk.Set(couchstore.NewDocInfo(ik, 0),
+			couchstore.NewDocument(ik, []byte("1")))
+	}
+	return setIndexDoc(bulk, fieldIndexDocPrefix+k, keys)
+}
+
+// dbIndexFields rebuilds the field index from every document, for the
+// fields now configured, or removes it if there are none.
+func dbIndexFields(dq *dbWriter, bulk couchstore.BulkWriter,
+	queued int) (couchstore.BulkWriter, error) {
+	if _, ok := dq.db.(*memHandle); ok {
+		return bulk, errNotOnDisk
+	}
+	bulk = commitBeforeMove(dq, bulk, queued, "indexing")
+	dq.index = nil
+
+	m, err := loadMeta(dq.dbname)
+	if err != nil {
+		return bulk, err
+	}
+	path := indexPath(dq.dbname)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return bulk, err
+	}
+	if m.Indexes == nil {
+		return bulk, nil
+	}
+
+	inf, err := dq.db.Info()
+	if err != nil {
+		return bulk, err
+	}
+	idx, err := couchstore.Open(path, true)
+	if err != nil {
+		return bulk, err
+	}
+	recordDBConn(path, idx)
+	defer closeDBConn(idx)
+
+	fields := m.Indexes.Fields
+	ibulk := idx.Bulk()
+	defer ibulk.Close()
+	err = dq.db.WalkDocs("", func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo, doc *couchstore.Document) error {
+		keys := fieldIndexKeys(fields, di.ID(), doc.Value())
+		if len(keys) == 0 {
+			return nil
+		}
+		return setIndexEntries(ibulk, di.ID(), keys)
+	})
+	if err == nil {
+		err = setIndexDoc(ibulk, fieldIndexFieldsKey, fields)
+	}
+	if err == nil {
+		err = setIndexDoc(ibulk, fieldIndexSeqKey, inf.LastSeq)
+	}
+	if err == nil {
+		err = ibulk.Commit()
+	}
+	if err != nil {
+		os.Remove(path)
+		return bulk, err
+	}
+	dq.index = &fieldIndexer{dbname: dq.dbname, fields: fields,
+		pending: map[string][]string{}}
+	dbLog.Info("rebuilt field index", "db", dq.dbname, "docs", inf.DocCount)
+	return bulk, nil
+}
+
+func dbindexFields(dbname string) error {
+	return dbrewrite(dbqitem{dbname: dbname, op: opIndexFields})
+}
+
+// indexedWalk returns a walk over just the documents a query's
+// filters could match, or nil if none of them is on an indexed field.
+// It walks like dbStore.Walk, but the query's range is all it
+// covers.
+func indexedWalk(q *queryIn, db dbStore) func(string, couchstore.WalkFun) error {
+	if len(q.filters) == 0 {
+		return nil
+	}
+	idx, fields, since, err := openFieldIndex(q.dbname)
+	if err != nil {
+		return nil
+	}
+	defer closeDBConn(idx)
+
+	indexed := map[string]bool{}
+	for _, f := range fields {
+		indexed[f] = true
+	}
+	which := -1
+	for i, f := range q.filters {
+		if indexed[f] {
+			which = i
+			break
+		}
+	}
+	if which < 0 {
+		return nil
+	}
+
+	inRange := func(k string) bool {
+		return k >= q.from && (q.to == "" || k < q.to)
+	}
+	found := map[string]bool{}
+	prefix := fieldIndexKey(q.filters[which], q.filtervals[which], "")
+	err = idx.Walk(prefix+q.from, func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		if !strings.HasPrefix(di.ID(), prefix) {
+			return couchstore.StopIteration
+		}
+		k := di.ID()[len(prefix):]
+		if !inRange(k) {
+			return couchstore.StopIteration
+		}
+		found[k] = true
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+
+	// Whatever the index hasn't caught up with.
+	main, err := dbopen(q.dbname)
+	if err != nil {
+		return nil
+	}
+	defer closeDBConn(main)
+	cs, ok := main.(changeSource)
+	if !ok {
+		return nil
+	}
+	err = cs.Changes(since, func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		if !di.Deleted() && inRange(di.ID()) {
+			found[di.ID()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	if r := recentDocs(q.dbname); r != nil {
+		(&memHandle{r}).Walk(q.from, func(_ *couchstore.Couchstore,
+			di *couchstore.DocInfo) error {
+			if !inRange(di.ID()) {
+				return couchstore.StopIteration
+			}
+			found[di.ID()] = true
+			return nil
+		})
+	}
+
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return func(from string, f couchstore.WalkFun) error {
+		for _, k := range keys {
+			if k < from {
+				continue
+			}
+			_, di, err := db.Get(k)
+			if err != nil {
+				continue
+			}
+			if err := f(nil, di); err != nil {
+				if err == couchstore.StopIteration {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func TestFieldIndexKeys(t *testing.T) {
+	got := fieldIndexKeys([]string{"/host", "/up", "/tags"}, "k",
+		[]byte(`{"host": "web1", "up": true, "tags": ["a"]}`))
+	exp := []string{"/host\x00web1\x00k", "/up\x00true\x00k"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+}
+
+func TestFieldIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	const dbname = "indexed"
+	if err := dbcreate(dbPath(dbname)); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	defer forgetDB(dbname)
+
+	store := func(k, doc string) {
+		if err := dbstore(dbname, k, []byte(doc)); err != nil {
+			t.Fatalf("Error storing %v: %v", k, err)
+		}
+		if err := dbflush(dbname); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+	store("2012-08-10T00:00:00Z", `{"host": "web1"}`)
+	store("2012-08-10T00:00:01Z", `{"host": "web2"}`)
+
+	err = updateMeta(dbname, func(m *dbMeta) {
+		m.Indexes = &fieldIndexSpec{[]string{"/host"}}
+	})
+	if err != nil {
+		t.Fatalf("Error configuring: %v", err)
+	}
+	if err := dbindexFields(dbname); err != nil {
+		t.Fatalf("Error building the index: %v", err)
+	}
+
+	store("2012-08-10T00:00:02Z", `{"host": "web1"}`)
+	// Moved from web2 to web1, and then out of web1.
+	store("2012-08-10T00:00:01Z", `{"host": "web1"}`)
+	store("2012-08-10T00:00:00Z", `{"host": "web3"}`)
+
+	walked := func(filters, filtervals []string, from, to string) []string {
+		q := &queryIn{dbname: dbname, from: from, to: to,
+			filters: filters, filtervals: filtervals}
+		db, err := dbopenRead(dbname)
+		if err != nil {
+			t.Fatalf("Error opening: %v", err)
+		}
+		defer closeDBConn(db)
+		walk := indexedWalk(q, db)
+		if walk == nil {
+			return nil
+		}
+		rv := []string{}
+		walk(from, func(_ *couchstore.Couchstore, di *couchstore.DocInfo) error {
+			rv = append(rv, di.ID())
+			return nil
+		})
+		return rv
+	}
+
+	got := walked([]string{"/host"}, []string{"web1"}, "", "")
+	exp := []string{"2012-08-10T00:00:01Z", "2012-08-10T00:00:02Z"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v for web1, got %v", exp, got)
+	}
+	got = walked([]string{"/host"}, []string{"web1"},
+		"2012-08-10T00:00:02Z", "2012-08-10T00:00:03Z")
+	exp = []string{"2012-08-10T00:00:02Z"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v for web1 in range, got %v", exp, got)
+	}
+	if got := walked([]string{"/host"}, []string{"web2"}, "", ""); len(got) != 0 {
+		t.Errorf("Expected nothing for web2, got %v", got)
+	}
+	if got := walked([]string{"/dc"}, []string{"x"}, "", ""); got != nil {
+		t.Errorf("Expected no index for /dc, got %v", got)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// A database may declare the types of the fields it expects with PUT
+// /db/_schema, e.g.
+//
+//	{"fields": {"/temp": "number", "/host": "string"}, "mode": "coerce"}
+//
+// Writes are checked against it.  In reject mode (the default), a
+// document with a declared field of another type fails with 400.  In
+// coerce mode, strings holding numbers or booleans are converted, as
+// are scalars declared as strings, and only what can't be converted
+// fails.  Missing and null fields are fine either way.
+//
+// Queries take declared numbers as they are instead of rendering and
+// reparsing each one, so reducers like identity return them as
+// numbers.
+
+const (
+	fieldsReject = "reject"
+	fieldsCoerce = "coerce"
+)
+
+type fieldSchema struct {
+	Fields map[string]string `json:"fields"`
+	Mode   string            `json:"mode,omitempty"`
+}
+
+// A fieldError is a write that doesn't match the declared types.
+type fieldError struct {
+	ptr, want string
+	got       interface{}
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%v should be a %v, got %v", e.ptr, e.want,
+		jsonType(e.got))
+}
+
+func validFieldSchema(s fieldSchema) error {
+	switch s.Mode {
+	case "", fieldsReject, fieldsCoerce:
+	default:
+		return fmt.Errorf("unknown mode: %v", s.Mode)
+	}
+	for ptr, typ := range s.Fields {
+		if !strings.HasPrefix(ptr, "/") {
+			return fmt.Errorf("not a JSON pointer: %q", ptr)
+		}
+		switch typ {
+		case "number", "string", "boolean", "array", "object":
+		default:
+			return fmt.Errorf("unknown type for %v: %v", ptr, typ)
+		}
+	}
+	return nil
+}
+
+func dbFieldSchema(dbname string) *fieldSchema {
+	m, err := loadMeta(ownerDB(dbname))
+	if err != nil || m.Schema == nil || len(m.Schema.Fields) == 0 {
+		return nil
+	}
+	return m.Schema
+}
+
+// dbNumericFields returns the pointers declared as numbers.
+func dbNumericFields(dbname string) map[string]bool {
+	s := dbFieldSchema(dbname)
+	if s == nil {
+		return nil
+	}
+	rv := map[string]bool{}
+	for ptr, typ := range s.Fields {
+		if typ == "number" {
+			rv[ptr] = true
+		}
+	}
+	return rv
+}
+
+func pointerParts(ptr string) []string {
+	parts := strings.Split(ptr[1:], "/")
+	for i, p := range parts {
+		parts[i] = strings.Replace(strings.Replace(p, "~1", "/", -1),
+			"~0", "~", -1)
+	}
+	return parts
+}
+
+// findField returns the container holding a pointer's value and the
+// value's key in it.
+func findField(v interface{}, ptr string) (map[string]interface{}, string, bool) {
+	parts := pointerParts(ptr)
+	for _, p := range parts[:len(parts)-1] {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		v = m[p]
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, "", false
+	}
+	last := parts[len(parts)-1]
+	_, ok = m[last]
+	return m, last, ok
+}
+
+// coerceField converts a value to the given type if it sensibly can.
+func coerceField(v interface{}, want string) (interface{}, bool) {
+	switch want {
+	case "number":
+		if s, ok := v.(string); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			return f, err == nil
+		}
+	case "boolean":
+		if s, ok := v.(string); ok {
+			b, err := strconv.ParseBool(strings.TrimSpace(s))
+			return b, err == nil
+		}
+	case "string":
+		switch x := v.(type) {
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(x), true
+		}
+	}
+	return nil, false
+}
+
+// applyFieldSchema checks a document against declared field types,
+// returning it as it should be stored.
+func applyFieldSchema(s *fieldSchema, doc []byte) ([]byte, error) {
+	if s == nil {
+		return doc, nil
+	}
+	var v interface{}
+	if json.Unmarshal(doc, &v) != nil {
+		return doc, nil
+	}
+	changed := false
+	for ptr, want := range s.Fields {
+		m, k, ok := findField(v, ptr)
+		if !ok || m[k] == nil || jsonType(m[k]) == want {
+			continue
+		}
+		if s.Mode == fieldsCoerce {
+			if c, ok := coerceField(m[k], want); ok {
+				m[k] = c
+				changed = true
+				continue
+			}
+		}
+		return nil, &fieldError{ptr, want, m[k]}
+	}
+	if !changed {
+		return doc, nil
+	}
+	return json.Marshal(v)
+}
+
+func getFieldSchema(parts []string, w http.ResponseWriter, req *http.Request) {
+	s := dbFieldSchema(parts[0])
+	if s == nil {
+		s = &fieldSchema{Fields: map[string]string{}}
+	}
+	if s.Mode == "" {
+		s.Mode = fieldsReject
+	}
+	mustEncode(200, w, s)
+}
+
+func putFieldSchema(parts []string, w http.ResponseWriter, req *http.Request) {
+	s := fieldSchema{}
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err == nil {
+		err = validFieldSchema(s)
+	}
+	if err != nil {
+		emitError(400, w, "Bad schema", err.Error())
+		return
+	}
+
+	err = updateMeta(parts[0], func(m *dbMeta) {
+		m.Schema = &s
+		if len(s.Fields) == 0 {
+			m.Schema = nil
+		}
+	})
+	if err != nil {
+		emitError(500, w, "Error storing schema", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidFieldSchema(t *testing.T) {
+	tests := []struct {
+		s  fieldSchema
+		ok bool
+	}{
+		{fieldSchema{}, true},
+		{fieldSchema{Fields: map[string]string{"/a": "number"}}, true},
+		{fieldSchema{Fields: map[string]string{"/a": "number"},
+			Mode: fieldsCoerce}, true},
+		{fieldSchema{Mode: "whatever"}, false},
+		{fieldSchema{Fields: map[string]string{"a": "number"}}, false},
+		{fieldSchema{Fields: map[string]string{"/a": "int"}}, false},
+	}
+
+	for _, test := range tests {
+		err := validFieldSchema(test.s)
+		if (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %+v, got %v", test.ok, test.s, err)
+		}
+	}
+}
+
+func TestApplyFieldSchema(t *testing.T) {
+	fields := map[string]string{
+		"/temp":      "number",
+		"/host":      "string",
+		"/x~1y/up":   "boolean",
+		"/tags":      "array",
+		"/not/there": "number",
+	}
+	reject := &fieldSchema{Fields: fields}
+	coerce := &fieldSchema{Fields: fields, Mode: fieldsCoerce}
+
+	tests := []struct {
+		s       *fieldSchema
+		in, exp string
+		err     bool
+	}{
+		{nil, `{"temp": "x"}`, `{"temp": "x"}`, false},
+		{reject, `{"temp": 3, "host": "a"}`, `{"temp": 3, "host": "a"}`, false},
+		{reject, `{"temp": null}`, `{"temp": null}`, false},
+		{reject, `{"temp": "3"}`, "", true},
+		{reject, `{"tags": {}}`, "", true},
+		{coerce, `{"temp": "3.5"}`, `{"temp":3.5}`, false},
+		{coerce, `{"host": 7}`, `{"host":"7"}`, false},
+		{coerce, `{"x/y": {"up": "true"}}`, `{"x/y":{"up":true}}`, false},
+		{coerce, `{"temp": "hot"}`, "", true},
+		{coerce, `{"tags": "a"}`, "", true},
+	}
+
+	for _, test := range tests {
+		got, err := applyFieldSchema(test.s, []byte(test.in))
+		if (err != nil) != test.err {
+			t.Errorf("Expected error=%v for %v, got %v",
+				test.err, test.in, err)
+			continue
+		}
+		if err == nil && string(got) != test.exp {
+			t.Errorf("Expected %v for %v, got %s", test.exp, test.in, got)
+		}
+	}
+}
+
+func TestDocValueNumeric(t *testing.T) {
+	doc := map[string]interface{}{"/a": 1.5}
+	v := docValue(nil, "/a", doc, map[string]bool{"/a": true})
+	if f, ok := v.(float64); !ok || f != 1.5 {
+		t.Errorf("Expected 1.5, got %#v", v)
+	}
+}
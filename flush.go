@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A flushController decides how many writes a writer batches up and
+// how long it waits before committing them.  With -maxDurability set,
+// it adapts both to the ingest rate and commit cost, so writes are
+// always committed within that time: quiet databases commit almost
+// immediately, while busy ones commit larger batches less often.
+// Otherwise, the fixed -maxOpQueue and -flushDelay are used.
+type flushController struct {
+	mu         sync.Mutex
+	batchLimit int
+	delay      time.Duration
+	commitCost time.Duration // moving average
+	rate       float64       // moving average, items per second
+	lastCommit time.Time
+}
+
+const (
+	minFlushBatch = 16
+	minFlushDelay = time.Millisecond
+	// Weight given to the newest sample in moving averages.
+	flushSmoothing = 0.2
+)
+
+func newFlushController(delay time.Duration) *flushController {
+	return &flushController{
+		batchLimit: maxOpQueue.get(),
+		delay:      delay,
+		lastCommit: time.Now(),
+	}
+}
+
+// reset returns to fixed settings after they've changed.  Adaptive
+// controllers carry on adapting.
+func (c *flushController) reset(delay time.Duration) {
+	if maxDurability.get() > 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batchLimit = maxOpQueue.get()
+	c.delay = delay
+}
+
+func (c *flushController) limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batchLimit
+}
+
+func (c *flushController) wait() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delay
+}
+
+// committed records a commit of n items that took the given time and
+// adjusts the batch limit and delay for the next one.
+func (c *flushController) committed(n int, took time.Duration, now time.Time) {
+	if maxDurability.get() <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elapsed := now.Sub(c.lastCommit).Seconds(); elapsed > 0 {
+		c.rate += flushSmoothing * (float64(n)/elapsed - c.rate)
+	}
+	c.commitCost += time.Duration(flushSmoothing *
+		float64(took-c.commitCost))
+	c.lastCommit = now
+
+	// Leave room for the commit itself within the durability target,
+	// and don't spend more than half the time committing.
+	budget := maxDurability.get() - c.commitCost
+	c.delay = 2 * c.commitCost
+	if c.delay > budget {
+		c.delay = budget
+	}
+	if c.delay < minFlushDelay {
+		c.delay = minFlushDelay
+	}
+
+	c.batchLimit = int(c.rate * budget.Seconds())
+	if c.batchLimit < minFlushBatch {
+		c.batchLimit = minFlushBatch
+	}
+	if max := 10 * maxOpQueue.get(); c.batchLimit > max {
+		c.batchLimit = max
+	}
+}
+
+func (c *flushController) stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"adaptive":       maxDurability.get() > 0,
+		"batch_limit":    c.batchLimit,
+		"flush_delay_ms": float64(c.delay) / float64(time.Millisecond),
+		"commit_cost_ms": float64(c.commitCost) / float64(time.Millisecond),
+		"ingest_rate":    c.rate,
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlushControllerFixed(t *testing.T) {
+	c := newFlushController(flushTime.get())
+	c.committed(100000, time.Second, time.Now().Add(time.Second))
+	if c.limit() != maxOpQueue.get() || c.wait() != flushTime.get() {
+		t.Errorf("Expected fixed limits, got %v, %v", c.limit(), c.wait())
+	}
+}
+
+func TestFlushControllerAdaptive(t *testing.T) {
+	defer func(d time.Duration) { maxDurability.set(d) }(maxDurability.get())
+	maxDurability.set(time.Second)
+
+	// A quiet database with cheap commits commits almost right away.
+	quiet := newFlushController(flushTime.get())
+	now := quiet.lastCommit
+	for i := 0; i < 50; i++ {
+		now = now.Add(time.Second)
+		quiet.committed(1, time.Millisecond, now)
+	}
+	if quiet.wait() > 10*time.Millisecond || quiet.limit() != minFlushBatch {
+		t.Errorf("Expected short waits and small batches, got %v, %v",
+			quiet.wait(), quiet.limit())
+	}
+
+	// A busy database batches more and waits longer, but always
+	// within the durability target.
+	busy := newFlushController(flushTime.get())
+	now = busy.lastCommit
+	for i := 0; i < 50; i++ {
+		now = now.Add(500 * time.Millisecond)
+		busy.committed(5000, 300*time.Millisecond, now)
+	}
+	if busy.limit() <= quiet.limit() || busy.wait() <= quiet.wait() {
+		t.Errorf("Expected bigger batches when busy, got %v, %v",
+			busy.limit(), busy.wait())
+	}
+	if busy.wait()+busy.commitCost > maxDurability.get()+time.Millisecond {
+		t.Errorf("Wait %v plus commit %v exceeds %v",
+			busy.wait(), busy.commitCost, maxDurability.get())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+// A storageFormat describes the on-disk layout of a database.
+type storageFormat struct {
+	Version      int    `json:"version"`
+	KeyEncoding  string `json:"key_encoding"`
+	Compression  string `json:"compression"`
+	Partitioning string `json:"partitioning"`
+
+	keyLayout string
+}
+
+// RFC3339Nano drops trailing zeros, so keys of differing precision
+// don't sort in time order.  Version 2 keys are always full width.
+const fixedKeyLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+var storageFormats = map[int]storageFormat{
+	1: {1, "rfc3339nano", "snappy", "none", time.RFC3339Nano},
+	2: {2, "rfc3339fixed", "snappy", "none", fixedKeyLayout},
+}
+
+func parseFormatVersion(s string) (storageFormat, error) {
+	v, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(s), "v"))
+	if err != nil {
+		return storageFormat{}, fmt.Errorf("invalid format version: %q", s)
+	}
+	f, ok := storageFormats[v]
+	if !ok {
+		return f, fmt.Errorf("unsupported format version: %v", v)
+	}
+	return f, nil
+}
+
+func (f storageFormat) formatKey(t time.Time) string {
+	return t.UTC().Format(f.keyLayout)
+}
+
+// normalizeKey rewrites a timestamp key into this format's encoding.
+// Keys that aren't timestamps are left alone.
+func (f storageFormat) normalizeKey(k string) string {
+	t, err := parseCanonicalTime(k)
+	if err != nil {
+		return k
+	}
+	return f.formatKey(t)
+}
+
+func dbFormat(dbname string) storageFormat {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		log.Printf("Error loading metadata for %v: %v", dbname, err)
+		return storageFormats[1]
+	}
+	f, ok := storageFormats[m.Format]
+	if !ok {
+		log.Printf("Unknown format %v for %v", m.Format, dbname)
+		return storageFormats[1]
+	}
+	return f
+}
+
+// migrateTo writes every document in src into a new file at dest
+// using the key encoding of the target format.
+func migrateTo(src dbStore, dest string,
+	to storageFormat) error {
+
+	os.Remove(dest)
+	out, err := couchstore.Open(dest, true)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	bulk := out.Bulk()
+	defer bulk.Close()
+
+	queued := 0
+	err = src.WalkDocs("", func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo, doc *couchstore.Document) error {
+		k := to.normalizeKey(di.ID())
+		bulk.Set(couchstore.NewDocInfo(k, couchstore.DocIsCompressed),
+			couchstore.NewDocument(k, doc.Value()))
+		queued++
+		if queued >= maxOpQueue.get() {
+			queued = 0
+			return bulk.Commit()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bulk.Commit()
+}
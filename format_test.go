@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestFormatVersionParsing(t *testing.T) {
+	tests := []struct {
+		input string
+		exp   int
+	}{
+		{"1", 1},
+		{"v1", 1},
+		{"2", 2},
+		{"V2", 2},
+	}
+
+	for _, x := range tests {
+		f, err := parseFormatVersion(x.input)
+		if err != nil {
+			t.Errorf("Error on %v - %v", x.input, err)
+			continue
+		}
+		if f.Version != x.exp {
+			t.Errorf("Expected %v for %v, got %v", x.exp, x.input, f.Version)
+		}
+	}
+
+	for _, bad := range []string{"", "v", "v99", "two"} {
+		if f, err := parseFormatVersion(bad); err == nil {
+			t.Errorf("Expected error on %q, got %v", bad, f)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		version int
+		input   string
+		exp     string
+	}{
+		{1, "2012-08-28T21:24:35.370000000Z", "2012-08-28T21:24:35.37Z"},
+		{1, "2012-08-28T21:24:35Z", "2012-08-28T21:24:35Z"},
+		{2, "2012-08-28T21:24:35.37Z", "2012-08-28T21:24:35.370000000Z"},
+		{2, "2012-08-28T21:24:35Z", "2012-08-28T21:24:35.000000000Z"},
+		{2, "not a time", "not a time"},
+	}
+
+	for _, x := range tests {
+		got := storageFormats[x.version].normalizeKey(x.input)
+		if got != x.exp {
+			t.Errorf("Expected %v for v%d %v, got %v",
+				x.exp, x.version, x.input, got)
+		}
+	}
+}
+
+func TestFixedKeysSortInTimeOrder(t *testing.T) {
+	ordered := []string{
+		"2012-08-28T21:24:35Z",
+		"2012-08-28T21:24:35.3Z",
+		"2012-08-28T21:24:35.37465188Z",
+		"2012-08-28T21:24:36Z",
+	}
+
+	f := storageFormats[2]
+	keys := []string{}
+	for _, k := range ordered {
+		keys = append(keys, f.normalizeKey(k))
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Fatalf("Expected v2 keys to sort in time order: %v", keys)
+	}
+}
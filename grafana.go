@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-jsonpointer"
+	"github.com/dustin/gojson"
+)
+
+// Each database can serve as a Grafana SimpleJSON datasource at
+// /db/_grafana.  Targets are written reducer(ptr), as in
+// max(/cpu/user), or as a bare pointer for its avg.  Panels group by
+// the interval Grafana picks for them.  Annotation queries are a
+// pointer: every document in range with something there becomes an
+// annotation, with that as its text.  In an events database, they're
+// a search instead, of words the text must contain and #tags.
+
+const grafanaDefaultReducer = "avg"
+
+// The most annotations returned for one request.
+const grafanaMaxAnnotations = 1000
+
+var grafanaTargetPattern = regexp.MustCompile(`^([^()]+)\((.+)\)$`)
+
+type grafanaRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+	Hide   bool   `json:"hide"`
+}
+
+type grafanaQuery struct {
+	Range      grafanaRange    `json:"range"`
+	Interval   string          `json:"interval"`
+	IntervalMs int             `json:"intervalMs"`
+	Targets    []grafanaTarget `json:"targets"`
+}
+
+type grafanaAnnotationQuery struct {
+	Range      grafanaRange    `json:"range"`
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+// parseGrafanaTarget splits a target into its pointer and reducer.
+func parseGrafanaTarget(target string) (string, string) {
+	target = strings.TrimSpace(target)
+	if m := grafanaTargetPattern.FindStringSubmatch(target); m != nil {
+		return m[2], m[1]
+	}
+	return target, grafanaDefaultReducer
+}
+
+// grafanaForm translates a Grafana query into query parameters, one
+// reduction per visible target.  It returns the targets in the
+// order of their reductions.
+func grafanaForm(gq grafanaQuery) (url.Values, []grafanaTarget) {
+	form := url.Values{
+		"from":  {gq.Range.From},
+		"to":    {gq.Range.To},
+		"group": {gq.Interval},
+	}
+	if gq.IntervalMs > 0 {
+		form.Set("group", strconv.Itoa(gq.IntervalMs))
+	}
+	targets := []grafanaTarget{}
+	for _, t := range gq.Targets {
+		if t.Hide || strings.TrimSpace(t.Target) == "" {
+			continue
+		}
+		ptr, red := parseGrafanaTarget(t.Target)
+		form.Add("ptr", ptr)
+		form.Add("reducer", red)
+		targets = append(targets, t)
+	}
+	return form, targets
+}
+
+// grafanaResponse lays results out as a series per target, or a
+// table for targets of type table.
+func grafanaResponse(targets []grafanaTarget,
+	results queryResults) []interface{} {
+
+	keys := make([]int64, 0, len(results))
+	for ts := range results {
+		keys = append(keys, ts)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	rv := []interface{}{}
+	for i, t := range targets {
+		points := [][]interface{}{}
+		for _, ts := range keys {
+			var v interface{}
+			if i < len(results[ts]) {
+				v = results[ts][i]
+			}
+			if t.Type == "table" {
+				points = append(points, []interface{}{ts, v})
+			} else {
+				points = append(points, []interface{}{v, ts})
+			}
+		}
+		if t.Type == "table" {
+			rv = append(rv, map[string]interface{}{
+				"type": "table",
+				"columns": []map[string]string{
+					{"text": "Time", "type": "time"},
+					{"text": t.Target, "type": "number"},
+				},
+				"rows": points,
+			})
+		} else {
+			rv = append(rv, map[string]interface{}{
+				"target":     t.Target,
+				"refId":      t.RefID,
+				"datapoints": points,
+			})
+		}
+	}
+	return rv
+}
+
+func grafanaTest(args []string, w http.ResponseWriter, req *http.Request) {
+	if _, err := os.Stat(dbPath(args[0])); err != nil &&
+		memDatabase(args[0]) == nil && len(federationMembers(args[0])) == 0 {
+		emitError(404, w, "not_found", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+// grafanaSearch lists the numeric fields the database is known to
+// have, those declared in its schema and those seen in its
+// documents, narrowed to the ones containing the search text.
+func grafanaSearch(args []string, w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Target string `json:"target"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		emitError(400, w, "Bad search", err.Error())
+		return
+	}
+
+	seen := dbNumericFields(args[0])
+	if seen == nil {
+		seen = map[string]bool{}
+	}
+	if *trackSchema && memDatabase(args[0]) == nil {
+		for _, ptr := range dbSchema(args[0]).fieldsOfType("number") {
+			seen[ptr] = true
+		}
+	}
+	rv := []string{}
+	for ptr := range seen {
+		if strings.Contains(ptr, body.Target) {
+			rv = append(rv, ptr)
+		}
+	}
+	sort.Strings(rv)
+	mustEncode(200, w, rv)
+}
+
+func grafanaQueryHandler(args []string, w http.ResponseWriter, req *http.Request) {
+	gq := grafanaQuery{}
+	if err := json.NewDecoder(req.Body).Decode(&gq); err != nil {
+		emitError(400, w, "Bad query", err.Error())
+		return
+	}
+	form, targets := grafanaForm(gq)
+	if len(targets) == 0 {
+		mustEncode(200, w, []interface{}{})
+		return
+	}
+	p, err := parseQueryParams(form)
+	if err != nil {
+		emitParamError(w, err)
+		return
+	}
+	serverStatsCollector.add(statQuery, 1)
+	if err := addStoredExclusions(args[0], &p, req); err != nil {
+		emitError(500, w, "Error loading exclusions", err.Error())
+		return
+	}
+
+	results, err := queryResultsFor(args[0], p)
+	if err != nil {
+		if pe, ok := err.(*paramError); ok {
+			emitParamError(w, pe)
+		} else {
+			emitError(500, w, "Error running query", err.Error())
+		}
+		return
+	}
+	mustEncode(200, w, grafanaResponse(targets, results))
+}
+
+func grafanaAnnotations(args []string, w http.ResponseWriter, req *http.Request) {
+	aq := grafanaAnnotationQuery{}
+	if err := json.NewDecoder(req.Body).Decode(&aq); err != nil {
+		emitError(400, w, "Bad annotation query", err.Error())
+		return
+	}
+	spec := struct {
+		Query string `json:"query"`
+	}{}
+	if len(aq.Annotation) == 0 {
+		aq.Annotation = json.RawMessage("null")
+	}
+	if err := json.Unmarshal(aq.Annotation, &spec); err != nil {
+		emitError(400, w, "Bad annotation", err.Error())
+		return
+	}
+	if isEventDB(args[0]) {
+		grafanaEvents(args[0], aq, spec.Query, w)
+		return
+	}
+
+	ptr := strings.TrimSpace(spec.Query)
+	if !strings.HasPrefix(ptr, "/") {
+		emitError(400, w, "Bad annotation",
+			fmt.Sprintf("query should be a JSON pointer, got %q", spec.Query))
+		return
+	}
+
+	from, err := cleanupRangeParam(args[0], aq.Range.From, "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(args[0], aq.Range.To, "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+
+	rv := []map[string]interface{}{}
+	err = dbwalk(args[0], from, to, func(k string, v []byte) error {
+		if len(rv) >= grafanaMaxAnnotations {
+			return errCanceled
+		}
+		found, err := jsonpointer.Find(v, ptr)
+		if err != nil || found == nil || string(found) == "null" {
+			return nil
+		}
+		t, err := parseCanonicalTime(k)
+		if err != nil {
+			return nil
+		}
+		text := string(found)
+		var s string
+		if json.Unmarshal(found, &s) == nil {
+			text = s
+		}
+		rv = append(rv, map[string]interface{}{
+			"annotation": aq.Annotation,
+			"time":       t.UnixNano() / 1e6,
+			"title":      ptr,
+			"text":       text,
+		})
+		return nil
+	})
+	if err != nil && err != errCanceled {
+		emitError(500, w, "Error reading documents", err.Error())
+		return
+	}
+	mustEncode(200, w, rv)
+}
+
+// grafanaEvents answers an annotation query from an events database.
+func grafanaEvents(dbname string, aq grafanaAnnotationQuery, query string,
+	w http.ResponseWriter) {
+
+	var from, to time.Time
+	var err error
+	if aq.Range.From != "" {
+		if from, err = parseTime(aq.Range.From); err != nil {
+			emitError(400, w, "Bad from value", err.Error())
+			return
+		}
+	}
+	if aq.Range.To != "" {
+		if to, err = parseTime(aq.Range.To); err != nil {
+			emitError(400, w, "Bad to value", err.Error())
+			return
+		}
+	}
+	words, tags := []string{}, []string{}
+	for _, f := range strings.Fields(query) {
+		if strings.HasPrefix(f, "#") && len(f) > 1 {
+			tags = append(tags, f[1:])
+		} else {
+			words = append(words, f)
+		}
+	}
+
+	events, err := findEvents(dbname, from, to, strings.Join(words, " "),
+		tags, grafanaMaxAnnotations)
+	if err != nil {
+		emitError(500, w, "Error reading events", err.Error())
+		return
+	}
+	rv := []map[string]interface{}{}
+	for _, e := range events {
+		a := map[string]interface{}{
+			"annotation": aq.Annotation,
+			"time":       e.Start.UnixNano() / 1e6,
+			"title":      e.Text,
+			"text":       e.Text,
+			"tags":       e.Tags,
+		}
+		if e.End.After(e.Start) {
+			a["isRegion"] = true
+			a["timeEnd"] = e.End.UnixNano() / 1e6
+		}
+		rv = append(rv, a)
+	}
+	mustEncode(200, w, rv)
+}
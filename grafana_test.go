@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
+)
+
+func TestGrafanaForm(t *testing.T) {
+	gq := grafanaQuery{
+		Range:      grafanaRange{"2016-10-31T06:33:44.866Z", "2016-10-31T12:33:44.866Z"},
+		Interval:   "30s",
+		IntervalMs: 30000,
+		Targets: []grafanaTarget{
+			{Target: "/temp", RefID: "A"},
+			{Target: "max(/cpu/user)", RefID: "B"},
+			{Target: "/hidden", Hide: true},
+			{Target: " "},
+		},
+	}
+	form, targets := grafanaForm(gq)
+	if len(targets) != 2 {
+		t.Fatalf("Expected two visible targets, got %v", targets)
+	}
+	if g := form.Get("group"); g != "30000" {
+		t.Errorf("Expected group 30000, got %v", g)
+	}
+	if !reflect.DeepEqual(form["ptr"], []string{"/temp", "/cpu/user"}) ||
+		!reflect.DeepEqual(form["reducer"], []string{"avg", "max"}) {
+		t.Errorf("Expected avg(/temp) and max(/cpu/user), got %v", form)
+	}
+	if _, err := parseQueryParams(form); err != nil {
+		t.Errorf("Expected the form to parse, got %v", err)
+	}
+
+	results := queryResults{2000: {1.5, nil}, 1000: {1.0, 2.0}}
+	targets[1].Type = "table"
+	got, err := json.Marshal(grafanaResponse(targets, results))
+	if err != nil {
+		t.Fatalf("Error encoding response: %v", err)
+	}
+	exp := `[{"datapoints":[[1,1000],[1.5,2000]],"refId":"A","target":"/temp"},` +
+		`{"columns":[{"text":"Time","type":"time"},{"text":"max(/cpu/user)","type":"number"}],` +
+		`"rows":[[1000,2],[2000,null]],"type":"table"}]`
+	if string(got) != exp {
+		t.Errorf("Expected\n%s\ngot\n%s", exp, got)
+	}
+}
+
+func TestGrafanaAnnotations(t *testing.T) {
+	createMemDatabase("grafana", memOptions{})
+	defer dropMemDatabase("grafana")
+	defer dbRemoveConn("grafana")
+	b := memDatabase("grafana").Bulk()
+	for k, v := range map[string]string{
+		"2012-08-10T00:00:00Z": `{"event":"deploy"}`,
+		"2012-08-11T00:00:00Z": `{"temp":20}`,
+		"2012-08-12T00:00:00Z": `{"event":{"v":2}}`,
+	} {
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, []byte(v)))
+	}
+	b.Commit()
+
+	body := `{"range":{"from":"2012-08-01T00:00:00Z","to":"2012-09-01T00:00:00Z"},` +
+		`"annotation":{"name":"deploys","query":"/event"}}`
+	req, _ := http.NewRequest("POST", "/grafana/_grafana/annotations",
+		strings.NewReader(body))
+	w := httptest.NewRecorder()
+	grafanaAnnotations([]string{"grafana"}, w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %v: %s", w.Code, w.Body)
+	}
+	got := []struct {
+		Time int64  `json:"time"`
+		Text string `json:"text"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	if len(got) != 2 || got[0].Time != 1344556800000 ||
+		got[0].Text != "deploy" || got[1].Text != `{"v":2}` {
+		t.Errorf("Expected two events, got %s", w.Body)
+	}
+
+	req, _ = http.NewRequest("POST", "/grafana/_grafana/annotations",
+		strings.NewReader(`{"annotation":{"query":"event"}}`))
+	w = httptest.NewRecorder()
+	grafanaAnnotations([]string{"grafana"}, w, req)
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for a query that isn't a pointer, got %v", w.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/dustin/go-couchstore"
+)
+
+// With groupby=/pointer, each time group is broken down further by
+// the value found at that pointer in each document, e.g.
+//
+//	{"1346013960000": {"web1": [0.5], "web2": [0.7]}}
+//
+// Documents without a scalar value there are left out.  Grouped
+// results only come from plain databases; merging them across
+// federation members or shards isn't supported.
+
+var errGroupByResults = &paramError{"Bad groupby value",
+	"groupby results can't be merged or stored"}
+
+// reduction is a set of running reducers, one per pointer.
+type reduction struct {
+	chans   []chan ptrval
+	results []chan interface{}
+}
+
+func startReducers(pi *processIn) *reduction {
+	r := &reduction{
+		chans:   make([]chan ptrval, 0, len(pi.reds)),
+		results: make([]chan interface{}, 0, len(pi.reds)),
+	}
+	for _, name := range pi.reds {
+		ch, res := make(chan ptrval), make(chan interface{})
+		r.chans = append(r.chans, ch)
+		r.results = append(r.results, res)
+
+		go func(fr string) {
+			res <- lookupReducer(fr, pi.funcs, pi.before)(ch)
+		}(name)
+	}
+	return r
+}
+
+// values waits for each reducer's result.  The input channels must be
+// closed for them to finish.
+func (r *reduction) values() []interface{} {
+	rv := make([]interface{}, len(r.results))
+	for i := range r.results {
+		rv[i] = <-r.results[i]
+		if f, fok := rv[i].(float64); fok &&
+			(math.IsNaN(f) || math.IsInf(f, 0)) {
+			rv[i] = nil
+		}
+	}
+	return rv
+}
+
+// groupValue renders a document's groupby value as a result key.
+func groupValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case float64, bool:
+		return fmt.Sprintf("%v", x), true
+	}
+	return "", false
+}
+
+// processGroupedDocs reduces a chunk's documents by group, charging
+// the documents and each group's reducers to the query's budget.
+func processGroupedDocs(pi *processIn, db dbStore, plan *extractPlan,
+	numeric map[string]bool,
+	charge func(int64) bool) (map[string][]interface{}, error) {
+
+	groups := map[string]*reduction{}
+	over := false
+	dodoc := func(di *couchstore.DocInfo, included bool) {
+		doc, err := db.GetFromDocInfo(di)
+		if err != nil {
+			return
+		}
+		if !charge(int64(len(doc.Value()))) {
+			over = true
+			return
+		}
+		fetched := plan.fetch(doc.Value())
+		if !matchesFilters(fetched, pi.filters, pi.filtervals) {
+			return
+		}
+		g, ok := groupValue(fetched[pi.groupby])
+		if !ok {
+			return
+		}
+		r := groups[g]
+		if r == nil {
+			// The next group's first document is only there
+			// for rates; it doesn't start a group of its own.
+			if !included {
+				return
+			}
+			if !charge(int64(len(pi.reds))*reducerCost + int64(len(g))) {
+				over = true
+				return
+			}
+			r = startReducers(pi)
+			groups[g] = r
+		}
+		plan.reduce(di, r.chans, fetched, numeric, included)
+	}
+
+	cut := false
+	for _, di := range pi.infos {
+		if isClosed(pi.quit) {
+			cut = true
+		}
+		if cut || over {
+			break
+		}
+		dodoc(di, true)
+	}
+	if pi.nextInfo != nil && !cut && !over {
+		dodoc(pi.nextInfo, false)
+	}
+
+	for _, r := range groups {
+		closeAll(r.chans)
+	}
+	rv := make(map[string][]interface{}, len(groups))
+	for g, r := range groups {
+		rv[g] = r.values()
+	}
+	if over {
+		return nil, errQueryMemory
+	}
+	if cut {
+		return nil, pi.quitErr()
+	}
+	return rv, nil
+}
@@ -1,31 +1,45 @@
 package main
 
 import (
-	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-couchstore"
 	"github.com/dustin/go-humanize"
+	"github.com/dustin/go-jsonpointer"
 	"github.com/dustin/gojson"
 )
 
 func serverInfo(parts []string, w http.ResponseWriter, req *http.Request) {
-	sinfo := map[string]string{
+	formats := []storageFormat{}
+	for v := 1; v <= len(storageFormats); v++ {
+		formats = append(formats, storageFormats[v])
+	}
+	sinfo := map[string]interface{}{
 		"seriesly": "Why so series?", "version": "seriesly 0.0",
+		"formats": formats,
+		"ordering": map[string]string{
+			"writes": "committed in the order they're accepted, per database" +
+				" (per shard for sharded databases)",
+			"seq": "each accepted write's position in that order, returned" +
+				" in X-Seriesly-Seq or the seq field of bulk responses",
+			"ordered": "with ordered=true, a write is acknowledged only once" +
+				" committed, so later writes can't be committed before it",
+		},
 	}
 	mustEncode(200, w, sinfo)
 }
 
 func listDatabases(parts []string, w http.ResponseWriter, req *http.Request) {
-	mustEncode(200, w, dblist(*dbRoot))
+	mustEncode(200, w, visibleDBs(req))
 }
 
 func notImplemented(parts []string, w http.ResponseWriter, req *http.Request) {
@@ -33,8 +47,54 @@ func notImplemented(parts []string, w http.ResponseWriter, req *http.Request) {
 }
 
 func createDB(parts []string, w http.ResponseWriter, req *http.Request) {
+	if err := tenantCanCreate(parts[0]); err != nil {
+		emitError(403, w, "Forbidden", err.Error())
+		return
+	}
+	dbType := req.FormValue("type")
+	switch dbType {
+	case "memory":
+		createMemoryDB(parts, w, req)
+		return
+	case "", dbTypeEvents, dbTypeBlobs:
+	default:
+		emitError(400, w, "Bad type value", dbType)
+		return
+	}
+
+	fv := req.FormValue("format")
+	if fv == "" {
+		fv = strconv.Itoa(*defaultFormat)
+	}
+	format, err := parseFormatVersion(fv)
+	if err != nil {
+		emitError(400, w, "Bad format value", err.Error())
+		return
+	}
+
+	shard := req.FormValue("shard")
+	if err := validShardPeriod(shard); err != nil {
+		emitError(400, w, "Bad shard value", err.Error())
+		return
+	}
+
+	conflicts := req.FormValue("conflicts")
+	if err := validConflictPolicy(conflicts); err != nil {
+		emitError(400, w, "Bad conflicts value", err.Error())
+		return
+	}
+
 	path := dbPath(parts[0])
-	err := dbcreate(path)
+	_, existsErr := os.Stat(path)
+	err = dbcreate(path)
+	if err == nil && os.IsNotExist(existsErr) {
+		err = storeMeta(parts[0], dbMeta{Format: format.Version,
+			Shard: shard, Conflicts: conflicts, Type: dbType})
+		if err == nil {
+			notify(hookCreated, parts[0], map[string]interface{}{
+				"format": format.Version, "shard": shard, "type": dbType})
+		}
+	}
 	if err == nil {
 		w.WriteHeader(201)
 	} else {
@@ -42,6 +102,21 @@ func createDB(parts []string, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func createMemoryDB(parts []string, w http.ResponseWriter, req *http.Request) {
+	if _, err := os.Stat(dbPath(parts[0])); err == nil {
+		emitError(409, w, "Conflict", "a disk database by that name exists")
+		return
+	}
+	opts, err := parseMemOptions(parts[0], req.Form)
+	if err != nil {
+		emitError(400, w, "Bad memory database options", err.Error())
+		return
+	}
+	createMemDatabase(parts[0], opts)
+	notify(hookCreated, parts[0], map[string]interface{}{"type": "memory"})
+	w.WriteHeader(201)
+}
+
 func checkDB(args []string, w http.ResponseWriter, req *http.Request) {
 	dbname := args[0]
 	if db, err := dbopen(dbname); err == nil {
@@ -52,53 +127,235 @@ func checkDB(args []string, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// newDocument stores a document at the time given by ts, or found at
+// ts_ptr in the document, or now.  ts_format names the unit of epoch
+// times.  With monotonic=true, "now" is unique and later than any
+// time the database already has, and is returned in X-Seriesly-Key.
 func newDocument(args []string, w http.ResponseWriter, req *http.Request) {
-	var k, fk string
+	var fk, format, ptr string
 	form, err := url.ParseQuery(req.URL.RawQuery)
 	if err == nil {
 		fk = form.Get("ts")
+		format = form.Get("ts_format")
+		ptr = form.Get("ts_ptr")
 	}
 
-	if fk == "" {
-		k = time.Now().UTC().Format(time.RFC3339Nano)
-	} else {
-		t, err := parseTime(fk)
+	body, ok := readDocument(args[0], fk, w, req)
+	if !ok {
+		return
+	}
+	if fk == "" && ptr != "" {
+		v, err := jsonpointer.Find(body, ptr)
+		if err != nil || v == nil {
+			emitError(400, w, "Bad time format",
+				fmt.Sprintf("no timestamp at %v", ptr))
+			return
+		}
+		// Strings are unquoted; numbers are kept as written.
+		fk = string(v)
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			fk = s
+		}
+	}
+
+	if fk == "" && req.FormValue("monotonic") == "true" {
+		storeDocumentNow(args[0], body, w, req)
+		return
+	}
+
+	k := time.Now().UTC().Format(time.RFC3339Nano)
+	if fk != "" {
+		t, err := parseTimeFormat(fk, format)
 		if err != nil {
 			emitError(400, w, "Bad time format", err.Error())
 			return
 		}
 		k = t.UTC().Format(time.RFC3339Nano)
 	}
-	putDocument([]string{args[0], k}, w, req)
+	storeDocument(args[0], k, body, w, req)
 }
 
-func putDocument(args []string, w http.ResponseWriter, req *http.Request) {
-	dbname := args[0]
-	k := args[1]
+// readDocument reads and validates a JSON request body, or wraps a
+// blob for a blobs database, reporting any problem to the client.
+func readDocument(dbname, k string,
+	w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+
+	if isBlobDB(dbname) {
+		return readBlob(w, req)
+	}
 	defer req.Body.Close()
-	body, err := ioutil.ReadAll(req.Body)
+	r, err := requestBody(req)
 	if err != nil {
-		emitError(400, w, "Bad Request",
-			fmt.Sprintf("Error reading body: %v", err))
-		return
+		emitBodyError(w, err)
+		return nil, false
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		emitBodyError(w, err)
+		return nil, false
+	}
+	if body, err = jsonBody(req, body); err != nil {
+		emitError(400, w, "Error parsing MessagePack data", err.Error())
+		return nil, false
 	}
 
 	err = json.Validate(body)
 	if err != nil {
-		emitError(400, w, "Error parsing JSON data", err.Error())
+		emitError(400, w, "Error parsing JSON data",
+			malformedReason(err, quarantine(dbname, k, "http", body, err)))
+		return nil, false
+	}
+	return body, true
+}
+
+func putDocument(args []string, w http.ResponseWriter, req *http.Request) {
+	body, ok := readDocument(args[0], args[1], w, req)
+	if !ok {
+		return
+	}
+	seq, err := dbmodify(args[0], args[1], body, opReplace,
+		requestProvenance(args[0], req))
+	if err != nil {
+		emitStoreError(w, err)
 		return
 	}
+	serverStatsCollector.add(statIngest, 1)
+	sessionWrote(sessionToken(req), args[0])
+	w.Header().Set("X-Seriesly-Seq", strconv.FormatUint(seq, 10))
+	w.WriteHeader(201)
+}
 
-	err = dbstore(dbname, k, body)
+func storeDocument(dbname, k string, body []byte,
+	w http.ResponseWriter, req *http.Request) {
 
-	if err == nil {
-		w.WriteHeader(201)
-	} else {
+	seq, err := dbstoreOp(dbname, k, body, opStoreItem,
+		req.FormValue("ordered") == "true", requestProvenance(dbname, req))
+	if err != nil {
+		emitStoreError(w, err)
+		return
+	}
+	serverStatsCollector.add(statIngest, 1)
+	sessionWrote(sessionToken(req), dbname)
+	w.Header().Set("X-Seriesly-Seq", strconv.FormatUint(seq, 10))
+	w.WriteHeader(201)
+}
+
+func storeDocumentNow(dbname string, body []byte,
+	w http.ResponseWriter, req *http.Request) {
+
+	k, seq, err := dbstoreNow(dbname, body,
+		req.FormValue("ordered") == "true", requestProvenance(dbname, req))
+	if err != nil {
+		emitStoreError(w, err)
+		return
+	}
+	serverStatsCollector.add(statIngest, 1)
+	sessionWrote(sessionToken(req), dbname)
+	w.Header().Set("X-Seriesly-Key", k)
+	w.Header().Set("X-Seriesly-Seq", strconv.FormatUint(seq, 10))
+	w.WriteHeader(201)
+}
+
+func emitStoreError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*fieldError); ok {
+		emitError(400, w, "Bad field type", err.Error())
+		return
+	}
+	if _, ok := err.(*eventError); ok {
+		emitError(400, w, "Bad event", err.Error())
+		return
+	}
+	switch err {
+	case errReadOnly:
+		emitError(403, w, "Forbidden", err.Error())
+	case errRateLimited:
+		w.Header().Set("Retry-After", strconv.Itoa(*admissionRetry))
+		emitError(429, w, "Too Many Requests", err.Error())
+	case errKeyConflict:
+		emitError(409, w, "Conflict", err.Error())
+	case errNotFound:
+		emitError(404, w, "not_found", err.Error())
+	case errQueueFull:
+		w.Header().Set("Retry-After", strconv.Itoa(*admissionRetry))
+		emitError(503, w, "Service Unavailable", err.Error())
+	case errQuotaExceeded, errDiskFull:
+		emitError(507, w, "Insufficient Storage", err.Error())
+	case errBatchSpansShards:
+		emitError(400, w, "Bad Request", err.Error())
+	default:
 		emitError(500, w, "Error storing data", err.Error())
 	}
 }
 
-func cleanupRangeParam(in, def string) (string, error) {
+// bulkStore stores an object mapping timestamps to documents.  With
+// atomic=true, the documents are committed together or not at all.
+func bulkStore(args []string, w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	r, err := requestBody(req)
+	if err != nil {
+		emitBodyError(w, err)
+		return
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		emitBodyError(w, err)
+		return
+	}
+	if body, err = jsonBody(req, body); err != nil {
+		emitError(400, w, "Error parsing MessagePack data", err.Error())
+		return
+	}
+
+	docs := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &docs); err != nil {
+		emitError(400, w, "Error parsing JSON data",
+			malformedReason(err, quarantine(args[0], "", "bulk", body, err)))
+		return
+	}
+
+	items := make([]dbqitem, 0, len(docs))
+	format := req.FormValue("ts_format")
+	for ts, doc := range docs {
+		t, err := parseTimeFormat(ts, format)
+		if err != nil {
+			emitError(400, w, "Bad time format", err.Error())
+			return
+		}
+		items = append(items, dbqitem{dbname: args[0],
+			k: t.UTC().Format(time.RFC3339Nano), data: doc,
+			op: opStoreItem})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].k < items[j].k })
+
+	var seq uint64
+	if req.FormValue("atomic") == "true" {
+		seq, err = dbstoreBatch(args[0], items)
+	} else {
+		// Documents are queued in order, so waiting for the last
+		// one to be committed covers them all.
+		ordered := req.FormValue("ordered") == "true"
+		for i, item := range items {
+			seq, err = dbstoreSeq(args[0], item.k, item.data,
+				ordered && i == len(items)-1)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		emitStoreError(w, err)
+		return
+	}
+	serverStatsCollector.add(statIngest, int64(len(items)))
+	sessionWrote(sessionToken(req), args[0])
+	mustEncode(201, w, map[string]interface{}{"ok": true,
+		"count": len(items), "seq": seq})
+}
+
+func cleanupRangeParam(dbname, in, def string) (string, error) {
 	if in == "" {
 		return def, nil
 	}
@@ -106,194 +363,376 @@ func cleanupRangeParam(in, def string) (string, error) {
 	if err != nil {
 		return in, err
 	}
-	return t.UTC().Format(time.RFC3339Nano), nil
+	return dbFormat(dbname).formatKey(t), nil
 }
 
-func canGzip(req *http.Request) bool {
-	acceptable := req.Header.Get("accept-encoding")
-	return strings.Contains(acceptable, "gzip")
+// addStoredExclusions applies a database's exclusion windows to a
+// query unless it asked not to.
+func addStoredExclusions(dbname string, p *queryParams, req *http.Request) error {
+	if req.FormValue("stored_exclusions") == "false" {
+		return nil
+	}
+	stored, err := dbExclusions(dbname)
+	if err != nil {
+		return err
+	}
+	p.exclude = append(p.exclude, stored...)
+	return nil
 }
 
-func query(args []string, w http.ResponseWriter, req *http.Request) {
-	// Parse the params
-
+// queryInto runs a query and stores each group as a document in the
+// target database.
+func queryInto(args []string, w http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 
-	group, err := strconv.Atoi(req.FormValue("group"))
+	target := scopedDB(req, req.FormValue("target"))
+	if !localDBName.MatchString(target) || target == args[0] {
+		emitError(400, w, "Bad target value",
+			fmt.Sprintf("invalid target database: %q", req.FormValue("target")))
+		return
+	}
+	if dbReadOnly(target) {
+		emitError(403, w, "Forbidden", errReadOnly.Error())
+		return
+	}
+
+	p, err := parseQueryParams(req.Form)
 	if err != nil {
-		emitError(400, w, "Bad group value", err.Error())
+		emitParamError(w, err)
+		return
+	}
+	if err := validOutputFormat(req.FormValue("format")); err != nil {
+		emitError(400, w, "Bad format value", err.Error())
+		return
+	}
+	serverStatsCollector.add(statQuery, 1)
+	if err := addStoredExclusions(args[0], &p, req); err != nil {
+		emitError(500, w, "Error loading exclusions", err.Error())
 		return
 	}
 
-	from, err := cleanupRangeParam(req.FormValue("from"), "")
+	results, err := queryResultsFor(args[0], p)
 	if err != nil {
-		emitError(400, w, "Bad from value", err.Error())
+		if pe, ok := err.(*paramError); ok {
+			emitParamError(w, pe)
+		} else {
+			emitError(500, w, "Error running query", err.Error())
+		}
+		return
+	}
+	if err := materialize(target, p, results); err != nil {
+		emitStoreError(w, err)
+		return
+	}
+	serverStatsCollector.add(statIngest, int64(len(results)))
+	mustEncode(200, w, map[string]interface{}{
+		"ok":     true,
+		"target": target,
+		"count":  len(results),
+	})
+}
+
+// postQuery runs a query described by a JSON body.
+func postQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	r, err := requestBody(req)
+	if err != nil {
+		emitBodyError(w, err)
+		return
+	}
+	defer r.Close()
+
+	body := queryBody{}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		if err == errBodyTooLarge {
+			emitBodyError(w, err)
+			return
+		}
+		emitError(400, w, "Error parsing query", err.Error())
 		return
 	}
-	to, err := cleanupRangeParam(req.FormValue("to"), "")
+	req.Form = body.values()
+	req.PostForm = url.Values{}
+	query(args, w, req)
+}
+
+// A query that times out or fails once results have started going to
+// the client leaves out the groups it didn't finish, and reports why
+// in this trailer.
+const queryErrorTrailer = "X-Seriesly-Error"
+
+func query(args []string, w http.ResponseWriter, req *http.Request) {
+	// Parse the params
+
+	req.ParseForm()
+
+	p, err := parseQueryParams(req.Form)
 	if err != nil {
-		emitError(400, w, "Bad to value", err.Error())
+		emitParamError(w, err)
+		return
+	}
+	if err := validOutputFormat(req.FormValue("format")); err != nil {
+		emitError(400, w, "Bad format value", err.Error())
+		return
+	}
+	if err := validOutputLayout(req); err != nil {
+		emitError(400, w, "Bad layout value", err.Error())
+		return
+	}
+	serverStatsCollector.add(statQuery, 1)
+
+	if err := addStoredExclusions(args[0], &p, req); err != nil {
+		emitError(500, w, "Error loading exclusions", err.Error())
 		return
 	}
 
-	ptrs := req.Form["ptr"]
-	reds := make([]string, 0, len(ptrs))
-	for _, r := range req.Form["reducer"] {
-		_, ok := reducers[r]
-		if !ok {
-			emitError(400, w, "No such reducer", r)
+	if p.consistency == consistencySession {
+		if err := sessionSync(sessionToken(req), args[0]); err != nil {
+			emitError(500, w, "Error committing session writes", err.Error())
 			return
 		}
-		reds = append(reds, r)
 	}
 
-	if len(ptrs) < 1 {
-		emitError(400, w, "Pointer required",
-			"At least one ptr argument is required")
+	if e := req.FormValue("explain"); e == "true" || e == "analyze" {
+		explainQuery(args[0], p, e == "analyze", w)
 		return
 	}
 
-	if len(ptrs) != len(reds) {
-		emitError(400, w, "Parameter mismatch",
-			"Must supply the same number of pointers and reducers")
+	if notModified(w, req, queryETag(args[0], p, req)) {
 		return
 	}
 
-	filters := req.Form["f"]
-	filtervals := req.Form["fv"]
-	if len(filters) != len(filtervals) {
-		emitError(400, w, "Parameter mismatch",
-			"Must supply the same number of filters and filter values")
+	if p.groupby != "" && (len(federationMembers(args[0])) > 0 ||
+		dbShardPeriod(args[0]) != "") {
+		emitError(400, w, "Bad groupby value",
+			"groupby isn't supported for federated or sharded databases")
+		return
+	}
+
+	if members := federationMembers(args[0]); len(members) > 0 {
+		start := time.Now()
+		federatedQuery(members, p, w, req)
+		recordSlowQuery(slowQuery{DB: args[0], Plan: "federated",
+			Params: req.Form}, time.Since(start))
+		return
+	}
+	if dbShardPeriod(args[0]) != "" {
+		start := time.Now()
+		shardedQuery(args[0], p, w, req)
+		recordSlowQuery(slowQuery{DB: args[0], Plan: "sharded",
+			Params: req.Form}, time.Since(start))
 		return
 	}
 
-	q := executeQuery(args[0], from, to, group, ptrs, reds, filters, filtervals)
+	q, err := p.start(args[0])
+	if err != nil {
+		emitParamError(w, err)
+		return
+	}
+	timeout := p.timeout
 	defer close(q.out)
 	defer close(q.cherr)
 
-	output := io.Writer(w)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	gone := closeNotify(w)
 
-	if canGzip(req) {
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		output = gz
-	} else {
-		output = w
-	}
+	output, closer := responseOutput(w, req)
+	defer closer()
+
+	results := newResultWriter(w, req, output)
 
 	going := true
 	finished := int32(0)
 	started := false
 	walkComplete := false
+	var firstResult, walkDone time.Time
+	var queryErr error
 	for going {
 		select {
 		case po := <-q.out:
+			if po.err == errQueryMemory {
+				if !started {
+					started = true
+					results = discardWriter{}
+					w.Header().Set("Content-Type", "text/plain")
+					w.WriteHeader(507)
+					fmt.Fprintf(output, "%v", errQueryMemory)
+				}
+				q.cancel()
+			}
 			if !started {
 				started = true
+				w.Header().Set("Trailer", queryErrorTrailer)
 				w.WriteHeader(200)
-				output.Write([]byte{'{'})
 			}
-			if finished != 0 {
-				output.Write([]byte{',', '\n'})
+			if finished == 0 {
+				firstResult = time.Now()
 			}
 			finished++
-
-			_, err := fmt.Fprintf(output, `"%d": `, po.key/1e6)
-			if err == nil {
-				var d []byte
-				d, err = json.Marshal(po.value)
-				if err == nil {
-					_, err = output.Write(d)
+			if po.err != nil {
+				// Whatever a chunk that failed or was cut
+				// short got is left out rather than passed
+				// off as its group's result.
+				if queryErr == nil {
+					queryErr = po.err
 				}
+				going = (q.started-finished > 0) || !walkComplete
+				continue
 			}
-			if err != nil {
-				log.Printf("Error sending item: %v", err)
-				output = ioutil.Discard
-				q.before = time.Time{}
+
+			if err := results.write(po); err != nil {
+				queryLog.Warn("error sending results", "db", args[0],
+					"err", err)
+				results = discardWriter{}
+				q.cancel()
 			}
 			going = (q.started-finished > 0) || !walkComplete
 		case err = <-q.cherr:
+			walkDone = time.Now()
 			if err != nil {
+				if queryErr == nil {
+					queryErr = err
+				}
+				queryLog.Error("walk failed", "db", args[0], "err", err)
 				if !started {
-					w.WriteHeader(500)
+					started = true
+					results = discardWriter{}
+					status := 500
+					switch err {
+					case errCanceled, errTimeout:
+						status = 504
+					case errQueryMemory:
+						status = 507
+					}
 					w.Header().Set("Content-Type", "text/plain")
+					w.WriteHeader(status)
 					fmt.Fprintf(output, "Error beginning traversal: %v", err)
 				}
-				log.Printf("Walk completed with err: %v", err)
-				going = false
 			}
+			// Wait for anything still in flight so workers never
+			// send on a closed channel.
+			going = q.started-finished > 0
 			walkComplete = true
+		case <-deadline.C:
+			queryLog.Warn("query timed out, canceling", "db", args[0],
+				"timeout", timeout)
+			if queryErr == nil {
+				queryErr = errTimeout
+			}
+			q.cancel()
+		case <-gone:
+			queryLog.Info("client went away, canceling query",
+				"db", args[0])
+			gone = nil
+			results = discardWriter{}
+			q.cancel()
 		}
 	}
 
 	if started {
-		output.Write([]byte{'}'})
+		results.finish()
+		if queryErr != nil {
+			// The results sent are incomplete.
+			w.Header().Set(queryErrorTrailer, queryErr.Error())
+		}
 	}
 
 	duration := time.Since(q.start)
-	if duration > *minQueryLogDuration {
-		log.Printf("Completed query processing in %v, %v keys, %v chunks",
-			duration, humanize.Comma(int64(q.totalKeys)),
-			humanize.Comma(int64(q.started)))
+	if duration > minQueryLogDuration.get() {
+		queryLog.Info("completed query", "db", args[0], "took", duration,
+			"keys", humanize.Comma(int64(q.totalKeys)),
+			"chunks", humanize.Comma(int64(q.started)))
+	}
+
+	s := slowQuery{DB: args[0], Plan: "scan", Params: req.Form,
+		Keys: q.totalKeys, Chunks: q.started, Phases: map[string]float64{}}
+	if queryErr != nil {
+		s.Error = queryErr.Error()
+	}
+	if !q.walking.IsZero() {
+		s.Phases["queued"] = millis(q.walking.Sub(q.start))
+		if !walkDone.IsZero() {
+			s.Phases["walk"] = millis(walkDone.Sub(q.walking))
+			s.Phases["drain"] = millis(time.Since(walkDone))
+		}
+	}
+	if !firstResult.IsZero() {
+		s.Phases["first_result"] = millis(firstResult.Sub(q.start))
 	}
+	recordSlowQuery(s, duration)
 }
 
-func deleteBulk(args []string, w http.ResponseWriter, req *http.Request) {
-	// Parse the params
+// queryTimeoutParam returns the time a query may run, which is the
+// requested timeout if given, but never more than maxQueryTime.
+func queryTimeoutParam(s string) (time.Duration, error) {
+	timeout := queryTimeout.get()
+	if defaultQueryTime.get() > 0 && defaultQueryTime.get() < timeout {
+		timeout = defaultQueryTime.get()
+	}
+	if s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		if d <= 0 {
+			return 0, fmt.Errorf("timeout must be positive")
+		}
+		if d < queryTimeout.get() {
+			timeout = d
+		} else {
+			timeout = queryTimeout.get()
+		}
+	}
+	return timeout, nil
+}
 
+// deleteRange deletes the documents in [from, to) through the
+// writer, then compacts what it deleted from with compact=true.
+func deleteRange(args []string, w http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 
-	compactAfter := strings.ToLower(req.FormValue("compact"))
-
-	from, err := cleanupRangeParam(req.FormValue("from"), "")
+	if req.FormValue("from") == "" && req.FormValue("to") == "" {
+		emitError(400, w, "Range required",
+			"from or to is required; delete the database to remove everything")
+		return
+	}
+	from, err := cleanupRangeParam(args[0], req.FormValue("from"), "")
 	if err != nil {
 		emitError(400, w, "Bad from value", err.Error())
 		return
 	}
-	to, err := cleanupRangeParam(req.FormValue("to"), "")
+	to, err := cleanupRangeParam(args[0], req.FormValue("to"), "")
 	if err != nil {
 		emitError(400, w, "Bad to value", err.Error())
 		return
 	}
+	if _, err := os.Stat(dbPath(args[0])); err != nil &&
+		memDatabase(args[0]) == nil {
+		emitError(404, w, "not_found", err.Error())
+		return
+	}
 
-	db, err := dbopen(args[0])
+	d, err := dbdeleteRange(args[0], from, to)
 	if err != nil {
-		emitError(400, w, "Unable to open Database", err.Error())
+		emitStoreError(w, err)
 		return
 	}
-
-	bulk := db.Bulk()
-	deleteCount := 0
-	commitThreshold := 10000
-
-	err = dbwalkKeys(args[0], from, to, func(k string) error {
-
-		bulk.Delete(couchstore.NewDocInfo(k, 0))
-		deleteCount++
-		if deleteCount >= commitThreshold {
-			bulk.Commit()
-			deleteCount = 0
+	if strings.ToLower(req.FormValue("compact")) == "true" {
+		for _, dbname := range d.touched {
+			if err := dbcompact(dbname); err != nil {
+				emitError(500, w, "Error compacting", err.Error())
+				return
+			}
 		}
-		return err
-	})
-
-	if deleteCount > 0 {
-		bulk.Commit()
-	}
-
-	bulk.Close()
-
-	if compactAfter == "true" {
-		err = dbcompact(args[0])
 	}
-
-	w.WriteHeader(201)
-
+	mustEncode(200, w, map[string]interface{}{"ok": true, "deleted": d.deleted})
 }
+
 func deleteDB(parts []string, w http.ResponseWriter, req *http.Request) {
-	err := dbdelete(parts[0])
+	err := dbtrash(parts[0], time.Now())
 	if err == nil {
+		notify(hookDeleted, parts[0], nil)
 		mustEncode(200, w, map[string]interface{}{"ok": true})
 	} else {
 		emitError(500, w, "Error deleting DB", err.Error())
@@ -309,50 +748,429 @@ func compact(parts []string, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func allDocs(args []string, w http.ResponseWriter, req *http.Request) {
-	// Parse the params
+func migrate(parts []string, w http.ResponseWriter, req *http.Request) {
+	to, err := parseFormatVersion(req.FormValue("to"))
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+	err = dbmigrate(parts[0], to)
+	if err == nil {
+		mustEncode(200, w, map[string]interface{}{"ok": true,
+			"format": to})
+	} else {
+		emitError(500, w, "Error migrating DB", err.Error())
+	}
+}
 
-	req.ParseForm()
+func getRollups(parts []string, w http.ResponseWriter, req *http.Request) {
+	m, err := loadMeta(parts[0])
+	if err != nil {
+		emitError(500, w, "Error loading metadata", err.Error())
+		return
+	}
+	if m.Rollups == nil {
+		emitError(404, w, "not_found", "no rollups configured")
+		return
+	}
+	mustEncode(200, w, m.Rollups)
+}
 
-	from, err := cleanupRangeParam(req.FormValue("from"), "")
+func putRollups(parts []string, w http.ResponseWriter, req *http.Request) {
+	spec := rollupSpec{}
+	err := json.NewDecoder(req.Body).Decode(&spec)
+	if err == nil {
+		err = spec.validate()
+	}
 	if err != nil {
-		emitError(400, w, "Bad from value", err.Error())
+		emitError(400, w, "Bad rollup spec", err.Error())
 		return
 	}
-	to, err := cleanupRangeParam(req.FormValue("to"), "")
+
+	for _, i := range spec.Intervals {
+		if err := dbcreate(dbPath(rollupDBName(parts[0], i))); err != nil {
+			emitError(500, w, "Error creating rollup DB", err.Error())
+			return
+		}
+	}
+	err = updateMeta(parts[0], func(m *dbMeta) { m.Rollups = &spec })
 	if err != nil {
-		emitError(400, w, "Bad to value", err.Error())
+		emitError(500, w, "Error storing rollups", err.Error())
 		return
 	}
+	// Have the writer pick up the new configuration when it reopens.
+	dbRemoveConn(parts[0])
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
 
-	limit, err := strconv.Atoi(req.FormValue("limit"))
+func getValueIndex(parts []string, w http.ResponseWriter, req *http.Request) {
+	m, err := loadMeta(parts[0])
 	if err != nil {
-		limit = 2000000000
+		emitError(500, w, "Error loading metadata", err.Error())
+		return
+	}
+	if m.ValueIndex == nil {
+		emitError(404, w, "not_found", "no value index configured")
+		return
 	}
+	mustEncode(200, w, m.ValueIndex)
+}
 
-	output := io.Writer(w)
+// putValueIndex configures the pointers to index, and builds the
+// index for them from the documents already stored.
+func putValueIndex(parts []string, w http.ResponseWriter, req *http.Request) {
+	spec := valueIndexSpec{}
+	err := json.NewDecoder(req.Body).Decode(&spec)
+	if err == nil {
+		err = spec.validate()
+	}
+	if err != nil {
+		emitError(400, w, "Bad value index spec", err.Error())
+		return
+	}
+	err = updateMeta(parts[0], func(m *dbMeta) { m.ValueIndex = &spec })
+	if err != nil {
+		emitError(500, w, "Error storing value index", err.Error())
+		return
+	}
+	rebuildValueIndex(parts, w, req)
+}
 
-	if canGzip(req) {
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		output = gz
+func rebuildValueIndex(parts []string, w http.ResponseWriter, req *http.Request) {
+	err := dbreindex(parts[0])
+	if err == nil {
+		mustEncode(200, w, map[string]interface{}{"ok": true})
 	} else {
-		output = w
+		emitError(500, w, "Error building value index", err.Error())
 	}
+}
+
+func getFieldIndex(parts []string, w http.ResponseWriter, req *http.Request) {
+	m, err := loadMeta(parts[0])
+	if err != nil {
+		emitError(500, w, "Error loading metadata", err.Error())
+		return
+	}
+	if m.Indexes == nil {
+		emitError(404, w, "not_found", "no indexed fields configured")
+		return
+	}
+	mustEncode(200, w, m.Indexes)
+}
+
+// putFieldIndex configures the fields to index, and builds the index
+// for them from the documents already stored.
+func putFieldIndex(parts []string, w http.ResponseWriter, req *http.Request) {
+	spec := fieldIndexSpec{}
+	err := json.NewDecoder(req.Body).Decode(&spec)
+	if err == nil {
+		err = spec.validate()
+	}
+	if err != nil {
+		emitError(400, w, "Bad index spec", err.Error())
+		return
+	}
+	err = updateMeta(parts[0], func(m *dbMeta) { m.Indexes = &spec })
+	if err != nil {
+		emitError(500, w, "Error storing indexes", err.Error())
+		return
+	}
+	rebuildFieldIndex(parts, w, req)
+}
+
+func rebuildFieldIndex(parts []string, w http.ResponseWriter, req *http.Request) {
+	err := dbindexFields(parts[0])
+	if err == nil {
+		mustEncode(200, w, map[string]interface{}{"ok": true})
+	} else {
+		emitError(500, w, "Error building index", err.Error())
+	}
+}
+
+func getQuota(parts []string, w http.ResponseWriter, req *http.Request) {
+	m, err := loadMeta(parts[0])
+	if err != nil {
+		emitError(500, w, "Error loading metadata", err.Error())
+		return
+	}
+	if m.Quota == nil {
+		emitError(404, w, "not_found", "no quota configured")
+		return
+	}
+	mustEncode(200, w, m.Quota)
+}
+
+func putQuota(parts []string, w http.ResponseWriter, req *http.Request) {
+	spec := quotaSpec{}
+	err := json.NewDecoder(req.Body).Decode(&spec)
+	if err == nil {
+		err = spec.validate()
+	}
+	if err != nil {
+		emitError(400, w, "Bad quota spec", err.Error())
+		return
+	}
+
+	db, err := dbopen(parts[0])
+	if err != nil {
+		emitError(404, w, "not_found", err.Error())
+		return
+	}
+	defer closeDBConn(db)
+
+	err = updateMeta(parts[0], func(m *dbMeta) { m.Quota = &spec })
+	if err != nil {
+		emitError(500, w, "Error storing quota", err.Error())
+		return
+	}
+	checkQuota(parts[0], db)
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+// deleteByQuery deletes the documents a query with the same range
+// and filters would see.  With dry_run=true, it only counts them.
+func deleteByQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	from, err := cleanupRangeParam(args[0], req.FormValue("from"), "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(args[0], req.FormValue("to"), "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+
+	filters, filtervals := req.Form["f"], req.Form["fv"]
+	if len(filters) < 1 {
+		emitError(400, w, "Filter required",
+			"At least one f argument is required")
+		return
+	}
+	if len(filters) != len(filtervals) {
+		emitError(400, w, "Parameter mismatch",
+			"Must supply the same number of filters and filter values")
+		return
+	}
+
+	dryRun := req.FormValue("dry_run") == "true"
+	n, err := dbdeleteMatching(args[0], from, to, filters, filtervals, dryRun)
+	if err != nil {
+		emitStoreError(w, err)
+		return
+	}
+	rv := map[string]interface{}{"ok": true, "matched": n}
+	if !dryRun {
+		rv["deleted"] = n
+	}
+	mustEncode(200, w, rv)
+}
+
+func getExclusions(parts []string, w http.ResponseWriter, req *http.Request) {
+	ws, err := dbExclusions(parts[0])
+	if err != nil {
+		emitError(500, w, "Error loading exclusions", err.Error())
+		return
+	}
+	mustEncode(200, w, ws)
+}
+
+func putExclusions(parts []string, w http.ResponseWriter, req *http.Request) {
+	ws := []exclusionWindow{}
+	err := json.NewDecoder(req.Body).Decode(&ws)
+	if err == nil {
+		err = validateExclusions(ws)
+	}
+	if err != nil {
+		emitError(400, w, "Bad exclusions", err.Error())
+		return
+	}
+
+	err = updateMeta(parts[0], func(m *dbMeta) { m.Exclusions = ws })
+	if err != nil {
+		emitError(500, w, "Error storing exclusions", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+func schemaDrift(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !*trackSchema || memDatabase(parts[0]) != nil {
+		emitError(404, w, "not_found", "schema tracking is disabled")
+		return
+	}
+	if _, err := os.Stat(dbPath(parts[0])); err != nil {
+		emitError(404, w, "not_found", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{
+		"weeks": dbSchema(parts[0]).report(),
+	})
+}
+
+func serverStats(parts []string, w http.ResponseWriter, req *http.Request) {
+	mustEncode(200, w, map[string]interface{}{
+		"quotas":  quotaStatuses(),
+		"lanes":   laneStats(),
+		"windows": serverStatsCollector.report(time.Now()),
+		"writers": writerDelays.stats(),
+	})
+}
+
+// shardedQuery runs a query against each shard in range, merging
+// the results as for a federation.
+func shardedQuery(dbname string, p queryParams,
+	w http.ResponseWriter, req *http.Request) {
+
+	from, err := cleanupRangeParam(dbname, p.from, "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(dbname, p.to, "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+	scanned, pruned := partitionShards(dbname, from, to)
+	w.Header().Set("X-Seriesly-Partitions-Scanned", strconv.Itoa(len(scanned)))
+	w.Header().Set("X-Seriesly-Partitions-Pruned", strconv.Itoa(len(pruned)))
+	shards := shardsInRange(dbname, from, to)
+	if len(shards) == 0 {
+		emptyResults(w, req)
+		return
+	}
+	federatedQuery(shards, p, w, req)
+}
+
+func listShards(parts []string, w http.ResponseWriter, req *http.Request) {
+	period := dbShardPeriod(parts[0])
+	if period == "" {
+		emitError(404, w, "not_found", "not a sharded database")
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{
+		"period": period,
+		"shards": dbShards(parts[0]),
+	})
+}
+
+func deleteShard(parts []string, w http.ResponseWriter, req *http.Request) {
+	if dbShardPeriod(parts[0]) == "" {
+		emitError(404, w, "not_found", "not a sharded database")
+		return
+	}
+	if err := dropShard(parts[0], parts[1]); err != nil {
+		emitError(404, w, "not_found", err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func getFederation(parts []string, w http.ResponseWriter, req *http.Request) {
+	members := federationMembers(parts[0])
+	if len(members) == 0 {
+		emitError(404, w, "not_found", "not a federated database")
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"members": members})
+}
+
+func putFederation(parts []string, w http.ResponseWriter, req *http.Request) {
+	def := struct {
+		Members []string `json:"members"`
+	}{}
+	err := json.NewDecoder(req.Body).Decode(&def)
+	for i, m := range def.Members {
+		if !isRemoteMember(m) {
+			def.Members[i] = scopedDB(req, m)
+		}
+	}
+	if err == nil {
+		err = validateMembers(parts[0], def.Members)
+	}
+	if err != nil {
+		emitError(400, w, "Bad federation", err.Error())
+		return
+	}
+	if _, err := os.Stat(dbPath(parts[0])); err == nil {
+		emitError(409, w, "Conflict", "a database by that name exists")
+		return
+	}
+	err = updateMeta(parts[0], func(m *dbMeta) { m.Members = def.Members })
+	if err != nil {
+		emitError(500, w, "Error storing federation", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+func allDocs(args []string, w http.ResponseWriter, req *http.Request) {
+	// Parse the params
+
+	req.ParseForm()
+
+	from, err := cleanupRangeParam(args[0], req.FormValue("from"), "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(args[0], req.FormValue("to"), "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+
+	p, err := parsePage(req, from, to, -1)
+	if err != nil {
+		emitError(400, w, "Bad paging value", err.Error())
+		return
+	}
+	sample, err := parseSample(req)
+	if err != nil {
+		emitError(400, w, "Bad sample value", err.Error())
+		return
+	}
+	// A sample has no next page; skip and limit apply as it's walked.
+	ok := true
+	if sample == nil {
+		next := ""
+		from, to, next, ok, err = pageRange(args[0], p)
+		if err != nil {
+			emitError(500, w, "Error walking keys", err.Error())
+			return
+		}
+		setNextPage(w, next)
+	}
+
+	output, closer := responseOutput(w, req)
+	defer closer()
 	w.WriteHeader(200)
 
 	output.Write([]byte{'{'})
 	defer output.Write([]byte{'}'})
+	if !ok {
+		return
+	}
 
 	seenOne := false
 
-	walked := 0
-	err = dbwalk(args[0], from, to, func(k string, v []byte) error {
-		if walked > limit {
-			return io.EOF
+	walk := dbwalk
+	if p.descending {
+		walk = dbwalkReverse
+	}
+	if sample != nil {
+		walk = func(dbname, from, to string, f func(k string, v []byte) error) error {
+			return dbwalkSampled(dbname, p, sample, f)
+		}
+	}
+	gone := closeNotify(w)
+	err = walk(args[0], from, to, func(k string, v []byte) error {
+		if isClosed(gone) {
+			return errCanceled
 		}
-		walked++
 		if seenOne {
 			output.Write([]byte(",\n"))
 		} else {
@@ -367,17 +1185,214 @@ func allDocs(args []string, w http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// exportChanges emits committed documents in commit order along with
+// the cursor to pass as since_seq to pick up where it left off.
+func exportChanges(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	since := uint64(0)
+	if s := req.FormValue("since_seq"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			emitError(400, w, "Bad since_seq value", err.Error())
+			return
+		}
+	}
+	limit := 1000
+	if s := req.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			emitError(400, w, "Bad limit value", s)
+			return
+		}
+	}
+
+	if memDatabase(args[0]) != nil {
+		emitError(400, w, "Bad request", errNotOnDisk.Error())
+		return
+	}
+	// Their documents are in other files, each with its own
+	// sequence numbers.
+	if dbShardPeriod(args[0]) != "" || len(federationMembers(args[0])) > 0 {
+		emitError(400, w, "Bad request",
+			"changes can't be exported from sharded or federated databases")
+		return
+	}
+
+	output, closer := responseOutput(w, req)
+	defer closer()
+	w.Header().Set("Trailer", queryErrorTrailer)
+	w.WriteHeader(200)
+
+	output.Write([]byte(`{"results": [`))
+
+	gone := closeNotify(w)
+	next := since
+	sent := 0
+	err := dbchanges(args[0], since, func(di *couchstore.DocInfo,
+		v []byte) error {
+		if sent >= limit {
+			return couchstore.StopIteration
+		}
+		if isClosed(gone) {
+			return errCanceled
+		}
+		id, err := json.Marshal(di.ID())
+		if err != nil {
+			return err
+		}
+		if sent > 0 {
+			output.Write([]byte(","))
+		}
+		sent++
+		next = di.Seq()
+		_, err = fmt.Fprintf(output, "\n{\"seq\": %d, \"id\": %s, ",
+			di.Seq(), id)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			_, err = output.Write([]byte(`"deleted": true}`))
+			return err
+		}
+		output.Write([]byte(`"doc": `))
+		output.Write(v)
+		_, err = output.Write([]byte{'}'})
+		return err
+	})
+	fmt.Fprintf(output, "\n], \"next_seq\": %d}", next)
+	if err != nil {
+		// What was sent is still a batch to resume after, but
+		// it's short.
+		httpLog.Warn("error exporting changes", "db", args[0], "err", err)
+		w.Header().Set(queryErrorTrailer, err.Error())
+	}
+}
+
+// importChanges applies a batch of changes in the form produced by
+// _export_changes in a single commit.  Since request bodies may be
+// gzipped, a replicator can pass a compressed export through as is.
+func importChanges(args []string, w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	r, err := requestBody(req)
+	if err != nil {
+		emitBodyError(w, err)
+		return
+	}
+	defer r.Close()
+
+	changes := struct {
+		Results []struct {
+			ID      string          `json:"id"`
+			Doc     json.RawMessage `json:"doc"`
+			Deleted bool            `json:"deleted"`
+		} `json:"results"`
+		NextSeq uint64 `json:"next_seq"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&changes); err != nil {
+		notify(hookReplicationError, args[0],
+			map[string]interface{}{"error": err.Error()})
+		if err == errBodyTooLarge {
+			emitBodyError(w, err)
+			return
+		}
+		emitError(400, w, "Error parsing changes", err.Error())
+		return
+	}
+
+	items := make([]dbqitem, 0, len(changes.Results))
+	for _, c := range changes.Results {
+		item := dbqitem{dbname: args[0], k: c.ID, data: c.Doc,
+			op: opStoreItem}
+		if c.Deleted {
+			item.op = opDeleteItem
+		}
+		items = append(items, item)
+	}
+	var seq uint64
+	if len(items) > 0 {
+		seq, err = dbstoreBatch(args[0], items)
+		if err != nil {
+			notify(hookReplicationError, args[0], map[string]interface{}{
+				"error": err.Error(), "count": len(items)})
+			emitStoreError(w, err)
+			return
+		}
+		serverStatsCollector.add(statIngest, int64(len(items)))
+	}
+	mustEncode(200, w, map[string]interface{}{
+		"ok":       true,
+		"count":    len(items),
+		"seq":      seq,
+		"next_seq": changes.NextSeq,
+	})
+}
+
+func cloneDB(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	target := scopedDB(req, req.FormValue("target"))
+	if !localDBName.MatchString(target) || target == args[0] {
+		emitError(400, w, "Bad target value",
+			fmt.Sprintf("invalid target database: %q", req.FormValue("target")))
+		return
+	}
+	if err := tenantCanCreate(target); err != nil {
+		emitError(403, w, "Forbidden", err.Error())
+		return
+	}
+	from, err := cleanupRangeParam(args[0], req.FormValue("from"), "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(args[0], req.FormValue("to"), "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+
+	n, err := dbclone(args[0], target, from, to)
+	switch {
+	case os.IsExist(err):
+		emitError(409, w, "Conflict", "target database already exists")
+	case err != nil:
+		emitError(500, w, "Error cloning database", err.Error())
+	default:
+		mustEncode(201, w, map[string]interface{}{"ok": true, "count": n})
+	}
+}
+
+// dumpDocs streams documents as NDJSON lines of {"timestamp": doc},
+// the form tools/load reads.  An interrupted dump can be resumed
+// with after= set to the last timestamp received.  With sample=, only
+// some are dumped (see sample.go).
 func dumpDocs(args []string, w http.ResponseWriter, req *http.Request) {
 	// Parse the params
 
 	req.ParseForm()
 
-	from, err := cleanupRangeParam(req.FormValue("from"), "")
+	after := req.FormValue("after")
+	if after != "" && req.FormValue("from") != "" {
+		emitError(400, w, "Bad Request", "from and after are exclusive")
+		return
+	}
+	from, err := cleanupRangeParam(args[0], req.FormValue("from"), "")
 	if err != nil {
 		emitError(400, w, "Bad from value", err.Error())
 		return
 	}
-	to, err := cleanupRangeParam(req.FormValue("to"), "")
+	if after != "" {
+		from, err = cleanupRangeParam(args[0], after, "")
+		if err != nil {
+			emitError(400, w, "Bad after value", err.Error())
+			return
+		}
+		after = from
+	}
+	to, err := cleanupRangeParam(args[0], req.FormValue("to"), "")
 	if err != nil {
 		emitError(400, w, "Bad to value", err.Error())
 		return
@@ -387,24 +1402,39 @@ func dumpDocs(args []string, w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		limit = 2000000000
 	}
-
-	output := io.Writer(w)
-
-	if canGzip(req) {
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		output = gz
-	} else {
-		output = w
+	sample, err := parseSample(req)
+	if err != nil {
+		emitError(400, w, "Bad sample value", err.Error())
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	output, closer := responseOutput(w, req)
+	defer closer()
 	w.WriteHeader(200)
 
+	walk := dbwalk
+	if sample != nil {
+		p := page{from: from, to: to, limit: limit}
+		if after != "" {
+			p.from = after + "\x00"
+		}
+		walk = func(dbname, from, to string, f func(k string, v []byte) error) error {
+			return dbwalkSampled(dbname, p, sample, f)
+		}
+	}
+	gone := closeNotify(w)
 	walked := 0
-	err = dbwalk(args[0], from, to, func(k string, v []byte) error {
-		if walked > limit {
+	err = walk(args[0], from, to, func(k string, v []byte) error {
+		if k == after {
+			return nil
+		}
+		if walked >= limit {
 			return io.EOF
 		}
+		if isClosed(gone) {
+			return errCanceled
+		}
 		walked++
 		_, err := fmt.Fprintf(output, `{"%s": `, k)
 		if err != nil {
@@ -412,15 +1442,29 @@ func dumpDocs(args []string, w http.ResponseWriter, req *http.Request) {
 		}
 		_, err = output.Write(v)
 		output.Write([]byte{'}', '\n'})
+		if walked%maxOpQueue.get() == 0 {
+			flushOutput(w, output)
+		}
 		return err
 	})
 }
 
 func getDocument(parts []string, w http.ResponseWriter, req *http.Request) {
+	if notModified(w, req, docETag(parts[0], parts[1])) {
+		return
+	}
 	d, err := dbGetDoc(parts[0], parts[1])
 	if err == nil {
+		if prov := docProvenance(parts[0], parts[1]); prov != nil {
+			w.Header().Set("X-Seriesly-Provenance", string(prov))
+		}
+	}
+	switch {
+	case err == nil && isBlobDB(parts[0]):
+		writeBlob(w, req, d)
+	case err == nil:
 		w.Write(d)
-	} else {
+	default:
 		emitError(404, w, "Error retrieving value", err.Error())
 	}
 }
@@ -434,17 +1478,35 @@ func dbInfo(args []string, w http.ResponseWriter, req *http.Request) {
 	defer closeDBConn(db)
 
 	inf, err := db.Info()
-	if err == nil {
-		mustEncode(200, w, map[string]interface{}{
-			"last_seq":      inf.LastSeq,
-			"doc_count":     inf.DocCount,
-			"deleted_count": inf.DeletedCount,
-			"space_used":    inf.SpaceUsed,
-			"header_pos":    inf.HeaderPosition,
-		})
-	} else {
+	if err != nil {
 		emitError(500, w, "Error getting db info", err.Error())
+		return
+	}
+
+	format := dbFormat(args[0])
+	oldest, newest := keyRange(db, format)
+	rv := map[string]interface{}{
+		"last_seq":      inf.LastSeq,
+		"doc_count":     inf.DocCount,
+		"deleted_count": inf.DeletedCount,
+		"space_used":    inf.SpaceUsed,
+		"header_pos":    inf.HeaderPosition,
+		"format":        format,
+		"write_queue":   queueInfo(args[0]),
+		"oldest":        oldest,
+		"newest":        newest,
+	}
+	// Every commit appends to the file, so its modification time
+	// is the time of the last commit.
+	if st, err := os.Stat(dbPath(args[0])); err == nil {
+		rv["file_size"] = st.Size()
+		rv["last_commit"] = st.ModTime().UTC()
+		if st.Size() > 0 {
+			rv["fragmentation"] = 1 -
+				float64(inf.SpaceUsed)/float64(st.Size())
+		}
 	}
+	mustEncode(200, w, rv)
 }
 
 // TODO:
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// GET /_healthz says whether the server is alive: it answers, and can
+// write under -root.  GET /_readyz says whether it should be sent
+// traffic: no write queue is nearly full, and there's disk space to
+// spare.  Both answer 200 when all's well and 503 otherwise, with the
+// checks that were made, and neither needs credentials.
+
+var minFreeMB = flag.Int64("minFreeMB", 512,
+	"Not ready with less free space than this under -root (0 to not check)")
+var readyQueueFull = flag.Float64("readyQueueFull", 0.9,
+	"Not ready when a write queue is at least this fraction full")
+
+// diskFree is the space available to unprivileged users on the
+// filesystem holding path.
+func diskFree(path string) (uint64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// checkWritableRoot writes and removes a file under -root.
+func checkWritableRoot() error {
+	f, err := ioutil.TempFile(*dbRoot, ".healthz")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(f.Name())
+	return err
+}
+
+// saturatedQueues lists the databases whose write queues are at least
+// -readyQueueFull full.
+func saturatedQueues() []string {
+	rv := []string{}
+	dbLock.Lock()
+	for n, w := range dbConns {
+		if c := cap(w.ch); c > 0 &&
+			float64(len(w.ch)) >= *readyQueueFull*float64(c) {
+			rv = append(rv, n)
+		}
+	}
+	dbLock.Unlock()
+	sort.Strings(rv)
+	return rv
+}
+
+func healthz(parts []string, w http.ResponseWriter, req *http.Request) {
+	root := map[string]interface{}{"path": *dbRoot, "ok": true}
+	status := 200
+	if err := checkWritableRoot(); err != nil {
+		root["ok"] = false
+		root["error"] = err.Error()
+		status = 503
+	}
+	mustEncode(status, w, map[string]interface{}{
+		"ok":     status == 200,
+		"checks": map[string]interface{}{"root": root},
+	})
+}
+
+func readyz(parts []string, w http.ResponseWriter, req *http.Request) {
+	saturated := saturatedQueues()
+	ready := len(saturated) == 0
+	queues := map[string]interface{}{
+		"ok":        ready,
+		"saturated": saturated,
+		"threshold": *readyQueueFull,
+	}
+
+	disk := map[string]interface{}{"ok": true, "min_free_mb": *minFreeMB}
+	if *minFreeMB > 0 {
+		free, err := diskFree(*dbRoot)
+		switch {
+		case err != nil:
+			disk["ok"] = false
+			disk["error"] = err.Error()
+		default:
+			disk["free_mb"] = free >> 20
+			disk["ok"] = free>>20 >= uint64(*minFreeMB)
+		}
+		ready = ready && disk["ok"] == true
+	}
+	if diskIsFull() {
+		disk["ok"] = false
+		disk["writes_refused"] = true
+		ready = false
+	}
+
+	status := 200
+	if !ready {
+		status = 503
+	}
+	mustEncode(status, w, map[string]interface{}{
+		"ok": ready,
+		"checks": map[string]interface{}{
+			"queues": queues,
+			"disk":   disk,
+		},
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+
+	req, _ := http.NewRequest("GET", "/_healthz", nil)
+	*dbRoot = dir
+	w := httptest.NewRecorder()
+	healthz(nil, w, req)
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %v: %s", w.Code, w.Body)
+	}
+	if left, _ := ioutil.ReadDir(dir); len(left) != 0 {
+		t.Errorf("Expected the check to clean up, found %v", left)
+	}
+
+	*dbRoot = filepath.Join(dir, "missing")
+	w = httptest.NewRecorder()
+	healthz(nil, w, req)
+	if w.Code != 503 {
+		t.Errorf("Expected 503 for a missing root, got %v: %s", w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer func(r string, m int64, q float64) {
+		*dbRoot, *minFreeMB, *readyQueueFull = r, m, q
+	}(*dbRoot, *minFreeMB, *readyQueueFull)
+	*dbRoot, *minFreeMB, *readyQueueFull = os.TempDir(), 1, 0.5
+
+	req, _ := http.NewRequest("GET", "/_readyz", nil)
+	w := httptest.NewRecorder()
+	readyz(nil, w, req)
+	if w.Code != 200 {
+		t.Errorf("Expected 200, got %v: %s", w.Code, w.Body)
+	}
+
+	full := &dbWriter{dbname: "full", ch: make(chan dbqitem, 2),
+		flush: newFlushController(time.Second)}
+	full.ch <- dbqitem{}
+	dbLock.Lock()
+	dbConns["full"] = full
+	dbLock.Unlock()
+	defer dbRemoveConn("full")
+
+	w = httptest.NewRecorder()
+	readyz(nil, w, req)
+	if w.Code != 503 {
+		t.Errorf("Expected 503 with a saturated queue, got %v: %s",
+			w.Code, w.Body)
+	}
+
+	dbRemoveConn("full")
+	*minFreeMB = 1 << 40
+	w = httptest.NewRecorder()
+	readyz(nil, w, req)
+	if w.Code != 503 {
+		t.Errorf("Expected 503 without the disk space, got %v: %s",
+			w.Code, w.Body)
+	}
+}
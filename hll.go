@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// The cardinality reducer estimates how many distinct values there are
+// with a HyperLogLog sketch, in fixed memory however many there are,
+// with a standard error of about 1.6%.  Missing values, objects and
+// arrays aren't counted.
+//
+// cardinality_sketch returns the sketch itself, base64 encoded, which
+// is how federated queries merge cardinalities from their members.
+
+// hllBits of each hash pick a register.
+const hllBits = 12
+
+type hll []uint8
+
+func newHLL() hll {
+	return make(hll, 1<<hllBits)
+}
+
+// hllHash hashes the JSON form of a value, so "1" and 1 differ.
+func hllHash(v interface{}) (uint64, bool) {
+	var b []byte
+	switch x := v.(type) {
+	case string:
+		b = append(b, '"')
+		b = append(b, x...)
+	case float64:
+		b = strconv.AppendFloat(b, x, 'g', -1, 64)
+	case bool:
+		b = strconv.AppendBool(b, x)
+	default:
+		return 0, false
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	// FNV's high bits mix poorly, so finish it as splitmix64 does.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31), true
+}
+
+func (s hll) add(v interface{}) {
+	x, ok := hllHash(v)
+	if !ok {
+		return
+	}
+	i := x >> (64 - hllBits)
+	// The position of the first one bit in the rest.
+	rank := uint8(1)
+	for w := x << hllBits; w&(1<<63) == 0 && rank <= 64-hllBits; w <<= 1 {
+		rank++
+	}
+	if rank > s[i] {
+		s[i] = rank
+	}
+}
+
+func (s hll) merge(o hll) {
+	for i := range s {
+		if i < len(o) && o[i] > s[i] {
+			s[i] = o[i]
+		}
+	}
+}
+
+func (s hll) estimate() float64 {
+	m := float64(len(s))
+	sum, zeros := 0.0, 0
+	for _, r := range s {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is better for small cardinalities.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(e + 0.5)
+}
+
+func (s hll) String() string {
+	return base64.StdEncoding.EncodeToString(s)
+}
+
+func parseHLL(v interface{}) (hll, bool) {
+	str, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(str)
+	if err != nil || len(b) != 1<<hllBits {
+		return nil, false
+	}
+	return hll(b), true
+}
+
+func collectHLL(input chan ptrval) hll {
+	s := newHLL()
+	for v := range input {
+		if v.included {
+			s.add(v.val)
+		}
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCardinality(t *testing.T) {
+	in := []interface{}{"a", "b", "a", 1.0, "1", nil, true,
+		map[string]interface{}{"a": 1}}
+	if got := reducers["cardinality"](streamCollection(in)); got != 5.0 {
+		t.Errorf("Expected 5 distinct, got %v", got)
+	}
+
+	for _, n := range []int{100, 10000, 100000} {
+		s := newHLL()
+		for i := 0; i < n; i++ {
+			s.add(fmt.Sprintf("user%d", i))
+			s.add(fmt.Sprintf("user%d", i/2))
+		}
+		e := s.estimate()
+		if math.Abs(e-float64(n))/float64(n) > 0.05 {
+			t.Errorf("Expected about %v, got %v", n, e)
+		}
+	}
+}
+
+func TestCardinalityMerge(t *testing.T) {
+	p := queryParams{ptrs: []string{"/u"}, reds: []string{"cardinality"}}
+	expanded, positions := expandForMerge(p)
+	if expanded.reds[0] != "cardinality_sketch" {
+		t.Fatalf("Expected a sketch, got %v", expanded.reds)
+	}
+
+	a, b := newHLL(), newHLL()
+	for i := 0; i < 1000; i++ {
+		a.add(fmt.Sprintf("user%d", i))
+		b.add(fmt.Sprintf("user%d", i+500))
+	}
+	got := mergeResults(p, positions, []queryResults{
+		{1000: {a.String()}}, {1000: {b.String()}}})
+	e, _ := got[1000][0].(float64)
+	if math.Abs(e-1500)/1500 > 0.05 {
+		t.Errorf("Expected about 1500, got %v", got[1000])
+	}
+}
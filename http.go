@@ -0,0 +1,288 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func canGzip(req *http.Request) bool {
+	if jsonpCallbackParam(req) != "" {
+		return false
+	}
+	acceptable := req.Header.Get("accept-encoding")
+	return strings.Contains(acceptable, "gzip")
+}
+
+// responseOutput returns the writer a streaming response body should
+// be written to, compressing it if the client will accept that.  The
+// returned function must be called when the response is complete.
+func responseOutput(w http.ResponseWriter,
+	req *http.Request) (io.Writer, func()) {
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !canGzip(req) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	return gz, func() { gz.Close() }
+}
+
+var maxBodyMB = intFlag("maxBodyMB", 64,
+	"Largest request body accepted, once decompressed")
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// A bodyError is a request body that can't be read at all.
+type bodyError struct {
+	status int
+	title  string
+	err    error
+}
+
+func (e *bodyError) Error() string {
+	return e.err.Error()
+}
+
+// requestBody returns a reader over the decoded request body, which
+// fails with errBodyTooLarge past maxBodyMB.
+func requestBody(req *http.Request) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	switch strings.ToLower(req.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		r = ioutil.NopCloser(req.Body)
+	case "gzip":
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, &bodyError{400, "Bad Request",
+				fmt.Errorf("error decompressing body: %v", err)}
+		}
+		r = gz
+	default:
+		return nil, &bodyError{415, "Unsupported Media Type",
+			fmt.Errorf("unsupported content encoding: %v",
+				req.Header.Get("Content-Encoding"))}
+	}
+	return &limitedBody{r, int64(maxBodyMB.get()) << 20}, nil
+}
+
+// A limitedBody is a body that fails once more than left bytes have
+// been read, so a small compressed body can't expand without bound.
+type limitedBody struct {
+	r    io.ReadCloser
+	left int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.r.Close()
+}
+
+// emitBodyError reports a request body that couldn't be read.
+func emitBodyError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *bodyError:
+		emitError(e.status, w, e.title, e.Error())
+		return
+	}
+	if err == errBodyTooLarge {
+		emitError(413, w, "Request Entity Too Large",
+			fmt.Sprintf("request bodies are limited to %vMB", maxBodyMB.get()))
+		return
+	}
+	emitError(400, w, "Bad Request",
+		fmt.Sprintf("Error reading body: %v", err))
+}
+
+// flushOutput pushes anything buffered in out through to the client.
+func flushOutput(w http.ResponseWriter, out io.Writer) {
+	if f, ok := out.(interface {
+		Flush() error
+	}); ok {
+		f.Flush()
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// closeNotify returns a channel that's closed when the client goes
+// away, or nil if that can't be detected.
+func closeNotify(w http.ResponseWriter) <-chan bool {
+	if cn, ok := w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+// Cross-origin requests are allowed from -corsOrigins, so browser
+// dashboards can query directly.  Preflights are answered with the
+// methods routed for the path unless -corsMethods says otherwise, and
+// with whatever headers were asked for unless -corsHeaders does.
+
+var corsOrigins = flag.String("corsOrigins", "*",
+	"Comma separated origins allowed cross-origin requests (* for any, empty for none)")
+var corsMethods = flag.String("corsMethods", "",
+	"Methods allowed in CORS preflights (default: those routed for the path)")
+var corsHeaders = flag.String("corsHeaders", "",
+	"Request headers allowed in CORS preflights (default: those asked for)")
+var corsMaxAge = flag.Duration("corsMaxAge", 10*time.Minute,
+	"How long browsers may cache CORS preflight results")
+
+// Response headers browsers let scripts read.
+const corsExposed = "ETag, Retry-After, X-Seriesly-Key, X-Seriesly-Seq, " +
+	"X-Seriesly-Next, X-Seriesly-Error, " +
+	"X-RateLimit-Limit, X-RateLimit-Remaining"
+
+// corsOrigin returns the Access-Control-Allow-Origin value for a
+// request's origin, or "" if it's not allowed.
+func corsOrigin(origin string) string {
+	for _, o := range strings.Split(*corsOrigins, ",") {
+		o = strings.TrimSpace(o)
+		switch {
+		case o == "*":
+			return "*"
+		case o != "" && o == origin:
+			return origin
+		}
+	}
+	return ""
+}
+
+// setCORS adds the CORS headers for a request, reporting whether its
+// origin is allowed.
+func setCORS(w http.ResponseWriter, req *http.Request) bool {
+	allowed := corsOrigin(req.Header.Get("Origin"))
+	if allowed == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if allowed != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+	w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+	return true
+}
+
+// setPreflight adds the headers answering a CORS preflight, on top of
+// those setCORS added.
+func setPreflight(w http.ResponseWriter, req *http.Request, routed []string) {
+	methods := strings.Join(routed, ", ")
+	w.Header().Set("Allow", methods)
+	if corsOrigin(req.Header.Get("Origin")) == "" {
+		return
+	}
+	if *corsMethods != "" {
+		methods = *corsMethods
+	}
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	headers := *corsHeaders
+	if headers == "" {
+		headers = req.Header.Get("Access-Control-Request-Headers")
+	}
+	if headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	if *corsMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age",
+			strconv.Itoa(int(corsMaxAge.Seconds())))
+	}
+}
+
+// JSONP: with callback=fn, GETs of documents and queries are wrapped
+// as a call to fn, for browsers that can't make CORS requests.  The
+// wrapped response isn't compressed.
+
+var jsonpCallback = regexp.MustCompile(`^[a-zA-Z_$][0-9a-zA-Z_$.]*$`)
+
+type jsonpWriter struct {
+	http.ResponseWriter
+	callback string
+	started  bool
+}
+
+func (j *jsonpWriter) WriteHeader(status int) {
+	if j.started || status == 204 || status == 304 {
+		j.ResponseWriter.WriteHeader(status)
+		return
+	}
+	j.started = true
+	j.Header().Del("Content-Length")
+	j.Header().Set("Content-Type", "application/javascript")
+	j.ResponseWriter.WriteHeader(status)
+	io.WriteString(j.ResponseWriter, j.callback+"(")
+}
+
+func (j *jsonpWriter) Write(b []byte) (int, error) {
+	if !j.started {
+		j.WriteHeader(200)
+	}
+	return j.ResponseWriter.Write(b)
+}
+
+func (j *jsonpWriter) Flush() {
+	if f, ok := j.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (j *jsonpWriter) CloseNotify() <-chan bool {
+	if cn, ok := j.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+// jsonpCallbackParam returns the callback a GET asked for, if any.
+func jsonpCallbackParam(req *http.Request) string {
+	if req.Method != "GET" {
+		return ""
+	}
+	return req.URL.Query().Get("callback")
+}
+
+// jsonp wraps a handler's response in the requested callback.
+func jsonp(h routeHandler) routeHandler {
+	return func(parts []string, w http.ResponseWriter, req *http.Request) {
+		cb := jsonpCallbackParam(req)
+		if cb == "" {
+			h(parts, w, req)
+			return
+		}
+		if !jsonpCallback.MatchString(cb) {
+			emitError(400, w, "Bad callback value",
+				fmt.Sprintf("invalid callback: %q", cb))
+			return
+		}
+		jw := &jsonpWriter{ResponseWriter: w, callback: cb}
+		h(parts, jw, req)
+		if jw.started {
+			io.WriteString(w, ");")
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGzipRequestBody(t *testing.T) {
+	exp := `{"some": "document"}`
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(exp))
+	gz.Close()
+
+	req, err := http.NewRequest("POST", "/x", buf)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+
+	r, err := requestBody(req)
+	if err != nil {
+		t.Fatalf("Error decoding body: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading body: %v", err)
+	}
+	if string(got) != exp {
+		t.Fatalf("Expected %s, got %s", exp, got)
+	}
+}
+
+func TestUnknownRequestEncoding(t *testing.T) {
+	req, err := http.NewRequest("POST", "/x", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Encoding", "lzma")
+
+	if _, err := requestBody(req); err == nil {
+		t.Fatalf("Expected error on unknown encoding")
+	}
+}
+
+func TestQueryTimeoutParam(t *testing.T) {
+	defer func(m, d time.Duration) {
+		queryTimeout.set(m)
+		defaultQueryTime.set(d)
+	}(queryTimeout.get(), defaultQueryTime.get())
+	queryTimeout.set(time.Minute)
+	defaultQueryTime.set(0)
+
+	tests := []struct {
+		input string
+		exp   time.Duration
+	}{
+		{"", time.Minute},
+		{"30s", 30 * time.Second},
+		{"1h", time.Minute},
+	}
+	for _, x := range tests {
+		got, err := queryTimeoutParam(x.input)
+		if err != nil {
+			t.Errorf("Error on %q: %v", x.input, err)
+		}
+		if got != x.exp {
+			t.Errorf("Expected %v for %q, got %v", x.exp, x.input, got)
+		}
+	}
+
+	defaultQueryTime.set(10 * time.Second)
+	if got, _ := queryTimeoutParam(""); got != 10*time.Second {
+		t.Errorf("Expected default of 10s, got %v", got)
+	}
+
+	for _, bad := range []string{"soon", "-1s", "0"} {
+		if _, err := queryTimeoutParam(bad); err == nil {
+			t.Errorf("Expected error on %q", bad)
+		}
+	}
+}
+
+func TestDumpResume(t *testing.T) {
+	createMemDatabase("dumptest", memOptions{Policy: memEvict})
+	defer dropMemDatabase("dumptest")
+	keys := []string{"2013-01-01T00:00:00Z", "2013-01-01T00:00:01Z",
+		"2013-01-01T00:00:02Z"}
+	ops := []memOp{}
+	for _, k := range keys {
+		ops = append(ops, memOp{k, []byte(`1`), false})
+	}
+	memDatabase("dumptest").commit(ops)
+
+	tests := []struct {
+		query, exp string
+	}{
+		{"", `{"` + keys[0] + `": 1}` + "\n" + `{"` + keys[1] + `": 1}` + "\n" +
+			`{"` + keys[2] + `": 1}` + "\n"},
+		{"limit=1", `{"` + keys[0] + `": 1}` + "\n"},
+		{"after=" + keys[0] + "&limit=1", `{"` + keys[1] + `": 1}` + "\n"},
+		{"after=" + keys[2], ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/dumptest/_dump?"+test.query, nil)
+		w := httptest.NewRecorder()
+		dumpDocs([]string{"dumptest"}, w, req)
+		if w.Code != 200 || w.Body.String() != test.exp {
+			t.Errorf("For %q expected %q, got %v %q",
+				test.query, test.exp, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	createMemDatabase("deltest", memOptions{Policy: memEvict})
+	defer dropMemDatabase("deltest")
+	defer dbRemoveConn("deltest")
+	memDatabase("deltest").commit([]memOp{
+		{"2013-01-01T00:00:00Z", []byte(`{"src": "bad"}`), false},
+		{"2013-01-01T00:00:01Z", []byte(`{"src": "good"}`), false},
+		{"2013-01-01T00:00:02Z", []byte(`{"src": "bad"}`), false},
+	})
+
+	for _, dry := range []bool{true, false} {
+		n, err := dbdeleteMatching("deltest", "", "",
+			[]string{"/src"}, []string{"bad"}, dry)
+		if err != nil || n != 2 {
+			t.Fatalf("Expected 2 matches (dry run %v), got %v, %v", dry, n, err)
+		}
+	}
+
+	left := []string{}
+	dbwalk("deltest", "", "", func(k string, v []byte) error {
+		left = append(left, k)
+		return nil
+	})
+	if len(left) != 1 || left[0] != "2013-01-01T00:00:01Z" {
+		t.Errorf("Expected only the good document to remain, got %v", left)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	defer func(o, m, h string) {
+		*corsOrigins, *corsMethods, *corsHeaders = o, m, h
+	}(*corsOrigins, *corsMethods, *corsHeaders)
+
+	tests := []struct {
+		origins, origin, exp string
+	}{
+		{"*", "https://dash.example.com", "*"},
+		{"*", "", "*"},
+		{"", "https://dash.example.com", ""},
+		{"https://a.example.com, https://dash.example.com",
+			"https://dash.example.com", "https://dash.example.com"},
+		{"https://a.example.com", "https://dash.example.com", ""},
+	}
+	for _, test := range tests {
+		*corsOrigins = test.origins
+		req, _ := http.NewRequest("GET", "/db/_query", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		setCORS(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.exp {
+			t.Errorf("Expected %q from %q for %q, got %q",
+				test.exp, test.origins, test.origin, got)
+		}
+	}
+
+	*corsOrigins = "https://dash.example.com"
+	req, _ := http.NewRequest("OPTIONS", "/db/_query", nil)
+	req.Header.Set("Origin", "https://dash.example.com")
+	req.Header.Set("Access-Control-Request-Headers", "If-None-Match")
+	w := httptest.NewRecorder()
+	setCORS(w, req)
+	setPreflight(w, req, []string{"GET", "POST"})
+	exp := map[string]string{
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "If-None-Match",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	}
+	for h, v := range exp {
+		if got := w.Header().Get(h); got != v {
+			t.Errorf("Expected %v of %q, got %q", h, v, got)
+		}
+	}
+
+	*corsMethods, *corsHeaders = "GET", "Content-Type"
+	w = httptest.NewRecorder()
+	setPreflight(w, req, []string{"GET", "POST"})
+	if w.Header().Get("Access-Control-Allow-Methods") != "GET" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" {
+		t.Errorf("Expected the configured methods and headers, got %v",
+			w.Header())
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	h := jsonp(func(parts []string, w http.ResponseWriter, req *http.Request) {
+		mustEncode(200, w, map[string]interface{}{"ok": true})
+	})
+
+	tests := []struct {
+		method, query string
+		code          int
+		body          string
+	}{
+		{"GET", "", 200, `{"ok":true}`},
+		{"GET", "?callback=app.update", 200, `app.update({"ok":true});`},
+		{"POST", "?callback=app.update", 200, `{"ok":true}`},
+		{"GET", "?callback=alert(1)", 400, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "/db/_query"+test.query, nil)
+		w := httptest.NewRecorder()
+		h(nil, w, req)
+		if w.Code != test.code {
+			t.Errorf("Expected %v for %v %q, got %v", test.code,
+				test.method, test.query, w.Code)
+			continue
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("Expected %s for %v %q, got %s", test.body,
+				test.method, test.query, w.Body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/db/_query?callback=f", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if canGzip(req) {
+		t.Errorf("Expected JSONP responses left uncompressed")
+	}
+}
+
+func TestBadRequestBodies(t *testing.T) {
+	defer func(n int) { maxBodyMB.set(n) }(maxBodyMB.get())
+	maxBodyMB.set(1)
+
+	big := &bytes.Buffer{}
+	gz := gzip.NewWriter(big)
+	gz.Write(make([]byte, 2<<20))
+	gz.Close()
+
+	tests := []struct {
+		body     []byte
+		encoding string
+		exp      int
+	}{
+		{[]byte("not gzip"), "gzip", 400},
+		{[]byte("{}"), "lzma", 415},
+		{big.Bytes(), "gzip", 413},
+		{make([]byte, 2<<20), "", 413},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("PATCH", "/x/y", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Content-Encoding", test.encoding)
+		w := httptest.NewRecorder()
+		patchDocument([]string{"x", "y"}, w, req)
+		if w.Code != test.exp {
+			t.Errorf("Expected %v for %v, got %v: %s",
+				test.exp, test.encoding, w.Code, w.Body)
+		}
+	}
+}
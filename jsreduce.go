@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// Queries may define their own reducers in JavaScript when the built
+// in ones don't fit.  A function is given a name with
+// function=name=source and used as reducer js:name.  It's called with
+// an array of the values found at its pointer in each document of a
+// group; the pointer "" passes whole documents, so a function can
+// combine fields, e.g.
+//
+//	function(docs) {
+//	    var sum = 0, weight = 0;
+//	    for (var i = 0; i < docs.length; i++) {
+//	        sum += docs[i].latency * docs[i].count;
+//	        weight += docs[i].count;
+//	    }
+//	    return sum / weight;
+//	}
+//
+// Functions are interrupted once the query's time is up.  Their
+// results can't be merged across federation members or shards, so
+// those queries get the first member's result for each group.
+
+const jsReducerPrefix = "js:"
+
+var errScriptTimeout = errors.New("script ran out of time")
+
+// parseJSFunction splits a function parameter into its name and source
+// and checks that the source is a function.
+func parseJSFunction(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !localDBName.MatchString(parts[0]) {
+		return "", "", fmt.Errorf("expected name=source: %q", s)
+	}
+	v, err := otto.New().Run("(" + parts[1] + ")")
+	if err != nil {
+		return "", "", fmt.Errorf("%v: %v", parts[0], err)
+	}
+	if !v.IsFunction() {
+		return "", "", fmt.Errorf("%v is not a function", parts[0])
+	}
+	return parts[0], parts[1], nil
+}
+
+// jsValue undoes processDoc's rendering of scalars as strings, so
+// scripts can do arithmetic on numbers.
+func jsValue(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return s
+}
+
+func jsReducer(src string, deadline time.Time) reducer {
+	return func(input chan ptrval) (rv interface{}) {
+		vals := []interface{}{}
+		for v := range input {
+			if v.included && v.val != nil {
+				vals = append(vals, jsValue(v.val))
+			}
+		}
+
+		vm := otto.New()
+		vm.Interrupt = make(chan func(), 1)
+		t := time.AfterFunc(deadline.Sub(time.Now()), func() {
+			vm.Interrupt <- func() { panic(errScriptTimeout) }
+		})
+		defer t.Stop()
+		defer func() {
+			if r := recover(); r != nil {
+				if r != errScriptTimeout {
+					panic(r)
+				}
+				rv = nil
+			}
+		}()
+
+		if err := vm.Set("values", vals); err != nil {
+			return nil
+		}
+		v, err := vm.Run("(" + src + ")(values)")
+		if err != nil {
+			return nil
+		}
+		rv, err = v.Export()
+		if err != nil {
+			return nil
+		}
+		return rv
+	}
+}
+
+// lookupReducer finds a built in reducer or one of a query's
+// functions.
+func lookupReducer(name string, funcs map[string]string,
+	deadline time.Time) reducer {
+
+	if strings.HasPrefix(name, jsReducerPrefix) {
+		return jsReducer(funcs[name[len(jsReducerPrefix):]], deadline)
+	}
+	if c, ok, err := parseCondReducer(name); ok && err == nil {
+		return c.reducer()
+	}
+	if pair, _, _, ok := parsePairReducer(name); ok {
+		return pairReducers[pair]
+	}
+	return reducers[name]
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestJSReducer(t *testing.T) {
+	form := url.Values{
+		"group":    {"1000"},
+		"ptr":      {""},
+		"reducer":  {"js:n"},
+		"function": {"n=function(values) { return values.length; }"},
+	}
+	p, err := parseQueryParams(form)
+	if err != nil {
+		t.Fatalf("Error parsing params: %v", err)
+	}
+
+	ch := make(chan ptrval)
+	go func() {
+		defer close(ch)
+		ch <- ptrval{nil, map[string]interface{}{"a": 1.0}, true}
+		ch <- ptrval{nil, "2", true}
+		ch <- ptrval{nil, "3", false}
+	}()
+	got := lookupReducer(p.reds[0], p.funcs, time.Now().Add(time.Minute))(ch)
+	if got != 2.0 {
+		t.Errorf("Expected 2 included values, got %v", got)
+	}
+}
+
+func TestJSFunctionValidation(t *testing.T) {
+	for _, bad := range []string{"nameonly", "n=1 + 1", "bad name=function() {}"} {
+		if _, _, err := parseJSFunction(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+
+	form := url.Values{"group": {"1000"}, "ptr": {"/a"}, "reducer": {"js:missing"}}
+	if _, err := parseQueryParams(form); err == nil {
+		t.Errorf("Expected an error for an undefined function")
+	}
+}
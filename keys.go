@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Keys are timestamps, but some writers append a suffix to tell apart
+// documents stored at the same instant (e.g. 2013-01-01T00:00:00Z#2).
+// Such keys are grouped by their timestamp prefix.
+
+// splitKey separates a key's timestamp from anything after it.
+func splitKey(k string) (string, string) {
+	i := strings.IndexByte(k, 'Z')
+	if i < 0 {
+		return k, ""
+	}
+	return k[:i+1], k[i+1:]
+}
+
+// keyInfo describes how a raw key decodes.
+type keyInfo struct {
+	Key        string `json:"key"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	UnixNano   int64  `json:"unix_nano,omitempty"`
+	Suffix     string `json:"suffix,omitempty"`
+	Valid      bool   `json:"valid"`
+	Collision  bool   `json:"collision,omitempty"`
+	OutOfOrder bool   `json:"out_of_order,omitempty"`
+}
+
+// keyInspector decodes keys in order, noting problems relative to the
+// keys before them.
+type keyInspector struct {
+	prefixCounts map[string]int
+	last         int64
+	lastPrefix   string
+	Keys         int `json:"keys"`
+	Unparseable  int `json:"unparseable"`
+	Collisions   int `json:"collisions"`
+	OutOfOrder   int `json:"out_of_order"`
+}
+
+func newKeyInspector() *keyInspector {
+	return &keyInspector{prefixCounts: map[string]int{}, last: -1}
+}
+
+func (ki *keyInspector) inspect(k string) keyInfo {
+	ki.Keys++
+	rv := keyInfo{Key: k}
+	prefix, suffix := splitKey(k)
+	rv.Suffix = suffix
+	n := parseKey(k)
+	if n < 0 {
+		ki.Unparseable++
+		return rv
+	}
+	rv.Valid = true
+	rv.UnixNano = n
+	rv.Timestamp = time.Unix(0, n).UTC().Format(time.RFC3339Nano)
+
+	ki.prefixCounts[prefix]++
+	if ki.prefixCounts[prefix] > 1 || prefix == ki.lastPrefix {
+		rv.Collision = true
+		ki.Collisions++
+	}
+	if n < ki.last {
+		rv.OutOfOrder = true
+		ki.OutOfOrder++
+	}
+	ki.last, ki.lastPrefix = n, prefix
+	return rv
+}
+
+// collisions returns the timestamp prefixes shared by several keys.
+func (ki *keyInspector) collisions() map[string]int {
+	rv := map[string]int{}
+	for p, n := range ki.prefixCounts {
+		if n > 1 {
+			rv[p] = n
+		}
+	}
+	return rv
+}
+
+// debugKeys lists raw keys in a range with how they decode, for
+// tracking down colliding or misordered keys.
+func debugKeys(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	from, err := cleanupRangeParam(args[0], req.FormValue("from"), "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(args[0], req.FormValue("to"), "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+	p, err := parsePage(req, from, to, 1000)
+	if err != nil {
+		emitError(400, w, "Bad paging value", err.Error())
+		return
+	}
+
+	ki := newKeyInspector()
+	keys := []keyInfo{}
+	next := ""
+	n := 0
+	err = p.walkKeys(args[0], func(k string) error {
+		onPage, isNext := p.take(n)
+		n++
+		if isNext {
+			next = k
+			return io.EOF
+		}
+		if onPage {
+			keys = append(keys, ki.inspect(k))
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		emitError(500, w, "Error walking keys", err.Error())
+		return
+	}
+	setNextPage(w, next)
+	rv := map[string]interface{}{
+		"keys":       keys,
+		"summary":    ki,
+		"collisions": ki.collisions(),
+		"truncated":  next != "",
+	}
+	if next != "" {
+		rv["next"] = next
+	}
+	mustEncode(200, w, rv)
+}
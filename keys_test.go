@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitKey(t *testing.T) {
+	tests := []struct {
+		k, ts, suffix string
+	}{
+		{"2013-01-01T00:00:00Z", "2013-01-01T00:00:00Z", ""},
+		{"2013-01-01T00:00:00Z#2", "2013-01-01T00:00:00Z", "#2"},
+		{"junk", "junk", ""},
+	}
+	for _, test := range tests {
+		ts, suffix := splitKey(test.k)
+		if ts != test.ts || suffix != test.suffix {
+			t.Errorf("Expected %q to split into %q %q, got %q %q",
+				test.k, test.ts, test.suffix, ts, suffix)
+		}
+	}
+
+	if parseKey("2013-01-01T00:00:00Z#2") != parseKey("2013-01-01T00:00:00Z") {
+		t.Errorf("Expected a suffixed key to parse as its prefix")
+	}
+}
+
+func TestKeyInspector(t *testing.T) {
+	ki := newKeyInspector()
+	for _, k := range []string{
+		"2013-01-01T00:00:00Z",
+		"2013-01-01T00:00:00Z#2",
+		"2013-01-01T00:00:01Z",
+		"2012-01-01T00:00:00Z",
+		"junk",
+	} {
+		ki.inspect(k)
+	}
+	if ki.Keys != 5 || ki.Collisions != 1 || ki.OutOfOrder != 1 ||
+		ki.Unparseable != 1 {
+		t.Errorf("Unexpected summary: %+v", ki)
+	}
+	c := ki.collisions()
+	if len(c) != 1 || c["2013-01-01T00:00:00Z"] != 2 {
+		t.Errorf("Expected one colliding prefix, got %v", c)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Log lines have a level (debug, info, warn or error) and come from a
+// component, and may carry fields, given as alternating keys and
+// values:
+//
+//	dbLog.Info("compacted", "db", name, "took", took)
+//
+// A component logs at -logLevel (debug with -v) unless -logLevels
+// gives it its own, e.g. "database=debug,http=warn".  PUT /_logging
+// changes components' levels until restart.  With -logJSON, each line
+// is a JSON object with time, level, component, msg and the fields.
+//
+// Lines logged without a level, through log.Printf, always appear, as
+// info from the server component.
+
+var logLevel = stringFlag("logLevel", "info",
+	"Lowest level to log: debug, info, warn or error")
+var logLevels = stringFlag("logLevels", "",
+	"Per-component log levels, e.g. database=debug,http=warn")
+var logJSON = flag.Bool("logJSON", false, "Log as JSON lines")
+
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l level) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(s string) (level, error) {
+	for i, n := range levelNames {
+		if s == n {
+			return level(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level: %v", s)
+}
+
+// parseLevels parses component=level pairs, as in -logLevels.
+func parseLevels(s string) (map[string]level, error) {
+	rv := map[string]level{}
+	for _, kv := range commaList(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected component=level, got %v", kv)
+		}
+		l, err := parseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		rv[strings.TrimSpace(parts[0])] = l
+	}
+	return rv, nil
+}
+
+func validLogLevels() error {
+	if _, err := parseLevel(logLevel.get()); err != nil {
+		return err
+	}
+	_, err := parseLevels(logLevels.get())
+	return err
+}
+
+type logger string
+
+var logLock = sync.Mutex{}
+var logComponents = map[string]bool{}
+var logOverrides = map[string]level{}
+
+var dbLog = newLogger("database")
+var httpLog = newLogger("http")
+var queryLog = newLogger("query")
+var serverLog = newLogger("server")
+
+func newLogger(component string) logger {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logComponents[component] = true
+	return logger(component)
+}
+
+// componentLevel is the lowest level a component logs.
+func componentLevel(component string) level {
+	logLock.Lock()
+	l, ok := logOverrides[component]
+	logLock.Unlock()
+	if ok {
+		return l
+	}
+	if m, err := parseLevels(logLevels.get()); err == nil {
+		if l, ok := m[component]; ok {
+			return l
+		}
+	}
+	if *verbose {
+		return levelDebug
+	}
+	l, _ = parseLevel(logLevel.get())
+	return l
+}
+
+func (l logger) enabled(lvl level) bool {
+	return lvl >= componentLevel(string(l))
+}
+
+func (l logger) Debug(msg string, kv ...interface{}) {
+	l.log(levelDebug, msg, kv)
+}
+
+func (l logger) Info(msg string, kv ...interface{}) {
+	l.log(levelInfo, msg, kv)
+}
+
+func (l logger) Warn(msg string, kv ...interface{}) {
+	l.log(levelWarn, msg, kv)
+}
+
+func (l logger) Error(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+}
+
+// Fatal logs an error regardless of level, and exits.
+func (l logger) Fatal(msg string, kv ...interface{}) {
+	writeLog(levelError, string(l), msg, kv)
+	os.Exit(1)
+}
+
+func (l logger) log(lvl level, msg string, kv []interface{}) {
+	if l.enabled(lvl) {
+		writeLog(lvl, string(l), msg, kv)
+	}
+}
+
+// Where log lines go, and whether text lines get a timestamp (syslog
+// adds its own).
+var logOutput io.Writer = os.Stderr
+var logStamp = true
+var logOutputLock = sync.Mutex{}
+
+// logValue is how a field's value is written.  Errors and durations
+// would otherwise come out as {} or nanoseconds in JSON.
+func logValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return v
+}
+
+func formatLog(now time.Time, lvl level, component, msg string,
+	kv []interface{}) []byte {
+
+	if len(kv)%2 == 1 {
+		kv = append(kv, "(missing)")
+	}
+	if *logJSON {
+		m := map[string]interface{}{
+			"time":      now.UTC().Format(time.RFC3339Nano),
+			"level":     lvl.String(),
+			"component": component,
+			"msg":       msg,
+		}
+		for i := 0; i < len(kv); i += 2 {
+			k := fmt.Sprint(kv[i])
+			if _, taken := m[k]; taken {
+				k = "field." + k
+			}
+			m[k] = logValue(kv[i+1])
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			b, _ = json.Marshal(map[string]interface{}{
+				"time": m["time"], "level": m["level"],
+				"component": component, "msg": msg,
+				"log_error": err.Error(),
+			})
+		}
+		return append(b, '\n')
+	}
+
+	parts := []string{}
+	if logStamp {
+		parts = append(parts, now.Format("2006/01/02 15:04:05"))
+	}
+	parts = append(parts, strings.ToUpper(lvl.String()), component+":", msg)
+	for i := 0; i < len(kv); i += 2 {
+		v := fmt.Sprint(logValue(kv[i+1]))
+		if strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		parts = append(parts, fmt.Sprintf("%v=%v", kv[i], v))
+	}
+	return []byte(strings.Join(parts, " ") + "\n")
+}
+
+func writeLog(lvl level, component, msg string, kv []interface{}) {
+	b := formatLog(time.Now(), lvl, component, msg, kv)
+	logOutputLock.Lock()
+	defer logOutputLock.Unlock()
+	logOutput.Write(b)
+}
+
+// stdLog carries lines from the log package into the same output.
+type stdLog struct{}
+
+func (stdLog) Write(p []byte) (int, error) {
+	writeLog(levelInfo, string(serverLog),
+		strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// setLogOutput sends all logging to w.
+func setLogOutput(w io.Writer, stamp bool) {
+	logOutputLock.Lock()
+	logOutput, logStamp = w, stamp
+	logOutputLock.Unlock()
+	log.SetOutput(stdLog{})
+	log.SetFlags(0)
+}
+
+func getLogging(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	logLock.Lock()
+	names := []string{}
+	for c := range logComponents {
+		names = append(names, c)
+	}
+	overridden := map[string]string{}
+	for c, l := range logOverrides {
+		overridden[c] = l.String()
+	}
+	logLock.Unlock()
+	sort.Strings(names)
+
+	components := map[string]string{}
+	for _, c := range names {
+		components[c] = componentLevel(c).String()
+	}
+	mustEncode(200, w, map[string]interface{}{
+		"level":      logLevel.get(),
+		"json":       *logJSON,
+		"components": components,
+		"overrides":  overridden,
+	})
+}
+
+// putLogging sets components' levels, e.g.
+//
+//	{"components": {"database": "debug", "http": ""}}
+//
+// where an empty level goes back to the flags.
+func putLogging(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	in := struct {
+		Components map[string]string `json:"components"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+		emitError(400, w, "Bad logging config", err.Error())
+		return
+	}
+	set := map[string]level{}
+	for c, s := range in.Components {
+		if s == "" {
+			continue
+		}
+		l, err := parseLevel(s)
+		if err != nil {
+			emitError(400, w, "Bad logging config", err.Error())
+			return
+		}
+		set[c] = l
+	}
+
+	logLock.Lock()
+	for c, s := range in.Components {
+		if s == "" {
+			delete(logOverrides, c)
+			continue
+		}
+		logOverrides[c] = set[c]
+		logComponents[c] = true
+	}
+	logLock.Unlock()
+	getLogging(parts, w, req)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+func TestLogLevels(t *testing.T) {
+	defer func(l, ls string, v bool) {
+		logLevel.set(l)
+		logLevels.set(ls)
+		*verbose = v
+		logOverrides = map[string]level{}
+	}(logLevel.get(), logLevels.get(), *verbose)
+	logLevel.set("warn")
+	logLevels.set("database=debug")
+	*verbose = false
+
+	if !dbLog.enabled(levelDebug) || httpLog.enabled(levelInfo) ||
+		!httpLog.enabled(levelError) {
+		t.Errorf("Expected database at debug and http at warn")
+	}
+
+	logLevels.set("database=loud")
+	if validLogLevels() == nil {
+		t.Errorf("Expected an error for a bad component level")
+	}
+	logLevels.set("")
+
+	defer func(a string) { *adminAuth = a }(*adminAuth)
+	*adminAuth = "sekrit"
+	req, _ := http.NewRequest("PUT", "/_logging",
+		strings.NewReader(`{"components": {"http": "debug"}}`))
+	w := httptest.NewRecorder()
+	putLogging(nil, w, req)
+	if w.Code != 401 || httpLog.enabled(levelDebug) {
+		t.Errorf("Expected 401 without credentials, got %v", w.Code)
+	}
+	*adminAuth = ""
+
+	req, _ = http.NewRequest("PUT", "/_logging",
+		strings.NewReader(`{"components": {"http": "debug"}}`))
+	w = httptest.NewRecorder()
+	putLogging(nil, w, req)
+	if w.Code != 200 || !httpLog.enabled(levelDebug) ||
+		queryLog.enabled(levelInfo) {
+		t.Errorf("Expected http at debug only, got %v: %s", w.Code, w.Body)
+	}
+
+	req, _ = http.NewRequest("PUT", "/_logging",
+		strings.NewReader(`{"components": {"http": ""}}`))
+	putLogging(nil, httptest.NewRecorder(), req)
+	if httpLog.enabled(levelInfo) {
+		t.Errorf("Expected http back at warn")
+	}
+
+	req, _ = http.NewRequest("PUT", "/_logging",
+		strings.NewReader(`{"components": {"http": "chatty"}}`))
+	w = httptest.NewRecorder()
+	putLogging(nil, w, req)
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for a bad level, got %v", w.Code)
+	}
+}
+
+func TestFormatLog(t *testing.T) {
+	defer func(j, s bool) { *logJSON, logStamp = j, s }(*logJSON, logStamp)
+	now := time.Date(2012, 8, 10, 12, 0, 0, 0, time.UTC)
+	kv := []interface{}{"db", "my db", "took", time.Second,
+		"err", errors.New("oops")}
+
+	*logJSON, logStamp = false, false
+	got := string(formatLog(now, levelWarn, "database", "closed", kv))
+	exp := `WARN database: closed db="my db" took=1s err=oops` + "\n"
+	if got != exp {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+
+	*logJSON = true
+	m := map[string]interface{}{}
+	b := formatLog(now, levelWarn, "database", "closed", kv)
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("Error decoding %s: %v", b, err)
+	}
+	if m["level"] != "warn" || m["component"] != "database" ||
+		m["msg"] != "closed" || m["db"] != "my db" || m["took"] != "1s" ||
+		m["err"] != "oops" || m["time"] != "2012-08-10T12:00:00Z" {
+		t.Errorf("Unexpected JSON log line: %s", b)
+	}
+}
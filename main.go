@@ -5,12 +5,12 @@ import (
 	"fmt"
 	"log"
 	"log/syslog"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"runtime"
 	"runtime/pprof"
-	"strings"
 	"time"
 
 	"github.com/dustin/gojson"
@@ -18,15 +18,41 @@ import (
 )
 
 var dbRoot = flag.String("root", "db", "Root directory for database files.")
-var flushTime = flag.Duration("flushDelay", time.Second*5,
+var flushTime = durationFlag("flushDelay", time.Second*5,
 	"Maximum amount of time to wait before flushing")
 var liveTime = flag.Duration("liveTime", time.Minute*5,
 	"How long to keep an idle DB open")
-var maxOpQueue = flag.Int("maxOpQueue", 1000,
+var maxOpQueue = intFlag("maxOpQueue", 1000,
 	"Maximum number of queued items before flushing")
+var queuePolicy = stringFlag("queuePolicy", queueBlock,
+	"What to do when a write queue is full: block, reject, or drop")
+var queueTimeout = durationFlag("queueTimeout", 0,
+	"How long a blocked write may wait (0 for forever)")
+var maxDurability = durationFlag("maxDurability", 0,
+	"Adapt flushing to commit writes within this time (0 for fixed flushDelay/maxOpQueue)")
+var pinWriters = flag.Bool("pinWriters", false,
+	"Give each database writer its own OS thread")
+var writerNice = flag.Int("writerNice", 0,
+	"Nice value for pinned writer threads (0 to leave alone)")
+var writerProcs = flag.Int("writerProcs", 0,
+	"Extra GOMAXPROCS beyond what query workers are sized for")
 var staticPath = flag.String("static", "static", "Path to static data")
-var queryTimeout = flag.Duration("maxQueryTime", time.Minute*5,
+var queryTimeout = durationFlag("maxQueryTime", time.Minute*5,
 	"Maximum amount of time a query is allowed to process.")
+var defaultQueryTime = durationFlag("defaultQueryTime", 0,
+	"Time a query may run when it doesn't specify a timeout (0 for maxQueryTime)")
+var maxHeavyQueries = flag.Int("maxQueries", 0,
+	"Maximum concurrent queries and scans (0 for unlimited)")
+var maxDocGets = flag.Int("maxDocGets", 0,
+	"Maximum concurrent document fetches (0 for unlimited)")
+var maxAdminOps = flag.Int("maxAdminOps", 0,
+	"Maximum concurrent admin operations like compaction (0 for unlimited)")
+var maxIngest = flag.Int("maxIngest", 0,
+	"Maximum concurrent document writes (0 for unlimited)")
+var admissionWait = flag.Duration("admissionWait", 0,
+	"How long a request may wait for a free slot before being rejected")
+var admissionRetry = flag.Int("admissionRetry", 1,
+	"Retry-After seconds sent when a request is rejected")
 var queryBacklog = flag.Int("queryBacklog", 0, "Query scan/group backlog size")
 var docBacklog = flag.Int("docBacklog", 0, "MR group request backlog size")
 var cacheAddr = flag.String("memcache", "", "Memcached server to connect to")
@@ -35,7 +61,41 @@ var cacheWorkers = flag.Int("cacheWorkers", 4, "Number of cache workers")
 var verbose = flag.Bool("v", false, "Verbose logging")
 var logAccess = flag.Bool("logAccess", false, "Log HTTP Requests")
 var useSyslog = flag.Bool("syslog", false, "Log to syslog")
-var minQueryLogDuration = flag.Duration("minQueryLogDuration",
+var recentBuffer = flag.Duration("recentBuffer", 0,
+	"How much recent data to keep in memory for queries (0 to disable)")
+var strictJSON = flag.Bool("strictJSON", false,
+	"Reject memcached writes that aren't valid JSON, as HTTP writes are")
+var quarantineMalformed = flag.Bool("quarantine", false,
+	"Keep writes rejected as malformed JSON in <db>"+errorsDBSuffix)
+var trackSchema = flag.Bool("trackSchema", true,
+	"Record which fields appear in documents for drift reports")
+var archiveURL = flag.String("archiveURL", "",
+	"S3-compatible bucket URL to archive old shards to")
+var archiveAfter = flag.Duration("archiveAfter", 7*24*time.Hour,
+	"How long after a shard ends to archive it")
+var archiveInterval = flag.Duration("archiveInterval", time.Hour,
+	"How often to look for shards to archive")
+var archiveCacheSize = flag.Int("archiveCache", 10,
+	"How many archived shards to keep fetched locally")
+var archiveAccessKey = flag.String("archiveAccessKey", "",
+	"Access key for the archive bucket")
+var archiveSecretKey = flag.String("archiveSecretKey", "",
+	"Secret key for the archive bucket")
+var archiveRegion = flag.String("archiveRegion", "us-east-1",
+	"Region of the archive bucket")
+var selfStats = flag.Duration("selfStats", 0,
+	"How often to record server metrics in "+selfStatsDB+" (0 to disable)")
+var maintenanceInterval = flag.Duration("maintenanceInterval", time.Minute,
+	"How often to apply database retention and compaction settings")
+var scheduleCheck = flag.Duration("scheduleCheck", time.Minute,
+	"How often to look for scheduled queries to run")
+var smtpAddr = flag.String("smtpAddr", "",
+	"SMTP server (host:port) for emailing scheduled query results")
+var smtpFrom = flag.String("smtpFrom", "seriesly@localhost",
+	"Sender address for emailed results")
+var defaultFormat = flag.Int("format", 1,
+	"Storage format version for newly created databases")
+var minQueryLogDuration = durationFlag("minQueryLogDuration",
 	time.Millisecond*100, "minimum query duration to log")
 
 // Profiling
@@ -54,7 +114,13 @@ type routingEntry struct {
 	Deadline time.Duration
 }
 
-const dbMatch = "[-%+()$_a-zA-Z0-9]+"
+const dbMatch = "[-%+()$_a-zA-Z0-9" + tenantSep + "]+"
+
+// The path of the query handlers, which get the query timeout as their
+// deadline once flags are parsed.
+const queryPath = "^/(" + dbMatch + ")/_query$"
+
+var reservedPath = regexp.MustCompile("^/_(.*)")
 
 var defaultDeadline = time.Millisecond * 50
 
@@ -64,14 +130,56 @@ func init() {
 	routingTable = []routingEntry{
 		routingEntry{"GET", regexp.MustCompile("^/$"),
 			serverInfo, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_healthz$"),
+			healthz, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_readyz$"),
+			readyz, defaultDeadline},
 		routingEntry{"GET", regexp.MustCompile("^/_static/(.*)"),
 			staticHandler, defaultDeadline},
 		routingEntry{"GET", regexp.MustCompile("^/_debug/open$"),
 			debugListOpenDBs, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_debug/dbconns$"),
+			debugListWriters, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_debug/readpool$"),
+			debugReadPool, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_debug/goroutines$"),
+			debugGoroutines, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_debug/pprof/([a-z]*)$"),
+			debugPprof, time.Minute},
+		routingEntry{"POST", regexp.MustCompile("^/_debug/pprof/(symbol)$"),
+			debugPprof, defaultDeadline},
 		// Database stuff
 		routingEntry{"GET", regexp.MustCompile("^/_all_dbs$"),
 			listDatabases, defaultDeadline},
-		routingEntry{"GET", regexp.MustCompile("^/_(.*)"),
+		routingEntry{"GET", regexp.MustCompile("^/_stats$"),
+			serverStats, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_tenants$"),
+			listTenants, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_tenants/([a-z][-_a-z0-9]*)$"),
+			getTenant, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/_tenants/([a-z][-_a-z0-9]*)$"),
+			putTenant, defaultDeadline},
+		routingEntry{"DELETE", regexp.MustCompile("^/_tenants/([a-z][-_a-z0-9]*)$"),
+			deleteTenant, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_slowlog$"),
+			getSlowLog, defaultDeadline},
+		routingEntry{"DELETE", regexp.MustCompile("^/_slowlog$"),
+			deleteSlowLog, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_logging$"),
+			getLogging, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/_logging$"),
+			putLogging, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_trash$"),
+			getTrash, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_ratelimits$"),
+			getRateLimits, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/_ratelimits$"),
+			putRateLimits, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_multi_query$"),
+			heavyLane.admit(jsonp(multiQuery)), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/_config/reload$"),
+			postConfigReload, defaultDeadline},
+		routingEntry{"GET", reservedPath,
 			reservedHandler, defaultDeadline},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/?$"),
 			dbInfo, defaultDeadline},
@@ -79,27 +187,128 @@ func init() {
 			checkDB, defaultDeadline},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_changes$"),
 			dbChanges, defaultDeadline},
-		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_query$"),
-			query, *queryTimeout},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_export_changes$"),
+			heavyLane.admit(exportChanges), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_import_changes$"),
+			ingestLane.admit(importChanges), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile(queryPath),
+			heavyLane.admit(jsonp(query)), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile(queryPath),
+			heavyLane.admit(postQuery), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_explain$"),
+			heavyLane.admit(explain), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_query_into$"),
+			heavyLane.admit(queryInto), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_events$"),
+			heavyLane.admit(listEvents), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_grafana/?$"),
+			grafanaTest, defaultDeadline},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_grafana/search$"),
+			grafanaSearch, defaultDeadline},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_grafana/query$"),
+			heavyLane.admit(grafanaQueryHandler), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_grafana/annotations$"),
+			heavyLane.admit(grafanaAnnotations), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_views$"),
+			listViews, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_views/(" + viewMatch + ")$"),
+			heavyLane.admit(jsonp(getView)), queryTimeout.get()},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_views/(" + viewMatch + ")$"),
+			putView, defaultDeadline},
+		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/_views/(" + viewMatch + ")$"),
+			deleteView, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_schedules$"),
+			listSchedules, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_schedules/(" + viewMatch + ")$"),
+			putSchedule, defaultDeadline},
+		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/_schedules/(" + viewMatch + ")$"),
+			deleteSchedule, defaultDeadline},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_schedules/(" + viewMatch + ")/_run$"),
+			heavyLane.admit(runScheduleNow), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_bulk$"),
+			ingestLane.admit(bulkStore), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_bulk_get$"),
+			fastLane.admit(bulkGet), queryTimeout.get()},
+		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/_range$"),
+			adminLane.admit(deleteRange), queryTimeout.get()},
+		// The old name for _range.
 		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/_bulk$"),
-			deleteBulk, *queryTimeout},
+			adminLane.admit(deleteRange), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_delete_by_query$"),
+			adminLane.admit(deleteByQuery), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_keys$"),
+			heavyLane.admit(debugKeys), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_shards$"),
+			listShards, defaultDeadline},
+		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/_shards/([0-9]{4}-[0-9]{2}-[0-9]{2})$"),
+			adminLane.admit(deleteShard), defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_federation$"),
+			getFederation, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_federation$"),
+			putFederation, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_schema_drift$"),
+			schemaDrift, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_quota$"),
+			getQuota, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_quota$"),
+			putQuota, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_config$"),
+			getConfig, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_config$"),
+			putConfig, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_schema$"),
+			getFieldSchema, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_schema$"),
+			putFieldSchema, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_exclusions$"),
+			getExclusions, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_exclusions$"),
+			putExclusions, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_rollups$"),
+			getRollups, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_rollups$"),
+			putRollups, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_value_index$"),
+			getValueIndex, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_value_index$"),
+			adminLane.admit(putValueIndex), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_value_index/_rebuild$"),
+			adminLane.admit(rebuildValueIndex), queryTimeout.get()},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_indexes$"),
+			getFieldIndex, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/_indexes$"),
+			adminLane.admit(putFieldIndex), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_indexes/_rebuild$"),
+			adminLane.admit(rebuildFieldIndex), queryTimeout.get()},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_all"),
-			allDocs, *queryTimeout},
+			heavyLane.admit(allDocs), queryTimeout.get()},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_dump"),
-			dumpDocs, *queryTimeout},
+			heavyLane.admit(dumpDocs), queryTimeout.get()},
 		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_compact"),
-			compact, time.Second * 30},
+			adminLane.admit(compact), time.Second * 30},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_undelete$"),
+			adminLane.admit(undeleteDB), defaultDeadline},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_clone$"),
+			adminLane.admit(cloneDB), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_rename$"),
+			adminLane.admit(moveDB(opRename)), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_copy$"),
+			adminLane.admit(moveDB(opCopy)), queryTimeout.get()},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_migrate$"),
+			adminLane.admit(migrate), queryTimeout.get()},
 		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/?$"),
 			createDB, defaultDeadline},
 		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/?$"),
 			deleteDB, defaultDeadline},
 		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/?$"),
-			newDocument, defaultDeadline},
+			ingestLane.admit(newDocument), defaultDeadline},
 		// Document stuff
 		routingEntry{"PUT", regexp.MustCompile("^/(" + dbMatch + ")/([^/]+)$"),
-			putDocument, defaultDeadline},
+			ingestLane.admit(putDocument), defaultDeadline},
+		routingEntry{"PATCH", regexp.MustCompile("^/(" + dbMatch + ")/([^/]+)$"),
+			ingestLane.admit(patchDocument), defaultDeadline},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/([^/]+)$"),
-			getDocument, defaultDeadline},
+			fastLane.admit(jsonp(getDocument)), defaultDeadline},
 		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/([^/]+)$"),
 			rmDocument, defaultDeadline},
 		// Pre-flight goodness
@@ -119,6 +328,12 @@ func mustEncode(status int, w http.ResponseWriter, ob interface{}) {
 }
 
 func emitError(status int, w http.ResponseWriter, e, reason string) {
+	switch {
+	case status >= 500:
+		serverStatsCollector.add(statError, 1)
+	case status >= 400:
+		serverStatsCollector.add(statClientError, 1)
+	}
 	m := map[string]string{"error": e, "reason": reason}
 	mustEncode(status, w, m)
 }
@@ -151,13 +366,16 @@ func handleOptions(parts []string, w http.ResponseWriter, req *http.Request) {
 			methods = append(methods, r.Method)
 		}
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	setPreflight(w, req, methods)
 	w.WriteHeader(204)
 }
 
 func findHandler(method, path string) (routingEntry, []string) {
 	for _, r := range routingTable {
+		if r.Path == reservedPath &&
+			(isSelfStatsPath(path) || isAuditPath(path)) {
+			continue
+		}
 		if r.Method == method {
 			matches := r.Path.FindAllStringSubmatch(path, 1)
 			if len(matches) > 0 {
@@ -171,14 +389,28 @@ func findHandler(method, path string) (routingEntry, []string) {
 
 func handler(w http.ResponseWriter, req *http.Request) {
 	if *logAccess {
-		log.Printf("%s %s %s", req.RemoteAddr, req.Method, req.URL)
+		httpLog.Info("request", "remote", req.RemoteAddr,
+			"method", req.Method, "url", req.URL)
+	}
+	setCORS(w, req)
+	w.Header().Set("Content-type", "application/json")
+	if *auditLog != "" {
+		aw := &auditWriter{ResponseWriter: w}
+		w = aw
+		defer func() { auditRequest(req, aw.status) }()
 	}
+	req, ok := routeTenant(w, req)
+	if !ok || !checkAuditAccess(w, req) {
+		return
+	}
+
 	route, hparts := findHandler(req.Method, req.URL.Path)
 	defer yellow.DeadlineLog(route.Deadline, "%v:%v with deadlined at %v",
 		req.Method, req.URL.Path, route.Deadline).Done()
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-type", "application/json")
+	if !authorize(w, req) || !checkWritable(w, req) {
+		return
+	}
 	route.Handler(hparts, w, req)
 }
 
@@ -202,52 +434,98 @@ func startProfiler() {
 
 }
 
-func main() {
-	halfProcs := runtime.GOMAXPROCS(0) / 2
-	if halfProcs < 1 {
-		halfProcs = 1
+func halfProcs() int {
+	if n := runtime.GOMAXPROCS(0) / 2; n > 1 {
+		return n
 	}
-	queryWorkers := flag.Int("queryWorkers", halfProcs,
-		"Number of query tree walkers.")
-	docWorkers := flag.Int("docWorkers", halfProcs,
-		"Number of document mapreduce workers.")
+	return 1
+}
+
+var queryWorkers = intFlag("queryWorkers", halfProcs(),
+	"Number of query tree walkers.")
+var docWorkers = intFlag("docWorkers", halfProcs(),
+	"Number of document mapreduce workers.")
 
+func main() {
 	addr := flag.String("addr", ":3133", "Address to bind to")
 	mcaddr := flag.String("memcbind", "", "Memcached server bind address")
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error loading %v: %v", *configFile, err)
+	}
+
+	if *writerProcs > 0 {
+		runtime.GOMAXPROCS(runtime.GOMAXPROCS(0) + *writerProcs)
+	}
 
 	if *useSyslog {
 		sl, err := syslog.New(syslog.LOG_INFO, "seriesly")
 		if err != nil {
 			log.Fatalf("Can't initialize syslog: %v", err)
 		}
-		log.SetOutput(sl)
-		log.SetFlags(0)
+		setLogOutput(sl, false)
+	} else {
+		setLogOutput(os.Stderr, true)
 	}
 
 	if err := os.MkdirAll(*dbRoot, 0777); err != nil {
 		log.Fatalf("Could not create %v: %v", *dbRoot, err)
 	}
+	if !*readOnly {
+		cleanupRewrites(*dbRoot)
+	}
+	if err := loadTenants(); err != nil {
+		log.Fatalf("Error loading tenants: %v", err)
+	}
+	if err := loadRateLimits(); err != nil {
+		log.Fatalf("Error loading rate limits: %v", err)
+	}
 
-	// Update the query handler deadline to the query timeout
-	found := false
+	// Update the query handler deadlines to the query timeout
+	found := 0
 	for i := range routingTable {
-		matches := routingTable[i].Path.FindAllStringSubmatch("/x/_query", 1)
-		if len(matches) > 0 {
-			routingTable[i].Deadline = *queryTimeout
-			found = true
-			break
+		r := &routingTable[i]
+		if (r.Method == "GET" || r.Method == "POST") &&
+			r.Path != nil && r.Path.String() == queryPath {
+			r.Deadline = queryTimeout.get()
+			found++
 		}
 	}
-	if !found {
+	if found != 2 {
 		log.Fatalf("Programming error:  Could not find query handler")
 	}
 
-	processorInput = make(chan *processIn, *docBacklog)
-	for i := 0; i < *docWorkers; i++ {
-		go docProcessor(processorInput)
+	if err := validQueuePolicy(queuePolicy.get()); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := validLogLevels(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if *archiveURL != "" {
+		archive = newObjectStore(*archiveURL)
+		if !*readOnly {
+			go archiver()
+		}
 	}
 
+	if *selfStats > 0 && !*readOnly {
+		go selfStatsRecorder(*selfStats)
+	}
+	go scheduler()
+	if !*readOnly {
+		go maintainer()
+		go diskWatchdog()
+	}
+
+	heavyLane.setLimit(*maxHeavyQueries)
+	fastLane.setLimit(*maxDocGets)
+	adminLane.setLimit(*maxAdminOps)
+	ingestLane.setLimit(*maxIngest)
+
+	processorInput = make(chan *processIn, *docBacklog)
+	docPool.resize(docWorkers.get())
+
 	if *cacheAddr == "" {
 		cacheInput = processorInput
 		// Note: cacheInputSet will be null here, there should be no caching
@@ -260,23 +538,43 @@ func main() {
 	}
 
 	queryInput = make(chan *queryIn, *queryBacklog)
-	for i := 0; i < *queryWorkers; i++ {
-		go queryExecutor()
-	}
+	queryPool.resize(queryWorkers.get())
+	go handleReloads()
 
 	if *pprofFile != "" {
 		go startProfiler()
 	}
 
+	if err := loadInherited(); err != nil {
+		log.Fatalf("Error picking up inherited listeners: %v", err)
+	}
+	listeners := map[string]net.Listener{}
+
 	if *mcaddr != "" {
-		go listenMC(*mcaddr)
+		listeners["memcached"] = listenMC(*mcaddr)
+	}
+
+	ls, err := listen("http", *addr)
+	if err != nil {
+		log.Fatalf("Error binding to %v: %v", *addr, err)
 	}
+	listeners["http"] = ls
 
 	s := &http.Server{
 		Addr:        *addr,
 		Handler:     http.HandlerFunc(handler),
 		ReadTimeout: 5 * time.Second,
 	}
-	log.Printf("Listening to web requests on %s", *addr)
-	log.Fatal(s.ListenAndServe())
+	go handleUpgrades(s, listeners)
+	waitForOldProcess()
+
+	if l := listeners["memcached"]; l != nil {
+		go waitForMCConnections(l)
+	}
+	httpLog.Info("listening", "addr", *addr)
+	if err := s.Serve(ls); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// An upgrade is draining; it'll exit when it's done.
+	select {}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dustin/gojson"
+)
+
+// Writes over HTTP are always checked for valid JSON.  With
+// -strictJSON, memcached writes are too, rather than being stored as
+// given and breaking queries later.  With -quarantine, anything
+// rejected this way is kept in <db>_errors along with the reason, so
+// it can be looked at or repaired and replayed.
+
+const errorsDBSuffix = "_errors"
+
+func errorsDB(dbname string) string {
+	return ownerDB(dbname) + errorsDBSuffix
+}
+
+// quarantineDoc describes a rejected write.  Payloads that aren't
+// even UTF-8 are kept as bytes (base64 in JSON).
+func quarantineDoc(dbname, k, source string, body []byte,
+	err error) map[string]interface{} {
+
+	doc := map[string]interface{}{
+		"db":     dbname,
+		"source": source,
+		"error":  err.Error(),
+	}
+	if k != "" {
+		doc["key"] = k
+	}
+	if utf8.Valid(body) {
+		doc["payload"] = string(body)
+	} else {
+		doc["payload_bytes"] = body
+	}
+	return doc
+}
+
+// quarantine stores a malformed write if -quarantine is set,
+// returning the database it went to.
+func quarantine(dbname, k, source string, body []byte, err error) string {
+	if !*quarantineMalformed {
+		return ""
+	}
+	target := errorsDB(dbname)
+	b, jerr := json.Marshal(quarantineDoc(dbname, k, source, body, err))
+	if jerr == nil {
+		jerr = ensureDB(target)
+	}
+	if jerr == nil {
+		jerr = dbstore(target, time.Now().UTC().Format(time.RFC3339Nano), b)
+	}
+	if jerr != nil {
+		log.Printf("Error quarantining a write to %v: %v", dbname, jerr)
+		return ""
+	}
+	return target
+}
+
+// malformedReason explains a rejected write to the client.
+func malformedReason(err error, target string) string {
+	if target == "" {
+		return err.Error()
+	}
+	return err.Error() + " (kept in " + target + ")"
+}
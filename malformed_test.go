@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuarantineDoc(t *testing.T) {
+	err := errors.New("bad")
+	doc := quarantineDoc("db/2012", "", "http", []byte(`{"a":`), err)
+	if doc["payload"] != `{"a":` || doc["error"] != "bad" {
+		t.Errorf("Unexpected quarantine doc: %v", doc)
+	}
+	if _, ok := doc["key"]; ok {
+		t.Errorf("Expected no key in %v", doc)
+	}
+
+	doc = quarantineDoc("db", "k", "memcached", []byte{0xff, 0xfe}, err)
+	if _, ok := doc["payload_bytes"].([]byte); !ok || doc["key"] != "k" {
+		t.Errorf("Expected bytes in %v", doc)
+	}
+
+	if errorsDB("db/2012") != "db_errors" {
+		t.Errorf("Expected shards to quarantine to db_errors, got %v",
+			errorsDB("db/2012"))
+	}
+}
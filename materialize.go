@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Query results can be written into another database, one document
+// per group, laid out like rollups: the avg of /cpu/user is stored at
+// /cpu/user/avg.
+
+// queryResultsFor runs a query to completion against any kind of
+// database.
+func queryResultsFor(dbname string, p queryParams) (queryResults, error) {
+	if p.groupby != "" {
+		return nil, errGroupByResults
+	}
+	members := federationMembers(dbname)
+	if len(members) == 0 && dbShardPeriod(dbname) != "" {
+		from, err := cleanupRangeParam(dbname, p.from, "")
+		if err != nil {
+			return nil, &paramError{"Bad from value", err.Error()}
+		}
+		to, err := cleanupRangeParam(dbname, p.to, "")
+		if err != nil {
+			return nil, &paramError{"Bad to value", err.Error()}
+		}
+		members = shardsInRange(dbname, from, to)
+		if len(members) == 0 {
+			return queryResults{}, nil
+		}
+	}
+	if len(members) > 0 {
+		rv, _, err := federatedResults(members, p)
+		return rv, err
+	}
+	return localMemberQuery(dbname, p)
+}
+
+// resultDoc lays out one group's values by pointer and reducer.
+func resultDoc(p queryParams, vals []interface{}) map[string]interface{} {
+	byPointer := map[string]interface{}{}
+	for i, ptr := range p.ptrs {
+		if i < len(vals) {
+			byPointer[ptr+"/"+p.reds[i]] = vals[i]
+		}
+	}
+	return pointerDoc(byPointer)
+}
+
+// ensureDB creates a database with the default format if it doesn't
+// exist yet.
+func ensureDB(dbname string) error {
+	path := dbPath(dbname)
+	if _, err := os.Stat(path); err == nil || memDatabase(dbname) != nil {
+		return nil
+	}
+	if err := dbcreate(path); err != nil {
+		return err
+	}
+	return storeMeta(dbname, dbMeta{Format: *defaultFormat})
+}
+
+// materialize stores each group of results as a document in target
+// and waits for them to be committed.
+func materialize(target string, p queryParams, results queryResults) error {
+	if err := ensureDB(target); err != nil {
+		return err
+	}
+	for ts, vals := range results {
+		d, err := json.Marshal(resultDoc(p, vals))
+		if err != nil {
+			return err
+		}
+		k := time.Unix(0, ts*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+		if err := dbstore(target, k, d); err != nil {
+			return err
+		}
+	}
+	return dbflush(target)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dustin/gojson"
 	"github.com/dustin/gomemcached"
 	"github.com/dustin/gomemcached/server"
 )
@@ -26,6 +30,12 @@ func (sess *mcSession) HandleMessage(
 
 	switch req.Opcode {
 	case SELECT_BUCKET:
+		if strings.Contains(string(req.Key), tenantSep) {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("Tenant databases are only available over HTTP"),
+			}
+		}
 		log.Printf("Selecting bucket %s", req.Key)
 		sess.dbname = string(req.Key)
 	case gomemcached.SETQ, gomemcached.SET:
@@ -44,6 +54,16 @@ func (sess *mcSession) HandleMessage(
 			k = t.UTC().Format(time.RFC3339Nano)
 		}
 
+		if *strictJSON {
+			if err := json.Validate(req.Body); err != nil {
+				quarantine(sess.dbname, k, "memcached", req.Body, err)
+				return &gomemcached.MCResponse{
+					Status: gomemcached.EINVAL,
+					Body:   []byte("Invalid JSON: " + err.Error()),
+				}
+			}
+		}
+
 		err := dbstore(sess.dbname, k, req.Body)
 		if err != nil {
 			return &gomemcached.MCResponse{
@@ -51,6 +71,7 @@ func (sess *mcSession) HandleMessage(
 				Body:   []byte(err.Error()),
 			}
 		}
+		serverStatsCollector.add(statIngest, 1)
 
 		if req.Opcode == gomemcached.SETQ {
 			return nil
@@ -63,25 +84,52 @@ func (sess *mcSession) HandleMessage(
 	return &gomemcached.MCResponse{}
 }
 
+var mcConnsLock = sync.Mutex{}
+var mcConns = map[net.Conn]bool{}
+
+// closeMCConnections disconnects all memcached clients, e.g. so they
+// reconnect to an upgraded process.
+func closeMCConnections() {
+	mcConnsLock.Lock()
+	defer mcConnsLock.Unlock()
+	for c := range mcConns {
+		c.Close()
+	}
+}
+
+func handleMCConnection(s net.Conn) {
+	mcConnsLock.Lock()
+	mcConns[s] = true
+	mcConnsLock.Unlock()
+
+	memcached.HandleIO(s, &mcSession{})
+
+	mcConnsLock.Lock()
+	delete(mcConns, s)
+	mcConnsLock.Unlock()
+}
+
 func waitForMCConnections(ls net.Listener) {
 	for {
 		s, e := ls.Accept()
 		if e == nil {
 			log.Printf("Got a connection from %s", s.RemoteAddr())
-			go memcached.HandleIO(s, &mcSession{})
+			go handleMCConnection(s)
+		} else if errors.Is(e, net.ErrClosed) {
+			return
 		} else {
 			log.Printf("Error accepting from %s", ls)
 		}
 	}
 }
 
-func listenMC(bindaddr string) {
-	ls, e := net.Listen("tcp", bindaddr)
+func listenMC(bindaddr string) net.Listener {
+	ls, e := listen("memcached", bindaddr)
 	if e != nil {
 		log.Fatalf("Error binding to memcached socket:  %s", e)
 	}
 
 	log.Printf("Listening for memcached connections on %v", bindaddr)
 
-	waitForMCConnections(ls)
+	return ls
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Each query may hold up to -queryMemoryMB of documents and reducers
+// at once: the documents of a group waiting to be reduced, and those
+// being reduced, along with a set of reducers for each value with
+// groupby.  These are estimates, meant to stop one huge group or
+// groupby from taking the process down rather than to account for
+// every byte.  A query over budget is stopped, with a 507 if nothing
+// has been sent yet.
+
+var queryMemoryMB = intFlag("queryMemoryMB", 512,
+	"Memory a query may use for documents and reducers (0 for no limit)")
+
+var errQueryMemory = errors.New("query exceeded its memory budget " +
+	"(try a smaller group, range or groupby)")
+
+const (
+	// A document waiting in a group.
+	docInfoCost = 256
+	// A running reducer: its goroutine and channels.
+	reducerCost = 8 << 10
+)
+
+type queryBudget struct {
+	limit int64
+	used  int64
+}
+
+func newQueryBudget() *queryBudget {
+	return &queryBudget{limit: int64(queryMemoryMB.get()) << 20}
+}
+
+// charge counts n more bytes against the budget, reporting whether
+// the query's still within it.  A nil budget has no limit.
+func (b *queryBudget) charge(n int64) bool {
+	if b == nil {
+		return true
+	}
+	used := atomic.AddInt64(&b.used, n)
+	return b.limit <= 0 || used <= b.limit
+}
+
+// release gives back bytes charged.
+func (b *queryBudget) release(n int64) {
+	if b != nil {
+		atomic.AddInt64(&b.used, -n)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func TestQueryBudget(t *testing.T) {
+	b := &queryBudget{limit: 100}
+	if !b.charge(60) || b.charge(60) {
+		t.Errorf("Expected the second charge to go over")
+	}
+	b.release(60)
+	if !b.charge(40) {
+		t.Errorf("Expected released bytes to be available again")
+	}
+	var none *queryBudget
+	if !none.charge(1 << 40) {
+		t.Errorf("Expected no limit without a budget")
+	}
+
+	createMemDatabase("budgettest", memOptions{Policy: memEvict})
+	defer dropMemDatabase("budgettest")
+	keys := []string{"2013-01-01T00:00:00Z", "2013-01-01T00:00:01Z",
+		"2013-01-01T00:00:02Z"}
+	memDatabase("budgettest").commit([]memOp{
+		{keys[0], []byte(`{"host": "a", "v": 1}`), false},
+		{keys[1], []byte(`{"host": "b", "v": 2}`), false},
+		{keys[2], []byte(`{"host": "c", "v": 3}`), false},
+	})
+
+	run := func(groupby string, limit int64) (*processOut, *queryBudget) {
+		out := make(chan *processOut, 1)
+		budget := &queryBudget{limit: limit}
+		pi := &processIn{dbname: "budgettest", ptrs: []string{"/v"},
+			reds: []string{"sum"}, groupby: groupby,
+			before: time.Now().Add(time.Minute), quit: make(chan bool),
+			out: out, budget: budget}
+		for _, k := range keys {
+			pi.infos = append(pi.infos, couchstore.NewDocInfo(k, 0))
+		}
+		processDocs(pi)
+		return <-out, budget
+	}
+
+	if po, b := run("", 1000); po.err != nil || b.used != 0 {
+		t.Errorf("Expected a result and everything released, got %v, %v",
+			po.err, b.used)
+	}
+	if po, _ := run("", 30); po.err != errQueryMemory {
+		t.Errorf("Expected the documents to go over, got %v", po.err)
+	}
+	if po, b := run("/host", 3*reducerCost); po.err != errQueryMemory ||
+		b.used != 0 {
+		t.Errorf("Expected the groups to go over, got %v, %v", po.err, b.used)
+	}
+	if po, _ := run("/host", 4*reducerCost); po.err != nil || len(po.groups) != 3 {
+		t.Errorf("Expected three groups, got %v, %v", po.err, po.groups)
+	}
+}
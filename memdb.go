@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+var errNotOnDisk = errors.New("memory databases have no file")
+var errMemoryFull = errors.New("memory database is full")
+var errNotFound = errors.New("document not found")
+
+// What to do when a memory database grows beyond its size cap.
+const (
+	memEvict  = "evict"  // drop the oldest documents
+	memReject = "reject" // refuse new writes
+	memSpill  = "spill"  // move the oldest documents to a disk database
+)
+
+type memOptions struct {
+	MaxSize int64         `json:"max_size"`
+	TTL     time.Duration `json:"ttl"`
+	Policy  string        `json:"policy"`
+	SpillTo string        `json:"spill_to,omitempty"`
+}
+
+// A memDB is a database that lives entirely in RAM.  Keys are kept
+// sorted so walks behave the same as they do against couchstore.
+type memDB struct {
+	name string
+	opts memOptions
+
+	mu   sync.RWMutex
+	keys []string
+	docs map[string][]byte
+	size int64
+	seq  uint64
+
+	// For recent buffers, the key from which every write has been
+	// seen.  Older documents may be in the file but not here.
+	since string
+	// For recent buffers, keys deleted since the file was last
+	// committed, which may still be in it.  nil otherwise.
+	tombstones map[string]bool
+	// Whether a spill is queued to the spill database and not yet
+	// committed there.
+	spilling bool
+}
+
+var memLock = sync.Mutex{}
+var memDBs = map[string]*memDB{}
+
+func parseMemOptions(dbname string, form url.Values) (memOptions, error) {
+	opts := memOptions{Policy: memEvict}
+	var err error
+	if s := form.Get("max_size"); s != "" {
+		opts.MaxSize, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid max_size: %v", err)
+		}
+	}
+	if s := form.Get("ttl"); s != "" {
+		opts.TTL, err = time.ParseDuration(s)
+		if err != nil {
+			return opts, fmt.Errorf("invalid ttl: %v", err)
+		}
+	}
+	if s := form.Get("policy"); s != "" {
+		opts.Policy = s
+	}
+	switch opts.Policy {
+	case memEvict, memReject:
+	case memSpill:
+		opts.SpillTo = form.Get("spill")
+		if opts.SpillTo == "" || opts.SpillTo == dbname {
+			return opts, errors.New("spill policy requires another database")
+		}
+	default:
+		return opts, fmt.Errorf("unknown policy: %v", opts.Policy)
+	}
+	return opts, nil
+}
+
+func createMemDatabase(dbname string, opts memOptions) {
+	memLock.Lock()
+	defer memLock.Unlock()
+	if memDBs[dbname] == nil {
+		memDBs[dbname] = &memDB{name: dbname, opts: opts,
+			docs: map[string][]byte{}}
+	}
+}
+
+func memDatabase(dbname string) *memDB {
+	memLock.Lock()
+	defer memLock.Unlock()
+	return memDBs[dbname]
+}
+
+func dropMemDatabase(dbname string) bool {
+	memLock.Lock()
+	defer memLock.Unlock()
+	_, ok := memDBs[dbname]
+	delete(memDBs, dbname)
+	return ok
+}
+
+func memDatabaseNames() []string {
+	memLock.Lock()
+	defer memLock.Unlock()
+	rv := make([]string, 0, len(memDBs))
+	for k := range memDBs {
+		rv = append(rv, k)
+	}
+	return rv
+}
+
+func (m *memDB) full() bool {
+	if m.opts.Policy != memReject || m.opts.MaxSize == 0 {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size >= m.opts.MaxSize
+}
+
+func (m *memDB) set(k string, v []byte) {
+	if old, ok := m.docs[k]; ok {
+		m.size -= int64(len(old))
+	} else {
+		m.size += int64(len(k))
+		if n := len(m.keys); n == 0 || m.keys[n-1] < k {
+			m.keys = append(m.keys, k)
+		} else {
+			i := sort.SearchStrings(m.keys, k)
+			m.keys = append(m.keys, "")
+			copy(m.keys[i+1:], m.keys[i:])
+			m.keys[i] = k
+		}
+	}
+	m.docs[k] = v
+	m.size += int64(len(v))
+	m.seq++
+}
+
+func (m *memDB) remove(k string) {
+	old, ok := m.docs[k]
+	if !ok {
+		return
+	}
+	i := sort.SearchStrings(m.keys, k)
+	m.keys = append(m.keys[:i], m.keys[i+1:]...)
+	delete(m.docs, k)
+	m.size -= int64(len(k) + len(old))
+	m.seq++
+}
+
+// trim applies expiry and, unless documents are spilled, the size
+// cap.  The caller must hold the write lock.
+func (m *memDB) trim() {
+	if m.opts.TTL > 0 {
+		cutoff := dbFormat(m.name).formatKey(time.Now().Add(-m.opts.TTL))
+		for len(m.keys) > 0 && m.keys[0] < cutoff {
+			m.remove(m.keys[0])
+		}
+	}
+
+	if m.opts.MaxSize == 0 || m.opts.Policy != memEvict {
+		return
+	}
+	for len(m.keys) > 0 && m.size > m.opts.MaxSize {
+		m.remove(m.keys[0])
+	}
+}
+
+// overflow returns the oldest documents over the size cap, which the
+// spill policy moves to disk.  The caller must hold the lock.
+func (m *memDB) overflow() map[string][]byte {
+	if m.opts.MaxSize == 0 || m.opts.Policy != memSpill {
+		return nil
+	}
+	var rv map[string][]byte
+	size := m.size
+	for _, k := range m.keys {
+		if size <= m.opts.MaxSize {
+			break
+		}
+		if rv == nil {
+			rv = map[string][]byte{}
+		}
+		rv[k] = m.docs[k]
+		size -= int64(len(k) + len(m.docs[k]))
+	}
+	return rv
+}
+
+// spill queues documents to the spill database, and only once
+// they're committed there drops them from memory.  It doesn't wait on
+// the spill database's writer; anything not written stays until a
+// later commit tries again.
+func (m *memDB) spill(docs map[string][]byte) {
+	items := make([]dbqitem, 0, len(docs))
+	for k, v := range docs {
+		items = append(items, dbqitem{dbname: m.opts.SpillTo, k: k, data: v,
+			op: opStoreItem})
+	}
+	cherr := make(chan error, 1)
+	writer, _, err := dbqueueBatch(m.opts.SpillTo, items, cherr)
+	if err != nil {
+		m.spilled(docs, err)
+		return
+	}
+	go func() {
+		m.spilled(docs, writer.waitCommitted(cherr))
+	}()
+}
+
+// spilled drops documents committed to the spill database.
+func (m *memDB) spilled(docs map[string][]byte, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spilling = false
+	if err != nil {
+		dbLog.Error("error spilling", "db", m.name, "to", m.opts.SpillTo,
+			"docs", len(docs), "err", err)
+		return
+	}
+	for k, v := range docs {
+		// Unless it's been rewritten since.
+		if cur, ok := m.docs[k]; ok && bytes.Equal(cur, v) {
+			m.remove(k)
+		}
+	}
+}
+
+func (m *memDB) commit(ops []memOp) {
+	m.mu.Lock()
+	for _, op := range ops {
+		if op.deleted {
+			m.remove(op.k)
+			if m.tombstones != nil {
+				m.tombstones[op.k] = true
+			}
+		} else {
+			m.set(op.k, op.v)
+			delete(m.tombstones, op.k)
+		}
+	}
+	m.trim()
+	var spilled map[string][]byte
+	if !m.spilling {
+		spilled = m.overflow()
+		m.spilling = len(spilled) > 0
+	}
+	m.mu.Unlock()
+
+	if len(spilled) > 0 {
+		m.spill(spilled)
+	}
+}
+
+// memHandle is an open reference to a memDB.  Each dbopen gets its
+// own so open connections can be tracked individually.
+type memHandle struct {
+	*memDB
+}
+
+func (h *memHandle) Close() error {
+	return nil
+}
+
+func (m *memDB) Bulk() couchstore.BulkWriter {
+	return &memBulk{m: m}
+}
+
+func (m *memDB) Get(id string) (*couchstore.Document, *couchstore.DocInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.docs[id]
+	if !ok {
+		return nil, nil, errNotFound
+	}
+	return couchstore.NewDocument(id, v), couchstore.NewDocInfo(id, 0), nil
+}
+
+func (m *memDB) GetFromDocInfo(di *couchstore.DocInfo) (*couchstore.Document, error) {
+	doc, _, err := m.Get(di.ID())
+	return doc, err
+}
+
+// keysFrom returns a snapshot of the live keys at or after from.
+func (m *memDB) keysFrom(from string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trim()
+	i := sort.SearchStrings(m.keys, from)
+	keys := make([]string, len(m.keys)-i)
+	copy(keys, m.keys[i:])
+	return keys
+}
+
+func (m *memDB) Walk(from string, f couchstore.WalkFun) error {
+	for _, k := range m.keysFrom(from) {
+		err := f(nil, couchstore.NewDocInfo(k, 0))
+		if err == couchstore.StopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memDB) WalkDocs(from string, f couchstore.DocWalkFun) error {
+	return m.Walk(from, func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		doc, err := m.GetFromDocInfo(di)
+		if err != nil {
+			// Expired or evicted since the walk began.
+			return nil
+		}
+		return f(d, di, doc)
+	})
+}
+
+func (m *memDB) Info() (couchstore.DBInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return couchstore.DBInfo{
+		LastSeq:   m.seq,
+		DocCount:  uint64(len(m.keys)),
+		SpaceUsed: uint64(m.size),
+	}, nil
+}
+
+func (m *memDB) CompactTo(dest string) error {
+	return errNotOnDisk
+}
+
+// memBulk batches up changes until commit, like a couchstore bulk
+// writer.
+type memBulk struct {
+	m   *memDB
+	ops []memOp
+}
+
+type memOp struct {
+	k       string
+	v       []byte
+	deleted bool
+}
+
+func (b *memBulk) Set(di *couchstore.DocInfo, doc *couchstore.Document) {
+	b.ops = append(b.ops, memOp{di.ID(), doc.Value(), false})
+}
+
+func (b *memBulk) Delete(di *couchstore.DocInfo) {
+	b.ops = append(b.ops, memOp{di.ID(), nil, true})
+}
+
+func (b *memBulk) Commit() error {
+	b.m.commit(b.ops)
+	b.ops = nil
+	return nil
+}
+
+func (b *memBulk) Close() error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func memKeys(t *testing.T, m *memDB) []string {
+	rv := []string{}
+	err := m.Walk("", func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		rv = append(rv, di.ID())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error walking: %v", err)
+	}
+	return rv
+}
+
+func TestMemDBOrdering(t *testing.T) {
+	m := &memDB{docs: map[string][]byte{}}
+	b := m.Bulk()
+	for _, k := range []string{"2012-01-03", "2012-01-01", "2012-01-02"} {
+		b.Set(couchstore.NewDocInfo(k, 0),
+			couchstore.NewDocument(k, []byte("{}")))
+	}
+	b.Delete(couchstore.NewDocInfo("2012-01-02", 0))
+	b.Set(couchstore.NewDocInfo("2012-01-04", 0),
+		couchstore.NewDocument("2012-01-04", []byte("{}")))
+	b.Commit()
+
+	exp := []string{"2012-01-01", "2012-01-03", "2012-01-04"}
+	if got := memKeys(t, m); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestMemDBEviction(t *testing.T) {
+	m := &memDB{docs: map[string][]byte{},
+		opts: memOptions{MaxSize: 40, Policy: memEvict}}
+	b := m.Bulk()
+	for _, k := range []string{"2012-01-01", "2012-01-02", "2012-01-03"} {
+		b.Set(couchstore.NewDocInfo(k, 0),
+			couchstore.NewDocument(k, []byte("{\"a\":1}")))
+	}
+	b.Commit()
+
+	exp := []string{"2012-01-02", "2012-01-03"}
+	if got := memKeys(t, m); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestMemDBSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	const spillTo = "spilled"
+	if err := dbcreate(dbPath(spillTo)); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	defer forgetDB(spillTo)
+
+	m := &memDB{name: "spilling", docs: map[string][]byte{},
+		opts: memOptions{MaxSize: 40, Policy: memSpill, SpillTo: spillTo}}
+	// Spills finish without the commit waiting on them.
+	settle := func() {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			m.mu.RLock()
+			spilling := m.spilling
+			m.mu.RUnlock()
+			if !spilling {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Spill never finished")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	keys := []string{"2012-01-01", "2012-01-02", "2012-01-03",
+		"2012-01-04", "2012-01-05"}
+	for i, k := range keys[:4] {
+		b := m.Bulk()
+		b.Set(couchstore.NewDocInfo(k, 0),
+			couchstore.NewDocument(k, []byte(fmt.Sprintf(`{"a":%d}`, i))))
+		b.Commit()
+		settle()
+		// Walking trims; it mustn't lose what's yet to be spilled.
+		memKeys(t, m)
+	}
+
+	// What can't be spilled stays in memory for the next commit.
+	setReadOnly := func(ro bool) {
+		err := updateMeta(spillTo, func(meta *dbMeta) {
+			meta.Config = &dbConfig{ReadOnly: ro}
+		})
+		if err != nil {
+			t.Fatalf("Error configuring: %v", err)
+		}
+	}
+	setReadOnly(true)
+	b := m.Bulk()
+	b.Set(couchstore.NewDocInfo(keys[4], 0),
+		couchstore.NewDocument(keys[4], []byte(`{"a":4}`)))
+	b.Commit()
+	settle()
+	if m.size <= m.opts.MaxSize {
+		t.Errorf("Expected more than %v in memory while the spill is refused",
+			m.opts.MaxSize)
+	}
+	setReadOnly(false)
+	m.Bulk().Commit()
+	settle()
+	if m.size > m.opts.MaxSize {
+		t.Errorf("Expected at most %v in memory, got %v", m.opts.MaxSize, m.size)
+	}
+
+	for i, k := range keys {
+		exp := fmt.Sprintf(`{"a":%d}`, i)
+		if doc, _, err := m.Get(k); err == nil {
+			if string(doc.Value()) != exp {
+				t.Errorf("Expected %s in memory for %v, got %s", exp, k, doc.Value())
+			}
+			continue
+		}
+		doc, err := dbGetDoc(spillTo, k)
+		if err != nil {
+			t.Errorf("Lost %v: %v", k, err)
+			continue
+		}
+		if string(doc) != exp {
+			t.Errorf("Expected %s spilled for %v, got %s", exp, k, doc)
+		}
+	}
+}
+
+func TestMemDBExpiry(t *testing.T) {
+	m := &memDB{docs: map[string][]byte{},
+		opts: memOptions{TTL: time.Minute, Policy: memEvict}}
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	recent := time.Now().UTC().Format(time.RFC3339Nano)
+	b := m.Bulk()
+	for _, k := range []string{old, recent} {
+		b.Set(couchstore.NewDocInfo(k, 0),
+			couchstore.NewDocument(k, []byte("{}")))
+	}
+	b.Commit()
+
+	exp := []string{recent}
+	if got := memKeys(t, m); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestMemOptions(t *testing.T) {
+	opts, err := parseMemOptions("x", url.Values{
+		"max_size": {"1024"}, "ttl": {"10m"}})
+	if err != nil {
+		t.Fatalf("Error parsing options: %v", err)
+	}
+	exp := memOptions{1024, 10 * time.Minute, memEvict, ""}
+	if opts != exp {
+		t.Fatalf("Expected %v, got %v", exp, opts)
+	}
+
+	for _, bad := range []url.Values{
+		{"policy": {"spill"}},
+		{"policy": {"spill"}, "spill": {"x"}},
+		{"policy": {"whatever"}},
+		{"ttl": {"soon"}},
+	} {
+		if _, err := parseMemOptions("x", bad); err == nil {
+			t.Errorf("Expected error on %v", bad)
+		}
+	}
+}
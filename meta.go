@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/dustin/gojson"
+)
+
+const metaExt = ".meta"
+
+// dbMeta is the per-database metadata stored alongside the couchstore
+// file.  Databases created before metadata existed have no file and
+// get the zero value, which is interpreted as format version 1.
+type dbMeta struct {
+	Format  int         `json:"format"`
+	Rollups *rollupSpec `json:"rollups,omitempty"`
+	Members []string    `json:"members,omitempty"`
+	Quota   *quotaSpec  `json:"quota,omitempty"`
+	Shard   string      `json:"shard,omitempty"`
+
+	// What to do with documents stored at a time already taken.
+	Conflicts string `json:"conflicts,omitempty"`
+
+	// Settings overriding server flags.
+	Config *dbConfig `json:"config,omitempty"`
+
+	// The types expected of fields in documents.
+	Schema *fieldSchema `json:"schema,omitempty"`
+
+	// Pointers whose numbers are kept in the value index.
+	ValueIndex *valueIndexSpec `json:"value_index,omitempty"`
+
+	// Fields with the keys of documents for each value indexed.
+	Indexes *fieldIndexSpec `json:"indexes,omitempty"`
+
+	// Periods left out of query reductions.
+	Exclusions []exclusionWindow `json:"exclusions,omitempty"`
+
+	// Saved queries by name, and when to run them.
+	Views     map[string]queryBody    `json:"views,omitempty"`
+	Schedules map[string]scheduleSpec `json:"schedules,omitempty"`
+
+	// Shards that have been moved to object storage.
+	Archived []string `json:"archived,omitempty"`
+
+	// "events" for a database of annotations, and the longest span
+	// of any event stored in it, in milliseconds.
+	Type         string `json:"type,omitempty"`
+	LongestEvent int64  `json:"longest_event,omitempty"`
+}
+
+var metaLock = sync.Mutex{}
+var metaCache = map[string]dbMeta{}
+
+func metaPath(dbname string) string {
+	return dbPath(dbname) + metaExt
+}
+
+func loadMeta(dbname string) (dbMeta, error) {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	return loadMetaLocked(dbname)
+}
+
+// loadMetaLocked is loadMeta with metaLock held.
+func loadMetaLocked(dbname string) (dbMeta, error) {
+	if m, ok := metaCache[dbname]; ok {
+		return m, nil
+	}
+
+	m := dbMeta{}
+	data, err := ioutil.ReadFile(metaPath(dbname))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return m, err
+	default:
+		if err := json.Unmarshal(data, &m); err != nil {
+			return m, err
+		}
+	}
+	if m.Format == 0 {
+		m.Format = 1
+	}
+	metaCache[dbname] = m
+	return m, nil
+}
+
+func storeMeta(dbname string, m dbMeta) error {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	return storeMetaLocked(dbname, m)
+}
+
+// storeMetaLocked is storeMeta with metaLock held.
+func storeMetaLocked(dbname string, m dbMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	fn := metaPath(dbname)
+	if err := ioutil.WriteFile(fn+".tmp", data, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		return err
+	}
+	metaCache[dbname] = m
+	return nil
+}
+
+// updateMeta applies f to the current metadata and stores the result.
+// No other update can come between, so f mustn't load or store
+// metadata itself.
+func updateMeta(dbname string, f func(m *dbMeta)) error {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+
+	m, err := loadMetaLocked(dbname)
+	if err != nil {
+		return err
+	}
+	f(&m)
+	return storeMetaLocked(dbname, m)
+}
+
+func dropMeta(dbname string) error {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+
+	delete(metaCache, dbname)
+	err := os.Remove(metaPath(dbname))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
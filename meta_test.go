@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentMetaUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	const dbname = "metatest"
+	defer dropMeta(dbname)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(n string) {
+			defer wg.Done()
+			err := updateMeta(dbname, func(m *dbMeta) {
+				views := map[string]queryBody{n: {}}
+				for k, v := range m.Views {
+					views[k] = v
+				}
+				m.Views = views
+			})
+			if err != nil {
+				t.Errorf("Error updating: %v", err)
+			}
+		}(fmt.Sprint("v", i))
+	}
+	wg.Wait()
+
+	m, err := loadMeta(dbname)
+	if err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if len(m.Views) != 20 {
+		t.Errorf("Expected 20 views, got %v", len(m.Views))
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// MessagePack is accepted in place of JSON for ingest, with
+// Content-Type: application/msgpack, and produced for queries with
+// format=msgpack.  Documents are still stored as JSON, so incoming
+// MessagePack is transcoded directly to JSON text (integers stay
+// integers, binary becomes base64 strings, as encoding/json would
+// render a []byte).  Query output is a map of group timestamps in
+// milliseconds to results, or with stream=true, a sequence of
+// one-entry maps.
+
+const msgpackType = "application/msgpack"
+
+var errMsgpackTruncated = errors.New("msgpack: truncated input")
+
+func isMsgpack(contentType string) bool {
+	ct := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return ct == msgpackType || ct == "application/x-msgpack"
+}
+
+// jsonBody transcodes a MessagePack request body to JSON.  Anything
+// else is returned as it is.
+func jsonBody(req *http.Request, body []byte) ([]byte, error) {
+	if !isMsgpack(req.Header.Get("Content-Type")) {
+		return body, nil
+	}
+	return msgpackToJSON(body)
+}
+
+type msgpackReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.b) {
+		return nil, errMsgpackTruncated
+	}
+	rv := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return rv, nil
+}
+
+func (r *msgpackReader) uint(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// msgpackToJSON transcodes a single MessagePack value to JSON.
+func msgpackToJSON(in []byte) ([]byte, error) {
+	r := &msgpackReader{b: in}
+	out := &bytes.Buffer{}
+	if err := r.value(out, 0); err != nil {
+		return nil, err
+	}
+	if r.pos != len(in) {
+		return nil, fmt.Errorf("msgpack: %d bytes after the value",
+			len(in)-r.pos)
+	}
+	return out.Bytes(), nil
+}
+
+const msgpackMaxDepth = 1000
+
+func (r *msgpackReader) value(out *bytes.Buffer, depth int) error {
+	if depth > msgpackMaxDepth {
+		return errors.New("msgpack: nested too deeply")
+	}
+	tb, err := r.next(1)
+	if err != nil {
+		return err
+	}
+	t := tb[0]
+	switch {
+	case t <= 0x7f:
+		out.WriteString(strconv.Itoa(int(t)))
+		return nil
+	case t >= 0xe0:
+		out.WriteString(strconv.Itoa(int(int8(t))))
+		return nil
+	case t&0xf0 == 0x80:
+		return r.object(out, int(t&0x0f), depth)
+	case t&0xf0 == 0x90:
+		return r.array(out, int(t&0x0f), depth)
+	case t&0xe0 == 0xa0:
+		return r.str(out, int(t&0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		out.WriteString("null")
+	case 0xc2:
+		out.WriteString("false")
+	case 0xc3:
+		out.WriteString("true")
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (t - 0xc4))
+		if err != nil {
+			return err
+		}
+		b, err := r.next(int(n))
+		if err != nil {
+			return err
+		}
+		out.WriteString(`"` + base64.StdEncoding.EncodeToString(b) + `"`)
+	case 0xca:
+		v, err := r.uint(4)
+		if err != nil {
+			return err
+		}
+		return writeJSONFloat(out, float64(math.Float32frombits(uint32(v))), 32)
+	case 0xcb:
+		v, err := r.uint(8)
+		if err != nil {
+			return err
+		}
+		return writeJSONFloat(out, math.Float64frombits(v), 64)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := r.uint(1 << (t - 0xcc))
+		if err != nil {
+			return err
+		}
+		out.WriteString(strconv.FormatUint(v, 10))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		v, err := r.uint(size)
+		if err != nil {
+			return err
+		}
+		// Sign extend from the encoded width.
+		shift := uint(64 - 8*size)
+		out.WriteString(strconv.FormatInt(int64(v<<shift)>>shift, 10))
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (t - 0xd9))
+		if err != nil {
+			return err
+		}
+		return r.str(out, int(n))
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (t - 0xdc))
+		if err != nil {
+			return err
+		}
+		return r.array(out, int(n), depth)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (t - 0xde))
+		if err != nil {
+			return err
+		}
+		return r.object(out, int(n), depth)
+	default:
+		return fmt.Errorf("msgpack: unsupported type 0x%02x", t)
+	}
+	return nil
+}
+
+func writeJSONFloat(out *bytes.Buffer, f float64, bits int) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("msgpack: %v can't be stored as JSON", f)
+	}
+	out.WriteString(strconv.FormatFloat(f, 'g', -1, bits))
+	return nil
+}
+
+func (r *msgpackReader) str(out *bytes.Buffer, n int) error {
+	b, err := r.next(n)
+	if err != nil {
+		return err
+	}
+	s, err := json.Marshal(string(b))
+	if err != nil {
+		return err
+	}
+	out.Write(s)
+	return nil
+}
+
+func (r *msgpackReader) array(out *bytes.Buffer, n int, depth int) error {
+	out.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if err := r.value(out, depth+1); err != nil {
+			return err
+		}
+	}
+	out.WriteByte(']')
+	return nil
+}
+
+// object transcodes a map.  JSON keys are strings, so numeric keys
+// are written as their decimal form.
+func (r *msgpackReader) object(out *bytes.Buffer, n int, depth int) error {
+	out.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		key := &bytes.Buffer{}
+		if err := r.value(key, depth+1); err != nil {
+			return err
+		}
+		switch k := key.Bytes(); {
+		case len(k) > 0 && k[0] == '"':
+			out.Write(k)
+		case len(k) > 0 && (k[0] == '-' || (k[0] >= '0' && k[0] <= '9')):
+			out.WriteString(`"` + key.String() + `"`)
+		default:
+			return fmt.Errorf("msgpack: unsupported map key %s", k)
+		}
+		out.WriteByte(':')
+		if err := r.value(out, depth+1); err != nil {
+			return err
+		}
+	}
+	out.WriteByte('}')
+	return nil
+}
+
+// msgpackWriter encodes values as MessagePack.
+type msgpackWriter struct {
+	buf bytes.Buffer
+}
+
+func (m *msgpackWriter) head(fix, max byte, b8, b16, b32 byte, n int) {
+	switch {
+	case n <= int(max):
+		m.buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		m.buf.Write([]byte{b8, byte(n)})
+	case n <= math.MaxUint16:
+		m.buf.WriteByte(b16)
+		binary.Write(&m.buf, binary.BigEndian, uint16(n))
+	default:
+		m.buf.WriteByte(b32)
+		binary.Write(&m.buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func (m *msgpackWriter) mapHeader(n int) {
+	m.head(0x80, 15, 0, 0xde, 0xdf, n)
+}
+
+func (m *msgpackWriter) int(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f, v < 0 && v >= -32:
+		m.buf.WriteByte(byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		m.buf.Write([]byte{0xd0, byte(v)})
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		m.buf.WriteByte(0xd1)
+		binary.Write(&m.buf, binary.BigEndian, int16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		m.buf.WriteByte(0xd2)
+		binary.Write(&m.buf, binary.BigEndian, int32(v))
+	default:
+		m.buf.WriteByte(0xd3)
+		binary.Write(&m.buf, binary.BigEndian, v)
+	}
+}
+
+func (m *msgpackWriter) encode(v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		m.buf.WriteByte(0xc0)
+	case bool:
+		if x {
+			m.buf.WriteByte(0xc3)
+		} else {
+			m.buf.WriteByte(0xc2)
+		}
+	case int:
+		m.int(int64(x))
+	case int64:
+		m.int(x)
+	case uint64:
+		if x <= math.MaxInt64 {
+			m.int(int64(x))
+		} else {
+			m.buf.WriteByte(0xcf)
+			binary.Write(&m.buf, binary.BigEndian, x)
+		}
+	case float64:
+		m.buf.WriteByte(0xcb)
+		binary.Write(&m.buf, binary.BigEndian, math.Float64bits(x))
+	case string:
+		m.head(0xa0, 31, 0xd9, 0xda, 0xdb, len(x))
+		m.buf.WriteString(x)
+	case []interface{}:
+		m.head(0x90, 15, 0, 0xdc, 0xdd, len(x))
+		for _, e := range x {
+			if err := m.encode(e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m.mapHeader(len(keys))
+		for _, k := range keys {
+			m.encode(k)
+			if err := m.encode(x[k]); err != nil {
+				return err
+			}
+		}
+	case map[string][]interface{}:
+		generic := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			generic[k] = v
+		}
+		return m.encode(generic)
+	default:
+		// Anything else goes through its JSON form.
+		b, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(b, &generic); err != nil {
+			return err
+		}
+		return m.encode(generic)
+	}
+	return nil
+}
+
+// msgpackMapWriter emits query results as one MessagePack map.  The
+// map's size comes first, so results are held until the end.
+type msgpackMapWriter struct {
+	out     io.Writer
+	keys    []int64
+	results []interface{}
+}
+
+func (m *msgpackMapWriter) write(po *processOut) error {
+	m.keys = append(m.keys, po.key/1e6)
+	m.results = append(m.results, po.result())
+	return nil
+}
+
+func (m *msgpackMapWriter) finish() error {
+	w := &msgpackWriter{}
+	w.mapHeader(len(m.keys))
+	for i, k := range m.keys {
+		w.int(k)
+		if err := w.encode(m.results[i]); err != nil {
+			return err
+		}
+	}
+	_, err := m.out.Write(w.buf.Bytes())
+	return err
+}
+
+// msgpackStreamWriter emits a one-entry map per group.
+type msgpackStreamWriter struct {
+	out   io.Writer
+	flush func()
+}
+
+func (s *msgpackStreamWriter) write(po *processOut) error {
+	w := &msgpackWriter{}
+	w.mapHeader(1)
+	w.int(po.key / 1e6)
+	if err := w.encode(po.result()); err != nil {
+		return err
+	}
+	_, err := s.out.Write(w.buf.Bytes())
+	s.flush()
+	return err
+}
+
+func (s *msgpackStreamWriter) finish() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackToJSON(t *testing.T) {
+	tests := []struct {
+		in  []byte
+		exp string
+	}{
+		{[]byte{0x05}, `5`},
+		{[]byte{0xff}, `-1`},
+		{[]byte{0xc0}, `null`},
+		{[]byte{0xc3}, `true`},
+		{[]byte{0xd0, 0x80}, `-128`},
+		{[]byte{0xd1, 0xff, 0x00}, `-256`},
+		{[]byte{0xcd, 0x01, 0x00}, `256`},
+		{[]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			`18446744073709551615`},
+		{[]byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, `1.5`},
+		{[]byte{0xca, 0x3f, 0xc0, 0, 0}, `1.5`},
+		{[]byte{0xa2, 'h', '"'}, `"h\""`},
+		{[]byte{0xc4, 0x02, 0x01, 0x02}, `"AQI="`},
+		{[]byte{0x92, 0x01, 0xa1, 'a'}, `[1,"a"]`},
+		{[]byte{0x82, 0xa1, 'a', 0x01, 0x02, 0xc2}, `{"a":1,"2":false}`},
+		{[]byte{0xde, 0x00, 0x01, 0xa1, 'x', 0x90}, `{"x":[]}`},
+	}
+	for _, test := range tests {
+		got, err := msgpackToJSON(test.in)
+		if err != nil || string(got) != test.exp {
+			t.Errorf("Expected % x to be %s, got %s %v", test.in, test.exp, got, err)
+		}
+	}
+
+	for _, bad := range [][]byte{
+		{}, {0x92, 0x01}, {0xd9, 0x05, 'a'}, {0xc1}, {0x01, 0x02},
+		{0x81, 0x90, 0x01}, {0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1},
+	} {
+		if got, err := msgpackToJSON(bad); err == nil {
+			t.Errorf("Expected an error for % x, got %s", bad, got)
+		}
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	v := map[string]interface{}{
+		"n":     1.5,
+		"count": 300,
+		"neg":   int64(-70000),
+		"s":     strings.Repeat("x", 40),
+		"list":  []interface{}{nil, true, "a"},
+	}
+	w := &msgpackWriter{}
+	if err := w.encode(v); err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	got, err := msgpackToJSON(w.buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error decoding % x: %v", w.buf.Bytes(), err)
+	}
+	exp := `{"count":300,"list":[null,true,"a"],"n":1.5,"neg":-70000,"s":"` +
+		strings.Repeat("x", 40) + `"}`
+	if string(got) != exp {
+		t.Errorf("Expected %s, got %s", exp, got)
+	}
+}
+
+func TestMsgpackResults(t *testing.T) {
+	buf := &bytes.Buffer{}
+	rw := &msgpackMapWriter{out: buf}
+	rw.write(&processOut{key: 2000 * 1e6, value: []interface{}{1.0}})
+	rw.write(&processOut{key: 3000 * 1e6, value: []interface{}{nil}})
+	rw.finish()
+	got, err := msgpackToJSON(buf.Bytes())
+	if err != nil || string(got) != `{"2000":[1],"3000":[null]}` {
+		t.Errorf("Expected two groups, got %s %v", got, err)
+	}
+
+	req, _ := http.NewRequest("POST", "/db", nil)
+	req.Header.Set("Content-Type", "application/msgpack; charset=binary")
+	if body, err := jsonBody(req, []byte{0x81, 0xa1, 'a', 0x01}); err != nil ||
+		string(body) != `{"a":1}` {
+		t.Errorf("Expected a transcoded body, got %s %v", body, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if body, _ := jsonBody(req, []byte(`{}`)); string(body) != `{}` {
+		t.Errorf("Expected JSON untouched, got %s", body)
+	}
+}
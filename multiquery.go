@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// A multi-series query runs one query against several databases,
+// plain, federated, or sharded, e.g.
+//
+//	GET /_multi_query?db=hits&db=lookups&ptr=/n&reducer=sum&group=60000
+//
+// and returns each database's values in every group any of them has:
+//
+//	{"1344556800000": {"values": {"hits": [90], "lookups": [120]}}}
+//
+// Each expr= combines the databases' values in every group with the
+// arithmetic of pointer expressions, naming each value by database and
+// reducer, e.g. a cache hit rate:
+//
+//	expr=(hits.sum)/(lookups.sum)*100
+//
+// adds "exprs": [75] to the group.  An expression is null in groups
+// missing a value it uses, or where it divides by zero.  Only reducers
+// the query uses once can be named.
+
+// seriesRefs names the values expressions may use.
+func seriesRefs(dbs, reds []string) map[string]bool {
+	uses := map[string]int{}
+	for _, r := range reds {
+		uses[r]++
+	}
+	rv := map[string]bool{}
+	for _, db := range dbs {
+		for _, r := range reds {
+			if uses[r] == 1 {
+				rv[db+"."+r] = true
+			}
+		}
+	}
+	return rv
+}
+
+func parseSeriesExprs(exprs, dbs, reds []string) ([]ptrExpr, error) {
+	refs := seriesRefs(dbs, reds)
+	rv := make([]ptrExpr, 0, len(exprs))
+	for _, s := range exprs {
+		e, err := (&exprParser{s: s, refs: refs}).parse()
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, e)
+	}
+	return rv, nil
+}
+
+// multiResults runs a query against each database at once.
+func multiResults(dbs []string, params []queryParams) ([]queryResults, error) {
+	results := make([]queryResults, len(dbs))
+	errs := make([]error, len(dbs))
+	wg := sync.WaitGroup{}
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, db string) {
+			defer wg.Done()
+			results[i], errs[i] = queryResultsFor(db, params[i])
+		}(i, db)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			if _, ok := err.(*paramError); ok {
+				return nil, err
+			}
+			return nil, fmt.Errorf("querying %v: %v", dbs[i], err)
+		}
+	}
+	return results, nil
+}
+
+// seriesGroups lays out each group's values by database, along with
+// the expressions computed from them.
+func seriesGroups(dbs, reds []string, exprs []ptrExpr,
+	results []queryResults) map[string]interface{} {
+
+	refs := seriesRefs(dbs, reds)
+	groups := map[int64]bool{}
+	for _, res := range results {
+		for ts := range res {
+			groups[ts] = true
+		}
+	}
+
+	rv := make(map[string]interface{}, len(groups))
+	for ts := range groups {
+		values := map[string]interface{}{}
+		named := map[string]interface{}{}
+		for i, db := range dbs {
+			vals, ok := results[i][ts]
+			if !ok {
+				continue
+			}
+			values[db] = vals
+			for j, r := range reds {
+				if name := db + "." + r; refs[name] && j < len(vals) {
+					named[name] = vals[j]
+				}
+			}
+		}
+		group := map[string]interface{}{"values": values}
+		if len(exprs) > 0 {
+			computed := make([]interface{}, len(exprs))
+			for i, e := range exprs {
+				if v, ok := e.eval(named); ok {
+					computed[i] = v
+				}
+			}
+			group["exprs"] = computed
+		}
+		rv[strconv.FormatInt(ts, 10)] = group
+	}
+	return rv
+}
+
+func multiQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	names := req.Form["db"]
+	if len(names) == 0 {
+		emitError(400, w, "Database required",
+			"At least one db argument is required")
+		return
+	}
+	// The path names no database, so each is checked against its
+	// tenant and auth rules here.
+	dbs := make([]string, len(names))
+	for i, name := range names {
+		db := scopedDB(req, name)
+		if !localDBName.MatchString(db) {
+			emitError(400, w, "Bad db value",
+				fmt.Sprintf("invalid database: %q", name))
+			return
+		}
+		if !authorizeDB(w, req, db, true) {
+			return
+		}
+		if _, err := os.Stat(dbPath(db)); err != nil && memDatabase(db) == nil {
+			emitError(404, w, "not_found", err.Error())
+			return
+		}
+		dbs[i] = db
+	}
+
+	p, err := parseQueryParams(req.Form)
+	if err != nil {
+		emitParamError(w, err)
+		return
+	}
+	if p.groupby != "" {
+		emitParamError(w, errGroupByResults)
+		return
+	}
+	exprs, err := parseSeriesExprs(req.Form["expr"], names, p.reds)
+	if err != nil {
+		emitError(400, w, "Bad expr value", err.Error())
+		return
+	}
+	serverStatsCollector.add(statQuery, 1)
+
+	params := make([]queryParams, len(dbs))
+	for i, db := range dbs {
+		params[i] = p
+		params[i].exclude = append([]exclusionWindow{}, p.exclude...)
+		if err := addStoredExclusions(db, &params[i], req); err != nil {
+			emitError(500, w, "Error loading exclusions", err.Error())
+			return
+		}
+	}
+
+	results, err := multiResults(dbs, params)
+	if err != nil {
+		if pe, ok := err.(*paramError); ok {
+			emitParamError(w, pe)
+		} else {
+			emitError(500, w, "Error running query", err.Error())
+		}
+		return
+	}
+	mustEncode(200, w, seriesGroups(names, p.reds, exprs, results))
+}
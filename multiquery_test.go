@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/gojson"
+)
+
+func TestSeriesExprs(t *testing.T) {
+	dbs := []string{"hits", "lookups"}
+	reds := []string{"sum", "max", "max"}
+	exprs, err := parseSeriesExprs([]string{
+		"(hits.sum)/(lookups.sum)*100",
+		"((hits.sum) + 1) * 2",
+		"(/v)",
+	}, dbs, reds)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	vals := map[string]interface{}{"hits.sum": 3.0, "lookups.sum": 4.0}
+	for i, exp := range []float64{75, 8} {
+		if got, ok := exprs[i].eval(vals); !ok || got != exp {
+			t.Errorf("Expected %v from expression %v, got %v/%v",
+				exp, i, got, ok)
+		}
+	}
+	if _, ok := exprs[0].eval(map[string]interface{}{"hits.sum": 3.0}); ok {
+		t.Errorf("Expected nothing without lookups.sum")
+	}
+
+	for _, bad := range []string{"(misses.sum)", "(hits.max)", "(hits.sum", ""} {
+		if _, err := parseSeriesExprs([]string{bad}, dbs, reds); err == nil {
+			t.Errorf("Expected error on %q", bad)
+		}
+	}
+}
+
+func TestMultiQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+	startTestQueries()
+
+	for dbname, docs := range map[string]map[string]string{
+		"hits": {
+			"2012-08-10T00:00:00Z": `{"n": 1}`,
+			"2012-08-10T00:00:30Z": `{"n": 2}`,
+			"2012-08-10T00:01:00Z": `{"n": 1}`,
+		},
+		"lookups": {
+			"2012-08-10T00:00:00Z": `{"n": 4}`,
+			"2012-08-10T00:02:00Z": `{"n": 4}`,
+		},
+	} {
+		if err := dbcreate(dbPath(dbname)); err != nil {
+			t.Fatalf("Error creating %v: %v", dbname, err)
+		}
+		defer forgetDB(dbname)
+		for k, doc := range docs {
+			if err := dbstore(dbname, k, []byte(doc)); err != nil {
+				t.Fatalf("Error storing %v: %v", k, err)
+			}
+		}
+		if err := dbflush(dbname); err != nil {
+			t.Fatalf("Error flushing: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_multi_query?db=hits&db=lookups"+
+		"&ptr=/n&reducer=sum&group=60000"+
+		"&expr=(hits.sum)/(lookups.sum)*100", nil)
+	multiQuery(nil, w, req)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %v: %s", w.Code, w.Body)
+	}
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	exp := map[string]interface{}{
+		"1344556800000": map[string]interface{}{
+			"values": map[string]interface{}{
+				"hits":    []interface{}{3.0},
+				"lookups": []interface{}{4.0},
+			},
+			"exprs": []interface{}{75.0},
+		},
+		"1344556860000": map[string]interface{}{
+			"values": map[string]interface{}{
+				"hits": []interface{}{1.0},
+			},
+			"exprs": []interface{}{nil},
+		},
+		"1344556920000": map[string]interface{}{
+			"values": map[string]interface{}{
+				"lookups": []interface{}{4.0},
+			},
+			"exprs": []interface{}{nil},
+		},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	// A tenant's database, and one only some may read.
+	if err := dbcreate(dbPath("acme:secret")); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	defer forgetDB("acme:secret")
+	err = updateMeta("lookups", func(m *dbMeta) {
+		m.Config = &dbConfig{Auth: &authRules{Read: []string{"r"}}}
+	})
+	if err != nil {
+		t.Fatalf("Error configuring: %v", err)
+	}
+
+	tests := []struct {
+		q, token string
+		exp      int
+	}{
+		{"db=hits&ptr=/n&reducer=sum&expr=(misses.sum)", "", 400},
+		{"ptr=/n&reducer=sum", "", 400},
+		{"db=hits&ptr=/n&reducer=sum&groupby=/host", "", 400},
+		{"db=acme:secret&ptr=/n&reducer=sum", "", 400},
+		{"db=hits&db=lookups&ptr=/n&reducer=sum", "", 401},
+		{"db=hits&db=lookups&ptr=/n&reducer=sum", "x", 403},
+		{"db=hits&db=lookups&ptr=/n&reducer=sum&group=60000", "r", 200},
+		{"db=hits&db=misses&ptr=/n&reducer=sum", "", 404},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/_multi_query?"+test.q, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", test.token)
+		}
+		multiQuery(nil, w, req)
+		if w.Code != test.exp {
+			t.Errorf("Expected %v for %v with %q, got %v: %s",
+				test.exp, test.q, test.token, w.Code, w.Body)
+		}
+	}
+}
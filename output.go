@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// A resultWriter renders query results to a client as they arrive.
+type resultWriter interface {
+	write(po *processOut) error
+	finish() error
+}
+
+// JSON results are keyed by each group's start in milliseconds, or
+// with keys=iso, its time, or with keys=offset, the milliseconds since
+// from.  layout=array lists them in order as [key, values] pairs
+// instead of an object.
+type keyFormat struct {
+	iso, offset bool
+	base        int64
+}
+
+func parseKeyFormat(req *http.Request) (keyFormat, error) {
+	switch k := req.FormValue("keys"); k {
+	case "", "millis":
+		return keyFormat{}, nil
+	case "iso":
+		return keyFormat{iso: true}, nil
+	case "offset":
+		if req.FormValue("from") == "" {
+			return keyFormat{}, fmt.Errorf("offset keys need a from time")
+		}
+		t, err := parseTime(req.FormValue("from"))
+		if err != nil {
+			return keyFormat{}, err
+		}
+		return keyFormat{offset: true, base: t.UnixNano()}, nil
+	default:
+		return keyFormat{}, fmt.Errorf("unknown key format: %v", k)
+	}
+}
+
+// name is the key for a group starting at ns.
+func (k keyFormat) name(ns int64) string {
+	switch {
+	case k.iso:
+		return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+	case k.offset:
+		ns -= k.base
+	}
+	return strconv.FormatInt(ns/1e6, 10)
+}
+
+// value is the key as a JSON value, which is a number unless it's a
+// time.
+func (k keyFormat) value(ns int64) string {
+	if k.iso {
+		return `"` + k.name(ns) + `"`
+	}
+	return k.name(ns)
+}
+
+// validOutputLayout checks a query's keys and layout parameters.
+func validOutputLayout(req *http.Request) error {
+	if _, err := parseKeyFormat(req); err != nil {
+		return err
+	}
+	switch l := req.FormValue("layout"); l {
+	case "", "map", "array":
+		return nil
+	default:
+		return fmt.Errorf("unknown layout: %v", l)
+	}
+}
+
+// validOutputFormat checks a query's format parameter.
+func validOutputFormat(f string) error {
+	switch f {
+	case "", "json", "msgpack", "arrow":
+		return nil
+	}
+	return fmt.Errorf("unknown output format: %v", f)
+}
+
+// newResultWriter picks how a query's results are rendered from its
+// format and stream parameters, or its Accept header if it has no
+// format.  With descending=true, results are held back until the
+// query's done, and then written newest first, as they are oldest
+// first for layout=array unless streaming.  Any transforms are applied
+// before that, oldest first.
+func newResultWriter(w http.ResponseWriter, req *http.Request,
+	output io.Writer) resultWriter {
+
+	rw := formatWriter(w, req, output)
+	switch {
+	case req.FormValue("descending") == "true":
+		rw = &orderedWriter{rw: rw, descending: true}
+	case req.FormValue("layout") == "array" && req.FormValue("stream") != "true":
+		rw = &orderedWriter{rw: rw}
+	}
+	// Checked by parseQueryParams.
+	if ts, err := parseTransforms(req.Form["transform"]); err == nil && len(ts) > 0 {
+		rw = &transformWriter{rw: rw, transforms: ts}
+	}
+	return rw
+}
+
+func formatWriter(w http.ResponseWriter, req *http.Request,
+	output io.Writer) resultWriter {
+
+	flush := func() { flushOutput(w, output) }
+	stream := req.FormValue("stream") == "true"
+	if req.FormValue("format") == "msgpack" {
+		w.Header().Set("Content-Type", msgpackType)
+		if stream {
+			return &msgpackStreamWriter{output, flush}
+		}
+		return &msgpackMapWriter{out: output}
+	}
+	if req.FormValue("format") == "arrow" {
+		w.Header().Set("Content-Type", arrowType)
+		return &arrowWriter{out: output, names: arrowColumnNames(req)}
+	}
+	if req.FormValue("format") == "" && acceptsProtobuf(req) {
+		w.Header().Set("Content-Type", protobufType)
+		if stream {
+			return &protobufWriter{output, flush}
+		}
+		return &protobufWriter{out: output}
+	}
+	// Checked by validOutputLayout.
+	keys, _ := parseKeyFormat(req)
+	array := req.FormValue("layout") == "array"
+	if stream {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return &streamWriter{out: output, flush: flush, keys: keys, array: array}
+	}
+	if array {
+		return &arrayWriter{out: output, keys: keys}
+	}
+	return &mapWriter{out: output, keys: keys}
+}
+
+// emptyResults responds to a query that has nothing to read.
+func emptyResults(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("format") == "msgpack" {
+		w.Header().Set("Content-Type", msgpackType)
+		w.WriteHeader(200)
+		w.Write([]byte{0x80})
+		return
+	}
+	if req.FormValue("format") == "arrow" {
+		w.Header().Set("Content-Type", arrowType)
+		w.WriteHeader(200)
+		(&arrowWriter{out: w, names: arrowColumnNames(req)}).finish()
+		return
+	}
+	if req.FormValue("format") == "" && acceptsProtobuf(req) {
+		w.Header().Set("Content-Type", protobufType)
+		w.WriteHeader(200)
+		return
+	}
+	if req.FormValue("layout") == "array" {
+		mustEncode(200, w, []interface{}{})
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{})
+}
+
+// mapWriter emits a single JSON object keyed by group timestamp.
+type mapWriter struct {
+	out  io.Writer
+	n    int
+	keys keyFormat
+}
+
+func (m *mapWriter) write(po *processOut) error {
+	sep := ",\n"
+	if m.n == 0 {
+		sep = "{"
+	}
+	m.n++
+	d, err := json.Marshal(po.result())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(m.out, `%s"%s": %s`, sep, m.keys.name(po.key), d)
+	return err
+}
+
+func (m *mapWriter) finish() error {
+	if m.n == 0 {
+		return nil
+	}
+	_, err := m.out.Write([]byte{'}'})
+	return err
+}
+
+// streamWriter emits one JSON object per line per group and pushes
+// each through to the client as soon as it's written.
+type streamWriter struct {
+	out   io.Writer
+	flush func()
+	keys  keyFormat
+	array bool
+}
+
+func (s *streamWriter) write(po *processOut) error {
+	d, err := json.Marshal(po.result())
+	if err != nil {
+		return err
+	}
+	if s.array {
+		_, err = fmt.Fprintf(s.out, "[%s, %s]\n", s.keys.value(po.key), d)
+	} else {
+		_, err = fmt.Fprintf(s.out, "{\"%s\": %s}\n", s.keys.name(po.key), d)
+	}
+	s.flush()
+	return err
+}
+
+func (s *streamWriter) finish() error {
+	return nil
+}
+
+// arrayWriter emits a JSON array of [key, values] pairs.
+type arrayWriter struct {
+	out  io.Writer
+	n    int
+	keys keyFormat
+}
+
+func (a *arrayWriter) write(po *processOut) error {
+	sep := ",\n"
+	if a.n == 0 {
+		sep = "["
+	}
+	a.n++
+	d, err := json.Marshal(po.result())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(a.out, "%s[%s, %s]", sep, a.keys.value(po.key), d)
+	return err
+}
+
+func (a *arrayWriter) finish() error {
+	end := "]"
+	if a.n == 0 {
+		end = "[]"
+	}
+	_, err := a.out.Write([]byte(end))
+	return err
+}
+
+// orderedWriter collects results to hand on in key order.
+type orderedWriter struct {
+	rw         resultWriter
+	pos        []*processOut
+	descending bool
+}
+
+func (d *orderedWriter) write(po *processOut) error {
+	d.pos = append(d.pos, po)
+	return nil
+}
+
+func (d *orderedWriter) finish() error {
+	sort.SliceStable(d.pos, func(i, j int) bool {
+		if d.descending {
+			return d.pos[i].key > d.pos[j].key
+		}
+		return d.pos[i].key < d.pos[j].key
+	})
+	for _, po := range d.pos {
+		if err := d.rw.write(po); err != nil {
+			return err
+		}
+	}
+	return d.rw.finish()
+}
+
+// discardWriter is swapped in once a client has gone away.
+type discardWriter struct{}
+
+func (discardWriter) write(po *processOut) error { return nil }
+func (discardWriter) finish() error              { return nil }
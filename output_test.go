@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testResults = []*processOut{
+	{key: 1346013961000000000, value: []interface{}{1.0, "a"}},
+	{key: 1346013962000000000, value: []interface{}{2.0, nil}},
+}
+
+func TestMapWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	mw := &mapWriter{out: buf}
+	for _, po := range testResults {
+		if err := mw.write(po); err != nil {
+			t.Fatalf("Error writing %v: %v", po, err)
+		}
+	}
+	mw.finish()
+
+	exp := `{"1346013961000": [1,"a"],` + "\n" + `"1346013962000": [2,null]}`
+	if buf.String() != exp {
+		t.Fatalf("Expected %s, got %s", exp, buf.String())
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	flushes := 0
+	sw := &streamWriter{out: buf, flush: func() { flushes++ }}
+	for _, po := range testResults {
+		if err := sw.write(po); err != nil {
+			t.Fatalf("Error writing %v: %v", po, err)
+		}
+	}
+	sw.finish()
+
+	exp := "{\"1346013961000\": [1,\"a\"]}\n{\"1346013962000\": [2,null]}\n"
+	if buf.String() != exp {
+		t.Fatalf("Expected %s, got %s", exp, buf.String())
+	}
+	if flushes != len(testResults) {
+		t.Fatalf("Expected %v flushes, got %v", len(testResults), flushes)
+	}
+}
+
+func TestKeyFormats(t *testing.T) {
+	tests := []struct {
+		query, exp string
+	}{
+		{"", `{"1346013961000": [1,"a"],` + "\n" + `"1346013962000": [2,null]}`},
+		{"keys=iso", `{"2012-08-26T20:46:01Z": [1,"a"],` + "\n" +
+			`"2012-08-26T20:46:02Z": [2,null]}`},
+		{"keys=offset&from=2012-08-26T20:46:00Z",
+			`{"1000": [1,"a"],` + "\n" + `"2000": [2,null]}`},
+		{"layout=array", `[[1346013961000, [1,"a"]],` + "\n" +
+			`[1346013962000, [2,null]]]`},
+		{"layout=array&keys=iso", `[["2012-08-26T20:46:01Z", [1,"a"]],` +
+			"\n" + `["2012-08-26T20:46:02Z", [2,null]]]`},
+		{"layout=array&stream=true&keys=offset&from=2012-08-26T20:46:00Z",
+			"[1000, [1,\"a\"]]\n[2000, [2,null]]\n"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/db/_query?"+test.query, nil)
+		if err := validOutputLayout(req); err != nil {
+			t.Fatalf("Error validating %v: %v", test.query, err)
+		}
+		buf := &bytes.Buffer{}
+		rw := newResultWriter(httptest.NewRecorder(), req, buf)
+		for _, po := range testResults {
+			rw.write(po)
+		}
+		rw.finish()
+		if buf.String() != test.exp {
+			t.Errorf("Expected %s for %v, got %s", test.exp, test.query, buf)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/db/_query?layout=array", nil)
+	buf := &bytes.Buffer{}
+	rw := newResultWriter(httptest.NewRecorder(), req, buf)
+	rw.write(testResults[1])
+	rw.write(testResults[0])
+	rw.finish()
+	exp := `[[1346013961000, [1,"a"]],` + "\n" + `[1346013962000, [2,null]]]`
+	if buf.String() != exp {
+		t.Errorf("Expected arrays in order, %s, got %s", exp, buf)
+	}
+
+	for _, bad := range []string{"keys=x", "keys=offset", "layout=list"} {
+		req, _ := http.NewRequest("GET", "/db/_query?"+bad, nil)
+		if validOutputLayout(req) == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
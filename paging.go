@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// The _all and _keys listings can be read a page at a time: skip
+// passes over that many documents first, and limit caps how many are
+// listed.  When there are more, the X-Seriesly-Next header (and "next"
+// in _keys) has the key the next page starts at, to pass back as
+// startkey_docid along with the same from and to.
+//
+// With descending=true, listing starts from the newest, and pages go
+// back in time.
+
+type page struct {
+	from, to    string
+	skip, limit int
+	descending  bool
+}
+
+// parsePage reads paging parameters for the range from..to.  A
+// negative limit is no limit.
+func parsePage(req *http.Request, from, to string, defLimit int) (page, error) {
+	p := page{from: from, to: to, limit: defLimit,
+		descending: req.FormValue("descending") == "true"}
+	switch s := req.FormValue("startkey_docid"); {
+	case s == "":
+	case p.descending && (p.to == "" || s < p.to):
+		// Just after s, so s is included.
+		p.to = s + "\x00"
+	case !p.descending && s > p.from:
+		p.from = s
+	}
+	if s := req.FormValue("skip"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("skip must be zero or more, got %q", s)
+		}
+		p.skip = n
+	}
+	if s := req.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("limit must be positive, got %q", s)
+		}
+		p.limit = n
+	}
+	return p, nil
+}
+
+// take reports whether the nth key walked (from 0) is on the page,
+// and whether it's where the next page starts.
+func (p page) take(n int) (onPage, next bool) {
+	switch {
+	case n < p.skip:
+		return false, false
+	case p.limit >= 0 && n >= p.skip+p.limit:
+		return false, true
+	}
+	return true, false
+}
+
+// walkKeys walks the keys in the page's range in its order.
+func (p page) walkKeys(dbname string, f func(k string) error) error {
+	if p.descending {
+		return dbwalkKeysReverse(dbname, p.from, p.to, f)
+	}
+	return dbwalkKeys(dbname, p.from, p.to, f)
+}
+
+// pageRange finds the keys a page covers, from inclusive to exclusive,
+// and where the next page starts, if there is one.  ok is false if the
+// page is empty.
+func pageRange(dbname string, p page) (from, to, next string, ok bool, err error) {
+	if p.skip == 0 && p.limit < 0 {
+		return p.from, p.to, "", true, nil
+	}
+	first, last := "", ""
+	n := 0
+	err = p.walkKeys(dbname, func(k string) error {
+		onPage, isNext := p.take(n)
+		n++
+		switch {
+		case isNext:
+			next = k
+			return io.EOF
+		case onPage:
+			if !ok {
+				first, ok = k, true
+			}
+			last = k
+		}
+		return nil
+	})
+	if err == io.EOF {
+		err = nil
+	}
+	if p.descending {
+		return last, first + "\x00", next, ok, err
+	}
+	to = p.to
+	if next != "" {
+		to = next
+	}
+	return first, to, next, ok, err
+}
+
+func setNextPage(w http.ResponseWriter, next string) {
+	if next != "" {
+		w.Header().Set("X-Seriesly-Next", next)
+	}
+}
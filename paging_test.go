@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
+)
+
+func TestPaging(t *testing.T) {
+	createMemDatabase("paged", memOptions{})
+	defer dropMemDatabase("paged")
+	defer dbRemoveConn("paged")
+	b := memDatabase("paged").Bulk()
+	all := []string{"2012-08-10T00:00:00Z", "2012-08-11T00:00:00Z",
+		"2012-08-12T00:00:00Z", "2012-08-13T00:00:00Z", "2012-08-14T00:00:00Z"}
+	for _, k := range all {
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, []byte("{}")))
+	}
+	b.Commit()
+
+	page := func(query string) ([]string, string) {
+		req, _ := http.NewRequest("GET", "/paged/_all?"+query, nil)
+		w := httptest.NewRecorder()
+		allDocs([]string{"paged"}, w, req)
+		if w.Code != 200 {
+			t.Fatalf("Expected 200 for %v, got %v: %s", query, w.Code, w.Body)
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatalf("Error decoding %s: %v", w.Body, err)
+		}
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys, w.Header().Get("X-Seriesly-Next")
+	}
+
+	if keys, next := page(""); !reflect.DeepEqual(keys, all) || next != "" {
+		t.Errorf("Expected everything, got %v, next %q", keys, next)
+	}
+
+	got := []string{}
+	query := "limit=2"
+	for i := 0; i < 5; i++ {
+		keys, next := page(query)
+		got = append(got, keys...)
+		if next == "" {
+			break
+		}
+		query = "limit=2&startkey_docid=" + next
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Errorf("Expected to page through everything, got %v", got)
+	}
+
+	keys, next := page("skip=1&limit=2&to=2012-08-14")
+	if !reflect.DeepEqual(keys, all[1:3]) || next != all[3] {
+		t.Errorf("Expected %v then %v, got %v then %q", all[1:3], all[3],
+			keys, next)
+	}
+	if keys, next := page("skip=10"); len(keys) != 0 || next != "" {
+		t.Errorf("Expected nothing past the end, got %v, %q", keys, next)
+	}
+
+	req, _ := http.NewRequest("GET", "/paged/_keys?skip=3&limit=1", nil)
+	w := httptest.NewRecorder()
+	debugKeys([]string{"paged"}, w, req)
+	kr := struct {
+		Keys []keyInfo `json:"keys"`
+		Next string    `json:"next"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &kr); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	if len(kr.Keys) != 1 || kr.Keys[0].Key != all[3] || kr.Next != all[4] {
+		t.Errorf("Expected key %v then %v, got %s", all[3], all[4], w.Body)
+	}
+
+	for _, q := range []string{"skip=-1", "limit=0", "limit=lots"} {
+		req, _ := http.NewRequest("GET", "/paged/_all?"+q, nil)
+		w := httptest.NewRecorder()
+		allDocs([]string{"paged"}, w, req)
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for %v, got %v", q, w.Code)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// Pair reducers relate two values from each document rather than
+// reducing one, e.g. reducer=covariance:/a:/b.  With a single
+// pointer, as in covariance:/b, the query's pointer in the same
+// position is the first of the pair.  Like JavaScript reducers, their
+// results can't be merged across federation members or shards.
+
+// ptrpair is the value a pair reducer sees for each document.
+type ptrpair struct {
+	a, b interface{}
+}
+
+var pairReducers = map[string]reducer{
+	"covariance": func(input chan ptrval) interface{} {
+		var n, sa, sb, sab float64
+		for p := range pairFloats(input) {
+			n++
+			sa += p[0]
+			sb += p[1]
+			sab += p[0] * p[1]
+		}
+		if n < 2 {
+			return math.NaN()
+		}
+		// The sample covariance.
+		return (sab - sa*sb/n) / (n - 1)
+	},
+	"correlation": func(input chan ptrval) interface{} {
+		var n, sa, sb, saa, sbb, sab float64
+		for p := range pairFloats(input) {
+			n++
+			sa += p[0]
+			sb += p[1]
+			saa += p[0] * p[0]
+			sbb += p[1] * p[1]
+			sab += p[0] * p[1]
+		}
+		return (n*sab - sa*sb) /
+			math.Sqrt((n*saa-sa*sa)*(n*sbb-sb*sb))
+	},
+	"ratio_sum": func(input chan ptrval) interface{} {
+		var sa, sb float64
+		for p := range pairFloats(input) {
+			sa += p[0]
+			sb += p[1]
+		}
+		return sa / sb
+	},
+}
+
+// parsePairReducer splits a pair reducer into its name and pointers.
+// first is empty when only the second pointer is named.
+func parsePairReducer(s string) (name, first, second string, ok bool) {
+	i := strings.Index(s, ":/")
+	if i < 0 {
+		return "", "", "", false
+	}
+	name, rest := s[:i], s[i+1:]
+	if _, ok = pairReducers[name]; !ok {
+		return "", "", "", false
+	}
+	if j := strings.Index(rest, ":/"); j >= 0 {
+		return name, rest[:j], rest[j+1:], true
+	}
+	return name, "", rest, true
+}
+
+// pairPointers returns the pointers to extract for a query's
+// reducers, along with the second pointer of any pairs, or the
+// pointer a conditional reducer tests.
+func pairPointers(ptrs, reds []string) ([]string, []string) {
+	var pairs []string
+	for i, r := range reds {
+		_, first, second, ok := parsePairReducer(r)
+		if c, cond, err := parseCondReducer(r); cond && err == nil {
+			first, second, ok = c.value, c.ptr, true
+		}
+		if !ok {
+			continue
+		}
+		if pairs == nil {
+			pairs = make([]string, len(ptrs))
+			ptrs = append([]string{}, ptrs...)
+		}
+		if first != "" {
+			ptrs[i] = first
+		}
+		pairs[i] = second
+	}
+	return ptrs, pairs
+}
+
+// pairFloats passes on the pairs where both values are numbers.
+func pairFloats(in chan ptrval) chan [2]float64 {
+	ch := make(chan [2]float64)
+	go func() {
+		defer close(ch)
+		for v := range in {
+			p, ok := v.val.(ptrpair)
+			if !v.included || !ok {
+				continue
+			}
+			a, aok := ptrFloat(p.a)
+			b, bok := ptrFloat(p.b)
+			if aok && bok {
+				ch <- [2]float64{a, b}
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePairReducer(t *testing.T) {
+	tests := []struct {
+		in, name, first, second string
+		ok                      bool
+	}{
+		{"covariance:/a:/b", "covariance", "/a", "/b", true},
+		{"ratio_sum:/b", "ratio_sum", "", "/b", true},
+		{"sum", "", "", "", false},
+		{"nosuch:/a:/b", "", "", "", false},
+	}
+	for _, test := range tests {
+		name, first, second, ok := parsePairReducer(test.in)
+		if name != test.name || first != test.first ||
+			second != test.second || ok != test.ok {
+			t.Errorf("Expected %q to parse as %q %q %q %v, got %q %q %q %v",
+				test.in, test.name, test.first, test.second, test.ok,
+				name, first, second, ok)
+		}
+	}
+
+	ptrs, pairs := pairPointers([]string{"/x", "/y"},
+		[]string{"sum", "covariance:/a:/b"})
+	if !reflect.DeepEqual(ptrs, []string{"/x", "/a"}) ||
+		!reflect.DeepEqual(pairs, []string{"", "/b"}) {
+		t.Errorf("Unexpected pointers %v and pairs %v", ptrs, pairs)
+	}
+}
+
+func TestPairReducers(t *testing.T) {
+	form := url.Values{
+		"group":   {"1000"},
+		"ptr":     {"/a", "/a", "/a"},
+		"reducer": {"covariance:/b", "correlation:/b", "ratio_sum:/b"},
+	}
+	p, err := parseQueryParams(form)
+	if err != nil {
+		t.Fatalf("Error parsing params: %v", err)
+	}
+
+	exp := []float64{2, 1, 0.5}
+	for i, r := range p.reds {
+		ch := make(chan ptrval)
+		go func() {
+			defer close(ch)
+			ch <- ptrval{nil, ptrpair{"1", "2"}, true}
+			ch <- ptrval{nil, ptrpair{"2", "4"}, true}
+			ch <- ptrval{nil, ptrpair{"3", "6"}, true}
+			ch <- ptrval{nil, ptrpair{"3", nil}, true}
+			ch <- ptrval{nil, ptrpair{"9", "1"}, false}
+		}()
+		got := lookupReducer(r, p.funcs, time.Now().Add(time.Minute))(ch)
+		if f, ok := got.(float64); !ok || math.Abs(f-exp[i]) > 1e-9 {
+			t.Errorf("Expected %v for %v, got %v", exp[i], r, got)
+		}
+	}
+}
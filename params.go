@@ -0,0 +1,303 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryParams is a parsed query request.  Range values are kept as
+// given, since their key encoding depends on the database queried.
+type queryParams struct {
+	group      int
+	slide      int
+	calendar   *calendarGroup
+	tz         string
+	from       string
+	to         string
+	ptrs       []string
+	reds       []string
+	filters    []string
+	filtervals []string
+	timeout    time.Duration
+	exclude    []exclusionWindow
+	funcs      map[string]string
+	groupby    string
+
+	consistency string
+}
+
+// A paramError describes a bad query parameter to the client.
+type paramError struct {
+	title  string
+	reason string
+}
+
+func (e *paramError) Error() string {
+	return e.title + ": " + e.reason
+}
+
+func emitParamError(w http.ResponseWriter, err error) {
+	if pe, ok := err.(*paramError); ok {
+		emitError(400, w, pe.title, pe.reason)
+	} else {
+		emitError(400, w, "Bad Request", err.Error())
+	}
+}
+
+func parseQueryParams(form url.Values) (queryParams, error) {
+	p := queryParams{
+		from:       form.Get("from"),
+		to:         form.Get("to"),
+		ptrs:       form["ptr"],
+		filters:    form["f"],
+		filtervals: form["fv"],
+		groupby:    form.Get("groupby"),
+		tz:         form.Get("tz"),
+	}
+
+	var err error
+	p.group, p.calendar, err = parseGroup(form.Get("group"), p.tz)
+	if err != nil {
+		return p, &paramError{"Bad group value", err.Error()}
+	}
+
+	if s := form.Get("slide"); s != "" {
+		p.slide, err = strconv.Atoi(s)
+		if err != nil {
+			return p, &paramError{"Bad slide value", err.Error()}
+		}
+		if p.calendar != nil {
+			return p, &paramError{"Bad slide value",
+				"calendar groups can't slide"}
+		}
+		if p.slide <= 0 || p.slide > p.group || p.group%p.slide != 0 {
+			return p, &paramError{"Bad slide value",
+				"slide must evenly divide group"}
+		}
+	}
+
+	for _, f := range form["function"] {
+		name, src, err := parseJSFunction(f)
+		if err != nil {
+			return p, &paramError{"Bad function", err.Error()}
+		}
+		if p.funcs == nil {
+			p.funcs = map[string]string{}
+		}
+		p.funcs[name] = src
+	}
+
+	for _, r := range form["reducer"] {
+		_, ok := reducers[r]
+		if strings.HasPrefix(r, jsReducerPrefix) {
+			_, ok = p.funcs[r[len(jsReducerPrefix):]]
+		}
+		if _, first, second, pair := parsePairReducer(r); pair {
+			for _, ptr := range []string{first, second} {
+				if isPtrExpr(ptr) {
+					if _, err := parsePtrExpr(ptr); err != nil {
+						return p, &paramError{"Bad pointer expression",
+							err.Error()}
+					}
+				}
+			}
+			ok = true
+		}
+		if c, cond, err := parseCondReducer(r); cond {
+			if err != nil {
+				return p, &paramError{"Bad condition", err.Error()}
+			}
+			if isPtrExpr(c.value) {
+				if _, err := parsePtrExpr(c.value); err != nil {
+					return p, &paramError{"Bad pointer expression",
+						err.Error()}
+				}
+			}
+			ok = true
+		}
+		if !ok {
+			return p, &paramError{"No such reducer", r}
+		}
+		p.reds = append(p.reds, r)
+	}
+
+	if _, err := parseTransforms(form["transform"]); err != nil {
+		return p, &paramError{"Bad transform value", err.Error()}
+	}
+
+	for _, ptr := range p.ptrs {
+		if isPtrExpr(ptr) {
+			if _, err := parsePtrExpr(ptr); err != nil {
+				return p, &paramError{"Bad pointer expression", err.Error()}
+			}
+		}
+	}
+
+	if len(p.ptrs) < 1 {
+		return p, &paramError{"Pointer required",
+			"At least one ptr argument is required"}
+	}
+
+	if len(p.ptrs) != len(p.reds) {
+		return p, &paramError{"Parameter mismatch",
+			"Must supply the same number of pointers and reducers"}
+	}
+
+	if p.groupby != "" && !strings.HasPrefix(p.groupby, "/") {
+		return p, &paramError{"Bad groupby value",
+			"groupby must be a JSON pointer"}
+	}
+
+	if len(p.filters) != len(p.filtervals) {
+		return p, &paramError{"Parameter mismatch",
+			"Must supply the same number of filters and filter values"}
+	}
+
+	p.timeout, err = queryTimeoutParam(form.Get("timeout"))
+	if err != nil {
+		return p, &paramError{"Bad timeout value", err.Error()}
+	}
+
+	for _, x := range form["exclude"] {
+		e, err := parseExclusionParam(x)
+		if err != nil {
+			return p, &paramError{"Bad exclude value", err.Error()}
+		}
+		p.exclude = append(p.exclude, e)
+	}
+
+	p.consistency = form.Get("consistency")
+	switch p.consistency {
+	case "", consistencyEventual, consistencySession:
+	default:
+		return p, &paramError{"Bad consistency value", p.consistency}
+	}
+
+	return p, nil
+}
+
+type queryReduction struct {
+	Ptr     string `json:"ptr"`
+	Reducer string `json:"reducer"`
+}
+
+type queryFilter struct {
+	Ptr   string `json:"ptr"`
+	Value string `json:"value"`
+}
+
+// queryBody is a query given as a JSON request body, for queries too
+// long to fit comfortably in a URL.
+type queryBody struct {
+	From             string           `json:"from"`
+	To               string           `json:"to"`
+	Group            queryGroup       `json:"group"`
+	TZ               string           `json:"tz,omitempty"`
+	Slide            int              `json:"slide,omitempty"`
+	Reductions       []queryReduction `json:"reductions"`
+	Filters          []queryFilter    `json:"filters"`
+	Exclude          []string         `json:"exclude"`
+	Timeout          string           `json:"timeout"`
+	Consistency      string           `json:"consistency"`
+	Stream           bool             `json:"stream"`
+	GroupBy          string           `json:"groupby"`
+	StoredExclusions *bool            `json:"stored_exclusions"`
+	// JavaScript reducers by name, used as reducer js:name.
+	Functions map[string]string `json:"functions,omitempty"`
+}
+
+// values renders the body as the equivalent query string parameters.
+func (b queryBody) values() url.Values {
+	rv := url.Values{"group": {string(b.Group)}}
+	if b.Slide > 0 {
+		rv.Set("slide", strconv.Itoa(b.Slide))
+	}
+	set := func(k, v string) {
+		if v != "" {
+			rv.Set(k, v)
+		}
+	}
+	set("from", b.From)
+	set("to", b.To)
+	set("timeout", b.Timeout)
+	set("consistency", b.Consistency)
+	set("tz", b.TZ)
+	set("groupby", b.GroupBy)
+	for _, r := range b.Reductions {
+		rv.Add("ptr", r.Ptr)
+		rv.Add("reducer", r.Reducer)
+	}
+	for _, f := range b.Filters {
+		rv.Add("f", f.Ptr)
+		rv.Add("fv", f.Value)
+	}
+	rv["exclude"] = b.Exclude
+	if b.Stream {
+		rv.Set("stream", "true")
+	}
+	for name, src := range b.Functions {
+		rv.Add("function", name+"="+src)
+	}
+	if b.StoredExclusions != nil {
+		rv.Set("stored_exclusions", strconv.FormatBool(*b.StoredExclusions))
+	}
+	return rv
+}
+
+// form renders the parameters back into a query string.
+func (p queryParams) form() url.Values {
+	rv := url.Values{
+		"group":   {strconv.Itoa(p.group)},
+		"ptr":     p.ptrs,
+		"reducer": p.reds,
+		"timeout": {p.timeout.String()},
+	}
+	if p.from != "" {
+		rv.Set("from", p.from)
+	}
+	if p.to != "" {
+		rv.Set("to", p.to)
+	}
+	if len(p.filters) > 0 {
+		rv["f"] = p.filters
+		rv["fv"] = p.filtervals
+	}
+	for _, e := range p.exclude {
+		rv.Add("exclude", e.From+","+e.To)
+	}
+	for name, src := range p.funcs {
+		rv.Add("function", name+"="+src)
+	}
+	if p.groupby != "" {
+		rv.Set("groupby", p.groupby)
+	}
+	if p.slide > 0 {
+		rv.Set("slide", strconv.Itoa(p.slide))
+	}
+	if p.calendar != nil {
+		rv.Set("group", p.calendar.String())
+	}
+	if p.tz != "" {
+		rv.Set("tz", p.tz)
+	}
+	return rv
+}
+
+// start begins executing the query against a database.
+func (p queryParams) start(dbname string) (*queryIn, error) {
+	from, err := cleanupRangeParam(dbname, p.from, "")
+	if err != nil {
+		return nil, &paramError{"Bad from value", err.Error()}
+	}
+	to, err := cleanupRangeParam(dbname, p.to, "")
+	if err != nil {
+		return nil, &paramError{"Bad to value", err.Error()}
+	}
+	return executeQuery(dbname, from, to, p.group, p.slide, p.calendar,
+		p.ptrs, p.reds,
+		p.filters, p.filtervals, p.exclude, p.funcs, p.groupby,
+		p.timeout), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/dustin/gojson"
+)
+
+// PUT /db/ts stores a document at a time, replacing whatever is
+// there regardless of the database's conflict policy.  PATCH /db/ts
+// applies a JSON merge patch (RFC 7386) to the document already
+// there.  Both are resolved by the writer, so a patch sees every
+// write queued before it.
+
+// mergePatch applies a merge patch to a document.  A patch that isn't
+// an object replaces the document, and null removes a field.
+func mergePatch(doc, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(patch), []byte("{")) {
+		return patch, nil
+	}
+	pm := map[string]json.RawMessage{}
+	if err := json.Unmarshal(patch, &pm); err != nil {
+		return nil, err
+	}
+	dm := map[string]json.RawMessage{}
+	if json.Unmarshal(doc, &dm) != nil || dm == nil {
+		dm = map[string]json.RawMessage{}
+	}
+	for k, v := range pm {
+		if string(bytes.TrimSpace(v)) == "null" {
+			delete(dm, k)
+			continue
+		}
+		merged, err := mergePatch(dm[k], v)
+		if err != nil {
+			return nil, err
+		}
+		dm[k] = merged
+	}
+	return encodeRawObject(dm), nil
+}
+
+// modify returns the key and document to store for a replace or a
+// patch.
+func (dq *dbWriter) modify(qi dbqitem) (string, []byte, error) {
+	k := dq.format.normalizeKey(qi.k)
+	if qi.op == opReplace {
+		return k, qi.data, nil
+	}
+	old, exists := dq.existing(k)
+	if !exists {
+		return k, nil, errNotFound
+	}
+	data, err := mergePatch(old, qi.data)
+	if err != nil {
+		return k, nil, err
+	}
+	data, err = applyFieldSchema(dbFieldSchema(dq.dbname), data)
+	if err == nil {
+		err = checkEvent(dq.dbname, k, data)
+	}
+	return k, data, err
+}
+
+func patchDocument(args []string, w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	r, err := requestBody(req)
+	if err != nil {
+		emitBodyError(w, err)
+		return
+	}
+	defer r.Close()
+	patch, err := ioutil.ReadAll(r)
+	if err != nil {
+		emitBodyError(w, err)
+		return
+	}
+	if patch, err = jsonBody(req, patch); err != nil {
+		emitError(400, w, "Error parsing MessagePack data", err.Error())
+		return
+	}
+	if err := json.Validate(patch); err != nil {
+		emitError(400, w, "Error parsing JSON data", err.Error())
+		return
+	}
+	if _, err := os.Stat(dbPath(args[0])); err != nil &&
+		memDatabase(args[0]) == nil {
+		emitError(404, w, "not_found", err.Error())
+		return
+	}
+
+	seq, err := dbmodify(args[0], args[1], patch, opPatch,
+		requestProvenance(args[0], req))
+	if err != nil {
+		emitStoreError(w, err)
+		return
+	}
+	serverStatsCollector.add(statIngest, 1)
+	sessionWrote(sessionToken(req), args[0])
+	w.Header().Set("X-Seriesly-Seq", strconv.FormatUint(seq, 10))
+	w.WriteHeader(200)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dustin/gojson"
+)
+
+func TestMergePatch(t *testing.T) {
+	// Examples from RFC 7386, appendix A.
+	tests := []struct {
+		doc, patch, exp string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		got, err := mergePatch([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("Error patching %s with %s: %v", test.doc, test.patch, err)
+			continue
+		}
+		var a, b interface{}
+		json.Unmarshal(got, &a)
+		json.Unmarshal([]byte(test.exp), &b)
+		ja, _ := json.Marshal(a)
+		jb, _ := json.Marshal(b)
+		if string(ja) != string(jb) {
+			t.Errorf("Expected %s patched with %s to be %s, got %s",
+				test.doc, test.patch, test.exp, got)
+		}
+	}
+}
+
+func TestModify(t *testing.T) {
+	dq := &dbWriter{db: &memHandle{testMemStore("a")},
+		format: storageFormats[1], conflicts: conflictReject}
+
+	k, data, err := dq.modify(dbqitem{k: "a", data: []byte(`{"n":1}`),
+		op: opReplace})
+	if k != "a" || string(data) != `{"n":1}` || err != nil {
+		t.Errorf("Expected a replace to ignore the policy, got %v %s %v",
+			k, data, err)
+	}
+
+	if _, _, err := dq.modify(dbqitem{k: "b", data: []byte(`{}`),
+		op: opPatch}); err != errNotFound {
+		t.Errorf("Expected patching nothing to fail, got %v", err)
+	}
+
+	dq.track("a", []byte(`{"n":1,"m":2}`))
+	_, data, err = dq.modify(dbqitem{k: "a", data: []byte(`{"m":null}`),
+		op: opPatch})
+	if string(data) != `{"n":1}` || err != nil {
+		t.Errorf("Expected the queued document patched, got %s %v", data, err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-couchstore"
+)
+
+// An extractPlan is what a query needs from each document, worked out
+// once when the query starts and shared by every worker reducing its
+// chunks: all the pointers to find, in one pass through a document,
+// and where each reducer's value comes from.  Nothing in a plan
+// changes once it's made.
+type extractPlan struct {
+	keys       []string
+	values     []valueSource
+	pairs      []valueSource
+	filters    []string
+	filtervals []string
+	groupby    string
+}
+
+// A valueSource is where one value given to a reducer comes from.
+type valueSource struct {
+	ptr  string
+	expr ptrExpr
+	id   bool
+}
+
+func newValueSource(p string, expr func(string) ptrExpr) valueSource {
+	s := valueSource{ptr: p, id: p == "_id"}
+	if isPtrExpr(p) {
+		s.expr = expr(p)
+	}
+	return s
+}
+
+// planExpr parses an expression that's already been validated.
+func planExpr(s string) ptrExpr {
+	e, err := parsePtrExpr(s)
+	if err != nil {
+		return numExpr(0)
+	}
+	return e
+}
+
+// newExtractPlan plans a query's extraction.  pairs are the second
+// pointers from pairPointers, if any.
+func newExtractPlan(ptrs, pairs, filters, filtervals []string,
+	groupby string) *extractPlan {
+
+	x := &extractPlan{filters: filters, filtervals: filtervals,
+		groupby: groupby}
+	seen := map[string]bool{}
+	need := func(f string) {
+		if f != "" && !seen[f] {
+			x.keys = append(x.keys, f)
+			seen[f] = true
+		}
+	}
+	for _, f := range filters {
+		need(f)
+	}
+	for i, p := range ptrs {
+		pair := ""
+		if i < len(pairs) {
+			pair = pairs[i]
+		}
+		x.values = append(x.values, newValueSource(p, planExpr))
+		x.pairs = append(x.pairs, newValueSource(pair, planExpr))
+		for _, s := range []valueSource{x.values[i], x.pairs[i]} {
+			if s.expr != nil {
+				for _, f := range s.expr.pointers() {
+					need(f)
+				}
+			} else {
+				need(s.ptr)
+			}
+		}
+	}
+	need(groupby)
+	return x
+}
+
+// fetch finds the values the plan needs in a document.
+func (x *extractPlan) fetch(doc []byte) map[string]interface{} {
+	return resolveFetch(doc, x.keys)
+}
+
+// reduce sends a document's values to each reducer, if it passes the
+// filters.
+func (x *extractPlan) reduce(di *couchstore.DocInfo, chs []chan ptrval,
+	fetched map[string]interface{}, numeric map[string]bool,
+	included bool) {
+
+	if !matchesFilters(fetched, x.filters, x.filtervals) {
+		return
+	}
+	pv := ptrval{di, nil, included}
+	for i, s := range x.values {
+		pv.val = s.value(di, fetched, numeric)
+		if x.pairs[i].ptr != "" {
+			pv.val = ptrpair{pv.val, x.pairs[i].value(di, fetched, numeric)}
+		}
+		chs[i] <- pv
+	}
+}
+
+// value finds a pointer's value in a document, rendering scalars as
+// strings unless they're declared numbers.
+func (s valueSource) value(di *couchstore.DocInfo,
+	fetched map[string]interface{}, numeric map[string]bool) interface{} {
+
+	val := fetched[s.ptr]
+	if f, ok := val.(float64); ok && numeric[s.ptr] {
+		return f
+	}
+	if s.id {
+		val = di.ID()
+	}
+	if s.expr != nil {
+		val = nil
+		if f, ok := s.expr.eval(fetched); ok {
+			val = f
+		}
+	}
+	switch val.(type) {
+	case int, uint, int64, float64, uint64, bool:
+		return fmt.Sprintf("%v", val)
+	}
+	return val
+}
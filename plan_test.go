@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func TestExtractPlan(t *testing.T) {
+	ptrs, pairs := pairPointers(
+		[]string{"/a", "(/a)+(/b)", "/c", "_id"},
+		[]string{"sum", "max", "covariance:/a", "count"})
+	x := newExtractPlan(ptrs, pairs, []string{"/src"}, []string{"x"}, "/host")
+	exp := []string{"/src", "/a", "/b", "/c", "_id", "/host"}
+	if !reflect.DeepEqual(x.keys, exp) {
+		t.Errorf("Expected keys %v, got %v", exp, x.keys)
+	}
+
+	di := couchstore.NewDocInfo("2013-01-01T00:00:00Z", 0)
+	chs := []chan ptrval{}
+	for range ptrs {
+		chs = append(chs, make(chan ptrval, 1))
+	}
+	doc := []byte(`{"src": "x", "a": 1, "b": 2, "c": 3, "host": "h"}`)
+	x.reduce(di, chs, x.fetch(doc), map[string]bool{"/c": true}, true)
+	got := []interface{}{}
+	for _, ch := range chs {
+		got = append(got, (<-ch).val)
+	}
+	expVals := []interface{}{"1", "3", ptrpair{3.0, "1"}, di.ID()}
+	if !reflect.DeepEqual(got, expVals) {
+		t.Errorf("Expected %#v, got %#v", expVals, got)
+	}
+
+	x.reduce(di, chs, x.fetch([]byte(`{"src": "y", "a": 1}`)), nil, true)
+	for i, ch := range chs {
+		select {
+		case v := <-ch:
+			t.Errorf("Expected %v to be filtered out, got %v", i, v)
+		default:
+		}
+	}
+}
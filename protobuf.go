@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// Query results in the protocol buffer form described in
+// query.proto, for clients that send Accept: application/protobuf.
+// The encoding is simple enough to write by hand, which saves
+// depending on generated code.
+
+const protobufType = "application/protobuf"
+
+func acceptsProtobuf(req *http.Request) bool {
+	for _, t := range strings.Split(req.Header.Get("Accept"), ",") {
+		t = strings.TrimSpace(strings.SplitN(t, ";", 2)[0])
+		if t == protobufType || t == "application/x-protobuf" {
+			return true
+		}
+	}
+	return false
+}
+
+// Wire types.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+)
+
+type pbBuffer []byte
+
+func (b *pbBuffer) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	*b = append(*b, tmp[:n]...)
+}
+
+func (b *pbBuffer) tag(field, wire int) {
+	b.varint(uint64(field<<3 | wire))
+}
+
+func (b *pbBuffer) bytes(field int, v []byte) {
+	b.tag(field, pbBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *pbBuffer) double(field int, v float64) {
+	b.tag(field, pbFixed64)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	*b = append(*b, tmp[:]...)
+}
+
+// pbValue encodes a Value message.
+func pbValue(v interface{}) []byte {
+	b := pbBuffer{}
+	switch x := v.(type) {
+	case nil:
+		b.tag(1, pbVarint)
+		b.varint(1)
+	case float64:
+		b.double(2, x)
+	case int:
+		b.double(2, float64(x))
+	case int64:
+		b.double(2, float64(x))
+	case string:
+		b.bytes(3, []byte(x))
+	default:
+		j, err := json.Marshal(x)
+		if err != nil {
+			j = []byte("null")
+		}
+		b.bytes(4, j)
+	}
+	return b
+}
+
+// pbValues encodes a list of values as repeated Value fields.
+func pbValues(field int, vals []interface{}) pbBuffer {
+	b := pbBuffer{}
+	for _, v := range vals {
+		b.bytes(field, pbValue(v))
+	}
+	return b
+}
+
+// pbGroup encodes a query result as a Group message.
+func pbGroup(po *processOut) []byte {
+	b := pbBuffer{}
+	b.tag(1, pbVarint)
+	b.varint(uint64(po.key / 1e6))
+	b = append(b, pbValues(2, po.value)...)
+
+	keys := make([]string, 0, len(po.groups))
+	for k := range po.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := pbBuffer{}
+		entry.bytes(1, []byte(k))
+		entry.bytes(2, pbValues(1, po.groups[k]))
+		b.bytes(3, entry)
+	}
+	return b
+}
+
+// protobufWriter writes each group as a groups field of QueryResult,
+// so the response is complete whenever it stops.  When streaming,
+// each group is pushed through to the client as it's written.
+type protobufWriter struct {
+	out   io.Writer
+	flush func()
+}
+
+func (p *protobufWriter) write(po *processOut) error {
+	b := pbBuffer{}
+	b.bytes(1, pbGroup(po))
+	_, err := p.out.Write(b)
+	if p.flush != nil {
+		p.flush()
+	}
+	return err
+}
+
+func (p *protobufWriter) finish() error {
+	return nil
+}
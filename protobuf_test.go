@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProtobufGroups(t *testing.T) {
+	buf := &bytes.Buffer{}
+	pw := &protobufWriter{out: buf}
+	pw.write(&processOut{key: 2000 * 1e6, value: []interface{}{1.5, nil}})
+
+	exp := []byte{
+		0x0a, 18, // groups
+		0x08, 0xd0, 0x0f, // timestamp 2000
+		0x12, 9, 0x11, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f, // number 1.5
+		0x12, 2, 0x08, 1, // null
+	}
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("Expected % x, got % x", exp, buf.Bytes())
+	}
+
+	tests := []struct {
+		v   interface{}
+		exp []byte
+	}{
+		{"up", []byte{0x1a, 2, 'u', 'p'}},
+		{[]interface{}{1.0}, []byte{0x22, 3, '[', '1', ']'}},
+	}
+	for _, test := range tests {
+		if got := pbValue(test.v); !bytes.Equal(got, test.exp) {
+			t.Errorf("Expected %v as % x, got % x", test.v, test.exp, got)
+		}
+	}
+
+	got := pbGroup(&processOut{key: 0,
+		groups: map[string][]interface{}{"a": {"x"}}})
+	exp = []byte{
+		0x08, 0, // timestamp
+		0x1a, 10, // by
+		0x0a, 1, 'a', // key
+		0x12, 5, 0x0a, 3, 0x1a, 1, 'x', // Values{text "x"}
+	}
+	if !bytes.Equal(got, exp) {
+		t.Errorf("Expected a by entry % x, got % x", exp, got)
+	}
+}
+
+func TestProtobufNegotiation(t *testing.T) {
+	tests := []struct {
+		accept, format, exp string
+	}{
+		{"", "", ""},
+		{"application/protobuf", "", protobufType},
+		{"text/html, application/x-protobuf;q=0.9", "", protobufType},
+		{"application/protobuf", "json", ""},
+		{"application/protobuf", "msgpack", msgpackType},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/db/_query?format="+test.format, nil)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		newResultWriter(w, req, w)
+		if got := w.Header().Get("Content-Type"); got != test.exp {
+			t.Errorf("Expected %q for %q/%q, got %q",
+				test.exp, test.accept, test.format, got)
+		}
+	}
+}
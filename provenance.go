@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
+)
+
+// With provenance configured, a database keeps where each document
+// came from: the Content-Type and source address of the request that
+// last wrote it, when it was received, and any request headers named
+// in the config, e.g.
+//
+//	{"provenance": {"headers": ["User-Agent", "X-Collector"]}}
+//
+// These are kept in a sidecar file rather than the document, so
+// queries see the same documents either way, and are returned as JSON
+// in the X-Seriesly-Provenance header of a GET.  Documents written
+// in bulk, or with provenance off, have none.
+
+const provenanceExt = ".provenance"
+
+type provenanceSpec struct {
+	Headers []string `json:"headers,omitempty"`
+}
+
+type provenance struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Source      string            `json:"source"`
+	Received    time.Time         `json:"received"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+func provenancePath(dbname string) string {
+	return dbPath(dbname) + provenanceExt
+}
+
+// requestProvenance records where a write came from, or returns nil
+// if the database doesn't keep provenance.
+func requestProvenance(dbname string, req *http.Request) []byte {
+	spec := dbConfigFor(dbname).Provenance
+	if spec == nil {
+		return nil
+	}
+	p := provenance{ContentType: req.Header.Get("Content-Type"),
+		Source: auditClient(req), Received: time.Now().UTC()}
+	for _, h := range spec.Headers {
+		if v := req.Header.Get(h); v != "" {
+			if p.Headers == nil {
+				p.Headers = map[string]string{}
+			}
+			p.Headers[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+	d, err := json.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+// A provenanceLog keeps a database's provenance file up to date as
+// its writer commits.  Only touched by the write loop.
+type provenanceLog struct {
+	dbname string
+	// Provenance of documents written since the last flush.  nil
+	// for those written without any.
+	pending map[string][]byte
+}
+
+// newProvenanceLog returns the log for a database, or nil if it
+// doesn't keep provenance.
+func newProvenanceLog(dbname string, db dbStore) *provenanceLog {
+	if _, ok := db.(*memHandle); ok {
+		return nil
+	}
+	if dbConfigFor(dbname).Provenance == nil {
+		return nil
+	}
+	return &provenanceLog{dbname: dbname, pending: map[string][]byte{}}
+}
+
+// add records the provenance of a write, replacing that of any
+// earlier one.
+func (l *provenanceLog) add(k string, prov []byte) {
+	if l != nil {
+		l.pending[k] = prov
+	}
+}
+
+func (l *provenanceLog) flush() {
+	if l == nil || len(l.pending) == 0 {
+		return
+	}
+	pending := l.pending
+	l.pending = map[string][]byte{}
+
+	path := provenancePath(l.dbname)
+	pf, err := couchstore.Open(path, true)
+	if err != nil {
+		dbLog.Error("error opening provenance", "db", l.dbname, "err", err)
+		return
+	}
+	recordDBConn(path, pf)
+	defer closeDBConn(pf)
+
+	bulk := pf.Bulk()
+	defer bulk.Close()
+	for k, prov := range pending {
+		if prov == nil {
+			bulk.Delete(couchstore.NewDocInfo(k, 0))
+			continue
+		}
+		bulk.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, prov))
+	}
+	if err := bulk.Commit(); err != nil {
+		dbLog.Error("error writing provenance", "db", l.dbname, "err", err)
+	}
+}
+
+// docProvenance returns the provenance of a document, if any was kept.
+func docProvenance(dbname, k string) []byte {
+	if shard, _ := shardFor(dbname, k, false); shard != "" {
+		dbname = shard
+	}
+	k = dbFormat(dbname).normalizeKey(k)
+	path := provenancePath(dbname)
+	pf, err := couchstore.Open(path, false)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dbLog.Warn("error opening provenance", "db", dbname, "err", err)
+		}
+		return nil
+	}
+	recordDBConn(path, pf)
+	defer closeDBConn(pf)
+	doc, _, err := pf.Get(k)
+	if err != nil {
+		return nil
+	}
+	return doc.Value()
+}
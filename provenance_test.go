@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/dustin/gojson"
+)
+
+func TestRequestProvenance(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/db", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Collector", "c1")
+	req.Header.Set("Authorization", "secret")
+
+	if prov := requestProvenance("plain", req); prov != nil {
+		t.Errorf("Expected no provenance without config, got %s", prov)
+	}
+
+	metaCache["prov"] = dbMeta{Format: 1, Config: &dbConfig{
+		Provenance: &provenanceSpec{[]string{"x-collector", "User-Agent"}}}}
+	defer delete(metaCache, "prov")
+
+	p := provenance{}
+	if err := json.Unmarshal(requestProvenance("prov", req), &p); err != nil {
+		t.Fatalf("Error decoding provenance: %v", err)
+	}
+	if p.ContentType != "application/json" || p.Source != "10.0.0.1" ||
+		p.Received.IsZero() {
+		t.Errorf("Expected the request's type, source and time, got %+v", p)
+	}
+	if len(p.Headers) != 1 || p.Headers["X-Collector"] != "c1" {
+		t.Errorf("Expected just the configured headers, got %v", p.Headers)
+	}
+}
+
+func TestProvenanceStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-prov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	const dbname = "prov"
+	if err := dbcreate(dbPath(dbname)); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	err = updateMeta(dbname, func(m *dbMeta) {
+		m.Config = &dbConfig{Provenance: &provenanceSpec{}}
+	})
+	if err != nil {
+		t.Fatalf("Error configuring: %v", err)
+	}
+	defer forgetDB(dbname)
+
+	const k = "2012-08-10T00:00:00Z"
+	_, err = dbstoreOp(dbname, k, []byte(`{"a": 1}`), opStoreItem, false,
+		[]byte(`{"source":"10.0.0.1"}`))
+	if err == nil {
+		err = dbflush(dbname)
+	}
+	if err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	if got := string(docProvenance(dbname, k)); got != `{"source":"10.0.0.1"}` {
+		t.Errorf("Expected the provenance stored, got %q", got)
+	}
+
+	// A write without any drops what was kept.
+	if err := dbstore(dbname, k, []byte(`{"a": 2}`)); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	if err := dbflush(dbname); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	if got := docProvenance(dbname, k); got != nil {
+		t.Errorf("Expected no provenance after a write without any, got %q", got)
+	}
+}
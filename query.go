@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"strconv"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dustin/go-couchstore"
 	"github.com/dustin/go-jsonpointer"
@@ -15,6 +17,7 @@ import (
 )
 
 var errTimeout = errors.New("query timed out")
+var errCanceled = errors.New("query canceled")
 
 type ptrval struct {
 	di       *couchstore.DocInfo
@@ -30,12 +33,25 @@ type processOut struct {
 	value       []interface{}
 	err         error
 	cacheOpaque uint32
+	// With groupby, values by the field's value instead.
+	groups map[string][]interface{}
 }
 
 func (p processOut) MarshalJSON() ([]byte, error) {
+	if p.groups != nil {
+		return json.Marshal(map[string]interface{}{"g": p.groups})
+	}
 	return json.Marshal(map[string]interface{}{"v": p.value})
 }
 
+// result is what's reported to clients for a group.
+func (p processOut) result() interface{} {
+	if p.groups != nil {
+		return p.groups
+	}
+	return p.value
+}
+
 type processIn struct {
 	cacheKey   string
 	dbname     string
@@ -47,7 +63,19 @@ type processIn struct {
 	before     time.Time
 	filters    []string
 	filtervals []string
+	funcs      map[string]string
+	groupby    string
+	quit       <-chan bool
 	out        chan<- *processOut
+	budget     *queryBudget
+	plan       *extractPlan
+}
+
+// extractPlan plans what to take from each document for a chunk that
+// wasn't given the query's plan.
+func (pi *processIn) extractPlan() *extractPlan {
+	ptrs, pairs := pairPointers(pi.ptrs, pi.reds)
+	return newExtractPlan(ptrs, pairs, pi.filters, pi.filtervals, pi.groupby)
 }
 
 type queryIn struct {
@@ -55,25 +83,60 @@ type queryIn struct {
 	from       string
 	to         string
 	group      int
+	slide      int
+	calendar   *calendarGroup
 	ptrs       []string
 	reds       []string
 	start      time.Time
+	walking    time.Time
 	before     time.Time
 	filters    []string
 	filtervals []string
+	exclude    []exclusionWindow
+	funcs      map[string]string
+	groupby    string
 	started    int32
 	totalKeys  int32
+	budget     *queryBudget
+	plan       *extractPlan
+	quit       chan bool
 	out        chan *processOut
 	cherr      chan error
 }
 
+// cancel stops a query from doing any more work.  Results already in
+// flight are still delivered.
+func (q *queryIn) cancel() {
+	select {
+	case <-q.quit:
+	default:
+		close(q.quit)
+	}
+}
+
+func isClosed(ch <-chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolveFetch finds the values at some pointers in a document.  The
+// document is scanned rather than decoded, and only the values found
+// are decoded.
 func resolveFetch(j []byte, keys []string) map[string]interface{} {
-	rv := map[string]interface{}{}
+	rv := make(map[string]interface{}, len(keys))
 	found, err := jsonpointer.FindMany(j, keys)
 	if err != nil {
 		return rv
 	}
 	for k, v := range found {
+		if val, ok := scanScalar(v); ok {
+			rv[k] = val
+			continue
+		}
 		var val interface{}
 		err = json.Unmarshal(v, &val)
 		if err == nil {
@@ -83,76 +146,90 @@ func resolveFetch(j []byte, keys []string) map[string]interface{} {
 	return rv
 }
 
-func processDoc(di *couchstore.DocInfo, chs []chan ptrval,
-	doc []byte, ptrs []string,
-	filters []string, filtervals []string,
-	included bool) {
-
-	pv := ptrval{di, nil, included}
-
-	// Find all keys for filters and comparisons so we can do a
-	// single pass through the document.
-	keys := make([]string, 0, len(filters)+len(ptrs))
-	seen := map[string]bool{}
-	for _, f := range filters {
-		if !seen[f] {
-			keys = append(keys, f)
-			seen[f] = true
-		}
+// scanScalar decodes the plain strings, numbers and literals that
+// make up most values without going through json.Unmarshal.  Anything
+// else, such as escaped strings, objects and arrays, isn't ok.
+func scanScalar(v []byte) (interface{}, bool) {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 {
+		return nil, false
 	}
-	for _, f := range ptrs {
-		if !seen[f] {
-			keys = append(keys, f)
-			seen[f] = true
-		}
+	switch c := v[0]; {
+	case c == '"':
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return nil, false
+		}
+		s := v[1 : len(v)-1]
+		if bytes.IndexByte(s, '\\') >= 0 || !utf8.Valid(s) {
+			return nil, false
+		}
+		return string(s), true
+	case c == '-' || (c >= '0' && c <= '9'):
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	switch string(v) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "null":
+		return nil, true
 	}
+	return nil, false
+}
 
-	fetched := resolveFetch(doc, keys)
+// matchesFilters reports whether every filter pointer was found with
+// its expected value.
+func matchesFilters(fetched map[string]interface{},
+	filters []string, filtervals []string) bool {
 
 	for i, p := range filters {
-		val := fetched[p]
-		checkVal := filtervals[i]
-		switch val.(type) {
-		case string:
-			if val != checkVal {
-				return
-			}
-		case int, uint, int64, float64, uint64, bool:
-			v := fmt.Sprintf("%v", val)
-			if v != checkVal {
-				return
-			}
-		default:
-			return
+		if v, ok := filterString(fetched[p]); !ok || v != filtervals[i] {
+			return false
 		}
 	}
+	return true
+}
 
-	for i, p := range ptrs {
-		val := fetched[p]
-		if p == "_id" {
-			val = di.ID()
-		}
-		switch x := val.(type) {
-		case int, uint, int64, float64, uint64, bool:
-			v := fmt.Sprintf("%v", val)
-			pv.val = v
-			chs[i] <- pv
-		default:
-			pv.val = x
-			chs[i] <- pv
-		}
+// filterString renders a value as filters compare it.  Only scalars
+// can match.
+func filterString(val interface{}) (string, bool) {
+	switch x := val.(type) {
+	case string:
+		return x, true
+	case int, uint, int64, float64, uint64, bool:
+		return fmt.Sprintf("%v", x), true
 	}
+	return "", false
+}
+
+// docValue finds a pointer's value in a document, rendering scalars
+// as strings unless they're declared numbers.
+func docValue(di *couchstore.DocInfo, p string,
+	fetched map[string]interface{}, numeric map[string]bool) interface{} {
+
+	return newValueSource(p, cachedPtrExpr).value(di, fetched, numeric)
+}
+
+func processDoc(di *couchstore.DocInfo, chs []chan ptrval,
+	doc []byte, ptrs []string, pairs []string, numeric map[string]bool,
+	filters []string, filtervals []string,
+	included bool) {
+
+	x := newExtractPlan(ptrs, pairs, filters, filtervals, "")
+	x.reduce(di, chs, x.fetch(doc), numeric, included)
 }
 
 func processDocs(pi *processIn) {
 
-	result := processOut{pi.cacheKey, pi.key, nil, nil, 0}
+	result := processOut{pi.cacheKey, pi.key, nil, nil, 0, nil}
 
 	if len(pi.ptrs) == 0 {
 		log.Panicf("No pointers specified in query: %#v", *pi)
 	}
 
-	db, err := dbopen(pi.dbname)
+	db, err := dbopenRange(pi.dbname, pi.infos[0].ID())
 	if err != nil {
 		result.err = err
 		pi.out <- &result
@@ -160,51 +237,80 @@ func processDocs(pi *processIn) {
 	}
 	defer closeDBConn(db)
 
-	chans := make([]chan ptrval, 0, len(pi.ptrs))
-	resultchs := make([]chan interface{}, 0, len(pi.ptrs))
-	for i, r := range pi.reds {
-		chans = append(chans, make(chan ptrval))
-		resultchs = append(resultchs, make(chan interface{}))
-
-		go func(fi int, fr string) {
-			resultchs[fi] <- reducers[fr](chans[fi])
-		}(i, r)
+	// The documents decoded count against the query's budget until
+	// they're reduced.
+	charged := int64(0)
+	defer func() { pi.budget.release(charged) }()
+	charge := func(n int64) bool {
+		charged += n
+		return pi.budget.charge(n)
 	}
 
-	go func() {
-		defer closeAll(chans)
-
-		dodoc := func(di *couchstore.DocInfo, included bool) {
-			doc, err := db.GetFromDocInfo(di)
-			if err == nil {
-				processDoc(di, chans, doc.Value(), pi.ptrs,
-					pi.filters, pi.filtervals, included)
-			} else {
-				for i := range pi.ptrs {
-					chans[i] <- ptrval{di, nil, included}
+	plan := pi.plan
+	if plan == nil {
+		plan = pi.extractPlan()
+	}
+	numeric := dbNumericFields(pi.dbname)
+	if pi.groupby != "" {
+		result.groups, result.err = processGroupedDocs(pi, db, plan,
+			numeric, charge)
+	} else {
+		infos := pi.infos
+		if pi.nextInfo != nil {
+			infos = append(infos[:len(infos):len(infos)], pi.nextInfo)
+		}
+		indexed := indexedValues(pi.dbname, plan, infos)
+		red := startReducers(pi)
+		over, cut := false, false
+		go func() {
+			defer closeAll(red.chans)
+
+			dodoc := func(di *couchstore.DocInfo, included bool) {
+				if fetched, ok := indexed[di.ID()]; ok {
+					plan.reduce(di, red.chans, fetched, numeric, included)
+					return
+				}
+				doc, err := db.GetFromDocInfo(di)
+				if err == nil && !charge(int64(len(doc.Value()))) {
+					over = true
+					return
+				}
+				if err == nil {
+					plan.reduce(di, red.chans, plan.fetch(doc.Value()),
+						numeric, included)
+				} else {
+					for i := range pi.ptrs {
+						red.chans[i] <- ptrval{di, nil, included}
+					}
 				}
 			}
-		}
 
-		for _, di := range pi.infos {
-			dodoc(di, true)
-		}
-		if pi.nextInfo != nil {
-			dodoc(pi.nextInfo, false)
-		}
-	}()
-
-	results := make([]interface{}, len(pi.ptrs))
-	for i := 0; i < len(pi.ptrs); i++ {
-		results[i] = <-resultchs[i]
-		if f, fok := results[i].(float64); fok &&
-			(math.IsNaN(f) || math.IsInf(f, 0)) {
-			results[i] = nil
+			for _, di := range pi.infos {
+				if isClosed(pi.quit) {
+					cut = true
+				}
+				if cut || over {
+					return
+				}
+				dodoc(di, true)
+			}
+			if pi.nextInfo != nil && !over {
+				dodoc(pi.nextInfo, false)
+			}
+		}()
+		result.value = red.values()
+		switch {
+		case over:
+			result.err = errQueryMemory
+		case cut:
+			result.err = pi.quitErr()
 		}
 	}
-	result.value = results
 
-	if result.cacheOpaque == 0 && result.cacheKey != "" {
+	// Only complete results are cached.  A chunk cut short would
+	// otherwise be handed to every later query asking for the same
+	// thing.
+	if result.cacheOpaque == 0 && result.cacheKey != "" && result.err == nil {
 		// It's OK if we can't store our newly pulled item in
 		// the cache, but it's most definitely not OK to stop
 		// here because of this.
@@ -216,38 +322,57 @@ func processDocs(pi *processIn) {
 	pi.out <- &result
 }
 
-func docProcessor(ch <-chan *processIn) {
-	for pi := range ch {
-		if time.Now().Before(pi.before) {
+var docPool = &workerPool{work: func(stop <-chan bool) {
+	docProcessor(processorInput, stop)
+}}
+
+func docProcessor(ch <-chan *processIn, stop <-chan bool) {
+	for {
+		var pi *processIn
+		select {
+		case pi = <-ch:
+		case <-stop:
+			return
+		}
+		if time.Now().Before(pi.before) && !isClosed(pi.quit) {
 			processDocs(pi)
 		} else {
-			pi.out <- &processOut{"", pi.key, nil, errTimeout, 0}
+			pi.out <- &processOut{"", pi.key, nil, pi.quitErr(), 0, nil}
 		}
 	}
 }
 
-func fetchDocs(dbname string, key int64, infos []*couchstore.DocInfo,
-	nextInfo *couchstore.DocInfo, ptrs []string, reds []string,
-	filters []string, filtervals []string,
-	before time.Time, out chan<- *processOut) {
+// quitErr is why a chunk was stopped before it was done: its query
+// either ran out of time or was canceled.
+func (pi *processIn) quitErr() error {
+	if time.Now().Before(pi.before) {
+		return errCanceled
+	}
+	return errTimeout
+}
+
+func fetchDocs(q *queryIn, key int64, infos []*couchstore.DocInfo,
+	nextInfo *couchstore.DocInfo) {
 
-	i := processIn{"", dbname, key, infos, nextInfo,
-		ptrs, reds, before, filters, filtervals, out}
+	i := processIn{"", q.dbname, key, infos, nextInfo,
+		q.ptrs, q.reds, q.before, q.filters, q.filtervals, q.funcs,
+		q.groupby, q.quit, q.out, q.budget, q.plan}
 
 	cacheInput <- &i
 }
 
 func runQuery(q *queryIn) {
+	q.walking = time.Now()
 	if len(q.ptrs) == 0 {
 		q.cherr <- fmt.Errorf("at least one pointer is required")
 		return
 	}
-	if q.group == 0 {
+	if q.group == 0 && q.calendar == nil {
 		q.cherr <- fmt.Errorf("group level cannot be zero")
 		return
 	}
 
-	db, err := dbopen(q.dbname)
+	db, err := dbopenRange(q.dbname, q.from)
 	if err != nil {
 		log.Printf("Error opening db: %v - %v", q.dbname, err)
 		q.cherr <- err
@@ -256,57 +381,125 @@ func runQuery(q *queryIn) {
 	defer closeDBConn(db)
 
 	chunk := int64(time.Duration(q.group) * time.Millisecond)
+	format := dbFormat(q.dbname)
+	bucket := func(k int64) (int64, int64) {
+		g := (k / chunk) * chunk
+		return g, g + chunk
+	}
+	if q.calendar != nil {
+		bucket = q.calendar.bucket
+	}
+
+	// Documents held for a group count against the query's budget
+	// until they're handed out.
+	fetch := func(key int64, infos []*couchstore.DocInfo,
+		nextInfo *couchstore.DocInfo) {
+		q.budget.release(int64(len(infos)) * docInfoCost)
+		atomic.AddInt32(&q.started, 1)
+		fetchDocs(q, key, infos, nextInfo)
+	}
+	// With a slide, documents are walked in slide sized buckets and
+	// handed out to each window covering them.
+	var windows *slidingWindows
+	perWindow := int64(1)
+	if q.slide > 0 {
+		windows = newSlidingWindows(chunk,
+			int64(time.Duration(q.slide)*time.Millisecond))
+		perWindow = chunk / windows.slide
+		chunk = windows.slide
+	}
+	addWindows := func(g int64, infos []*couchstore.DocInfo) bool {
+		windows.add(g, infos)
+		return q.budget.charge(int64(len(infos)) * (perWindow - 1) * docInfoCost)
+	}
 
 	infos := []*couchstore.DocInfo{}
 	g := int64(0)
 	nextg := ""
 
-	err = db.Walk(q.from, func(d *couchstore.Couchstore,
+	// With a filter on an indexed field, only the documents it could
+	// match are walked.
+	walk := db.Walk
+	if w := indexedWalk(q, db); w != nil {
+		walk = w
+	}
+	err = walk(q.from, func(d *couchstore.Couchstore,
 		di *couchstore.DocInfo) error {
 		kstr := di.ID()
 		var err error
 		if q.to != "" && kstr >= q.to {
 			err = couchstore.StopIteration
 		}
+		if isClosed(q.quit) {
+			return errCanceled
+		}
 
 		atomic.AddInt32(&q.totalKeys, 1)
 
+		if len(q.exclude) > 0 && excluded(q.exclude, parseKey(kstr)) {
+			return err
+		}
+
 		if kstr >= nextg {
+			k := parseKey(kstr)
 			if len(infos) > 0 {
-				atomic.AddInt32(&q.started, 1)
-				fetchDocs(q.dbname, g, infos, di,
-					q.ptrs, q.reds, q.filters, q.filtervals,
-					q.before, q.out)
+				if windows != nil {
+					if !addWindows(g, infos) {
+						return errQueryMemory
+					}
+					next, _ := bucket(k)
+					for _, w := range windows.complete(next) {
+						fetch(w.start, w.infos, di)
+					}
+				} else {
+					fetch(g, infos, di)
+				}
 
 				infos = make([]*couchstore.DocInfo, 0, len(infos))
 			}
 
-			k := parseKey(kstr)
-			g = (k / chunk) * chunk
-			nextgi := g + chunk
-			nextgt := time.Unix(nextgi/1e9, nextgi%1e9).UTC()
-			nextg = nextgt.Format(time.RFC3339Nano)
+			var nextgi int64
+			g, nextgi = bucket(k)
+			nextg = format.formatKey(time.Unix(nextgi/1e9, nextgi%1e9))
 		}
 		infos = append(infos, di)
+		if !q.budget.charge(docInfoCost) {
+			return errQueryMemory
+		}
 
 		return err
 	})
 
-	if err == nil && len(infos) > 0 {
-		atomic.AddInt32(&q.started, 1)
-		fetchDocs(q.dbname, g, infos, nil,
-			q.ptrs, q.reds, q.filters, q.filtervals,
-			q.before, q.out)
+	if err == nil && windows != nil {
+		if len(infos) > 0 {
+			addWindows(g, infos)
+		}
+		for _, w := range windows.complete(math.MaxInt64) {
+			fetch(w.start, w.infos, nil)
+		}
+	} else if err == nil && len(infos) > 0 {
+		fetch(g, infos, nil)
 	}
 
 	q.cherr <- err
 }
 
-func queryExecutor() {
-	for q := range queryInput {
-		if time.Now().Before(q.before) {
+var queryPool = &workerPool{work: queryExecutor}
+
+func queryExecutor(stop <-chan bool) {
+	for {
+		var q *queryIn
+		select {
+		case q = <-queryInput:
+		case <-stop:
+			return
+		}
+		switch {
+		case isClosed(q.quit):
+			q.cherr <- errCanceled
+		case time.Now().Before(q.before):
 			runQuery(q)
-		} else {
+		default:
 			log.Printf("Timed out query that's %v late",
 				time.Since(q.before))
 			q.cherr <- errTimeout
@@ -314,8 +507,11 @@ func queryExecutor() {
 	}
 }
 
-func executeQuery(dbname, from, to string, group int,
-	ptrs, reds, filters, filtervals []string) *queryIn {
+func executeQuery(dbname, from, to string, group, slide int,
+	calendar *calendarGroup,
+	ptrs, reds, filters, filtervals []string,
+	exclude []exclusionWindow, funcs map[string]string, groupby string,
+	timeout time.Duration) *queryIn {
 	now := time.Now()
 
 	rv := &queryIn{
@@ -323,15 +519,25 @@ func executeQuery(dbname, from, to string, group int,
 		from:       from,
 		to:         to,
 		group:      group,
+		slide:      slide,
+		calendar:   calendar,
 		ptrs:       ptrs,
 		reds:       reds,
 		start:      now,
-		before:     now.Add(*queryTimeout),
+		before:     now.Add(timeout),
 		filters:    filters,
 		filtervals: filtervals,
+		exclude:    exclude,
+		funcs:      funcs,
+		groupby:    groupby,
+		budget:     newQueryBudget(),
+		quit:       make(chan bool),
 		out:        make(chan *processOut),
 		cherr:      make(chan error),
 	}
+	// Shared by every chunk's workers.
+	vptrs, pairs := pairPointers(ptrs, reds)
+	rv.plan = newExtractPlan(vptrs, pairs, filters, filtervals, groupby)
 	queryInput <- rv
 	return rv
 }
@@ -339,18 +545,28 @@ func executeQuery(dbname, from, to string, group int,
 var processorInput chan *processIn
 var queryInput chan *queryIn
 
+// ptrFloat converts a value found by processDoc to a number.  Values
+// are usually rendered as strings, but declared numbers are passed
+// through as they are.
+func ptrFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
 func convertTofloat64(in chan ptrval) chan float64 {
 	ch := make(chan float64)
 	go func() {
 		defer close(ch)
 		for v := range in {
 			if v.included && v.val != nil {
-				switch value := v.val.(type) {
-				case string:
-					x, err := strconv.ParseFloat(value, 64)
-					if err == nil {
-						ch <- x
-					}
+				if x, ok := ptrFloat(v.val); ok {
+					ch <- x
 				}
 			}
 		}
@@ -370,36 +586,28 @@ func convertTofloat64Rate(in chan ptrval) chan float64 {
 	FIND_USABLE:
 		for v := range in {
 			if v.di != nil && v.val != nil {
-				switch value := v.val.(type) {
-				case string:
-					x, err := strconv.ParseFloat(value, 64)
-					if err == nil {
-						prevts = parseKey(v.di.ID())
-						preval = x
-						break FIND_USABLE
-					}
+				if x, ok := ptrFloat(v.val); ok {
+					prevts = parseKey(v.di.ID())
+					preval = x
+					break FIND_USABLE
 				}
 			}
 		}
 		// Then emit floats based on deltas from previous values.
 		for v := range in {
 			if v.di != nil && v.val != nil {
-				switch value := v.val.(type) {
-				case string:
-					x, err := strconv.ParseFloat(value, 64)
-					if err == nil {
-						thists := parseKey(v.di.ID())
-
-						val := ((x - preval) /
-							(float64(thists-prevts) / 1e9))
+				if x, ok := ptrFloat(v.val); ok {
+					thists := parseKey(v.di.ID())
 
-						if !(math.IsNaN(val) || math.IsInf(val, 0)) {
-							ch <- val
-						}
+					val := ((x - preval) /
+						(float64(thists-prevts) / 1e9))
 
-						prevts = thists
-						preval = x
+					if !(math.IsNaN(val) || math.IsInf(val, 0)) {
+						ch <- val
 					}
+
+					prevts = thists
+					preval = x
 				}
 			}
 		}
@@ -427,6 +635,26 @@ var reducers = map[string]reducer{
 		}
 		return rv
 	},
+	// first and last are for gauges, giving the value and its
+	// timestamp, as {"t": ..., "v": ...}.
+	"first": func(input chan ptrval) interface{} {
+		var rv interface{}
+		for v := range input {
+			if rv == nil && v.included && v.val != nil {
+				rv = map[string]interface{}{"t": v.di.ID(), "v": v.val}
+			}
+		}
+		return rv
+	},
+	"last": func(input chan ptrval) interface{} {
+		var rv interface{}
+		for v := range input {
+			if v.included && v.val != nil {
+				rv = map[string]interface{}{"t": v.di.ID(), "v": v.val}
+			}
+		}
+		return rv
+	},
 	"distinct": func(input chan ptrval) interface{} {
 		uvm := map[interface{}]bool{}
 		for v := range input {
@@ -449,6 +677,12 @@ var reducers = map[string]reducer{
 		}
 		return rv
 	},
+	"cardinality": func(input chan ptrval) interface{} {
+		return collectHLL(input).estimate()
+	},
+	"cardinality_sketch": func(input chan ptrval) interface{} {
+		return collectHLL(input).String()
+	},
 	"count": func(input chan ptrval) interface{} {
 		rv := 0
 		for v := range input {
@@ -502,6 +736,22 @@ var reducers = map[string]reducer{
 		}
 		return math.NaN()
 	},
+	// count_numeric and c_count count what avg and c_avg average, so
+	// averages can be merged across federation members and shards.
+	"count_numeric": func(input chan ptrval) interface{} {
+		rv := 0
+		for range convertTofloat64(input) {
+			rv++
+		}
+		return rv
+	},
+	"c_count": func(input chan ptrval) interface{} {
+		rv := 0
+		for range convertTofloat64Rate(input) {
+			rv++
+		}
+		return rv
+	},
 	"c": func(input chan ptrval) interface{} {
 		sum := float64(0)
 		for v := range convertTofloat64Rate(input) {
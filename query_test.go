@@ -3,11 +3,13 @@ package main
 import (
 	"io/ioutil"
 	"math"
+	"net/url"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
 )
 
 var testInput = []interface{}{}
@@ -155,6 +157,24 @@ OUTER:
 	}
 }
 
+func TestFirstLastReducers(t *testing.T) {
+	t0 := time.Unix(1347255646, 418514126).UTC()
+	ts := func(n int) string {
+		return t0.Add(time.Duration(n) * time.Second).Format(time.RFC3339Nano)
+	}
+	in := []interface{}{nil, "31", "63", nil}
+	exp := map[string]interface{}{
+		"first": map[string]interface{}{"t": ts(2), "v": "31"},
+		"last":  map[string]interface{}{"t": ts(3), "v": "63"},
+	}
+	for name, e := range exp {
+		got := reducers[name](streamCollection(in))
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("Expected %v for %v, got %v", e, name, got)
+		}
+	}
+}
+
 func TestEmptyReducers(t *testing.T) {
 	emptyInput := []interface{}{}
 	tests := []struct {
@@ -162,6 +182,8 @@ func TestEmptyReducers(t *testing.T) {
 		exp     interface{}
 	}{
 		{"any", nil},
+		{"first", nil},
+		{"last", nil},
 		{"count", 0},
 		{"sum", 0.0},
 		{"sumsq", 0.0},
@@ -204,6 +226,8 @@ func TestNilReducers(t *testing.T) {
 		exp     interface{}
 	}{
 		{"any", nil},
+		{"first", nil},
+		{"last", nil},
 		{"count", 0},
 		{"sum", 0.0},
 		{"sumsq", 0.0},
@@ -253,7 +277,8 @@ func TestPointers(t *testing.T) {
 	for _, test := range tests {
 		chans := make([]chan ptrval, 0, 1)
 		chans = append(chans, make(chan ptrval))
-		go processDoc(di, chans, bigInput, []string{test.pointer}, []string{}, []string{}, true)
+		go processDoc(di, chans, bigInput, []string{test.pointer}, nil, nil,
+			[]string{}, []string{}, true)
 		got := <-chans[0]
 		if test.exp != got.val {
 			t.Errorf("Expected %v for %v, got %v",
@@ -262,3 +287,159 @@ func TestPointers(t *testing.T) {
 	}
 
 }
+
+func TestQueryBody(t *testing.T) {
+	body := queryBody{}
+	err := json.Unmarshal([]byte(`{"from": "2013-01-01", "group": 60000,
+		"reductions": [{"ptr": "/a", "reducer": "avg"},
+			{"ptr": "/b", "reducer": "max"}],
+		"filters": [{"ptr": "/src", "value": "x"}],
+		"stream": true}`), &body)
+	if err != nil {
+		t.Fatalf("Error parsing body: %v", err)
+	}
+
+	form := body.values()
+	p, err := parseQueryParams(form)
+	if err != nil {
+		t.Fatalf("Error parsing params from %v: %v", form, err)
+	}
+	if p.from != "2013-01-01" || p.group != 60000 ||
+		!reflect.DeepEqual(p.ptrs, []string{"/a", "/b"}) ||
+		!reflect.DeepEqual(p.reds, []string{"avg", "max"}) ||
+		!reflect.DeepEqual(p.filtervals, []string{"x"}) {
+		t.Errorf("Unexpected params: %+v", p)
+	}
+	if form.Get("stream") != "true" {
+		t.Errorf("Expected stream to carry over, got %v", form)
+	}
+}
+
+func TestViewForm(t *testing.T) {
+	v := queryBody{From: "2013-01-01", To: "2013-02-01", Group: "1000"}
+	form, err := viewForm(v, url.Values{"from": {"2013-01-15"}})
+	if err != nil || form.Get("from") != "2013-01-15" ||
+		form.Get("to") != "2013-02-01" || form.Get("group") != "1000" {
+		t.Errorf("Expected request params over the view's, got %v, %v",
+			form, err)
+	}
+
+	v.Filters = append(v.Filters, queryFilter{"/host", "{{host}}.example.com"})
+	if got := viewPlaceholders(v); !reflect.DeepEqual(got, []string{"host"}) {
+		t.Errorf("Expected a host placeholder, got %v", got)
+	}
+	if _, err := viewForm(v, url.Values{}); err == nil {
+		t.Errorf("Expected an error for an unbound placeholder")
+	}
+	form, err = viewForm(v, url.Values{"host": {"web1"}})
+	if err != nil || form.Get("fv") != "web1.example.com" || form.Get("host") != "" {
+		t.Errorf("Expected host to be bound, got %v, %v", form, err)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	createMemDatabase("grouptest", memOptions{Policy: memEvict})
+	defer dropMemDatabase("grouptest")
+	keys := []string{"2013-01-01T00:00:00Z", "2013-01-01T00:00:01Z",
+		"2013-01-01T00:00:02Z", "2013-01-01T00:00:03Z"}
+	memDatabase("grouptest").commit([]memOp{
+		{keys[0], []byte(`{"host": "a", "v": 1}`), false},
+		{keys[1], []byte(`{"host": "b", "v": 2}`), false},
+		{keys[2], []byte(`{"host": "a", "v": 3}`), false},
+		{keys[3], []byte(`{"v": 4}`), false},
+	})
+
+	out := make(chan *processOut, 1)
+	pi := &processIn{dbname: "grouptest", ptrs: []string{"/v"},
+		reds: []string{"sum"}, groupby: "/host",
+		before: time.Now().Add(time.Minute), quit: make(chan bool), out: out}
+	for _, k := range keys {
+		pi.infos = append(pi.infos, couchstore.NewDocInfo(k, 0))
+	}
+	processDocs(pi)
+	got := (<-out).groups
+	exp := map[string][]interface{}{"a": {4.0}, "b": {2.0}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestScanScalar(t *testing.T) {
+	tests := []struct {
+		in      string
+		scanned bool
+	}{
+		{`"plain"`, true},
+		{` "spaced" `, true},
+		{`"café"`, true},
+		{`-1.5e3`, true},
+		{`42`, true},
+		{`true`, true},
+		{`false`, true},
+		{`null`, true},
+		{`"tab\tbed"`, false},
+		{`{"a": 1}`, false},
+		{`[1, 2]`, false},
+	}
+	for _, test := range tests {
+		var exp interface{}
+		if err := json.Unmarshal([]byte(test.in), &exp); err != nil {
+			t.Fatalf("Error decoding %s: %v", test.in, err)
+		}
+		got, ok := scanScalar([]byte(test.in))
+		switch {
+		case ok != test.scanned:
+			t.Errorf("Expected %s scanned to be %v", test.in, test.scanned)
+		case ok && !reflect.DeepEqual(got, exp):
+			t.Errorf("Expected %s to scan as %#v, got %#v", test.in, exp, got)
+		}
+	}
+	for _, bad := range []string{``, `"`, `"unterminated`, `nope`} {
+		if v, ok := scanScalar([]byte(bad)); ok {
+			t.Errorf("Expected %q not to scan, got %#v", bad, v)
+		}
+	}
+}
+
+func BenchmarkResolveFetch(b *testing.B) {
+	keys := []string{"/kind", "/data/children/0/data/score"}
+	b.SetBytes(int64(len(bigInput)))
+	for i := 0; i < b.N; i++ {
+		resolveFetch(bigInput, keys)
+	}
+}
+
+func TestCanceledChunk(t *testing.T) {
+	createMemDatabase("canceltest", memOptions{Policy: memEvict})
+	defer dropMemDatabase("canceltest")
+	k := "2013-01-01T00:00:00Z"
+	memDatabase("canceltest").commit([]memOp{{k, []byte(`{"v": 1}`), false}})
+
+	defer func(ch chan *processOut) { cacheInputSet = ch }(cacheInputSet)
+	cacheInputSet = make(chan *processOut, 2)
+
+	run := func(groupby string, before time.Time) *processOut {
+		out := make(chan *processOut, 1)
+		quit := make(chan bool)
+		close(quit)
+		pi := &processIn{cacheKey: "cached", dbname: "canceltest",
+			ptrs: []string{"/v"}, reds: []string{"sum"}, groupby: groupby,
+			before: before, quit: quit, out: out,
+			infos: []*couchstore.DocInfo{couchstore.NewDocInfo(k, 0)}}
+		processDocs(pi)
+		return <-out
+	}
+
+	later := time.Now().Add(time.Minute)
+	for _, groupby := range []string{"", "/v"} {
+		if po := run(groupby, later); po.err != errCanceled {
+			t.Errorf("Expected %q to be canceled, got %v", groupby, po.err)
+		}
+	}
+	if po := run("", time.Now().Add(-time.Second)); po.err != errTimeout {
+		t.Errorf("Expected a timeout, got %v", po.err)
+	}
+	if len(cacheInputSet) != 0 {
+		t.Errorf("Expected nothing cached, got %v", len(cacheInputSet))
+	}
+}
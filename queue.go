@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errQueueFull = errors.New("write queue is full")
+
+// What dbstore does when a database's write queue is full.
+const (
+	queueBlock  = "block"  // wait, up to -queueTimeout if set
+	queueReject = "reject" // fail the write immediately
+	queueDrop   = "drop"   // discard the oldest queued write
+)
+
+func validQueuePolicy(p string) error {
+	switch p {
+	case queueBlock, queueReject, queueDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown queue policy: %v", p)
+}
+
+// queueCounters are kept by database name so they survive the
+// writer being closed while idle.
+type queueCounters struct {
+	Rejected int64 `json:"rejected"`
+	Dropped  int64 `json:"dropped"`
+}
+
+var queueStatsLock = sync.Mutex{}
+var queueStats = map[string]*queueCounters{}
+
+func dbQueueCounters(dbname string) *queueCounters {
+	queueStatsLock.Lock()
+	defer queueStatsLock.Unlock()
+	c := queueStats[dbname]
+	if c == nil {
+		c = &queueCounters{}
+		queueStats[dbname] = c
+	}
+	return c
+}
+
+// enqueue hands an item to the writer according to -queuePolicy,
+// returning its position in the database's write order.
+func (w *dbWriter) enqueue(qi dbqitem) (uint64, error) {
+	// Hold the order while sending, so positions match the queue.
+	w.seqLock.Lock()
+	defer w.seqLock.Unlock()
+	n := uint64(1)
+	if len(qi.batch) > 0 {
+		n = uint64(len(qi.batch))
+	}
+
+	if err := w.send(qi); err != nil {
+		return 0, err
+	}
+	w.seq += n
+	return w.seq, nil
+}
+
+func (w *dbWriter) send(qi dbqitem) error {
+	select {
+	case w.ch <- qi:
+		return nil
+	default:
+	}
+
+	c := dbQueueCounters(w.dbname)
+	switch queuePolicy.get() {
+	case queueReject:
+		atomic.AddInt64(&c.Rejected, 1)
+		return errQueueFull
+	case queueDrop:
+		for {
+			select {
+			case w.ch <- qi:
+				return nil
+			case old := <-w.ch:
+				atomic.AddInt64(&c.Dropped, 1)
+				if old.cherr != nil {
+					old.cherr <- errQueueFull
+				}
+			}
+		}
+	}
+
+	if queueTimeout.get() <= 0 {
+		w.ch <- qi
+		return nil
+	}
+	t := time.NewTimer(queueTimeout.get())
+	defer t.Stop()
+	select {
+	case w.ch <- qi:
+		return nil
+	case <-t.C:
+		atomic.AddInt64(&c.Rejected, 1)
+		return errQueueFull
+	}
+}
+
+// waitCommitted waits for the writer to report on an item sent with
+// the given channel.
+func (w *dbWriter) waitCommitted(cherr chan error) error {
+	select {
+	case err := <-cherr:
+		return err
+	case <-w.quit:
+	}
+	// The writer commits everything it took before closing.
+	select {
+	case err := <-cherr:
+		return err
+	default:
+		return errClosed
+	}
+}
+
+// queueInfo describes a database's write queue for the info endpoint.
+func queueInfo(dbname string) map[string]interface{} {
+	depth := 0
+	var flush map[string]interface{}
+	dbLock.Lock()
+	if writer := dbConns[dbname]; writer != nil {
+		depth = len(writer.ch)
+		flush = writer.flush.stats()
+	}
+	dbLock.Unlock()
+
+	c := dbQueueCounters(dbname)
+	rv := map[string]interface{}{
+		"depth":    depth,
+		"capacity": maxOpQueue.get(),
+		"policy":   queuePolicy.get(),
+		"rejected": atomic.LoadInt64(&c.Rejected),
+		"dropped":  atomic.LoadInt64(&c.Dropped),
+	}
+	if flush != nil {
+		rv["flush"] = flush
+	}
+	return rv
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func testQueuePolicy(t *testing.T, policy string) (*dbWriter, error) {
+	defer func(p string) { queuePolicy.set(p) }(queuePolicy.get())
+	queuePolicy.set(policy)
+
+	w := &dbWriter{dbname: "queue-" + policy, ch: make(chan dbqitem, 1)}
+	if seq, err := w.enqueue(dbqitem{k: "a"}); err != nil || seq != 1 {
+		t.Fatalf("Error queueing into empty queue: %v, %v", seq, err)
+	}
+	_, err := w.enqueue(dbqitem{k: "b"})
+	return w, err
+}
+
+func TestQueueReject(t *testing.T) {
+	w, err := testQueuePolicy(t, queueReject)
+	if err != errQueueFull {
+		t.Fatalf("Expected errQueueFull, got %v", err)
+	}
+	if qi := <-w.ch; qi.k != "a" {
+		t.Errorf("Expected the first item to remain, got %v", qi.k)
+	}
+	if c := dbQueueCounters(w.dbname); c.Rejected != 1 || c.Dropped != 0 {
+		t.Errorf("Expected one rejection, got %+v", c)
+	}
+}
+
+func TestQueueDrop(t *testing.T) {
+	w, err := testQueuePolicy(t, queueDrop)
+	if err != nil {
+		t.Fatalf("Error queueing into full queue: %v", err)
+	}
+	if qi := <-w.ch; qi.k != "b" {
+		t.Errorf("Expected the newest item to remain, got %v", qi.k)
+	}
+	if c := dbQueueCounters(w.dbname); c.Rejected != 0 || c.Dropped != 1 {
+		t.Errorf("Expected one drop, got %+v", c)
+	}
+}
+
+func TestQueuePolicyValidation(t *testing.T) {
+	for _, p := range []string{queueBlock, queueReject, queueDrop} {
+		if err := validQueuePolicy(p); err != nil {
+			t.Errorf("Error validating %v: %v", p, err)
+		}
+	}
+	if validQueuePolicy("explode") == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
+
+func TestWaitCommitted(t *testing.T) {
+	w := &dbWriter{dbname: "queue-ordered", ch: make(chan dbqitem, 2),
+		quit: make(chan bool)}
+	for i := 0; i < 2; i++ {
+		seq, err := w.enqueue(dbqitem{k: "a", cherr: make(chan error, 1)})
+		if err != nil || seq != uint64(i+1) {
+			t.Fatalf("Error queueing %v: %v, %v", i, seq, err)
+		}
+	}
+
+	first, second := <-w.ch, <-w.ch
+	w.waiting = append(w.waiting, first.cherr)
+	w.committed(nil)
+	if err := w.waitCommitted(first.cherr); err != nil {
+		t.Errorf("Error waiting for a committed write: %v", err)
+	}
+
+	close(w.quit)
+	if err := w.waitCommitted(second.cherr); err != errClosed {
+		t.Errorf("Expected errClosed for an uncommitted write, got %v", err)
+	}
+}
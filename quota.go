@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+var errQuotaExceeded = errors.New("database quota exceeded")
+
+// A quotaSpec limits how much space a database may use.  Crossing a
+// warning threshold (a fraction of MaxSize) is reported but writes
+// are only refused once MaxSize itself is reached.
+type quotaSpec struct {
+	MaxSize int64     `json:"max_size"`
+	Warn    []float64 `json:"warn"`
+	Webhook string    `json:"webhook,omitempty"`
+}
+
+var defaultQuotaWarn = []float64{0.8, 0.9}
+
+func (q *quotaSpec) validate() error {
+	if q.MaxSize <= 0 {
+		return errors.New("max_size must be positive")
+	}
+	if q.Warn == nil {
+		q.Warn = defaultQuotaWarn
+	}
+	for _, w := range q.Warn {
+		if w <= 0 || w >= 1 {
+			return fmt.Errorf("warning threshold out of range: %v", w)
+		}
+	}
+	sort.Float64s(q.Warn)
+	return nil
+}
+
+// quotaStatus is what /_stats reports for a database with a quota.
+type quotaStatus struct {
+	Used      int64   `json:"used"`
+	Max       int64   `json:"max"`
+	State     string  `json:"state"`
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+const (
+	quotaOK       = "ok"
+	quotaWarning  = "warning"
+	quotaExceeded = "exceeded"
+)
+
+var quotaLock = sync.Mutex{}
+var quotaStates = map[string]quotaStatus{}
+
+func (q *quotaSpec) status(used int64) quotaStatus {
+	st := quotaStatus{Used: used, Max: q.MaxSize, State: quotaOK}
+	if used >= q.MaxSize {
+		st.State, st.Threshold = quotaExceeded, 1
+		return st
+	}
+	for _, w := range q.Warn {
+		if float64(used) >= w*float64(q.MaxSize) {
+			st.State, st.Threshold = quotaWarning, w
+		}
+	}
+	return st
+}
+
+// checkQuota refreshes a database's quota state from its current
+// size, raising an event if it got closer to its limit.
+func checkQuota(dbname string, db dbStore) {
+	m, err := loadMeta(dbname)
+	if err != nil || m.Quota == nil {
+		dropQuota(dbname)
+		return
+	}
+	inf, err := db.Info()
+	if err != nil {
+		log.Printf("Error checking quota of %v: %v", dbname, err)
+		return
+	}
+	st := m.Quota.status(int64(inf.SpaceUsed))
+
+	quotaLock.Lock()
+	prev, seen := quotaStates[dbname]
+	quotaStates[dbname] = st
+	quotaLock.Unlock()
+
+	if st.Threshold > prev.Threshold {
+		quotaEvent(dbname, m.Quota.Webhook, st)
+	} else if seen && st.State != prev.State {
+		log.Printf("Quota of %v is now %v (%v of %v bytes)",
+			dbname, st.State, st.Used, st.Max)
+	}
+}
+
+func quotaEvent(dbname, webhook string, st quotaStatus) {
+	log.Printf("Quota of %v is %v at %v%% (%v of %v bytes)",
+		dbname, st.State, int(st.Threshold*100), st.Used, st.Max)
+	if webhook == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"db":     dbname,
+		"status": st,
+	})
+	if err != nil {
+		return
+	}
+	go func() {
+		client := &http.Client{Timeout: 30 * time.Second}
+		res, err := client.Post(webhook, "application/json",
+			bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error sending quota event for %v: %v", dbname, err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			log.Printf("Quota webhook for %v returned %v", dbname, res.Status)
+		}
+	}()
+}
+
+func quotaReached(dbname string) bool {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	return quotaStates[dbname].State == quotaExceeded
+}
+
+func dropQuota(dbname string) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	delete(quotaStates, dbname)
+}
+
+func quotaStatuses() map[string]quotaStatus {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	rv := make(map[string]quotaStatus, len(quotaStates))
+	for k, v := range quotaStates {
+		rv[k] = v
+	}
+	return rv
+}
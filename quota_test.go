@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestQuotaStatus(t *testing.T) {
+	q := &quotaSpec{MaxSize: 1000}
+	if err := q.validate(); err != nil {
+		t.Fatalf("Error validating quota: %v", err)
+	}
+
+	tests := []struct {
+		used      int64
+		state     string
+		threshold float64
+	}{
+		{0, quotaOK, 0},
+		{799, quotaOK, 0},
+		{800, quotaWarning, 0.8},
+		{950, quotaWarning, 0.9},
+		{1000, quotaExceeded, 1},
+		{5000, quotaExceeded, 1},
+	}
+	for _, test := range tests {
+		st := q.status(test.used)
+		if st.State != test.state || st.Threshold != test.threshold {
+			t.Errorf("At %v expected %v/%v, got %v/%v", test.used,
+				test.state, test.threshold, st.State, st.Threshold)
+		}
+	}
+}
+
+func TestQuotaValidation(t *testing.T) {
+	bad := []quotaSpec{
+		{},
+		{MaxSize: -1},
+		{MaxSize: 10, Warn: []float64{1.5}},
+		{MaxSize: 10, Warn: []float64{0}},
+	}
+	for _, q := range bad {
+		if q.validate() == nil {
+			t.Errorf("Expected error validating %+v", q)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Each client -- identified by its Authorization header, or failing
+// that its address -- may make so many ingest and query requests per
+// second, with bursts of up to a second's worth.  Beyond that,
+// requests get 429 with a Retry-After.  The limits are -ingestRate
+// and -queryRate, and may be changed for particular credentials with
+// PUT /_ratelimits, e.g.
+//
+//	{"Bearer b1g": {"ingest": 5000, "query": -1}}
+//
+// where a negative rate is unlimited and zero uses the default.
+
+var ingestRate = flag.Float64("ingestRate", 0,
+	"Ingest requests per second allowed each client (0 for unlimited)")
+var queryRate = flag.Float64("queryRate", 0,
+	"Query requests per second allowed each client (0 for unlimited)")
+
+type rateSpec struct {
+	Ingest float64 `json:"ingest,omitempty"`
+	Query  float64 `json:"query,omitempty"`
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Buckets idle this long are full again, so they're forgotten.
+const rateIdle = time.Minute
+
+var rateLock = sync.Mutex{}
+var rateOverrides = map[string]rateSpec{}
+var rateBuckets = map[string]*rateBucket{}
+
+func rateLimitsPath() string {
+	return filepath.Join(*dbRoot, "_ratelimits.json")
+}
+
+func loadRateLimits() error {
+	data, err := ioutil.ReadFile(rateLimitsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rateLock.Lock()
+	defer rateLock.Unlock()
+	return json.Unmarshal(data, &rateOverrides)
+}
+
+func rateClient(req *http.Request) string {
+	if a := req.Header.Get("Authorization"); a != "" {
+		return a
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// clientRate is the rate a client is allowed for a kind of request,
+// with zero for unlimited.  rateLock must be held.
+func clientRate(kind, client string) float64 {
+	rate := *queryRate
+	if kind == "ingest" {
+		rate = *ingestRate
+	}
+	if o, ok := rateOverrides[client]; ok {
+		r := o.Query
+		if kind == "ingest" {
+			r = o.Ingest
+		}
+		switch {
+		case r < 0:
+			return 0
+		case r > 0:
+			return r
+		}
+	}
+	return rate
+}
+
+// takeRate spends a token for a request, returning the client's limit,
+// what's left, and how long to wait if nothing was.
+func takeRate(kind, client string, now time.Time) (float64, float64, time.Duration) {
+	rateLock.Lock()
+	defer rateLock.Unlock()
+	rate := clientRate(kind, client)
+	if rate <= 0 {
+		return 0, 0, 0
+	}
+	burst := math.Max(rate, 1)
+
+	key := kind + " " + client
+	b := rateBuckets[key]
+	if b == nil {
+		if len(rateBuckets) > 10000 {
+			pruneRateBuckets(now)
+		}
+		b = &rateBucket{tokens: burst, last: now}
+		rateBuckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return rate, b.tokens, wait
+	}
+	b.tokens--
+	return rate, b.tokens, 0
+}
+
+// pruneRateBuckets forgets idle clients.  rateLock must be held.
+func pruneRateBuckets(now time.Time) {
+	for k, b := range rateBuckets {
+		if now.Sub(b.last) > rateIdle {
+			delete(rateBuckets, k)
+		}
+	}
+}
+
+// checkRate applies a client's rate limit, reporting a refusal to it.
+func checkRate(kind string, w http.ResponseWriter, req *http.Request) bool {
+	rate, left, wait := takeRate(kind, rateClient(req), time.Now())
+	if rate == 0 {
+		return true
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(rate, 'f', -1, 64))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(left)))
+	if wait == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After",
+		strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	emitError(429, w, "Too Many Requests",
+		fmt.Sprintf("%v rate limit of %v/s exceeded", kind, rate))
+	return false
+}
+
+func getRateLimits(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	rateLock.Lock()
+	defer rateLock.Unlock()
+	mustEncode(200, w, rateOverrides)
+}
+
+func putRateLimits(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	limits := map[string]rateSpec{}
+	err := json.NewDecoder(req.Body).Decode(&limits)
+	if err == nil {
+		for client := range limits {
+			if client == "" {
+				err = errors.New("empty credential")
+			}
+		}
+	}
+	if err != nil {
+		emitError(400, w, "Bad rate limits", err.Error())
+		return
+	}
+
+	rateLock.Lock()
+	defer rateLock.Unlock()
+	data, err := json.Marshal(limits)
+	fn := rateLimitsPath()
+	if err == nil {
+		err = ioutil.WriteFile(fn+".tmp", data, 0666)
+	}
+	if err == nil {
+		err = os.Rename(fn+".tmp", fn)
+	}
+	if err != nil {
+		emitError(500, w, "Error storing rate limits", err.Error())
+		return
+	}
+	rateOverrides = limits
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
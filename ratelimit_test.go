@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTakeRate(t *testing.T) {
+	defer func(r float64) { *ingestRate = r }(*ingestRate)
+	*ingestRate = 2
+	rateLock.Lock()
+	rateOverrides = map[string]rateSpec{
+		"big":  {Ingest: 100},
+		"free": {Ingest: -1},
+	}
+	rateBuckets = map[string]*rateBucket{}
+	rateLock.Unlock()
+	defer func() { rateOverrides = map[string]rateSpec{} }()
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, _, wait := takeRate("ingest", "c", now); wait != 0 {
+			t.Fatalf("Expected a burst of 2 allowed, failed at %v", i)
+		}
+	}
+	rate, _, wait := takeRate("ingest", "c", now)
+	if rate != 2 || wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms at 2/s, got %v at %v/s", wait, rate)
+	}
+	if _, _, wait := takeRate("ingest", "c", now.Add(wait)); wait != 0 {
+		t.Errorf("Expected a token after waiting, got %v", wait)
+	}
+	if _, _, wait := takeRate("query", "c", now); wait != 0 {
+		t.Errorf("Expected queries unlimited, got %v", wait)
+	}
+
+	if rate, _, _ := takeRate("ingest", "big", now); rate != 100 {
+		t.Errorf("Expected an override of 100/s, got %v", rate)
+	}
+	if rate, _, _ := takeRate("ingest", "free", now); rate != 0 {
+		t.Errorf("Expected an unlimited override, got %v", rate)
+	}
+}
+
+func TestCheckRate(t *testing.T) {
+	defer func(r float64) { *queryRate = r }(*queryRate)
+	*queryRate = 1
+	rateLock.Lock()
+	rateBuckets = map[string]*rateBucket{}
+	rateLock.Unlock()
+
+	req, _ := http.NewRequest("GET", "/x/_query", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	first := httptest.NewRecorder()
+	if !checkRate("query", first, req) {
+		t.Fatalf("Expected the first query allowed")
+	}
+	if first.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Errorf("Expected limit headers, got %v", first.Header())
+	}
+	second := httptest.NewRecorder()
+	if checkRate("query", second, req) || second.Code != 429 ||
+		second.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After, got %v %v",
+			second.Code, second.Header())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// With -readonly, the server answers queries but refuses anything that
+// would change a database, so it can serve data files copied from
+// elsewhere.  Background work that writes (archiving, retention and
+// compaction, and recording self stats) isn't started.  A single
+// database may also be made read-only with "read_only" in its config;
+// its config can still be changed, so it can be made writable again.
+
+var readOnly = flag.Bool("readonly", false,
+	"Serve queries, but refuse all writes")
+
+var errReadOnly = errors.New("database is read-only")
+
+// readingPaths are requests other than GETs that only read the
+// database they're for.  _query_into checks its target itself.
+var readingPaths = regexp.MustCompile(
+	"^/[^/]+/(_query|_query_into|_bulk_get|_schedules/[^/]+/_run)$")
+
+func dbReadOnly(dbname string) bool {
+	return *readOnly || dbConfigFor(dbname).ReadOnly
+}
+
+// writeRefused is why writes to a database are refused, if they are.
+func writeRefused(dbname string) error {
+	switch {
+	case dbReadOnly(dbname):
+		return errReadOnly
+	case diskIsFull() && memDatabase(dbname) == nil:
+		return errDiskFull
+	}
+	return nil
+}
+
+// dbPathOnly matches requests for a database itself, which may be
+// deleted to make space.
+var dbPathOnly = regexp.MustCompile("^/[^/]+/?$")
+
+// checkWritable refuses requests that would write to a read-only
+// database, or to one on disk while the disk is nearly full, reporting
+// it to the client.
+func checkWritable(w http.ResponseWriter, req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	dbname := requestDB(req.URL.Path)
+	if dbname == "" || readingPaths.MatchString(req.URL.Path) {
+		return true
+	}
+	if *readOnly || (dbConfigFor(dbname).ReadOnly &&
+		!strings.HasSuffix(req.URL.Path, "/_config")) {
+		emitError(403, w, "Forbidden", errReadOnly.Error())
+		return false
+	}
+	if diskIsFull() && memDatabase(dbname) == nil &&
+		!strings.HasSuffix(req.URL.Path, "/_config") &&
+		!(req.Method == "DELETE" && dbPathOnly.MatchString(req.URL.Path)) {
+		emitError(507, w, "Insufficient Storage", errDiskFull.Error())
+		return false
+	}
+	return true
+}
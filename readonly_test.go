@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	metaCache["replica"] = dbMeta{Format: 1,
+		Config: &dbConfig{ReadOnly: true}}
+	defer delete(metaCache, "replica")
+
+	tests := []struct {
+		global       bool
+		method, path string
+		ok           bool
+	}{
+		{false, "POST", "/replica", false},
+		{false, "DELETE", "/replica", false},
+		{false, "GET", "/replica/_query", true},
+		{false, "POST", "/replica/_query", true},
+		{false, "PUT", "/replica/_config", true},
+		{false, "POST", "/other", true},
+		{true, "PUT", "/other", false},
+		{true, "PUT", "/other/_config", false},
+		{true, "POST", "/other/_query_into", true},
+		{true, "POST", "/other/_bulk_get", true},
+		{true, "POST", "/_config/reload", true},
+		{true, "GET", "/other/_all_docs", true},
+	}
+
+	defer func() { *readOnly = false }()
+	for _, test := range tests {
+		*readOnly = test.global
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		w := httptest.NewRecorder()
+		ok := checkWritable(w, req)
+		if ok != test.ok || (!ok && w.Code != 403) {
+			t.Errorf("%v %v (readonly=%v): expected %v, got %v/%v",
+				test.method, test.path, test.global, test.ok, ok, w.Code)
+		}
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	metaCache["replica"] = dbMeta{Format: 1,
+		Config: &dbConfig{ReadOnly: true}}
+	defer delete(metaCache, "replica")
+
+	if _, err := dbstoreSeq("replica", "2012-08-10T00:00:00Z",
+		[]byte(`{}`), false); err != errReadOnly {
+		t.Errorf("Expected a read-only error, got %v", err)
+	}
+	if _, err := dbstoreBatch("replica", nil); err != errReadOnly {
+		t.Errorf("Expected a read-only error, got %v", err)
+	}
+}
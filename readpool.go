@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queries open a database file for each chunk they read.  Rather than
+// open and close it every time, read handles are kept for reuse: up
+// to -readPool idle handles per database, each closed after
+// -readPoolIdle unused.  A handle is used by one reader at a time.
+//
+// A handle only sees what was committed when it was opened, so one is
+// reused only while the file's unchanged since (same file, size and
+// modification time).  Rewrites and deletes close a database's idle
+// handles straight away, and those in use as they come back.
+//
+// There's no memory mapped alternative: go-couchstore only opens files
+// through couchstore's default file ops, and doesn't expose the hook
+// for replacing them, so every read is a pread on the handle.  Reusing
+// handles at least saves reading the header and root nodes again.
+
+var readPoolSize = intFlag("readPool", 4,
+	"Idle read handles to keep per database (0 to disable)")
+var readPoolIdle = durationFlag("readPoolIdle", time.Minute,
+	"How long to keep an unused read handle")
+
+// The least time between sweeps for idle handles, however short
+// -readPoolIdle is.
+const minReadPoolSweep = time.Second
+
+type pooledHandle struct {
+	dbStore
+	name   string
+	st     os.FileInfo
+	gen    uint64
+	idleAt time.Time
+}
+
+type readHandlePool struct {
+	mu    sync.Mutex
+	idle  map[string][]*pooledHandle
+	inUse map[string]int
+	gen   map[string]uint64
+
+	hits, misses, stale int64
+
+	sweeping sync.Once
+}
+
+var readPool = &readHandlePool{
+	idle:  map[string][]*pooledHandle{},
+	inUse: map[string]int{},
+	gen:   map[string]uint64{},
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() &&
+		a.ModTime().Equal(b.ModTime())
+}
+
+// get returns a read handle for a database, reusing an idle one if
+// the file hasn't changed.  closeDBConn gives it back.
+func (p *readHandlePool) get(name string) (dbStore, error) {
+	if readPoolSize.get() <= 0 || memDatabase(name) != nil {
+		return dbopen(name)
+	}
+	st, err := os.Stat(dbPath(name))
+	if err != nil {
+		// Let dbopen say what's wrong.
+		return dbopen(name)
+	}
+
+	stale := []*pooledHandle{}
+	p.mu.Lock()
+	hs := p.idle[name]
+	var found *pooledHandle
+	for len(hs) > 0 && found == nil {
+		h := hs[len(hs)-1]
+		hs = hs[:len(hs)-1]
+		if sameFile(h.st, st) {
+			found = h
+		} else {
+			stale = append(stale, h)
+		}
+	}
+	p.setIdle(name, hs)
+	gen := p.gen[name]
+	p.inUse[name]++
+	p.mu.Unlock()
+
+	atomic.AddInt64(&p.stale, int64(len(stale)))
+	for _, h := range stale {
+		closeDBConn(h.dbStore)
+	}
+	if found != nil {
+		atomic.AddInt64(&p.hits, 1)
+		return found, nil
+	}
+
+	atomic.AddInt64(&p.misses, 1)
+	db, err := dbopen(name)
+	if err != nil {
+		p.mu.Lock()
+		p.release(name)
+		p.mu.Unlock()
+		return nil, err
+	}
+	return &pooledHandle{dbStore: db, name: name, st: st, gen: gen}, nil
+}
+
+// setIdle and release must be called with the lock held.
+func (p *readHandlePool) setIdle(name string, hs []*pooledHandle) {
+	if len(hs) == 0 {
+		delete(p.idle, name)
+	} else {
+		p.idle[name] = hs
+	}
+}
+
+func (p *readHandlePool) release(name string) {
+	if p.inUse[name]--; p.inUse[name] <= 0 {
+		delete(p.inUse, name)
+	}
+}
+
+// put takes a handle back, keeping it if there's room and it's still
+// current.
+func (p *readHandlePool) put(h *pooledHandle) {
+	p.mu.Lock()
+	p.release(h.name)
+	keep := h.gen == p.gen[h.name] && len(p.idle[h.name]) < readPoolSize.get()
+	if keep {
+		h.idleAt = time.Now()
+		p.idle[h.name] = append(p.idle[h.name], h)
+	}
+	p.mu.Unlock()
+
+	if !keep {
+		closeDBConn(h.dbStore)
+		return
+	}
+	p.sweeping.Do(func() { go p.sweeper() })
+}
+
+// invalidate closes a database's idle handles, and those in use when
+// they're given back.
+func (p *readHandlePool) invalidate(name string) {
+	p.mu.Lock()
+	hs := p.idle[name]
+	delete(p.idle, name)
+	p.gen[name]++
+	p.mu.Unlock()
+
+	for _, h := range hs {
+		closeDBConn(h.dbStore)
+	}
+}
+
+// evict closes the handles idle since before the given time.
+func (p *readHandlePool) evict(before time.Time) int {
+	old := []*pooledHandle{}
+	p.mu.Lock()
+	for name, hs := range p.idle {
+		keep := hs[:0]
+		for _, h := range hs {
+			if h.idleAt.Before(before) {
+				old = append(old, h)
+			} else {
+				keep = append(keep, h)
+			}
+		}
+		p.setIdle(name, keep)
+	}
+	p.mu.Unlock()
+
+	for _, h := range old {
+		closeDBConn(h.dbStore)
+	}
+	return len(old)
+}
+
+func (p *readHandlePool) sweeper() {
+	for {
+		time.Sleep(sweepInterval(readPoolIdle.get()))
+		p.evict(time.Now().Add(-readPoolIdle.get()))
+	}
+}
+
+func sweepInterval(idle time.Duration) time.Duration {
+	if idle/2 < minReadPoolSweep {
+		return minReadPoolSweep
+	}
+	return idle / 2
+}
+
+func (p *readHandlePool) stats() map[string]interface{} {
+	p.mu.Lock()
+	idle, inUse := 0, 0
+	for _, hs := range p.idle {
+		idle += len(hs)
+	}
+	for _, n := range p.inUse {
+		inUse += n
+	}
+	p.mu.Unlock()
+	return map[string]interface{}{
+		"idle":   idle,
+		"in_use": inUse,
+		"hits":   atomic.LoadInt64(&p.hits),
+		"misses": atomic.LoadInt64(&p.misses),
+		"stale":  atomic.LoadInt64(&p.stale),
+	}
+}
+
+func debugReadPool(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	mustEncode(200, w, readPool.stats())
+}
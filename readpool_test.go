@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-readpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string, n int) {
+		*dbRoot = r
+		readPoolSize.set(n)
+	}(*dbRoot, readPoolSize.get())
+	*dbRoot = dir
+	readPoolSize.set(1)
+
+	if err := ioutil.WriteFile(dbPath("pooled"), []byte("v1"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := os.Stat(dbPath("pooled"))
+	p := &readHandlePool{idle: map[string][]*pooledHandle{},
+		inUse: map[string]int{}, gen: map[string]uint64{}}
+	handle := func() *pooledHandle {
+		h := &memHandle{&memDB{name: "pooled"}}
+		recordDBConn("pooled", h)
+		return &pooledHandle{dbStore: h, name: "pooled", st: st}
+	}
+
+	a, b := handle(), handle()
+	p.inUse["pooled"] = 2
+	p.put(a)
+	p.put(b)
+	if s := p.stats(); s["idle"] != 1 || s["in_use"] != 0 {
+		t.Errorf("Expected one handle kept, got %v", s)
+	}
+
+	got, err := p.get("pooled")
+	if err != nil || got != a {
+		t.Fatalf("Expected the idle handle back, got %v, %v", got, err)
+	}
+	p.invalidate("pooled")
+	p.put(got.(*pooledHandle))
+	if s := p.stats(); s["idle"] != 0 || s["hits"] != int64(1) {
+		t.Errorf("Expected an invalidated handle closed, got %v", s)
+	}
+
+	// A handle from before the file changed isn't reused.
+	c := handle()
+	c.gen = p.gen["pooled"]
+	p.inUse["pooled"]++
+	p.put(c)
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(dbPath("pooled"), []byte("v2, longer"),
+		0666); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := p.get("pooled"); got == c {
+		t.Errorf("Expected a stale handle not to be reused")
+	}
+	if s := p.stats(); s["stale"] != int64(1) {
+		t.Errorf("Expected one stale handle, got %v", s)
+	}
+
+	d := handle()
+	d.gen = p.gen["pooled"]
+	p.put(d)
+	if n := p.evict(time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("Expected to evict 1 idle handle, evicted %v", n)
+	}
+}
+
+func TestSweepInterval(t *testing.T) {
+	tests := []struct{ idle, exp time.Duration }{
+		{0, minReadPoolSweep},
+		{time.Nanosecond, minReadPoolSweep},
+		{-time.Minute, minReadPoolSweep},
+		{time.Minute, 30 * time.Second},
+	}
+	for _, test := range tests {
+		if got := sweepInterval(test.idle); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.idle, got)
+		}
+	}
+}
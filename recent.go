@@ -0,0 +1,130 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+// covers reports whether the buffer holds every document at or after
+// the given key.
+func (m *memDB) covers(from string) bool {
+	if from == "" || from < m.since {
+		return false
+	}
+	cutoff := dbFormat(m.name).formatKey(time.Now().Add(-m.opts.TTL))
+	return from >= cutoff
+}
+
+// deleted reports whether a key was deleted after the file was last
+// committed.
+func (m *memDB) deleted(k string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tombstones[k]
+}
+
+// deletedKeys returns a snapshot of the keys deleted after the file
+// was last committed.
+func (m *memDB) deletedKeys() map[string]bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rv := make(map[string]bool, len(m.tombstones))
+	for k := range m.tombstones {
+		rv[k] = true
+	}
+	return rv
+}
+
+// clearTombstones forgets deletes once they're committed to the file.
+func (m *memDB) clearTombstones() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.tombstones) > 0 {
+		m.tombstones = map[string]bool{}
+	}
+}
+
+// hybridStore overlays a writer's buffer of recent documents on the
+// database file so readers see writes, and deletes, before they're
+// committed.
+type hybridStore struct {
+	dbStore
+	recent *memDB
+}
+
+func (h *hybridStore) Get(id string) (*couchstore.Document,
+	*couchstore.DocInfo, error) {
+	if doc, di, err := h.recent.Get(id); err == nil {
+		return doc, di, nil
+	}
+	if h.recent.deleted(id) {
+		return nil, nil, errNotFound
+	}
+	return h.dbStore.Get(id)
+}
+
+func (h *hybridStore) GetFromDocInfo(di *couchstore.DocInfo) (*couchstore.Document, error) {
+	if doc, _, err := h.recent.Get(di.ID()); err == nil {
+		return doc, nil
+	}
+	if h.recent.deleted(di.ID()) {
+		return nil, errNotFound
+	}
+	return h.dbStore.GetFromDocInfo(di)
+}
+
+// Walk merges the buffered keys into the walk of the file, leaving
+// out those deleted.
+func (h *hybridStore) Walk(from string, f couchstore.WalkFun) error {
+	keys := h.recent.keysFrom(from)
+	dead := h.recent.deletedKeys()
+
+	i := 0
+	var ferr error
+	err := h.dbStore.Walk(from, func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		for ; i < len(keys) && keys[i] < di.ID(); i++ {
+			ferr = f(d, couchstore.NewDocInfo(keys[i], 0))
+			if ferr != nil {
+				return ferr
+			}
+		}
+		if i < len(keys) && keys[i] == di.ID() {
+			i++
+		}
+		if dead[di.ID()] {
+			return nil
+		}
+		ferr = f(d, di)
+		return ferr
+	})
+	if ferr == couchstore.StopIteration {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for ; i < len(keys); i++ {
+		err := f(nil, couchstore.NewDocInfo(keys[i], 0))
+		if err == couchstore.StopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *hybridStore) WalkDocs(from string, f couchstore.DocWalkFun) error {
+	return h.Walk(from, func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		doc, err := h.GetFromDocInfo(di)
+		if err != nil {
+			return nil
+		}
+		return f(d, di, doc)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func testMemStore(keys ...string) *memDB {
+	m := &memDB{docs: map[string][]byte{}}
+	b := m.Bulk()
+	for _, k := range keys {
+		b.Set(couchstore.NewDocInfo(k, 0),
+			couchstore.NewDocument(k, []byte(`"`+k+`"`)))
+	}
+	b.Commit()
+	return m
+}
+
+func TestHybridWalk(t *testing.T) {
+	disk := &memHandle{testMemStore("a", "c", "e")}
+	h := &hybridStore{disk, testMemStore("b", "c", "f")}
+
+	tests := []struct {
+		from, to string
+		exp      []string
+	}{
+		{"", "", []string{"a", "b", "c", "e", "f"}},
+		{"b", "", []string{"b", "c", "e", "f"}},
+		{"", "c", []string{"a", "b"}},
+		{"", "f", []string{"a", "b", "c", "e"}},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		err := h.Walk(test.from, func(d *couchstore.Couchstore,
+			di *couchstore.DocInfo) error {
+			if test.to != "" && di.ID() >= test.to {
+				return couchstore.StopIteration
+			}
+			got = append(got, di.ID())
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Error walking from %q: %v", test.from, err)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v from %q to %q, got %v",
+				test.exp, test.from, test.to, got)
+		}
+	}
+}
+
+func TestHybridGetPrefersBuffer(t *testing.T) {
+	disk := &memHandle{testMemStore("a")}
+	recent := testMemStore()
+	recent.commit([]memOp{{"a", []byte(`"new"`), false}})
+	h := &hybridStore{disk, recent}
+
+	doc, _, err := h.Get("a")
+	if err != nil {
+		t.Fatalf("Error getting doc: %v", err)
+	}
+	if string(doc.Value()) != `"new"` {
+		t.Fatalf("Expected buffered doc, got %s", doc.Value())
+	}
+}
+
+func TestHybridHidesDeletes(t *testing.T) {
+	disk := &memHandle{testMemStore("a", "c", "e")}
+	recent := testMemStore()
+	recent.tombstones = map[string]bool{}
+	recent.commit([]memOp{{"b", []byte(`"b"`), false},
+		{"c", nil, true}, {"b", nil, true}, {"e", nil, true},
+		{"e", []byte(`"e"`), false}})
+	h := &hybridStore{disk, recent}
+
+	if _, _, err := h.Get("c"); err != errNotFound {
+		t.Errorf("Expected a deleted doc to be gone, got %v", err)
+	}
+	if _, err := h.GetFromDocInfo(couchstore.NewDocInfo("c", 0)); err != errNotFound {
+		t.Errorf("Expected a deleted doc to be gone, got %v", err)
+	}
+	got := []string{}
+	h.Walk("", func(d *couchstore.Couchstore, di *couchstore.DocInfo) error {
+		got = append(got, di.ID())
+		return nil
+	})
+	if exp := []string{"a", "e"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	// Once the file's committed, it's the file that's right.
+	recent.clearTombstones()
+	if _, _, err := h.Get("c"); err != nil {
+		t.Errorf("Expected the file's doc after a commit, got %v", err)
+	}
+}
+
+func TestRecentCovers(t *testing.T) {
+	f := storageFormats[1]
+	now := time.Now()
+	m := &memDB{name: "recent-covers-test",
+		opts:  memOptions{TTL: time.Hour},
+		since: f.formatKey(now.Add(-10 * time.Minute))}
+
+	tests := []struct {
+		from time.Time
+		exp  bool
+	}{
+		{now, true},
+		{now.Add(-5 * time.Minute), true},
+		{now.Add(-20 * time.Minute), false},
+		{now.Add(-2 * time.Hour), false},
+	}
+	for _, test := range tests {
+		if got := m.covers(f.formatKey(test.from)); got != test.exp {
+			t.Errorf("covers(%v) = %v, expected %v", test.from, got, test.exp)
+		}
+	}
+	if m.covers("") {
+		t.Errorf("An open ended range shouldn't be covered")
+	}
+
+	m.since = f.formatKey(now.Add(-2 * time.Hour))
+	if m.covers(f.formatKey(now.Add(-90 * time.Minute))) {
+		t.Errorf("Expired range shouldn't be covered")
+	}
+}
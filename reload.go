@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/dustin/gojson"
+)
+
+// With -config, flags may also be given in a JSON file, e.g.
+//
+//	{"flushDelay": "2s", "maxOpQueue": 5000, "queryWorkers": 8}
+//
+// Flags given on the command line win.  The file is reread on SIGHUP
+// or POST /_config/reload, and changes to the reloadable flags (see
+// settings.go) take effect without a restart: they're read as they're
+// used, worker pools are resized, and open writers pick up new flush
+// settings (other writer settings apply as writers are reopened).
+// Other flags are only set at startup, so changing them is reported
+// and ignored.  A flag removed from the file goes back to its default.
+
+var configFile = flag.String("config", "",
+	"JSON file of flag values, reread on SIGHUP or POST /_config/reload")
+
+var configLock = sync.Mutex{}
+
+// Flags given on the command line, and those last set from the file.
+var cmdlineFlags = map[string]bool{}
+var fileFlags = map[string]string{}
+
+// readConfigFile returns the flag values in a config file as strings
+// flag.Set understands.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	rv := map[string]string{}
+	for k, v := range raw {
+		s := ""
+		if json.Unmarshal(v, &s) != nil {
+			// Numbers and booleans are used as written.
+			s = string(v)
+		}
+		rv[k] = s
+	}
+	return rv, nil
+}
+
+// applyConfig sets flags to the given values, or back to their
+// defaults if they were set from a file before and no longer are.
+// Nothing changes unless every value is valid.  It returns what
+// changed.
+func applyConfig(vals map[string]string, startup bool) (map[string]string, error) {
+	want := map[string]string{}
+	for name := range fileFlags {
+		if f := flag.Lookup(name); f != nil {
+			want[name] = f.DefValue
+		}
+	}
+	for name, v := range vals {
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown flag: %v", name)
+		}
+		want[name] = v
+	}
+
+	changed := map[string]string{}
+	old := map[string]string{}
+	var err error
+	for name, v := range want {
+		f := flag.Lookup(name)
+		if cmdlineFlags[name] || f.Value.String() == v {
+			continue
+		}
+		if _, ok := f.Value.(reloadableValue); !ok && !startup {
+			log.Printf("Ignoring change to %v until restart", name)
+			continue
+		}
+		old[name] = f.Value.String()
+		if err = f.Value.Set(v); err != nil {
+			err = fmt.Errorf("bad value for %v: %v", name, err)
+			break
+		}
+		changed[name] = v
+	}
+	if err == nil {
+		err = validQueuePolicy(queuePolicy.get())
+	}
+	if err == nil {
+		err = validLogLevels()
+	}
+	if err != nil {
+		for name, v := range old {
+			flag.Lookup(name).Value.Set(v)
+		}
+		return nil, err
+	}
+	fileFlags = vals
+	return changed, nil
+}
+
+// loadConfig applies the config file at startup, after flags are
+// parsed.
+func loadConfig() error {
+	if *configFile == "" {
+		return nil
+	}
+	flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+	vals, err := readConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+	configLock.Lock()
+	defer configLock.Unlock()
+	_, err = applyConfig(vals, true)
+	return err
+}
+
+// reloadConfig rereads the config file and puts changes into effect.
+func reloadConfig() (map[string]string, error) {
+	if *configFile == "" {
+		return nil, fmt.Errorf("no config file given")
+	}
+	vals, err := readConfigFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	configLock.Lock()
+	defer configLock.Unlock()
+	changed, err := applyConfig(vals, false)
+	if err != nil {
+		return nil, err
+	}
+
+	queryPool.resize(queryWorkers.get())
+	docPool.resize(docWorkers.get())
+	resetWriterFlushes()
+
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Reloaded %v = %v", name, changed[name])
+	}
+	return changed, nil
+}
+
+// resetWriterFlushes applies the current flush settings to open
+// writers.
+func resetWriterFlushes() {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	for n, w := range dbConns {
+		w.flush.reset(dbFlushDelay(n))
+	}
+}
+
+func handleReloads() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if _, err := reloadConfig(); err != nil {
+			log.Printf("Error reloading %v: %v", *configFile, err)
+		}
+	}
+}
+
+func postConfigReload(parts []string, w http.ResponseWriter, req *http.Request) {
+	changed, err := reloadConfig()
+	if err != nil {
+		emitError(400, w, "Error reloading config", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true,
+		"changed": changed})
+}
+
+// A workerPool runs a changeable number of copies of a worker, each
+// of which returns when its stop channel is closed.
+type workerPool struct {
+	mu    sync.Mutex
+	work  func(stop <-chan bool)
+	stops []chan bool
+}
+
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.stops) < n {
+		stop := make(chan bool)
+		p.stops = append(p.stops, stop)
+		go p.work(stop)
+	}
+	for len(p.stops) > n && len(p.stops) > 1 {
+		close(p.stops[len(p.stops)-1])
+		p.stops = p.stops[:len(p.stops)-1]
+	}
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stops)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(fn, []byte(`{"flushDelay": "2s",
+		"maxOpQueue": 5000, "v": true}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals, err := readConfigFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	exp := map[string]string{"flushDelay": "2s", "maxOpQueue": "5000",
+		"v": "true"}
+	for k, v := range exp {
+		if vals[k] != v {
+			t.Errorf("Expected %v=%v, got %v", k, v, vals[k])
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	defer func(d time.Duration, n int) {
+		flushTime.set(d)
+		maxOpQueue.set(n)
+		fileFlags = map[string]string{}
+		delete(cmdlineFlags, "maxOpQueue")
+	}(flushTime.get(), maxOpQueue.get())
+	flushTime.set(5 * time.Second)
+
+	changed, err := applyConfig(map[string]string{"flushDelay": "2s",
+		"root": "elsewhere"}, false)
+	if err != nil {
+		t.Fatalf("Error applying config: %v", err)
+	}
+	if flushTime.get() != 2*time.Second || changed["flushDelay"] != "2s" {
+		t.Errorf("Expected flushDelay 2s, got %v (%v)", flushTime.get(), changed)
+	}
+	if _, ok := changed["root"]; ok {
+		t.Errorf("Expected root to wait for a restart, got %v", changed)
+	}
+
+	if _, err := applyConfig(map[string]string{"flushDelay": "1s",
+		"maxOpQueue": "lots"}, false); err == nil {
+		t.Errorf("Expected an error for a bad value")
+	}
+	if flushTime.get() != 2*time.Second {
+		t.Errorf("Expected a failed reload to change nothing, got %v",
+			flushTime.get())
+	}
+	if _, err := applyConfig(map[string]string{"nonsense": "1"},
+		false); err == nil {
+		t.Errorf("Expected an error for an unknown flag")
+	}
+
+	cmdlineFlags["maxOpQueue"] = true
+	n := maxOpQueue.get()
+	if _, err := applyConfig(map[string]string{"maxOpQueue": "7"},
+		false); err != nil {
+		t.Fatalf("Error applying config: %v", err)
+	}
+	if maxOpQueue.get() != n {
+		t.Errorf("Expected the command line to win, got %v", maxOpQueue.get())
+	}
+	if flushTime.get() != 5*time.Second {
+		t.Errorf("Expected flushDelay back at its default, got %v",
+			flushTime.get())
+	}
+}
+
+func TestReloadWhileRunning(t *testing.T) {
+	defer func(d time.Duration, v bool) {
+		queryTimeout.set(d)
+		*verbose = v
+		fileFlags = map[string]string{}
+	}(queryTimeout.get(), *verbose)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			queryTimeoutParam("")
+		}
+	}()
+	changed, err := applyConfig(map[string]string{"maxQueryTime": "3m",
+		"v": fmt.Sprint(!*verbose)}, false)
+	<-done
+	if err != nil {
+		t.Fatalf("Error applying config: %v", err)
+	}
+	if queryTimeout.get() != 3*time.Minute {
+		t.Errorf("Expected maxQueryTime 3m, got %v", queryTimeout.get())
+	}
+	if _, ok := changed["v"]; ok {
+		t.Errorf("Expected v to wait for a restart, got %v", changed)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	running := make(chan int, 10)
+	p := &workerPool{work: func(stop <-chan bool) {
+		running <- 1
+		<-stop
+		running <- -1
+	}}
+
+	total := 0
+	wait := func(n int) {
+		for i := 0; i < n; i++ {
+			total += <-running
+		}
+	}
+	p.resize(3)
+	wait(3)
+	p.resize(1)
+	wait(2)
+	if total != 1 || p.size() != 1 {
+		t.Errorf("Expected 1 worker, got %v/%v", total, p.size())
+	}
+	p.resize(0)
+	if p.size() != 1 {
+		t.Errorf("Expected a pool to keep a worker, got %v", p.size())
+	}
+	p.resize(2)
+	wait(1)
+	if total != 2 {
+		t.Errorf("Expected 2 workers, got %v", total)
+	}
+}
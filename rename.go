@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+// Renaming or copying a database goes through its writer, and those
+// of its shards, so nothing else touches the files meanwhile.  Each
+// writer commits what it has queued first.  A renamed writer closes
+// once its files are moved, and a copy is written the way compaction
+// writes its new file, so it's either complete or not there at all.
+
+var errHasArchived = errors.New("database has archived shards")
+
+// baseFiles are a database's own files, leaving out its shards.
+func baseFiles(dbname string) []string {
+	return dbFiles(dbname)[:6]
+}
+
+// renameFiles renames whichever of a database's own files exist.  If
+// one can't be moved, those already moved are put back.
+func renameFiles(from, to string) error {
+	src, dest := baseFiles(from), baseFiles(to)
+	for i := range src {
+		err := os.Rename(filepath.Join(*dbRoot, src[i]),
+			filepath.Join(*dbRoot, dest[i]))
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			os.Rename(filepath.Join(*dbRoot, dest[j]),
+				filepath.Join(*dbRoot, src[j]))
+		}
+		return err
+	}
+	return nil
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// commitBeforeMove commits what's queued before the database's file
+// is copied or moved.
+func commitBeforeMove(dq *dbWriter, bulk couchstore.BulkWriter, queued int,
+	what string) couchstore.BulkWriter {
+	if queued == 0 {
+		return bulk
+	}
+	start := time.Now()
+	dq.committed(bulk.Commit())
+	flushRollups(dq.rollups, dq.db)
+	dq.values.flush(dq.db)
+	dq.index.flush(dq.db)
+	dq.prov.flush()
+	if *verbose {
+		log.Printf("Flushed %d items in %v for pre-%v",
+			queued, time.Since(start), what)
+	}
+	bulk.Close()
+	return dq.db.Bulk()
+}
+
+// dbCopyTo writes a copy of the database, with its metadata and
+// schema, under a new name.
+func dbCopyTo(dq *dbWriter, bulk couchstore.BulkWriter, queued int,
+	qi dbqitem) (couchstore.BulkWriter, error) {
+	if _, ok := dq.db.(*memHandle); ok {
+		return bulk, errNotOnDisk
+	}
+	bulk = commitBeforeMove(dq, bulk, queued, "copy")
+	dq.schema.flush()
+	dest := dbPath(qi.dest)
+	os.Remove(dest + rewriteExt)
+	err := dq.db.CompactTo(dest + rewriteExt)
+	if err != nil {
+		os.Remove(dest + rewriteExt)
+		return bulk, err
+	}
+	if err := swapInRewrite(dest); err != nil {
+		return bulk, err
+	}
+	src, dests := baseFiles(dq.dbname), baseFiles(qi.dest)
+	for i := 1; i < len(src); i++ {
+		err := copyFile(filepath.Join(*dbRoot, src[i]),
+			filepath.Join(*dbRoot, dests[i]))
+		if err != nil && !os.IsNotExist(err) {
+			return bulk, err
+		}
+	}
+	log.Printf("Copied %v to %v", dq.dbname, qi.dest)
+	return bulk, nil
+}
+
+// dbRenameTo moves the database's files to a new name.  On success,
+// the writer has nothing left to write to and must close.
+func dbRenameTo(dq *dbWriter, bulk couchstore.BulkWriter, queued int,
+	qi dbqitem) (couchstore.BulkWriter, error) {
+	if _, ok := dq.db.(*memHandle); ok {
+		return bulk, errNotOnDisk
+	}
+	bulk = commitBeforeMove(dq, bulk, queued, "rename")
+	dq.schema.flush()
+	if err := renameFiles(dq.dbname, qi.dest); err != nil {
+		return bulk, err
+	}
+	bulk.Close()
+	log.Printf("Renamed %v to %v", dq.dbname, qi.dest)
+	return nil, nil
+}
+
+// localShards lists a database's shards, failing if any of them are
+// archived, since those are stored under the database's name.
+func localShards(dbname string) ([]string, error) {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Archived) > 0 {
+		return nil, errHasArchived
+	}
+	return dbShards(dbname), nil
+}
+
+// dbmove renames or copies a database, shards first.
+func dbmove(dbname, to string, op dbOperation) error {
+	shards, err := localShards(dbname)
+	if err != nil {
+		return err
+	}
+	if len(shards) > 0 {
+		if err := os.MkdirAll(shardDir(to), 0777); err != nil {
+			return err
+		}
+	}
+	for _, s := range shards {
+		err := dbrewrite(dbqitem{dbname: dbname + "/" + s, op: op,
+			dest: to + "/" + s})
+		if err != nil {
+			return err
+		}
+	}
+	if err := dbrewrite(dbqitem{dbname: dbname, op: op, dest: to}); err != nil {
+		return err
+	}
+
+	if op == opRename {
+		for _, s := range shards {
+			forgetShard(dbname + "/" + s)
+			dropQuota(dbname + "/" + s)
+		}
+		if len(shards) > 0 {
+			if err := os.Remove(shardDir(dbname)); err != nil {
+				log.Printf("Error removing %v: %v", shardDir(dbname), err)
+			}
+		}
+		forgetDB(dbname)
+	}
+	forgetDB(to)
+	return nil
+}
+
+// moveDB handles both POST /db/_rename and POST /db/_copy, with the
+// new name in ?to=.
+func moveDB(op dbOperation) routeHandler {
+	return func(parts []string, w http.ResponseWriter, req *http.Request) {
+		to := scopedDB(req, req.FormValue("to"))
+		if !localDBName.MatchString(to) || to == parts[0] {
+			emitError(400, w, "Bad to value",
+				fmt.Sprintf("invalid database name: %q", req.FormValue("to")))
+			return
+		}
+		if memDatabase(parts[0]) != nil ||
+			len(federationMembers(parts[0])) > 0 {
+			emitError(400, w, "Bad Request",
+				"only databases stored on disk can be renamed or copied")
+			return
+		}
+		if _, err := os.Stat(dbPath(parts[0])); err != nil {
+			emitError(404, w, "not_found", err.Error())
+			return
+		}
+		if _, err := os.Stat(dbPath(to)); err == nil ||
+			memDatabase(to) != nil || len(federationMembers(to)) > 0 {
+			emitError(409, w, "Conflict", "a database by that name exists")
+			return
+		}
+		if op == opCopy || tenantOf(to) != tenantOf(parts[0]) {
+			if err := tenantCanCreate(to); err != nil {
+				emitError(403, w, "Forbidden", err.Error())
+				return
+			}
+		}
+
+		switch err := dbmove(parts[0], to, op); err {
+		case nil:
+			mustEncode(201, w, map[string]interface{}{"ok": true})
+		case errHasArchived:
+			emitError(409, w, "Conflict", err.Error())
+		default:
+			emitError(500, w, "Error moving database", err.Error())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRenameFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	ioutil.WriteFile(dbPath("old"), []byte("data"), 0666)
+	ioutil.WriteFile(metaPath("old"), []byte(`{"format": 2}`), 0666)
+
+	if err := renameFiles("old", "new"); err != nil {
+		t.Fatalf("Error renaming: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(dbPath("new")); string(b) != "data" {
+		t.Errorf("Expected the data renamed, got %q", b)
+	}
+	if b, _ := ioutil.ReadFile(metaPath("new")); string(b) != `{"format": 2}` {
+		t.Errorf("Expected the metadata renamed, got %q", b)
+	}
+	if _, err := os.Stat(dbPath("old")); !os.IsNotExist(err) {
+		t.Errorf("Expected the old name gone, got %v", err)
+	}
+
+	// The metadata can't replace a directory, so the data is put
+	// back.
+	os.MkdirAll(metaPath("blocked"), 0777)
+	ioutil.WriteFile(metaPath("blocked")+"/x", nil, 0666)
+	if err := renameFiles("new", "blocked"); err == nil {
+		t.Fatalf("Expected an error renaming onto a directory")
+	}
+	if b, _ := ioutil.ReadFile(dbPath("new")); string(b) != "data" {
+		t.Errorf("Expected the data put back, got %q", b)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(dir+"/a", []byte("contents"), 0666)
+	if err := copyFile(dir+"/a", dir+"/b"); err != nil {
+		t.Fatalf("Error copying: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(dir + "/b"); string(b) != "contents" {
+		t.Errorf("Expected a copy, got %q", b)
+	}
+	if err := copyFile(dir+"/missing", dir+"/c"); !os.IsNotExist(err) {
+		t.Errorf("Expected not found copying nothing, got %v", err)
+	}
+}
+
+func TestMoveDBChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	ioutil.WriteFile(dbPath("src"), nil, 0666)
+	ioutil.WriteFile(dbPath("taken"), nil, 0666)
+	metaCache["archived"] = dbMeta{Format: 1, Archived: []string{"2013-01-01"}}
+	defer delete(metaCache, "archived")
+	ioutil.WriteFile(dbPath("archived"), nil, 0666)
+
+	tests := []struct {
+		db, to string
+		exp    int
+	}{
+		{"src", "", 400},
+		{"src", "src", 400},
+		{"src", "bad/name", 400},
+		{"missing", "other", 404},
+		{"src", "taken", 409},
+		{"archived", "other", 409},
+	}
+	for _, test := range tests {
+		for _, op := range []dbOperation{opRename, opCopy} {
+			req, _ := http.NewRequest("POST", "/"+test.db+"/_rename?to="+test.to, nil)
+			w := httptest.NewRecorder()
+			moveDB(op)([]string{test.db}, w, req)
+			if w.Code != test.exp {
+				t.Errorf("Expected %v moving %v to %q, got %v: %s",
+					test.exp, test.db, test.to, w.Code, w.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func TestWalkReverse(t *testing.T) {
+	createMemDatabase("reversed", memOptions{})
+	defer dropMemDatabase("reversed")
+	defer dbRemoveConn("reversed")
+	b := memDatabase("reversed").Bulk()
+	keys := []string{}
+	// Sparse years ago, then dense recently.
+	for _, ts := range []time.Time{
+		time.Date(2005, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2010, 6, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		keys = append(keys, ts.Format(time.RFC3339Nano))
+	}
+	recent := time.Date(2012, 8, 10, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 250; i++ {
+		keys = append(keys, recent.Add(time.Duration(i)*time.Second).
+			Format(time.RFC3339Nano))
+	}
+	keys = append(keys, keys[len(keys)-1]+"#2")
+	// Fractional seconds sort before whole ones.
+	for _, f := range []string{"04:10.5Z", "04:10Z", "04:11.25Z", "04:11Z"} {
+		keys = append(keys, "2012-08-10T00:"+f)
+	}
+	for _, k := range keys {
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, []byte("{}")))
+	}
+	b.Commit()
+
+	sort.Strings(keys)
+
+	reversed := func(from, to string) []string {
+		rv := []string{}
+		err := dbwalkReverse("reversed", from, to, func(k string, v []byte) error {
+			rv = append(rv, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error walking back: %v", err)
+		}
+		return rv
+	}
+	backwards := func(ks []string) []string {
+		rv := []string{}
+		for i := len(ks) - 1; i >= 0; i-- {
+			rv = append(rv, ks[i])
+		}
+		return rv
+	}
+
+	if got := reversed("", ""); !reflect.DeepEqual(got, backwards(keys)) {
+		t.Errorf("Expected all %v keys backwards, got %v", len(keys), len(got))
+	}
+	if got := reversed(keys[1], keys[5]); !reflect.DeepEqual(got,
+		backwards(keys[1:5])) {
+		t.Errorf("Expected %v, got %v", backwards(keys[1:5]), got)
+	}
+
+	req, _ := http.NewRequest("GET",
+		"/reversed/_all?descending=true&limit=3", nil)
+	w := httptest.NewRecorder()
+	allDocs([]string{"reversed"}, w, req)
+	last := len(keys) - 1
+	exp := `"` + keys[last] + `": {},` + "\n" + `"` + keys[last-1] + `": {},` +
+		"\n" + `"` + keys[last-2] + `": {}`
+	if !strings.Contains(w.Body.String(), exp) ||
+		w.Header().Get("X-Seriesly-Next") != keys[last-3] {
+		t.Errorf("Expected the newest 3, newest first, got %s, next %q",
+			w.Body, w.Header().Get("X-Seriesly-Next"))
+	}
+
+	req, _ = http.NewRequest("GET", "/reversed/_all?descending=true&limit=2"+
+		"&startkey_docid="+keys[2], nil)
+	w = httptest.NewRecorder()
+	allDocs([]string{"reversed"}, w, req)
+	exp = `{"` + keys[2] + `": {},` + "\n" + `"` + keys[1] + `": {}}`
+	if w.Body.String() != exp || w.Header().Get("X-Seriesly-Next") != keys[0] {
+		t.Errorf("Expected %s, got %s, next %q", exp, w.Body,
+			w.Header().Get("X-Seriesly-Next"))
+	}
+}
+
+func TestDescendingResults(t *testing.T) {
+	out := &strings.Builder{}
+	rw := &orderedWriter{rw: &mapWriter{out: out}, descending: true}
+	for _, k := range []int64{2000, 1000, 3000} {
+		rw.write(&processOut{key: k * 1e6, value: []interface{}{k}})
+	}
+	rw.finish()
+	exp := `{"3000": [3000],` + "\n" + `"2000": [2000],` + "\n" + `"1000": [1000]}`
+	if out.String() != exp {
+		t.Errorf("Expected %s, got %s", exp, out)
+	}
+}
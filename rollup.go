@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/go-jsonpointer"
+	"github.com/dustin/gojson"
+)
+
+// A rollupSpec configures rollup databases maintained at ingest.
+// Each interval gets its own database named dbname_interval.
+type rollupSpec struct {
+	Intervals []string `json:"intervals"`
+	Pointers  []string `json:"pointers"`
+}
+
+// An accumulator is the mergeable summary of one field in one
+// rollup bucket.
+type accumulator struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+func (a *accumulator) add(v float64) {
+	if a.Count == 0 || v < a.Min {
+		a.Min = v
+	}
+	if a.Count == 0 || v > a.Max {
+		a.Max = v
+	}
+	a.Count++
+	a.Sum += v
+}
+
+// How many intervals of buckets to keep in memory before letting a
+// late arriving document reload the bucket from its database.
+const rollupHorizon = 4
+
+// A rollup tracks the open buckets for one rollup database.
+type rollup struct {
+	dbname   string
+	source   string
+	interval int64
+	pointers []string
+	buckets  map[int64]map[string]*accumulator
+	dirty    map[int64]bool
+	newest   int64
+	// Accumulators can't take a value back out, so buckets with a
+	// document overwritten or deleted since the last flush are
+	// recomputed from the source instead.
+	stale map[int64]bool
+	// Keys added since the last flush.
+	added map[string]bool
+	// Deletes of emptied buckets queued to the rollup database and
+	// not yet known to be committed.
+	deleting map[int64]queuedBatch
+}
+
+// queuedBatch is a batch queued to another database's writer, so its
+// result can be checked without waiting on that writer's commit.
+type queuedBatch struct {
+	writer *dbWriter
+	cherr  chan error
+}
+
+// done reports whether the batch has been committed or failed, and
+// how.
+func (q queuedBatch) done() (bool, error) {
+	select {
+	case err := <-q.cherr:
+		return true, err
+	case <-q.writer.quit:
+		select {
+		case err := <-q.cherr:
+			return true, err
+		default:
+			return true, errClosed
+		}
+	default:
+		return false, nil
+	}
+}
+
+func rollupDBName(dbname, interval string) string {
+	return dbname + "_" + interval
+}
+
+func (spec *rollupSpec) validate() error {
+	if len(spec.Intervals) == 0 || len(spec.Pointers) == 0 {
+		return errors.New("at least one interval and pointer are required")
+	}
+	for _, i := range spec.Intervals {
+		d, err := time.ParseDuration(i)
+		if err != nil {
+			return err
+		}
+		if d < time.Second {
+			return fmt.Errorf("interval too small: %v", i)
+		}
+	}
+	for _, p := range spec.Pointers {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid pointer: %q", p)
+		}
+	}
+	return nil
+}
+
+func newRollups(dbname string) []*rollup {
+	m, err := loadMeta(dbname)
+	if err != nil || m.Rollups == nil {
+		return nil
+	}
+	rv := []*rollup{}
+	for _, i := range m.Rollups.Intervals {
+		d, err := time.ParseDuration(i)
+		if err != nil {
+			log.Printf("Invalid rollup interval %q on %v", i, dbname)
+			continue
+		}
+		rv = append(rv, &rollup{
+			dbname:   rollupDBName(dbname, i),
+			source:   dbname,
+			interval: int64(d),
+			pointers: m.Rollups.Pointers,
+			buckets:  map[int64]map[string]*accumulator{},
+			dirty:    map[int64]bool{},
+			stale:    map[int64]bool{},
+			added:    map[string]bool{},
+			deleting: map[int64]queuedBatch{},
+		})
+	}
+	return rv
+}
+
+func numericValue(b []byte) (float64, bool) {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, false
+	}
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (r *rollup) bucketKey(b int64) string {
+	return dbFormat(r.dbname).formatKey(time.Unix(0, b))
+}
+
+// bucket returns the accumulators for the bucket starting at b,
+// seeding them from the rollup database if it was written before.
+func (r *rollup) bucket(b int64) map[string]*accumulator {
+	if accs, ok := r.buckets[b]; ok {
+		return accs
+	}
+	accs := map[string]*accumulator{}
+	if doc, err := dbGetDoc(r.dbname, r.bucketKey(b)); err == nil {
+		var m map[string]interface{}
+		if json.Unmarshal(doc, &m) == nil {
+			for _, p := range r.pointers {
+				d, err := json.Marshal(jsonpointer.Get(m, p))
+				a := &accumulator{}
+				if err == nil && json.Unmarshal(d, a) == nil && a.Count > 0 {
+					accs[p] = a
+				}
+			}
+		}
+	}
+	r.buckets[b] = accs
+	return accs
+}
+
+// values finds the numbers at a document's rolled up pointers.
+func (r *rollup) values(doc []byte) map[string]float64 {
+	found, err := jsonpointer.FindMany(doc, r.pointers)
+	if err != nil {
+		return nil
+	}
+	rv := map[string]float64{}
+	for p, raw := range found {
+		if v, ok := numericValue(raw); ok {
+			rv[p] = v
+		}
+	}
+	return rv
+}
+
+func (r *rollup) add(k string, doc []byte) {
+	ts := parseKey(k)
+	if ts < 0 {
+		return
+	}
+	b := (ts / r.interval) * r.interval
+	if r.added[k] {
+		// Overwritten before it was flushed.
+		r.stale[b] = true
+	}
+	r.added[k] = true
+
+	var accs map[string]*accumulator
+	for p, v := range r.values(doc) {
+		if accs == nil {
+			accs = r.bucket(b)
+		}
+		if accs[p] == nil {
+			accs[p] = &accumulator{}
+		}
+		accs[p].add(v)
+		r.dirty[b] = true
+	}
+	if b > r.newest {
+		r.newest = b
+	}
+}
+
+// retract marks the bucket of a document that's been overwritten or
+// deleted to be recomputed.
+func (r *rollup) retract(k string) {
+	ts := parseKey(k)
+	if ts < 0 {
+		return
+	}
+	r.stale[(ts/r.interval)*r.interval] = true
+}
+
+// rebuild recomputes a bucket from the source documents in it.
+func (r *rollup) rebuild(db dbStore, b int64) error {
+	format := dbFormat(r.source)
+	from := format.formatKey(time.Unix(0, b))
+	to := format.formatKey(time.Unix(0, b+r.interval))
+	accs := map[string]*accumulator{}
+	err := db.WalkDocs(from, func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo, doc *couchstore.Document) error {
+		if di.ID() >= to {
+			return couchstore.StopIteration
+		}
+		for p, v := range r.values(doc.Value()) {
+			if accs[p] == nil {
+				accs[p] = &accumulator{}
+			}
+			accs[p].add(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.buckets[b] = accs
+	r.dirty[b] = true
+	return nil
+}
+
+// retractRollups has the rollups recompute the bucket of a document
+// about to be overwritten, rather than count it twice.
+func (dq *dbWriter) retractRollups(k string) {
+	if len(dq.rollups) == 0 {
+		return
+	}
+	if _, exists := dq.existing(k); !exists {
+		return
+	}
+	for _, r := range dq.rollups {
+		r.retract(k)
+	}
+}
+
+// rollupDoc lays out accumulators in the shape of the source
+// document, so /cpu/user in the source becomes /cpu/user/sum, etc.
+func rollupDoc(accs map[string]*accumulator) map[string]interface{} {
+	vals := make(map[string]interface{}, len(accs))
+	for p, a := range accs {
+		vals[p] = a
+	}
+	return pointerDoc(vals)
+}
+
+// pointerDoc builds a document with each value at its JSON pointer.
+func pointerDoc(vals map[string]interface{}) map[string]interface{} {
+	rv := map[string]interface{}{}
+	for p, v := range vals {
+		parts := strings.Split(p[1:], "/")
+		m := rv
+		for _, part := range parts[:len(parts)-1] {
+			part = unescapePointer(part)
+			next, ok := m[part].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				m[part] = next
+			}
+			m = next
+		}
+		m[unescapePointer(parts[len(parts)-1])] = v
+	}
+	return rv
+}
+
+func unescapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~1", "/", -1), "~0", "~", -1)
+}
+
+// flush writes every changed bucket to the rollup database and
+// forgets buckets that have fallen behind the horizon.  db is the
+// source database, with everything added committed.  Nothing here
+// waits on the rollup database's writer; buckets that couldn't be
+// written are tried again on the next flush.
+func (r *rollup) flush(db dbStore) {
+	for b := range r.stale {
+		if err := r.rebuild(db, b); err != nil {
+			dbLog.Error("error recomputing rollup", "db", r.dbname, "err", err)
+		}
+	}
+	r.stale = map[int64]bool{}
+	r.added = map[string]bool{}
+	for b, q := range r.deleting {
+		if done, err := q.done(); done {
+			delete(r.deleting, b)
+			if err != nil {
+				dbLog.Error("error writing rollup", "db", r.dbname, "err", err)
+				r.dirty[b] = true
+			}
+		}
+	}
+	failed := map[int64]bool{}
+	for b := range r.dirty {
+		var err error
+		if accs := r.buckets[b]; len(accs) > 0 {
+			var d []byte
+			d, err = json.Marshal(rollupDoc(accs))
+			if err == nil {
+				err = dbstore(r.dbname, r.bucketKey(b), d)
+			}
+		} else {
+			// Nothing is left in it.
+			q := queuedBatch{cherr: make(chan error, 1)}
+			q.writer, _, err = dbqueueBatch(r.dbname, []dbqitem{{
+				dbname: r.dbname, k: r.bucketKey(b), op: opDeleteItem}},
+				q.cherr)
+			if err == nil {
+				r.deleting[b] = q
+			}
+		}
+		if err != nil {
+			dbLog.Error("error writing rollup", "db", r.dbname, "err", err)
+			failed[b] = true
+		}
+	}
+	r.dirty = failed
+	horizon := r.newest - rollupHorizon*r.interval
+	for b := range r.buckets {
+		if b < horizon {
+			delete(r.buckets, b)
+		}
+	}
+	// Past the horizon a bucket isn't known, so can't be retried.
+	for b := range r.dirty {
+		if b < horizon {
+			delete(r.dirty, b)
+		}
+	}
+}
+
+func flushRollups(rollups []*rollup, db dbStore) {
+	for _, r := range rollups {
+		r.flush(db)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/gojson"
+)
+
+func TestAccumulator(t *testing.T) {
+	a := accumulator{}
+	for _, v := range []float64{3, -1, 7} {
+		a.add(v)
+	}
+	exp := accumulator{3, 9, -1, 7}
+	if a != exp {
+		t.Fatalf("Expected %v, got %v", exp, a)
+	}
+}
+
+func TestRollupDocShape(t *testing.T) {
+	doc := rollupDoc(map[string]*accumulator{
+		"/cpu/user": {1, 2, 2, 2},
+		"/cpu/sys":  {1, 3, 3, 3},
+		"/a~1b":     {1, 4, 4, 4},
+	})
+	d, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	got := map[string]interface{}{}
+	json.Unmarshal(d, &got)
+
+	exp := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"cpu": {
+			"user": {"count": 1, "sum": 2, "min": 2, "max": 2},
+			"sys": {"count": 1, "sum": 3, "min": 3, "max": 3}
+		},
+		"a/b": {"count": 1, "sum": 4, "min": 4, "max": 4}
+	}`), &exp)
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestRollupSpecValidation(t *testing.T) {
+	good := rollupSpec{[]string{"1m", "1h"}, []string{"/x"}}
+	if err := good.validate(); err != nil {
+		t.Errorf("Unexpected error on %v: %v", good, err)
+	}
+	for _, bad := range []rollupSpec{
+		{nil, []string{"/x"}},
+		{[]string{"1m"}, nil},
+		{[]string{"1ms"}, []string{"/x"}},
+		{[]string{"soon"}, []string{"/x"}},
+		{[]string{"1m"}, []string{"x"}},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Expected error on %v", bad)
+		}
+	}
+}
+
+func TestResultDoc(t *testing.T) {
+	p := queryParams{ptrs: []string{"/cpu/user", "/cpu/user", "/a~1b"},
+		reds: []string{"avg", "max", "count"}}
+	got := resultDoc(p, []interface{}{1.5, 3.0, 2.0})
+	exp := map[string]interface{}{
+		"cpu": map[string]interface{}{
+			"user": map[string]interface{}{"avg": 1.5, "max": 3.0},
+		},
+		"a/b": map[string]interface{}{"count": 2.0},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestRollupRetraction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-rollup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	const dbname = "rolled"
+	rolled := rollupDBName(dbname, "1m")
+	for _, n := range []string{dbname, rolled} {
+		if err := dbcreate(dbPath(n)); err != nil {
+			t.Fatalf("Error creating %v: %v", n, err)
+		}
+		defer forgetDB(n)
+	}
+	err = updateMeta(dbname, func(m *dbMeta) {
+		m.Rollups = &rollupSpec{[]string{"1m"}, []string{"/v"}}
+	})
+	if err != nil {
+		t.Fatalf("Error configuring: %v", err)
+	}
+
+	bucket := func() accumulator {
+		doc, err := dbGetDoc(rolled, "2012-08-10T00:00:00Z")
+		if err != nil {
+			return accumulator{}
+		}
+		m := struct{ V accumulator }{}
+		if err := json.Unmarshal(doc, &m); err != nil {
+			t.Fatalf("Error decoding %s: %v", doc, err)
+		}
+		return m.V
+	}
+	store := func(k, doc string) {
+		if err := dbstore(dbname, k, []byte(doc)); err != nil {
+			t.Fatalf("Error storing %v: %v", k, err)
+		}
+	}
+	flush := func() {
+		for _, n := range []string{dbname, rolled} {
+			if err := dbflush(n); err != nil {
+				t.Fatalf("Error flushing %v: %v", n, err)
+			}
+		}
+	}
+
+	store("2012-08-10T00:00:00Z", `{"v": 1}`)
+	store("2012-08-10T00:00:10Z", `{"v": 5}`)
+	// Overwritten before and after it's flushed.
+	store("2012-08-10T00:00:20Z", `{"v": 100}`)
+	store("2012-08-10T00:00:20Z", `{"v": 50}`)
+	flush()
+	store("2012-08-10T00:00:20Z", `{"v": 3}`)
+	flush()
+	if got, exp := bucket(), (accumulator{3, 9, 1, 5}); got != exp {
+		t.Errorf("Expected %v after overwrites, got %v", exp, got)
+	}
+
+	_, err = dbstoreBatch(dbname, []dbqitem{
+		{dbname: dbname, k: "2012-08-10T00:00:10Z", op: opDeleteItem}})
+	if err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	flush()
+	if got, exp := bucket(), (accumulator{2, 4, 1, 3}); got != exp {
+		t.Errorf("Expected %v after a delete, got %v", exp, got)
+	}
+
+	// A bucket that can't be written is tried again on a later flush.
+	setReadOnly := func(ro bool) {
+		err := updateMeta(rolled, func(m *dbMeta) {
+			m.Config = &dbConfig{ReadOnly: ro}
+		})
+		if err != nil {
+			t.Fatalf("Error configuring: %v", err)
+		}
+	}
+	setReadOnly(true)
+	_, err = dbstoreBatch(dbname, []dbqitem{
+		{dbname: dbname, k: "2012-08-10T00:00:00Z", op: opDeleteItem},
+		{dbname: dbname, k: "2012-08-10T00:00:20Z", op: opDeleteItem}})
+	if err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	flush()
+	if got, exp := bucket(), (accumulator{2, 4, 1, 3}); got != exp {
+		t.Errorf("Expected %v while the rollup is read-only, got %v", exp, got)
+	}
+	setReadOnly(false)
+	store("2012-08-10T00:05:00Z", `{"v": 1}`)
+	flush()
+	if got := bucket(); got != (accumulator{}) {
+		t.Errorf("Expected the emptied bucket deleted, got %v", got)
+	}
+}
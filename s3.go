@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An objectStore is an S3-compatible bucket reached over plain HTTP.
+// Requests are signed with AWS signature version 4 when keys are
+// configured; otherwise they're sent as is (e.g. for a local gateway).
+type objectStore struct {
+	base      string
+	accessKey string
+	secretKey string
+	region    string
+	client    *http.Client
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func newObjectStore(base string) *objectStore {
+	return &objectStore{
+		base:      strings.TrimRight(base, "/"),
+		accessKey: *archiveAccessKey,
+		secretKey: *archiveSecretKey,
+		region:    *archiveRegion,
+		client:    &http.Client{},
+	}
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// signV4 signs a request for S3.  Every header already set on the
+// request is signed, along with the host.
+func signV4(req *http.Request, accessKey, secretKey, region string,
+	now time.Time) {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	if req.Header.Get("x-amz-content-sha256") == "" {
+		req.Header.Set("x-amz-content-sha256", unsignedPayload)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex(canonical)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, sig))
+}
+
+func (o *objectStore) do(method, name string, body io.Reader,
+	size int64) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, o.base+"/"+name, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if o.accessKey != "" {
+		signV4(req, o.accessKey, o.secretKey, o.region, time.Now())
+	}
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("HTTP error on %v %v: %v", method, name, res.Status)
+	}
+	return res, nil
+}
+
+func (o *objectStore) upload(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	res, err := o.do("PUT", name, f, st.Size())
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// download fetches an object into path, replacing it only once the
+// whole object has arrived.
+func (o *objectStore) download(name, path string) error {
+	res, err := o.do("GET", name, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, res.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
+
+func (o *objectStore) remove(name string) error {
+	res, err := o.do("DELETE", name, nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// _all and _dump take sample= to return some of the documents in a
+// range: below 1, each is picked with that probability (so 0.01 is
+// about 1%), and otherwise every nth is (so 100 is also 1%).  seed
+// makes a random sample repeatable.  Keys are walked, and only the
+// documents picked are read, and limit caps how many are returned.
+
+// sampleBatch is how many picked keys are fetched at a time.
+const sampleBatch = 1000
+
+type sampler struct {
+	rate  float64
+	every int
+	n     int
+	rnd   *rand.Rand
+}
+
+// parseSample reads the sample and seed parameters, returning nil if
+// there's no sampling.
+func parseSample(req *http.Request) (*sampler, error) {
+	s := req.FormValue("sample")
+	if s == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	switch {
+	case err != nil || f <= 0:
+		return nil, fmt.Errorf("sample must be a positive number, got %q", s)
+	case f >= 1 && f != float64(int(f)):
+		return nil, fmt.Errorf("sample must be below 1 or whole, got %q", s)
+	case f >= 1:
+		return &sampler{every: int(f)}, nil
+	}
+
+	seed := time.Now().UnixNano()
+	if s := req.FormValue("seed"); s != "" {
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("seed must be an integer, got %q", s)
+		}
+	}
+	return &sampler{rate: f, rnd: rand.New(rand.NewSource(seed))}, nil
+}
+
+// take reports whether to pick the next key.
+func (s *sampler) take() bool {
+	if s.every > 0 {
+		s.n++
+		return (s.n-1)%s.every == 0
+	}
+	return s.rnd.Float64() < s.rate
+}
+
+// dbwalkSampled walks the documents in a page's range that the sampler
+// picks, skipping the page's first skip keys, and stopping after its
+// limit of documents.
+func dbwalkSampled(dbname string, p page, s *sampler,
+	f func(k string, v []byte) error) error {
+
+	batch := []string{}
+	flush := func() error {
+		docs := map[string][]byte{}
+		_, err := dbGetDocs(dbname, batch, func(k string, v []byte) error {
+			docs[k] = v
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// In walk order, which descending reverses.
+		for _, k := range batch {
+			if v, ok := docs[k]; ok {
+				if err := f(k, v); err != nil {
+					return err
+				}
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	walked, picked := 0, 0
+	err := p.walkKeys(dbname, func(k string) error {
+		walked++
+		if walked <= p.skip || !s.take() {
+			return nil
+		}
+		if p.limit >= 0 && picked >= p.limit {
+			return io.EOF
+		}
+		picked++
+		batch = append(batch, k)
+		if len(batch) >= sampleBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil || err == io.EOF {
+		err = flush()
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/gojson"
+)
+
+func TestSampling(t *testing.T) {
+	createMemDatabase("sampled", memOptions{})
+	defer dropMemDatabase("sampled")
+	defer dbRemoveConn("sampled")
+	b := memDatabase("sampled").Bulk()
+	all := []string{}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("2012-08-10T00:%02d:%02dZ", i/60, i%60)
+		all = append(all, k)
+		b.Set(couchstore.NewDocInfo(k, 0), couchstore.NewDocument(k, []byte("{}")))
+	}
+	b.Commit()
+
+	sampled := func(query string) []string {
+		req, _ := http.NewRequest("GET", "/sampled/_all?"+query, nil)
+		w := httptest.NewRecorder()
+		allDocs([]string{"sampled"}, w, req)
+		if w.Code != 200 {
+			t.Fatalf("Expected 200 for %v, got %v: %s", query, w.Code, w.Body)
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatalf("Error decoding %s: %v", w.Body, err)
+		}
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	tenth := []string{}
+	for i := 0; i < len(all); i += 10 {
+		tenth = append(tenth, all[i])
+	}
+	if got := sampled("sample=10"); !reflect.DeepEqual(got, tenth) {
+		t.Errorf("Expected every tenth, %v, got %v", tenth, got)
+	}
+	if got := sampled("sample=10&limit=3"); !reflect.DeepEqual(got, tenth[:3]) {
+		t.Errorf("Expected %v, got %v", tenth[:3], got)
+	}
+	if got := sampled("sample=1&skip=98"); !reflect.DeepEqual(got, all[98:]) {
+		t.Errorf("Expected %v, got %v", all[98:], got)
+	}
+
+	some := sampled("sample=0.3&seed=7")
+	if len(some) == 0 || len(some) == len(all) {
+		t.Errorf("Expected some of the documents, got %v", len(some))
+	}
+	if again := sampled("sample=0.3&seed=7"); !reflect.DeepEqual(some, again) {
+		t.Errorf("Expected the same seed to pick the same, got %v then %v",
+			some, again)
+	}
+
+	for _, s := range []string{"0", "-1", "2.5", "x"} {
+		req, _ := http.NewRequest("GET", "/sampled/_all?sample="+s, nil)
+		w := httptest.NewRecorder()
+		allDocs([]string{"sampled"}, w, req)
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for sample=%v, got %v", s, w.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET",
+		"/sampled/_dump?sample=10&after="+all[0], nil)
+	w := httptest.NewRecorder()
+	dumpDocs([]string{"sampled"}, w, req)
+	dumped := []string{}
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("Error decoding %s: %v", sc.Bytes(), err)
+		}
+		for k := range m {
+			dumped = append(dumped, k)
+		}
+	}
+	expected := []string{}
+	for i := 1; i < len(all); i += 10 {
+		expected = append(expected, all[i])
+	}
+	if !reflect.DeepEqual(dumped, expected) {
+		t.Errorf("Expected %v dumped, got %v", expected, dumped)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// A scheduleSpec runs a view periodically over the window of time
+// leading up to each run, and sends the results to a webhook and/or
+// by email.
+type scheduleSpec struct {
+	View    string   `json:"view"`
+	Every   string   `json:"every"`
+	Window  string   `json:"window,omitempty"`
+	Format  string   `json:"format,omitempty"`
+	Webhook string   `json:"webhook,omitempty"`
+	Email   []string `json:"email,omitempty"`
+	// Values for the view's placeholders.
+	Params map[string]string `json:"params,omitempty"`
+
+	every, window time.Duration
+}
+
+const minScheduleEvery = time.Minute
+
+func (s *scheduleSpec) validate() error {
+	var err error
+	if s.View == "" {
+		return errors.New("view is required")
+	}
+	if s.every, err = time.ParseDuration(s.Every); err != nil {
+		return fmt.Errorf("bad every: %v", err)
+	}
+	if s.every < minScheduleEvery {
+		return fmt.Errorf("every must be at least %v", minScheduleEvery)
+	}
+	s.window = s.every
+	if s.Window != "" {
+		if s.window, err = time.ParseDuration(s.Window); err != nil {
+			return fmt.Errorf("bad window: %v", err)
+		}
+	}
+	switch s.Format {
+	case "":
+		s.Format = "json"
+	case "json", "csv":
+	default:
+		return fmt.Errorf("unknown format: %v", s.Format)
+	}
+	if s.Webhook == "" && len(s.Email) == 0 {
+		return errors.New("a webhook or email recipient is required")
+	}
+	if len(s.Email) > 0 && *smtpAddr == "" {
+		return errors.New("email requires -smtpAddr")
+	}
+	return nil
+}
+
+func dbSchedules(dbname string) map[string]scheduleSpec {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return nil
+	}
+	return m.Schedules
+}
+
+// resultsCSV renders results a row per group, a column per reducer.
+func resultsCSV(p queryParams, results queryResults) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	cw := csv.NewWriter(buf)
+	header := []string{"timestamp"}
+	for i, ptr := range p.ptrs {
+		header = append(header, ptr+"/"+p.reds[i])
+	}
+	cw.Write(header)
+
+	keys := make([]int64, 0, len(results))
+	for ts := range results {
+		keys = append(keys, ts)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, ts := range keys {
+		row := []string{time.Unix(0, ts*int64(time.Millisecond)).UTC().
+			Format(time.RFC3339Nano)}
+		for _, v := range results[ts] {
+			s := ""
+			if v != nil {
+				s = fmt.Sprint(v)
+			}
+			row = append(row, s)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// runSchedule runs a schedule's view over the window ending now and
+// renders the results in its format.
+func runSchedule(dbname string, s scheduleSpec, now time.Time) ([]byte, error) {
+	v, ok := dbView(dbname, s.View)
+	if !ok {
+		return nil, fmt.Errorf("no such view: %v", s.View)
+	}
+	bind := url.Values{
+		"from": {now.Add(-s.window).UTC().Format(time.RFC3339Nano)},
+		"to":   {now.UTC().Format(time.RFC3339Nano)},
+	}
+	for k, v := range s.Params {
+		bind.Set(k, v)
+	}
+	form, err := viewForm(v, bind)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseQueryParams(form)
+	if err != nil {
+		return nil, err
+	}
+	if form.Get("stored_exclusions") != "false" {
+		stored, err := dbExclusions(dbname)
+		if err != nil {
+			return nil, err
+		}
+		p.exclude = append(p.exclude, stored...)
+	}
+
+	results, err := queryResultsFor(dbname, p)
+	if err != nil {
+		return nil, err
+	}
+	if s.Format == "csv" {
+		return resultsCSV(p, results)
+	}
+	return json.Marshal(results)
+}
+
+func (s scheduleSpec) contentType() string {
+	if s.Format == "csv" {
+		return "text/csv"
+	}
+	return "application/json"
+}
+
+func deliverSchedule(dbname, name string, s scheduleSpec, body []byte) {
+	if s.Webhook != "" {
+		client := &http.Client{Timeout: 30 * time.Second}
+		res, err := client.Post(s.Webhook, s.contentType(),
+			bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error sending %v/%v results: %v", dbname, name, err)
+		} else {
+			res.Body.Close()
+			if res.StatusCode >= 300 {
+				log.Printf("Webhook for %v/%v returned %v",
+					dbname, name, res.Status)
+			}
+		}
+	}
+	if len(s.Email) > 0 {
+		msg := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: seriesly report %v/%v\r\n"+
+			"Content-Type: %v\r\n\r\n%s",
+			*smtpFrom, strings.Join(s.Email, ", "), dbname, name,
+			s.contentType(), body)
+		if err := smtp.SendMail(*smtpAddr, nil, *smtpFrom, s.Email,
+			[]byte(msg)); err != nil {
+			log.Printf("Error emailing %v/%v results: %v", dbname, name, err)
+		}
+	}
+}
+
+var scheduleLock = sync.Mutex{}
+var scheduleLastRun = map[string]time.Time{}
+
+// dueSchedules returns the names of a database's schedules due to run,
+// marking them as run.  Schedules are first due a period after they're
+// first seen.
+func dueSchedules(dbname string, specs map[string]scheduleSpec,
+	now time.Time) []string {
+
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	rv := []string{}
+	for name, s := range specs {
+		if s.validate() != nil {
+			continue
+		}
+		key := dbname + "/" + name
+		last, seen := scheduleLastRun[key]
+		switch {
+		case !seen:
+			scheduleLastRun[key] = now
+		case now.Sub(last) >= s.every:
+			scheduleLastRun[key] = now
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func runScheduledOnce(now time.Time) {
+	for _, dbname := range dblist(*dbRoot) {
+		specs := dbSchedules(dbname)
+		for _, name := range dueSchedules(dbname, specs, now) {
+			s := specs[name]
+			s.validate()
+			body, err := runSchedule(dbname, s, now)
+			if err != nil {
+				log.Printf("Error running schedule %v/%v: %v", dbname, name, err)
+				continue
+			}
+			go deliverSchedule(dbname, name, s, body)
+		}
+	}
+}
+
+func scheduler() {
+	for now := range time.Tick(*scheduleCheck) {
+		runScheduledOnce(now)
+	}
+}
+
+func listSchedules(parts []string, w http.ResponseWriter, req *http.Request) {
+	specs := dbSchedules(parts[0])
+	if specs == nil {
+		specs = map[string]scheduleSpec{}
+	}
+	mustEncode(200, w, specs)
+}
+
+func putSchedule(parts []string, w http.ResponseWriter, req *http.Request) {
+	s := scheduleSpec{}
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err == nil {
+		err = s.validate()
+	}
+	if err == nil {
+		if _, ok := dbView(parts[0], s.View); !ok {
+			err = fmt.Errorf("no such view: %v", s.View)
+		}
+	}
+	if err != nil {
+		emitError(400, w, "Bad schedule", err.Error())
+		return
+	}
+
+	err = updateMeta(parts[0], func(m *dbMeta) {
+		specs := map[string]scheduleSpec{}
+		for n, old := range m.Schedules {
+			specs[n] = old
+		}
+		specs[parts[1]] = s
+		m.Schedules = specs
+	})
+	if err != nil {
+		emitError(500, w, "Error storing schedule", err.Error())
+		return
+	}
+	mustEncode(201, w, map[string]interface{}{"ok": true})
+}
+
+func deleteSchedule(parts []string, w http.ResponseWriter, req *http.Request) {
+	if _, ok := dbSchedules(parts[0])[parts[1]]; !ok {
+		emitError(404, w, "not_found", "no such schedule")
+		return
+	}
+	err := updateMeta(parts[0], func(m *dbMeta) {
+		specs := map[string]scheduleSpec{}
+		for n, old := range m.Schedules {
+			if n != parts[1] {
+				specs[n] = old
+			}
+		}
+		m.Schedules = specs
+	})
+	if err != nil {
+		emitError(500, w, "Error deleting schedule", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+// runScheduleNow runs a schedule immediately and returns its results
+// rather than sending them, for trying one out.
+func runScheduleNow(parts []string, w http.ResponseWriter, req *http.Request) {
+	s, ok := dbSchedules(parts[0])[parts[1]]
+	if !ok {
+		emitError(404, w, "not_found", "no such schedule")
+		return
+	}
+	if err := s.validate(); err != nil {
+		emitError(500, w, "Bad schedule", err.Error())
+		return
+	}
+	body, err := runSchedule(parts[0], s, time.Now())
+	if err != nil {
+		emitError(500, w, "Error running schedule", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", s.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(200)
+	w.Write(body)
+}
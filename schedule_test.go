@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDueSchedules(t *testing.T) {
+	specs := map[string]scheduleSpec{
+		"hourly": {View: "v", Every: "1h", Webhook: "http://x/"},
+		"broken": {View: "v", Every: "1s", Webhook: "http://x/"},
+	}
+	now := time.Unix(1000000, 0)
+
+	if due := dueSchedules("sched", specs, now); len(due) != 0 {
+		t.Errorf("Expected nothing due when first seen, got %v", due)
+	}
+	if due := dueSchedules("sched", specs, now.Add(59*time.Minute)); len(due) != 0 {
+		t.Errorf("Expected nothing due within the hour, got %v", due)
+	}
+	due := dueSchedules("sched", specs, now.Add(time.Hour))
+	if len(due) != 1 || due[0] != "hourly" {
+		t.Errorf("Expected hourly to be due, got %v", due)
+	}
+}
+
+func TestResultsCSV(t *testing.T) {
+	p := queryParams{ptrs: []string{"/t", "/t"}, reds: []string{"min", "max"}}
+	got, err := resultsCSV(p, queryResults{
+		60000: {2.0, nil},
+		0:     {1.0, 3.5},
+	})
+	if err != nil {
+		t.Fatalf("Error rendering csv: %v", err)
+	}
+	exp := "timestamp,/t/min,/t/max\n" +
+		"1970-01-01T00:00:00Z,1,3.5\n" +
+		"1970-01-01T00:01:00Z,2,\n"
+	if string(got) != exp {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+}
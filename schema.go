@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+const schemaExt = ".schema"
+
+// How many weeks of field history to keep per database.
+const schemaWeeks = 12
+
+// A schemaTracker records which JSON pointer paths (and which types
+// of values at them) showed up in a database each week, keyed by the
+// document timestamp.
+type schemaTracker struct {
+	dbname string
+
+	mu    sync.Mutex
+	weeks map[string]map[string][]string
+	dirty bool
+}
+
+var schemaLock = sync.Mutex{}
+var schemaTrackers = map[string]*schemaTracker{}
+
+func schemaPath(dbname string) string {
+	return dbPath(dbname) + schemaExt
+}
+
+// dbSchema returns the tracker for a database, loading any history
+// recorded earlier.
+func dbSchema(dbname string) *schemaTracker {
+	schemaLock.Lock()
+	defer schemaLock.Unlock()
+
+	if s := schemaTrackers[dbname]; s != nil {
+		return s
+	}
+	s := &schemaTracker{dbname: dbname,
+		weeks: map[string]map[string][]string{}}
+	data, err := ioutil.ReadFile(schemaPath(dbname))
+	if err == nil {
+		err = json.Unmarshal(data, &s.weeks)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error loading schema history of %v: %v", dbname, err)
+	}
+	schemaTrackers[dbname] = s
+	return s
+}
+
+func dropSchema(dbname string) {
+	schemaLock.Lock()
+	defer schemaLock.Unlock()
+	delete(schemaTrackers, dbname)
+	os.Remove(schemaPath(dbname))
+}
+
+func weekOf(t time.Time) string {
+	y, w := t.UTC().ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", y, w)
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// leafTypes finds the type of every non-object value in a document.
+// Arrays are treated as values rather than walked.
+func leafTypes(prefix string, v interface{}, into map[string]string) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		into[prefix] = jsonType(v)
+		return
+	}
+	for k, sub := range m {
+		k = strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1)
+		leafTypes(prefix+"/"+k, sub, into)
+	}
+}
+
+func (s *schemaTracker) add(k string, doc []byte) {
+	if s == nil {
+		return
+	}
+	t, err := parseCanonicalTime(k)
+	if err != nil {
+		return
+	}
+	var v interface{}
+	if json.Unmarshal(doc, &v) != nil {
+		return
+	}
+	leaves := map[string]string{}
+	leafTypes("", v, leaves)
+
+	week := weekOf(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := s.weeks[week]
+	if fields == nil {
+		fields = map[string][]string{}
+		s.weeks[week] = fields
+	}
+	for p, typ := range leaves {
+		types := fields[p]
+		i := sort.SearchStrings(types, typ)
+		if i < len(types) && types[i] == typ {
+			continue
+		}
+		types = append(types, "")
+		copy(types[i+1:], types[i:])
+		types[i] = typ
+		fields[p] = types
+		s.dirty = true
+	}
+}
+
+func (s *schemaTracker) sortedWeeks() []string {
+	weeks := make([]string, 0, len(s.weeks))
+	for w := range s.weeks {
+		weeks = append(weeks, w)
+	}
+	sort.Strings(weeks)
+	return weeks
+}
+
+// flush writes out the history if anything new has been seen.
+func (s *schemaTracker) flush() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	weeks := s.sortedWeeks()
+	for len(weeks) > schemaWeeks {
+		delete(s.weeks, weeks[0])
+		weeks = weeks[1:]
+	}
+
+	data, err := json.Marshal(s.weeks)
+	if err == nil {
+		fn := schemaPath(s.dbname)
+		err = ioutil.WriteFile(fn+".tmp", data, 0666)
+		if err == nil {
+			err = os.Rename(fn+".tmp", fn)
+		}
+	}
+	if err != nil {
+		log.Printf("Error storing schema history of %v: %v", s.dbname, err)
+		return
+	}
+	s.dirty = false
+}
+
+type typeChange struct {
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+type schemaWeek struct {
+	Week        string                `json:"week"`
+	Fields      int                   `json:"fields"`
+	Added       []string              `json:"added"`
+	Removed     []string              `json:"removed"`
+	TypeChanges map[string]typeChange `json:"type_changes"`
+}
+
+// report compares each week's fields against the week before it.
+func (s *schemaTracker) report() []schemaWeek {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rv := []schemaWeek{}
+	var prev map[string][]string
+	for _, w := range s.sortedWeeks() {
+		fields := s.weeks[w]
+		sw := schemaWeek{Week: w, Fields: len(fields),
+			Added: []string{}, Removed: []string{},
+			TypeChanges: map[string]typeChange{}}
+		if prev != nil {
+			for p, types := range fields {
+				before, ok := prev[p]
+				switch {
+				case !ok:
+					sw.Added = append(sw.Added, p)
+				case strings.Join(before, ",") != strings.Join(types, ","):
+					sw.TypeChanges[p] = typeChange{before, types}
+				}
+			}
+			for p := range prev {
+				if _, ok := fields[p]; !ok {
+					sw.Removed = append(sw.Removed, p)
+				}
+			}
+		}
+		sort.Strings(sw.Added)
+		sort.Strings(sw.Removed)
+		rv = append(rv, sw)
+		prev = fields
+	}
+	return rv
+}
+
+// fieldsOfType lists the fields seen holding a type in any week.
+func (s *schemaTracker) fieldsOfType(typ string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, fields := range s.weeks {
+		for p, types := range fields {
+			i := sort.SearchStrings(types, typ)
+			if i < len(types) && types[i] == typ {
+				seen[p] = true
+			}
+		}
+	}
+	rv := make([]string, 0, len(seen))
+	for p := range seen {
+		rv = append(rv, p)
+	}
+	sort.Strings(rv)
+	return rv
+}
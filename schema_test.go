@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchemaDrift(t *testing.T) {
+	s := &schemaTracker{weeks: map[string]map[string][]string{}}
+	s.add("2013-01-01T00:00:00Z", []byte(`{"cpu": {"user": 1}, "host": "a"}`))
+	s.add("2013-01-02T00:00:00Z", []byte(`{"cpu": {"user": 2}, "a/b": []}`))
+	s.add("2013-01-08T00:00:00Z", []byte(`{"cpu": {"user": "3", "sys": 1}}`))
+	s.add("not a time", []byte(`{"ignored": true}`))
+
+	rep := s.report()
+	if len(rep) != 2 {
+		t.Fatalf("Expected two weeks, got %+v", rep)
+	}
+	first, second := rep[0], rep[1]
+	if first.Week != "2013-W01" || first.Fields != 3 {
+		t.Errorf("Unexpected first week: %+v", first)
+	}
+	if !reflect.DeepEqual(second.Added, []string{"/cpu/sys"}) {
+		t.Errorf("Expected /cpu/sys added, got %v", second.Added)
+	}
+	if !reflect.DeepEqual(second.Removed, []string{"/a~1b", "/host"}) {
+		t.Errorf("Expected /a~1b and /host removed, got %v", second.Removed)
+	}
+	exp := map[string]typeChange{
+		"/cpu/user": {[]string{"number"}, []string{"string"}},
+	}
+	if !reflect.DeepEqual(second.TypeChanges, exp) {
+		t.Errorf("Expected %v, got %v", exp, second.TypeChanges)
+	}
+}
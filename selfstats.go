@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// With -selfStats set, seriesly periodically stores its own metrics
+// in a local database, so it can be watched with its own queries.
+const selfStatsDB = "_seriesly_stats"
+
+// isSelfStatsPath reports whether a request is for the self stats
+// database, which is readable despite its reserved name.
+func isSelfStatsPath(path string) bool {
+	return path == "/"+selfStatsDB || strings.HasPrefix(path, "/"+selfStatsDB+"/")
+}
+
+func queueDepths() map[string]int {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	rv := map[string]int{}
+	for n, w := range dbConns {
+		if n != selfStatsDB {
+			rv[n] = len(w.ch)
+		}
+	}
+	return rv
+}
+
+// selfStatsDoc describes the server over the last interval.
+func selfStatsDoc(now time.Time, interval time.Duration) map[string]interface{} {
+	doc := serverStatsCollector.window(now, interval)
+	depths := queueDepths()
+	total := 0
+	for _, d := range depths {
+		total += d
+	}
+	doc["open_dbs"] = len(depths)
+	doc["queued"] = total
+	doc["queues"] = depths
+	doc["lanes"] = laneStats()
+	doc["writers"] = writerDelays.stats()
+	return doc
+}
+
+func recordSelfStats(now time.Time, interval time.Duration) error {
+	b, err := json.Marshal(selfStatsDoc(now, interval))
+	if err != nil {
+		return err
+	}
+	return dbstore(selfStatsDB, now.UTC().Format(time.RFC3339Nano), b)
+}
+
+func selfStatsRecorder(interval time.Duration) {
+	if err := ensureDB(selfStatsDB); err != nil {
+		log.Printf("Error creating %v: %v", selfStatsDB, err)
+		return
+	}
+	for now := range time.Tick(interval) {
+		if err := recordSelfStats(now, interval); err != nil {
+			log.Printf("Error recording self stats: %v", err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelfStatsRouting(t *testing.T) {
+	route, parts := findHandler("GET", "/"+selfStatsDB+"/_query")
+	if route.Path == reservedPath || len(parts) == 0 || parts[0] != selfStatsDB {
+		t.Errorf("Expected the self stats db to be queryable, got %v %v",
+			route.Path, parts)
+	}
+
+	route, _ = findHandler("GET", "/_seriesly_statsx/_query")
+	if route.Path != reservedPath {
+		t.Errorf("Expected other reserved names to stay reserved, got %v",
+			route.Path)
+	}
+}
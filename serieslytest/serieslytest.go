@@ -0,0 +1,210 @@
+// Package serieslytest runs real seriesly servers for black box
+// tests.  Each server gets its own temporary directory and port and
+// is stopped when the test ends:
+//
+//	s := serieslytest.Start(t)
+//	s.Seed("temps", map[time.Time]interface{}{t0: map[string]int{"c": 20}})
+//	s.AssertQuery("temps", client.Query{...}, []client.Row{...})
+//
+// The server is built from source the first time it's needed, unless
+// SERIESLY_BIN names a binary to use.
+package serieslytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/seriesly/client"
+)
+
+// Package is what's built when SERIESLY_BIN isn't set.
+const Package = "github.com/dustin/seriesly"
+
+// StartTimeout is how long Start waits for a server to answer.
+var StartTimeout = 30 * time.Second
+
+var build struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// binary finds or builds the server binary.
+func binary() (string, error) {
+	if p := os.Getenv("SERIESLY_BIN"); p != "" {
+		return p, nil
+	}
+	build.once.Do(func() {
+		dir, err := ioutil.TempDir("", "serieslytest")
+		if err != nil {
+			build.err = err
+			return
+		}
+		build.path = filepath.Join(dir, "seriesly")
+		out, err := exec.Command("go", "build", "-o", build.path,
+			Package).CombinedOutput()
+		if err != nil {
+			build.err = fmt.Errorf("building %v: %v\n%s", Package, err, out)
+		}
+	})
+	return build.path, build.err
+}
+
+// freeAddr finds a local address nothing is listening on.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// A Server is a running seriesly process.
+type Server struct {
+	// URL is the server's base URL, e.g. http://127.0.0.1:41234/
+	URL string
+	// Dir holds the server's databases.
+	Dir    string
+	Client *client.Client
+
+	t   testing.TB
+	cmd *exec.Cmd
+	log bytes.Buffer
+}
+
+// Start starts a server with any extra flags given, failing the test
+// if it doesn't come up.
+func Start(t testing.TB, args ...string) *Server {
+	t.Helper()
+	bin, err := binary()
+	if err != nil {
+		t.Fatalf("Error finding seriesly: %v", err)
+	}
+	addr, err := freeAddr()
+	if err != nil {
+		t.Fatalf("Error finding a port: %v", err)
+	}
+
+	s := &Server{URL: "http://" + addr + "/", Dir: t.TempDir(), t: t}
+	s.Client, err = client.New(s.URL)
+	if err != nil {
+		t.Fatalf("Error creating client: %v", err)
+	}
+	s.cmd = exec.Command(bin, append([]string{
+		"-addr", addr,
+		"-root", filepath.Join(s.Dir, "db"),
+		"-static", filepath.Join(s.Dir, "static"),
+		// Don't keep tests waiting for writes; args may override.
+		"-flushDelay", "10ms",
+	}, args...)...)
+	s.cmd.Stdout = &s.log
+	s.cmd.Stderr = &s.log
+	if err := s.cmd.Start(); err != nil {
+		t.Fatalf("Error starting seriesly: %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	if err := s.waitReady(); err != nil {
+		s.Stop()
+		t.Fatalf("seriesly didn't start: %v\n%s", err, s.log.String())
+	}
+	return s
+}
+
+func (s *Server) waitReady() error {
+	deadline := time.Now().Add(StartTimeout)
+	for {
+		res, err := http.Get(s.URL)
+		if err == nil {
+			res.Body.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Stop kills the server.  It's called when the test ends, so it's
+// only needed to test what happens while a server is down.
+func (s *Server) Stop() {
+	if s.cmd.ProcessState != nil {
+		return
+	}
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+// Log returns what the server has logged.
+func (s *Server) Log() string {
+	return s.log.String()
+}
+
+// Seed creates a database if needed and stores documents in it,
+// returning once they're committed.
+func (s *Server) Seed(db string, docs map[time.Time]interface{}) {
+	s.t.Helper()
+	if err := s.Client.CreateDB(db); err != nil {
+		s.t.Fatalf("Error creating %v: %v", db, err)
+	}
+	m := make(map[string]interface{}, len(docs))
+	for t, d := range docs {
+		m[t.UTC().Format(time.RFC3339Nano)] = d
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		s.t.Fatalf("Error encoding documents: %v", err)
+	}
+	res, err := http.Post(s.URL+db+"/_bulk?ordered=true",
+		"application/json", bytes.NewReader(b))
+	if err != nil {
+		s.t.Fatalf("Error seeding %v: %v", db, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		body, _ := ioutil.ReadAll(res.Body)
+		s.t.Fatalf("Error seeding %v: %v %s", db, res.Status, body)
+	}
+}
+
+// Query runs a query, failing the test if it doesn't succeed.
+func (s *Server) Query(db string, q client.Query) []client.Row {
+	s.t.Helper()
+	rows, err := s.Client.Query(db, q)
+	if err != nil {
+		s.t.Fatalf("Error querying %v: %v", db, err)
+	}
+	return rows
+}
+
+// AssertQuery checks a query's results.  Values are compared as
+// decoded from JSON, so numbers are float64s.
+func (s *Server) AssertQuery(db string, q client.Query, want []client.Row) {
+	s.t.Helper()
+	got := s.Query(db, q)
+	if len(got) != len(want) {
+		s.t.Errorf("Expected %v rows from %v, got %v: %v",
+			len(want), db, len(got), got)
+		return
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) ||
+			!reflect.DeepEqual(got[i].Values, want[i].Values) {
+			s.t.Errorf("Expected row %v from %v to be %v, got %v",
+				i, db, want[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package serieslytest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dustin/seriesly/client"
+)
+
+func TestServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs a server")
+	}
+	s := Start(t)
+
+	t0 := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Seed("temps", map[time.Time]interface{}{
+		t0:                                map[string]int{"c": 20},
+		t0.Add(time.Second):               map[string]int{"c": 22},
+		t0.Add(time.Minute + time.Second): map[string]int{"c": 30},
+	})
+	s.AssertQuery("temps", client.Query{Group: time.Minute,
+		Reductions: []client.Reduction{
+			{Pointer: "/c", Reducer: "avg"},
+			{Pointer: "/c", Reducer: "count"}}},
+		[]client.Row{
+			{Time: t0, Values: []interface{}{21.0, 2.0}},
+			{Time: t0.Add(time.Minute), Values: []interface{}{30.0, 1.0}},
+		})
+}
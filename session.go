@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Query consistency levels.  Eventual queries see what's been
+// committed.  Session queries also see everything the same client
+// has written, committing it first if need be.
+const (
+	consistencyEventual = "eventual"
+	consistencySession  = "session"
+)
+
+// Sessions that haven't written for this long are forgotten; the
+// writers' own flushes have long since committed what they wrote.
+const sessionIdle = 10 * time.Minute
+
+var sessionLock = sync.Mutex{}
+
+// A sessionMark records a session's latest write to a database.
+type sessionMark struct {
+	gen  uint64
+	when time.Time
+}
+
+// Databases each session token has written to since it last
+// synced them.
+var sessionWrites = map[string]map[string]sessionMark{}
+
+// Numbers each write so a sync can tell whether another came after
+// it started.
+var sessionGen uint64
+
+var sessionPruned time.Time
+
+// sessionToken identifies a client by the credentials it sends.
+func sessionToken(req *http.Request) string {
+	return req.Header.Get("Authorization")
+}
+
+func sessionWrote(token, dbname string) {
+	if token == "" {
+		return
+	}
+	now := time.Now()
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	dbs := sessionWrites[token]
+	if dbs == nil {
+		dbs = map[string]sessionMark{}
+		sessionWrites[token] = dbs
+	}
+	sessionGen++
+	dbs[dbname] = sessionMark{sessionGen, now}
+	if now.Sub(sessionPruned) >= sessionIdle {
+		pruneSessions(now)
+	}
+}
+
+// pruneSessions forgets writes older than sessionIdle.  sessionLock
+// must be held.
+func pruneSessions(now time.Time) {
+	sessionPruned = now
+	for token, dbs := range sessionWrites {
+		for dbname, m := range dbs {
+			if now.Sub(m.when) >= sessionIdle {
+				delete(dbs, dbname)
+			}
+		}
+		if len(dbs) == 0 {
+			delete(sessionWrites, token)
+		}
+	}
+}
+
+// sessionSynced forgets a session's write to a database once it's
+// committed, unless it's written there again since.
+func sessionSynced(token, dbname string, m sessionMark) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	dbs := sessionWrites[token]
+	if dbs[dbname].gen != m.gen {
+		return
+	}
+	delete(dbs, dbname)
+	if len(dbs) == 0 {
+		delete(sessionWrites, token)
+	}
+}
+
+// sessionSync makes sure a session's writes to a database are
+// committed.  Without a token, there's no telling which writes are
+// the client's, so everything queued is committed.  The session's
+// mark stays until the flush is done, so concurrent queries from it
+// wait for the flush too.
+func sessionSync(token, dbname string) error {
+	if token == "" {
+		return dbflush(dbname)
+	}
+	sessionLock.Lock()
+	m, pending := sessionWrites[token][dbname]
+	sessionLock.Unlock()
+	if !pending {
+		return nil
+	}
+	if err := dbflush(dbname); err != nil {
+		return err
+	}
+	sessionSynced(token, dbname, m)
+	return nil
+}
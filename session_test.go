@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionWrites(t *testing.T) {
+	sessionWrote("", "db")
+	if len(sessionWrites) != 0 {
+		t.Errorf("Expected anonymous writes not to be tracked")
+	}
+
+	pending := func(token, dbname string) bool {
+		_, ok := sessionWrites[token][dbname]
+		return ok
+	}
+	sessionWrote("tok", "db")
+	sessionWrote("tok", "other")
+	if !pending("tok", "db") || !pending("tok", "other") {
+		t.Fatalf("Expected writes to be tracked, got %v", sessionWrites)
+	}
+
+	if err := sessionSync("tok", "db"); err != nil {
+		t.Fatalf("Error syncing session: %v", err)
+	}
+	if pending("tok", "db") || !pending("tok", "other") {
+		t.Errorf("Expected only db to be synced, got %v", sessionWrites)
+	}
+
+	// A write while syncing still needs syncing.
+	m := sessionWrites["tok"]["other"]
+	sessionWrote("tok", "other")
+	sessionSynced("tok", "other", m)
+	if !pending("tok", "other") {
+		t.Errorf("Expected the later write to stay pending")
+	}
+
+	sessionSync("tok", "other")
+	if _, ok := sessionWrites["tok"]; ok {
+		t.Errorf("Expected the session to be forgotten, got %v", sessionWrites)
+	}
+}
+
+func TestSessionPruning(t *testing.T) {
+	defer func() { sessionWrites = map[string]map[string]sessionMark{} }()
+	sessionWrote("idle", "db")
+	sessionWrote("busy", "db")
+	now := time.Now().Add(sessionIdle)
+	sessionWrites["busy"]["db"] = sessionMark{sessionGen, now}
+
+	sessionLock.Lock()
+	pruneSessions(now)
+	sessionLock.Unlock()
+	if _, ok := sessionWrites["idle"]; ok {
+		t.Errorf("Expected the idle session to be forgotten")
+	}
+	if _, ok := sessionWrites["busy"]["db"]; !ok {
+		t.Errorf("Expected the busy session to be kept")
+	}
+}
+
+func TestConsistencyParam(t *testing.T) {
+	form := map[string][]string{"group": {"1000"}, "ptr": {"/x"},
+		"reducer": {"any"}, "consistency": {"strong"}}
+	if _, err := parseQueryParams(form); err == nil {
+		t.Errorf("Expected an error for an unknown consistency")
+	}
+	form["consistency"] = []string{consistencySession}
+	p, err := parseQueryParams(form)
+	if err != nil || p.consistency != consistencySession {
+		t.Errorf("Expected session consistency, got %v, %v", p.consistency, err)
+	}
+}
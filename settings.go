@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Flags that may change while running, when the config file is
+// reloaded, are kept behind atomics and read with get(), since
+// requests read them while a reload sets them.  Every other flag is
+// a plain variable and only set at startup.
+
+// A reloadableValue is a flag a reload may change.
+type reloadableValue interface {
+	flag.Value
+	reloadable()
+}
+
+type durationSetting int64
+
+func durationFlag(name string, value time.Duration, usage string) *durationSetting {
+	s := new(durationSetting)
+	s.set(value)
+	flag.Var(s, name, usage)
+	return s
+}
+
+func (s *durationSetting) get() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(s)))
+}
+
+func (s *durationSetting) set(d time.Duration) {
+	atomic.StoreInt64((*int64)(s), int64(d))
+}
+
+func (s *durationSetting) Set(v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	s.set(d)
+	return nil
+}
+
+func (s *durationSetting) String() string { return s.get().String() }
+func (s *durationSetting) reloadable()    {}
+
+type intSetting int64
+
+func intFlag(name string, value int, usage string) *intSetting {
+	s := new(intSetting)
+	s.set(value)
+	flag.Var(s, name, usage)
+	return s
+}
+
+func (s *intSetting) get() int {
+	return int(atomic.LoadInt64((*int64)(s)))
+}
+
+func (s *intSetting) set(n int) {
+	atomic.StoreInt64((*int64)(s), int64(n))
+}
+
+func (s *intSetting) Set(v string) error {
+	n, err := strconv.ParseInt(v, 0, strconv.IntSize)
+	if err != nil {
+		return err
+	}
+	s.set(int(n))
+	return nil
+}
+
+func (s *intSetting) String() string { return strconv.Itoa(s.get()) }
+func (s *intSetting) reloadable()    {}
+
+type stringSetting struct {
+	v atomic.Value
+}
+
+func stringFlag(name string, value string, usage string) *stringSetting {
+	s := &stringSetting{}
+	s.set(value)
+	flag.Var(s, name, usage)
+	return s
+}
+
+func (s *stringSetting) get() string {
+	v, _ := s.v.Load().(string)
+	return v
+}
+
+func (s *stringSetting) set(v string) {
+	s.v.Store(v)
+}
+
+func (s *stringSetting) Set(v string) error {
+	s.set(v)
+	return nil
+}
+
+func (s *stringSetting) String() string { return s.get() }
+func (s *stringSetting) reloadable()    {}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A sharded database keeps its documents in one file per day or week
+// under a directory named after the database, e.g. db/2024-06-01.couch.
+// Dropping old data is then just a matter of deleting old shards.
+
+const (
+	shardDay  = "day"
+	shardWeek = "week"
+)
+
+const shardLayout = "2006-01-02"
+
+var errBatchSpansShards = errors.New("batch spans more than one shard")
+
+func validShardPeriod(p string) error {
+	switch p {
+	case "", shardDay, shardWeek:
+		return nil
+	}
+	return fmt.Errorf("unknown shard period: %v", p)
+}
+
+func dbShardPeriod(dbname string) string {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return ""
+	}
+	return m.Shard
+}
+
+// shardStart truncates t to the start of the shard containing it.
+// Weekly shards start on Monday.
+func shardStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if period == shardWeek {
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+func shardEnd(period string, start time.Time) time.Time {
+	if period == shardWeek {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func shardName(dbname string, start time.Time) string {
+	return dbname + "/" + start.Format(shardLayout)
+}
+
+func shardDir(dbname string) string {
+	return filepath.Join(*dbRoot, dbname)
+}
+
+var shardLock = sync.Mutex{}
+var knownShards = map[string]bool{}
+
+// ensureShard creates a shard file (in its parent's format) the first
+// time it's written to.
+func ensureShard(dbname, shard string) error {
+	shardLock.Lock()
+	defer shardLock.Unlock()
+	if knownShards[shard] {
+		return nil
+	}
+
+	path := dbPath(shard)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(shardDir(dbname), 0777); err != nil {
+			return err
+		}
+		if err := dbcreate(path); err != nil {
+			return err
+		}
+		err = storeMeta(shard, dbMeta{Format: dbFormat(dbname).Version})
+		if err != nil {
+			return err
+		}
+	}
+	knownShards[shard] = true
+	return nil
+}
+
+func forgetShard(shard string) {
+	shardLock.Lock()
+	defer shardLock.Unlock()
+	delete(knownShards, shard)
+}
+
+// shardFor returns the shard a key is stored in, or "" if the
+// database isn't sharded.  Keys that aren't timestamps stay in the
+// parent database.
+func shardFor(dbname, k string, create bool) (string, error) {
+	period := dbShardPeriod(dbname)
+	if period == "" {
+		return "", nil
+	}
+	t, err := parseCanonicalTime(k)
+	if err != nil {
+		return "", nil
+	}
+	start := shardStart(period, t).Format(shardLayout)
+	switch {
+	case !isArchived(dbname, start):
+	case create:
+		err = unarchive(dbname, start)
+	default:
+		err = fetchedShards.ensureLocal(dbname, start)
+	}
+	if err != nil {
+		return "", err
+	}
+	shard := dbname + "/" + start
+	if create {
+		err = ensureShard(dbname, shard)
+	}
+	return shard, err
+}
+
+// dbShards lists the start dates of a database's shards, local or
+// archived, oldest first.
+func dbShards(dbname string) []string {
+	seen := map[string]bool{}
+	if m, err := loadMeta(dbname); err == nil {
+		for _, a := range m.Archived {
+			seen[a] = true
+		}
+	}
+	files, _ := ioutil.ReadDir(shardDir(dbname))
+	for _, f := range files {
+		n := f.Name()
+		if strings.HasSuffix(n, dbExt) {
+			seen[strings.TrimSuffix(n, dbExt)] = true
+		}
+	}
+	rv := make([]string, 0, len(seen))
+	for s := range seen {
+		rv = append(rv, s)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// shardsInRange returns the shards that may hold keys in [from, to).
+// Empty bounds are open.
+// partitionShards splits a database's shards into those that may hold
+// keys in range and those pruned by it.
+func partitionShards(dbname, from, to string) (scanned, pruned []string) {
+	period := dbShardPeriod(dbname)
+	scanned, pruned = []string{}, []string{}
+	for _, s := range dbShards(dbname) {
+		start, err := time.Parse(shardLayout, s)
+		if err != nil {
+			continue
+		}
+		switch {
+		case to != "" && parseKey(to) >= 0 && start.UnixNano() >= parseKey(to),
+			from != "" && parseKey(from) >= 0 &&
+				shardEnd(period, start).UnixNano() <= parseKey(from):
+			pruned = append(pruned, s)
+		default:
+			scanned = append(scanned, s)
+		}
+	}
+	return scanned, pruned
+}
+
+func shardsInRange(dbname, from, to string) []string {
+	scanned, _ := partitionShards(dbname, from, to)
+	rv := []string{}
+	for _, s := range scanned {
+		if isArchived(dbname, s) {
+			if err := fetchedShards.ensureLocal(dbname, s); err != nil {
+				log.Printf("Error fetching archived shard %v/%v: %v",
+					dbname, s, err)
+			}
+		}
+		rv = append(rv, dbname+"/"+s)
+	}
+	return rv
+}
+
+func dropShard(dbname, shard string) error {
+	name := dbname + "/" + shard
+	dbRemoveConn(name)
+	forgetShard(name)
+	fetchedShards.forget(name)
+	dropQuota(name)
+
+	archived := isArchived(dbname, shard)
+	if archived {
+		if archive != nil {
+			if err := archive.remove(archiveObjectName(name)); err != nil {
+				return err
+			}
+		}
+		if err := setArchived(dbname, shard, false); err != nil {
+			return err
+		}
+	}
+	err := os.Remove(dbPath(name))
+	if err != nil && !(archived && os.IsNotExist(err)) {
+		return err
+	}
+	return dropMeta(name)
+}
+
+func dropShards(dbname string) error {
+	for _, s := range dbShards(dbname) {
+		dropShard(dbname, s)
+	}
+	return os.RemoveAll(shardDir(dbname))
+}
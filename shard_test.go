@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShardStart(t *testing.T) {
+	ts := time.Date(2024, 6, 1, 13, 14, 15, 0, time.UTC) // a Saturday
+	if got := shardStart(shardDay, ts).Format(shardLayout); got != "2024-06-01" {
+		t.Errorf("Expected day shard 2024-06-01, got %v", got)
+	}
+	if got := shardStart(shardWeek, ts).Format(shardLayout); got != "2024-05-27" {
+		t.Errorf("Expected week shard 2024-05-27, got %v", got)
+	}
+}
+
+func TestShardsInRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	metaCache["sharded"] = dbMeta{Format: 1, Shard: shardDay}
+	defer delete(metaCache, "sharded")
+
+	os.MkdirAll(filepath.Join(dir, "sharded"), 0777)
+	for _, s := range []string{"2024-06-01", "2024-06-02", "2024-06-03"} {
+		ioutil.WriteFile(filepath.Join(dir, "sharded", s+dbExt), nil, 0666)
+	}
+
+	tests := []struct {
+		from, to string
+		exp      []string
+	}{
+		{"", "", []string{"2024-06-01", "2024-06-02", "2024-06-03"}},
+		{"2024-06-02T00:00:00Z", "", []string{"2024-06-02", "2024-06-03"}},
+		{"2024-06-01T12:00:00Z", "2024-06-02T00:00:00Z", []string{"2024-06-01"}},
+		{"2024-06-04T00:00:00Z", "", []string{}},
+	}
+	for _, test := range tests {
+		exp := []string{}
+		for _, s := range test.exp {
+			exp = append(exp, "sharded/"+s)
+		}
+		got := shardsInRange("sharded", test.from, test.to)
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("From %q to %q expected %v, got %v",
+				test.from, test.to, exp, got)
+		}
+	}
+
+	scanned, pruned := partitionShards("sharded", "2024-06-02T00:00:00Z",
+		"2024-06-03T00:00:00Z")
+	if !reflect.DeepEqual(scanned, []string{"2024-06-02"}) ||
+		!reflect.DeepEqual(pruned, []string{"2024-06-01", "2024-06-03"}) {
+		t.Errorf("Expected to scan only 2024-06-02, got %v, pruning %v",
+			scanned, pruned)
+	}
+
+	for _, n := range dblist(dir) {
+		if filepath.Dir(n) != "." {
+			t.Errorf("Expected shards not to be listed, got %v", n)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Queries taking at least -slowQueryTime are recorded with their
+// parameters, how many documents they scanned and where the time
+// went.  The most recent -slowLogSize are kept for GET /_slowlog
+// (newest first), and with -slowLog, every one is appended to a file
+// as a JSON line.
+//
+// A local query's phases are queued (waiting for a query worker),
+// walk (reading keys and handing out chunks, which are reduced
+// meanwhile), first_result, and drain (reducing the chunks still
+// outstanding when the walk finished).  Federated and sharded
+// queries are only timed as a whole.
+
+var slowQueryTime = durationFlag("slowQueryTime", 5*time.Second,
+	"Queries taking at least this long go in the slow log (0 to disable)")
+var slowLogFile = flag.String("slowLog", "",
+	"File to append slow queries to as JSON lines")
+var slowLogSize = flag.Int("slowLogSize", 100,
+	"How many slow queries GET /_slowlog keeps")
+
+type slowQuery struct {
+	Time    time.Time          `json:"time"`
+	DB      string             `json:"db"`
+	Plan    string             `json:"plan"`
+	Params  url.Values         `json:"params"`
+	TotalMS float64            `json:"total_ms"`
+	Keys    int32              `json:"keys_scanned"`
+	Chunks  int32              `json:"chunks"`
+	Phases  map[string]float64 `json:"phases,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+var slowLock = sync.Mutex{}
+var slowQueries = []slowQuery{}
+var slowFile *os.File
+
+// recordSlowQuery logs a query if it took long enough.
+func recordSlowQuery(s slowQuery, took time.Duration) {
+	if slowQueryTime.get() <= 0 || took < slowQueryTime.get() {
+		return
+	}
+	s.Time = time.Now().UTC()
+	s.TotalMS = millis(took)
+
+	slowLock.Lock()
+	defer slowLock.Unlock()
+	slowQueries = append(slowQueries, s)
+	if n := len(slowQueries) - *slowLogSize; n > 0 {
+		slowQueries = append([]slowQuery{}, slowQueries[n:]...)
+	}
+
+	if *slowLogFile == "" {
+		return
+	}
+	b, err := json.Marshal(s)
+	if err == nil && slowFile == nil {
+		slowFile, err = os.OpenFile(*slowLogFile,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if err == nil {
+		_, err = slowFile.Write(append(b, '\n'))
+	}
+	if err != nil {
+		log.Printf("Error writing to the slow log: %v", err)
+	}
+}
+
+func getSlowLog(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	slowLock.Lock()
+	rv := make([]slowQuery, 0, len(slowQueries))
+	for i := len(slowQueries) - 1; i >= 0; i-- {
+		rv = append(rv, slowQueries[i])
+	}
+	slowLock.Unlock()
+	mustEncode(200, w, map[string]interface{}{
+		"threshold": slowQueryTime.String(),
+		"queries":   rv,
+	})
+}
+
+func deleteSlowLog(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	slowLock.Lock()
+	slowQueries = []slowQuery{}
+	slowLock.Unlock()
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
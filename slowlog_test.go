@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+func TestSlowLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-slowlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration, f string, n int) {
+		slowQueryTime.set(d)
+		*slowLogFile, *slowLogSize = f, n
+		slowQueries = []slowQuery{}
+		if slowFile != nil {
+			slowFile.Close()
+			slowFile = nil
+		}
+	}(slowQueryTime.get(), *slowLogFile, *slowLogSize)
+	slowQueryTime.set(time.Second)
+	*slowLogFile = filepath.Join(dir, "slow.log")
+	*slowLogSize = 2
+
+	params := url.Values{"ptr": {"/x"}, "reducer": {"avg"}}
+	recordSlowQuery(slowQuery{DB: "fast", Params: params}, time.Millisecond)
+	for _, db := range []string{"a", "b", "c"} {
+		recordSlowQuery(slowQuery{DB: db, Plan: "scan", Params: params,
+			Phases: map[string]float64{"walk": 1500}}, 2*time.Second)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_slowlog", nil)
+	getSlowLog(nil, w, req)
+	got := struct {
+		Queries []slowQuery `json:"queries"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", w.Body, err)
+	}
+	if len(got.Queries) != 2 || got.Queries[0].DB != "c" ||
+		got.Queries[1].DB != "b" || got.Queries[0].TotalMS != 2000 ||
+		got.Queries[0].Params.Get("reducer") != "avg" {
+		t.Errorf("Expected the last two slow queries, newest first, got %s",
+			w.Body)
+	}
+
+	data, err := ioutil.ReadFile(*slowLogFile)
+	if err != nil {
+		t.Fatalf("Error reading the slow log: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 {
+		t.Errorf("Expected every slow query in the file, got %s", data)
+	}
+
+	defer func(a string) { *adminAuth = a }(*adminAuth)
+	*adminAuth = "sekrit"
+	for _, h := range []func([]string, http.ResponseWriter, *http.Request){
+		getSlowLog, deleteSlowLog} {
+		w := httptest.NewRecorder()
+		h(nil, w, req)
+		if w.Code != 401 {
+			t.Errorf("Expected 401 without credentials, got %v", w.Code)
+		}
+	}
+	if len(slowQueries) == 0 {
+		t.Errorf("Expected the slow log to be kept without credentials")
+	}
+
+	req.Header.Set("Authorization", "sekrit")
+	deleteSlowLog(nil, httptest.NewRecorder(), req)
+	if len(slowQueries) != 0 {
+		t.Errorf("Expected the slow log to be cleared, got %v", slowQueries)
+	}
+}
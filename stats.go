@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Things counted by the stats collector.
+const (
+	statIngest = iota
+	statQuery
+	statError
+	statClientError
+	numStats
+)
+
+// Rolling windows reported by /_stats.
+var statsWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+const statsSeconds = 15 * 60
+
+// How many recent flush timings to keep for percentiles.
+const maxFlushSamples = 4096
+
+type statsBucket struct {
+	sec    int64
+	counts [numStats]int64
+}
+
+type flushSample struct {
+	at time.Time
+	d  time.Duration
+}
+
+// A statsCollector counts events in one second buckets, enough to
+// cover the longest window.
+type statsCollector struct {
+	mu      sync.Mutex
+	buckets [statsSeconds]statsBucket
+	flushes []flushSample
+	next    int
+}
+
+var serverStatsCollector = &statsCollector{}
+
+func (s *statsCollector) addAt(now time.Time, stat int, n int64) {
+	sec := now.Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[sec%statsSeconds]
+	if b.sec != sec {
+		*b = statsBucket{sec: sec}
+	}
+	b.counts[stat] += n
+}
+
+func (s *statsCollector) add(stat int, n int64) {
+	s.addAt(time.Now(), stat, n)
+}
+
+func (s *statsCollector) flushedAt(now time.Time, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.flushes) < maxFlushSamples {
+		s.flushes = append(s.flushes, flushSample{now, d})
+	} else {
+		s.flushes[s.next] = flushSample{now, d}
+		s.next = (s.next + 1) % maxFlushSamples
+	}
+}
+
+func (s *statsCollector) flushed(d time.Duration) {
+	s.flushedAt(time.Now(), d)
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)-1))
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+func (s *statsCollector) window(now time.Time,
+	d time.Duration) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var counts [numStats]int64
+	oldest := now.Add(-d).Unix()
+	for _, b := range s.buckets {
+		if b.sec > oldest && b.sec <= now.Unix() {
+			for i, c := range b.counts {
+				counts[i] += c
+			}
+		}
+	}
+	lats := []time.Duration{}
+	for _, f := range s.flushes {
+		if now.Sub(f.at) < d {
+			lats = append(lats, f.d)
+		}
+	}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+
+	secs := d.Seconds()
+	return map[string]interface{}{
+		"ingest_rate":   float64(counts[statIngest]) / secs,
+		"query_rate":    float64(counts[statQuery]) / secs,
+		"errors":        counts[statError],
+		"client_errors": counts[statClientError],
+		"flush_latency_ms": map[string]interface{}{
+			"count": len(lats),
+			"p50":   percentile(lats, 0.5),
+			"p90":   percentile(lats, 0.9),
+			"p99":   percentile(lats, 0.99),
+		},
+	}
+}
+
+func (s *statsCollector) report(now time.Time) map[string]interface{} {
+	rv := map[string]interface{}{}
+	for _, w := range statsWindows {
+		rv[w.name] = s.window(now, w.d)
+	}
+	return rv
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsWindows(t *testing.T) {
+	s := &statsCollector{}
+	now := time.Unix(1000000, 0)
+
+	s.addAt(now, statIngest, 60)
+	s.addAt(now.Add(-2*time.Minute), statIngest, 240)
+	s.addAt(now.Add(-30*time.Second), statError, 1)
+	s.addAt(now.Add(-20*time.Minute), statIngest, 1000)
+	for i := 1; i <= 10; i++ {
+		s.flushedAt(now, time.Duration(i)*time.Millisecond)
+	}
+	s.flushedAt(now.Add(-10*time.Minute), time.Second)
+
+	rep := s.report(now)
+	m1 := rep["1m"].(map[string]interface{})
+	if m1["ingest_rate"] != 1.0 || m1["errors"] != int64(1) {
+		t.Errorf("Unexpected 1m stats: %v", m1)
+	}
+	m5 := rep["5m"].(map[string]interface{})
+	if m5["ingest_rate"] != 1.0 {
+		t.Errorf("Unexpected 5m ingest rate: %v", m5["ingest_rate"])
+	}
+
+	lat := m1["flush_latency_ms"].(map[string]interface{})
+	if lat["count"] != 10 || lat["p50"] != 5.0 || lat["p99"] != 9.0 {
+		t.Errorf("Unexpected 1m flush latency: %v", lat)
+	}
+	lat = rep["15m"].(map[string]interface{})["flush_latency_ms"].(map[string]interface{})
+	if lat["count"] != 11 || lat["p99"] != 10.0 {
+		t.Errorf("Unexpected 15m flush latency: %v", lat)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Tenants let teams share a server.  A tenant is created with PUT
+// /_tenants/<name>, e.g.
+//
+//	{"auth": ["Bearer t3am"], "max_dbs": 10,
+//	 "max_size": 1073741824, "max_rate": 1000}
+//
+// Its databases are then reached as /<tenant>/<db>/... with one of
+// its credentials, and /<tenant>/_all_dbs lists them.  They're stored
+// as <tenant>:<db>, a name no request can use directly, so a tenant
+// only ever sees its own.  max_dbs limits how many databases it may
+// have, max_size how many bytes their files may take, and max_rate
+// how many documents per second it may write; zero is unlimited.
+//
+// With -adminAuth set, /_tenants itself requires that credential.
+
+const tenantSep = ":"
+
+var adminAuth = flag.String("adminAuth", "",
+	"Authorization header required to manage tenants (empty for none)")
+
+var errRateLimited = errors.New("tenant write rate exceeded")
+
+var tenantName = regexp.MustCompile("^[a-z][a-z0-9_-]*$")
+
+type tenantSpec struct {
+	Auth    []string `json:"auth"`
+	MaxDBs  int      `json:"max_dbs,omitempty"`
+	MaxSize int64    `json:"max_size,omitempty"`
+	MaxRate float64  `json:"max_rate,omitempty"`
+}
+
+func (t tenantSpec) validate() error {
+	if t.MaxDBs < 0 || t.MaxSize < 0 || t.MaxRate < 0 {
+		return errors.New("limits can't be negative")
+	}
+	return nil
+}
+
+// tenantState is what's enforced for a tenant as it writes.
+type tenantState struct {
+	tokens  float64
+	last    time.Time
+	used    int64
+	checked time.Time
+}
+
+// How often a tenant's disk use is measured as it writes.
+const tenantUsageInterval = time.Second
+
+var tenantLock = sync.Mutex{}
+var tenants = map[string]tenantSpec{}
+var tenantStates = map[string]*tenantState{}
+
+func tenantsPath() string {
+	return filepath.Join(*dbRoot, "_tenants.json")
+}
+
+func loadTenants() error {
+	data, err := ioutil.ReadFile(tenantsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tenantLock.Lock()
+	defer tenantLock.Unlock()
+	return json.Unmarshal(data, &tenants)
+}
+
+// storeTenants saves the registry.  tenantLock must be held.
+func storeTenants() error {
+	data, err := json.Marshal(tenants)
+	if err != nil {
+		return err
+	}
+	fn := tenantsPath()
+	if err := ioutil.WriteFile(fn+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func lookupTenant(name string) (tenantSpec, bool) {
+	tenantLock.Lock()
+	defer tenantLock.Unlock()
+	t, ok := tenants[name]
+	return t, ok
+}
+
+// tenantOf is the tenant owning a database, if any.
+func tenantOf(dbname string) string {
+	if i := strings.Index(dbname, tenantSep); i > 0 {
+		return dbname[:i]
+	}
+	return ""
+}
+
+// tenantDBs lists a tenant's databases by their full names.
+func tenantDBs(tenant string) []string {
+	rv := []string{}
+	for _, n := range dblist(*dbRoot) {
+		if tenantOf(n) == tenant {
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+// tenantSize is the space taken by a tenant's files, shards included.
+func tenantSize(tenant string) int64 {
+	matches, _ := filepath.Glob(filepath.Join(*dbRoot, tenant+tenantSep+"*"))
+	size := int64(0)
+	for _, m := range matches {
+		filepath.Walk(m, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+type tenantKey struct{}
+
+func requestTenant(req *http.Request) string {
+	t, _ := req.Context().Value(tenantKey{}).(string)
+	return t
+}
+
+// routeTenant checks a request under a tenant against its credentials
+// and rewrites it to the database names it stores.
+func routeTenant(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if strings.Contains(parts[0], tenantSep) {
+		emitError(400, w, "illegal_database_name",
+			fmt.Sprintf("%q is reserved for tenants", tenantSep))
+		return req, false
+	}
+	t, ok := lookupTenant(parts[0])
+	if !ok {
+		return req, true
+	}
+	// Browsers don't send credentials with CORS preflights.
+	if len(t.Auth) > 0 && req.Method != "OPTIONS" && !hasCredential(req, t.Auth) {
+		emitError(401, w, "Unauthorized", "tenant credentials required")
+		return req, false
+	}
+
+	rest := ""
+	if len(parts) > 1 {
+		rest = parts[1]
+	}
+	u := *req.URL
+	switch {
+	case rest == "" || rest == "_all_dbs":
+		u.Path = "/_all_dbs"
+	case strings.HasPrefix(rest, "_"):
+		emitError(403, w, "Forbidden", "not available to tenants")
+		return req, false
+	default:
+		u.Path = "/" + parts[0] + tenantSep + rest
+	}
+	req = req.WithContext(context.WithValue(req.Context(), tenantKey{},
+		parts[0]))
+	req.URL = &u
+	return req, true
+}
+
+func hasCredential(req *http.Request, allowed []string) bool {
+	token := req.Header.Get("Authorization")
+	for _, a := range allowed {
+		if token == a {
+			return true
+		}
+	}
+	return false
+}
+
+// scopedDB resolves a database named in a request parameter, which
+// under a tenant is one of its own.  It returns "" for names that
+// can't be used.
+func scopedDB(req *http.Request, name string) string {
+	if strings.Contains(name, tenantSep) {
+		return ""
+	}
+	if t := requestTenant(req); t != "" {
+		return t + tenantSep + name
+	}
+	return name
+}
+
+// visibleDBs lists the databases a request may see, as it names them.
+func visibleDBs(req *http.Request) []string {
+	t := requestTenant(req)
+	rv := []string{}
+	for _, n := range dblist(*dbRoot) {
+		switch {
+		case t == "" && tenantOf(n) == "":
+			rv = append(rv, n)
+		case t != "" && tenantOf(n) == t:
+			rv = append(rv, strings.TrimPrefix(n, t+tenantSep))
+		}
+	}
+	return rv
+}
+
+// tenantCanCreate reports whether a database may be created under
+// its tenant's limit.
+func tenantCanCreate(dbname string) error {
+	tenant := tenantOf(dbname)
+	t, ok := lookupTenant(tenant)
+	if !ok || t.MaxDBs == 0 {
+		return nil
+	}
+	for _, n := range tenantDBs(tenant) {
+		if n == dbname {
+			return nil
+		}
+	}
+	if len(tenantDBs(tenant)) >= t.MaxDBs {
+		return fmt.Errorf("tenant %v may have at most %v databases",
+			tenant, t.MaxDBs)
+	}
+	return nil
+}
+
+// tenantAdmit accounts for n documents written to a database,
+// returning an error if its tenant is over a limit.
+func tenantAdmit(dbname string, n int, now time.Time) error {
+	tenant := tenantOf(dbname)
+	if tenant == "" {
+		return nil
+	}
+	t, ok := lookupTenant(tenant)
+	if !ok || (t.MaxRate == 0 && t.MaxSize == 0) {
+		return nil
+	}
+
+	tenantLock.Lock()
+	st := tenantStates[tenant]
+	if st == nil {
+		st = &tenantState{tokens: t.MaxRate, last: now}
+		tenantStates[tenant] = st
+	}
+	measure := t.MaxSize > 0 && now.Sub(st.checked) >= tenantUsageInterval
+	if measure {
+		st.checked = now
+	}
+	tenantLock.Unlock()
+
+	// Measure outside the lock; it walks the tenant's files.
+	if measure {
+		used := tenantSize(tenant)
+		tenantLock.Lock()
+		st.used = used
+		tenantLock.Unlock()
+	}
+
+	tenantLock.Lock()
+	defer tenantLock.Unlock()
+	if t.MaxSize > 0 && st.used >= t.MaxSize {
+		return errQuotaExceeded
+	}
+	if t.MaxRate > 0 {
+		st.tokens += now.Sub(st.last).Seconds() * t.MaxRate
+		if st.tokens > t.MaxRate {
+			st.tokens = t.MaxRate
+		}
+		st.last = now
+		// A batch bigger than a second's worth may go into debt,
+		// which later writes wait out.
+		if st.tokens <= 0 {
+			return errRateLimited
+		}
+		st.tokens -= float64(n)
+	}
+	return nil
+}
+
+// checkAdmin refuses server administration without -adminAuth.
+func checkAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if *adminAuth == "" || req.Header.Get("Authorization") == *adminAuth {
+		return true
+	}
+	emitError(401, w, "Unauthorized", "admin credentials required")
+	return false
+}
+
+func listTenants(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	tenantLock.Lock()
+	names := make([]string, 0, len(tenants))
+	for n := range tenants {
+		names = append(names, n)
+	}
+	tenantLock.Unlock()
+	sort.Strings(names)
+	mustEncode(200, w, names)
+}
+
+func getTenant(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	t, ok := lookupTenant(parts[0])
+	if !ok {
+		emitError(404, w, "not_found", "no such tenant")
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{
+		"tenant": t,
+		"dbs":    len(tenantDBs(parts[0])),
+		"size":   tenantSize(parts[0]),
+	})
+}
+
+func putTenant(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	name := parts[0]
+	t := tenantSpec{}
+	err := json.NewDecoder(req.Body).Decode(&t)
+	if err == nil {
+		err = t.validate()
+	}
+	if err == nil && !tenantName.MatchString(name) {
+		err = fmt.Errorf("invalid tenant name: %q", name)
+	}
+	if err != nil {
+		emitError(400, w, "Bad tenant", err.Error())
+		return
+	}
+	if _, err := os.Stat(dbPath(name)); err == nil ||
+		memDatabase(name) != nil || len(federationMembers(name)) > 0 {
+		emitError(409, w, "Conflict", "a database by that name exists")
+		return
+	}
+
+	tenantLock.Lock()
+	defer tenantLock.Unlock()
+	tenants[name] = t
+	delete(tenantStates, name)
+	if err := storeTenants(); err != nil {
+		emitError(500, w, "Error storing tenant", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+func deleteTenant(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	if n := len(tenantDBs(parts[0])); n > 0 {
+		emitError(409, w, "Conflict",
+			"tenant still has "+strconv.Itoa(n)+" databases")
+		return
+	}
+	tenantLock.Lock()
+	defer tenantLock.Unlock()
+	delete(tenants, parts[0])
+	delete(tenantStates, parts[0])
+	if err := storeTenants(); err != nil {
+		emitError(500, w, "Error storing tenants", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
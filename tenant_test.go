@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withTenant(name string, t tenantSpec) func() {
+	tenantLock.Lock()
+	tenants[name] = t
+	tenantLock.Unlock()
+	return func() {
+		tenantLock.Lock()
+		delete(tenants, name)
+		delete(tenantStates, name)
+		tenantLock.Unlock()
+	}
+}
+
+func TestRouteTenant(t *testing.T) {
+	defer withTenant("team", tenantSpec{Auth: []string{"secret"}})()
+
+	tests := []struct {
+		path, token, exp string
+		code             int
+	}{
+		{"/plain/_query", "", "/plain/_query", 0},
+		{"/team:db/_query", "", "", 400},
+		{"/team/db/_query", "", "", 401},
+		{"/team/db/_query", "wrong", "", 401},
+		{"/team/db/_query", "secret", "/team:db/_query", 0},
+		{"/team/db", "secret", "/team:db", 0},
+		{"/team/_all_dbs", "secret", "/_all_dbs", 0},
+		{"/team", "secret", "/_all_dbs", 0},
+		{"/team/_stats", "secret", "", 403},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", test.token)
+		}
+		w := httptest.NewRecorder()
+		req, ok := routeTenant(w, req)
+		switch {
+		case ok != (test.code == 0):
+			t.Errorf("%v: expected %v, got %v/%v", test.path, test.code,
+				ok, w.Code)
+		case !ok && w.Code != test.code:
+			t.Errorf("%v: expected %v, got %v", test.path, test.code, w.Code)
+		case ok && req.URL.Path != test.exp:
+			t.Errorf("%v: expected %v, got %v", test.path, test.exp,
+				req.URL.Path)
+		}
+	}
+}
+
+func TestScopedDB(t *testing.T) {
+	defer withTenant("team", tenantSpec{})()
+
+	plain, _ := http.NewRequest("GET", "/x/_query", nil)
+	if got := scopedDB(plain, "other"); got != "other" {
+		t.Errorf("Expected other, got %v", got)
+	}
+	if got := scopedDB(plain, "team:other"); got != "" {
+		t.Errorf("Expected tenant databases refused, got %v", got)
+	}
+
+	req, _ := http.NewRequest("GET", "/team/x/_query", nil)
+	req, _ = routeTenant(httptest.NewRecorder(), req)
+	if got := scopedDB(req, "other"); got != "team:other" {
+		t.Errorf("Expected team:other, got %v", got)
+	}
+}
+
+func TestTenantRate(t *testing.T) {
+	defer withTenant("team", tenantSpec{MaxRate: 10})()
+
+	now := time.Now()
+	if err := tenantAdmit("plain", 1000, now); err != nil {
+		t.Errorf("Expected databases outside tenants unlimited, got %v", err)
+	}
+	if err := tenantAdmit("team:db", 15, now); err != nil {
+		t.Errorf("Expected a burst to be admitted, got %v", err)
+	}
+	if err := tenantAdmit("team:db", 1, now); err != errRateLimited {
+		t.Errorf("Expected rate limiting, got %v", err)
+	}
+	later := now.Add(time.Second)
+	if err := tenantAdmit("team:db/2012-08-10", 1, later); err != nil {
+		t.Errorf("Expected writes allowed after a second, got %v", err)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -103,14 +105,105 @@ func parseCanonicalTime(in string) (time.Time, error) {
 		hour, minute, second, nsec, time.UTC), nil
 }
 
+// epochUnits are the nanoseconds in each unit epoch times may be
+// given in with ts_format.
+var epochUnits = map[string]int64{
+	"s":  1e9,
+	"ms": 1e6,
+	"us": 1e3,
+	"µs": 1e3,
+	"ns": 1,
+}
+
+// parseTimeFormat parses an epoch time in the named unit, or any time
+// parseTime understands if format is empty.
+func parseTimeFormat(in, format string) (time.Time, error) {
+	if format == "" {
+		return parseTime(in)
+	}
+	mult, ok := epochUnits[format]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown timestamp format: %v", format)
+	}
+	whole, frac := in, ""
+	if i := strings.IndexByte(in, '.'); i >= 0 {
+		whole, frac = in[:i], in[i+1:]
+	}
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return time.Time{}, errUnparseableTimestamp
+	}
+	ns := n * mult
+	if frac != "" {
+		// Work in billionths of the unit to avoid float rounding.
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		f, err := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil {
+			return time.Time{}, errUnparseableTimestamp
+		}
+		if strings.HasPrefix(whole, "-") {
+			f = -f
+		}
+		ns += f * mult / 1e9
+	}
+	return time.Unix(0, ns), nil
+}
+
+// relativeUnits are the units allowed in relative times.
+var relativeUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+var relativeTerm = regexp.MustCompile(`^([+-])([0-9]+)(ms|s|m|h|d|w)`)
+
+// parseRelativeTime parses times relative to now, e.g. now, now-6h or
+// now-1d+30m.
+func parseRelativeTime(in string, now time.Time) (time.Time, error) {
+	if !strings.HasPrefix(in, "now") {
+		return time.Time{}, errUnparseableTimestamp
+	}
+	rest := in[3:]
+	for rest != "" {
+		m := relativeTerm.FindStringSubmatch(rest)
+		if m == nil {
+			return time.Time{}, errUnparseableTimestamp
+		}
+		n, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		d := time.Duration(n) * relativeUnits[m[3]]
+		if m[1] == "-" {
+			d = -d
+		}
+		now = now.Add(d)
+		rest = rest[len(m[0]):]
+	}
+	return now, nil
+}
+
 func parseTime(in string) (time.Time, error) {
+	if strings.HasPrefix(in, "now") {
+		return parseRelativeTime(in, time.Now())
+	}
+
 	// First, try a few numerics
 	n, err := strconv.ParseInt(in, 10, 64)
 	if err == nil {
 		switch {
-		case n > int64(math.MaxInt32)*1000:
+		case n > int64(math.MaxInt32)*1e6:
 			// nanosecond timestamps
 			return time.Unix(n/1e9, n%1e9), nil
+		case n > int64(math.MaxInt32)*1000:
+			// microsecond timestamps
+			return time.Unix(n/1e6, (n%1e6)*1000), nil
 		case n > int64(math.MaxInt32):
 			// millisecond timestamps
 			return time.Unix(n/1000, (n%1000)*1e6), nil
@@ -30,6 +30,7 @@ func TestTimeParsing(t *testing.T) {
 		exp   string
 	}{
 		{"1346189075374651880", exampleTimeString},
+		{"1346189075374651", "2012-08-28T21:24:35.374651Z"},
 		{"1346189075374", milliAccuracy},
 		{"1346189075", secondAccuracy},
 		{"2012-08-28T21:24:35.37465188Z", exampleTimeString},
@@ -145,3 +146,61 @@ func BenchmarkParseTimeIntMillis(b *testing.B) {
 func BenchmarkParseTimeIntSecs(b *testing.B) {
 	benchTimeParsing(b, "1346189075")
 }
+
+func TestRelativeTimeParsing(t *testing.T) {
+	tests := []struct {
+		input string
+		exp   time.Duration
+	}{
+		{"now", 0},
+		{"now-6h", -6 * time.Hour},
+		{"now+90s", 90 * time.Second},
+		{"now-1d+30m", -24*time.Hour + 30*time.Minute},
+		{"now-2w", -14 * 24 * time.Hour},
+	}
+	for _, test := range tests {
+		got, err := parseRelativeTime(test.input, exampleTime)
+		if err != nil {
+			t.Errorf("Error parsing %v: %v", test.input, err)
+			continue
+		}
+		if d := got.Sub(exampleTime); d != test.exp {
+			t.Errorf("Expected %v to be now%+v, got now%+v",
+				test.input, test.exp, d)
+		}
+	}
+
+	for _, bad := range []string{"now-", "now-6", "now*2h", "now-6y", "then"} {
+		if _, err := parseRelativeTime(bad, exampleTime); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestTimeFormatParsing(t *testing.T) {
+	tests := []struct {
+		input, format, exp string
+	}{
+		{"1346189075", "s", secondAccuracy},
+		{"1346189075.374", "s", milliAccuracy},
+		{"1346189075374", "ms", milliAccuracy},
+		{"1346189075374651", "us", "2012-08-28T21:24:35.374651Z"},
+		{"1346189075374651880", "ns", exampleTimeString},
+		{secondAccuracy, "", secondAccuracy},
+	}
+	for _, test := range tests {
+		got, err := parseTimeFormat(test.input, test.format)
+		if err != nil {
+			t.Errorf("Error parsing %v as %v: %v", test.input, test.format, err)
+			continue
+		}
+		if s := got.UTC().Format(time.RFC3339Nano); s != test.exp {
+			t.Errorf("Expected %v as %v to be %v, got %v",
+				test.input, test.format, test.exp, s)
+		}
+	}
+
+	if _, err := parseTimeFormat("1346189075", "fortnights"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
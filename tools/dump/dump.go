@@ -104,8 +104,13 @@ func dump(wg *sync.WaitGroup, u url.URL, ch <-chan string) {
 func main() {
 	flag.Parse()
 
+	if *dbFile != "" {
+		dumpOffline()
+		return
+	}
+
 	if flag.NArg() == 0 {
-		log.Fatalf("Seriesly URL required")
+		log.Fatalf("Seriesly URL or -file required")
 	}
 
 	u, err := url.Parse(flag.Arg(0))
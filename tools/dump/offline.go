@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/go-jsonpointer"
+)
+
+// Offline dumps read a .couch file directly, for when the server is
+// down or unreachable.
+
+var (
+	dbFile = flag.String("file", "",
+		"dump this .couch file directly instead of from a server")
+	fromTime  = flag.String("from", "", "oldest timestamp to dump (-file only)")
+	toTime    = flag.String("to", "", "newest timestamp to dump (-file only)")
+	outFormat = flag.String("format", "ndjson",
+		"output format for -file: ndjson or csv")
+	csvFields = flag.String("fields", "",
+		"comma separated JSON pointers to emit as csv columns")
+)
+
+// timeRange is an inclusive range of document timestamps.  A zero
+// end is open.
+type timeRange struct {
+	from, to time.Time
+}
+
+func parseRange(from, to string) (timeRange, error) {
+	rv := timeRange{}
+	var err error
+	if from != "" {
+		if rv.from, err = time.Parse(time.RFC3339Nano, from); err != nil {
+			return rv, err
+		}
+	}
+	if to != "" {
+		rv.to, err = time.Parse(time.RFC3339Nano, to)
+	}
+	return rv, err
+}
+
+// contains reports whether a key is in range.  Older databases don't
+// use fixed width keys, so keys are compared by time, not bytes.
+func (r timeRange) contains(k string) bool {
+	if r.from.IsZero() && r.to.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339Nano, k)
+	if err != nil {
+		return false
+	}
+	if !r.from.IsZero() && t.Before(r.from) {
+		return false
+	}
+	return r.to.IsZero() || !t.After(r.to)
+}
+
+// A docWriter emits one document at a time.
+type docWriter interface {
+	write(k string, v []byte) error
+	flush() error
+}
+
+// ndjsonWriter writes the same lines as the server's _dump, so either
+// can be loaded back the same way.
+type ndjsonWriter struct {
+	w *bufio.Writer
+}
+
+func (n *ndjsonWriter) write(k string, v []byte) error {
+	_, err := fmt.Fprintf(n.w, `{"%s": %s}`+"\n", k, v)
+	return err
+}
+
+func (n *ndjsonWriter) flush() error {
+	return n.w.Flush()
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func newCSVWriter(out io.Writer, fields []string) (*csvWriter, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("csv output requires -fields")
+	}
+	c := &csvWriter{csv.NewWriter(out), fields}
+	return c, c.w.Write(append([]string{"timestamp"}, fields...))
+}
+
+func (c *csvWriter) write(k string, v []byte) error {
+	found, err := jsonpointer.FindMany(v, c.fields)
+	if err != nil {
+		return err
+	}
+	row := []string{k}
+	for _, f := range c.fields {
+		row = append(row, csvValue(found[f]))
+	}
+	return c.w.Write(row)
+}
+
+// csvValue unquotes strings and leaves anything else as JSON.
+func csvValue(b []byte) string {
+	s := ""
+	if json.Unmarshal(b, &s) == nil {
+		return s
+	}
+	return string(b)
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func newDocWriter(out io.Writer) (docWriter, error) {
+	switch *outFormat {
+	case "ndjson":
+		return &ndjsonWriter{bufio.NewWriter(out)}, nil
+	case "csv":
+		fields := []string{}
+		if *csvFields != "" {
+			fields = strings.Split(*csvFields, ",")
+		}
+		return newCSVWriter(out, fields)
+	}
+	return nil, fmt.Errorf("unknown output format: %v", *outFormat)
+}
+
+func dumpFile(path string, r timeRange, dw docWriter) (int, error) {
+	db, err := couchstore.Open(path, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	n := 0
+	err = db.WalkDocs("", func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo, doc *couchstore.Document) error {
+		if !r.contains(di.ID()) {
+			return nil
+		}
+		n++
+		return dw.write(di.ID(), doc.Value())
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, dw.flush()
+}
+
+func dumpOffline() {
+	r, err := parseRange(*fromTime, *toTime)
+	maybeFatal(err, "Error parsing range: %v", err)
+	dw, err := newDocWriter(os.Stdout)
+	maybeFatal(err, "%v", err)
+
+	start := time.Now()
+	n, err := dumpFile(*dbFile, r, dw)
+	maybeFatal(err, "Error dumping %v: %v", *dbFile, err)
+	vlog("Dumped %v documents from %v in %v", n, *dbFile, time.Since(start))
+}
@@ -3,13 +3,33 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	concurrency = flag.Int("j", 4, "number of concurrent senders")
+	batchSize   = flag.Int("batch", 500, "documents per bulk request")
+	rate        = flag.Float64("rate", 0,
+		"maximum documents per second (0 for unlimited)")
+	retries = flag.Int("retries", 5,
+		"how many times to retry a failed batch")
+	backoff = flag.Duration("backoff", 500*time.Millisecond,
+		"initial delay between retries, doubled each attempt")
+	progress = flag.Duration("progress", 5*time.Second,
+		"how often to report progress")
+)
+
+var sent, failed int64
+
 func maybeFatal(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -24,47 +44,137 @@ func setupDb(u string) {
 	res.Body.Close()
 }
 
-func sendOne(u, k string, body []byte) {
-	resp, err := http.DefaultClient.Post(u+"?ts="+k,
-		"application/json", bytes.NewReader(body))
+type batch map[string]*json.RawMessage
+
+// sendBatch posts a batch, reporting whether it's worth retrying and
+// how long the server asked us to wait.
+func sendBatch(u string, body []byte) (bool, time.Duration, error) {
+	res, err := http.Post(u+"/_bulk", "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return true, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 300 {
+		return false, 0, nil
+	}
+	wait := time.Duration(0)
+	if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		wait = time.Duration(s) * time.Second
+	}
+	return res.StatusCode >= 500, wait,
+		fmt.Errorf("HTTP error: %v", res.Status)
+}
+
+func sendWithRetry(u string, b batch) {
+	body, err := json.Marshal(b)
 	maybeFatal(err)
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-		log.Fatalf("HTTP Error on %v: %v", k, err)
+
+	delay := *backoff
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := sendBatch(u, body)
+		if err == nil {
+			atomic.AddInt64(&sent, int64(len(b)))
+			return
+		}
+		if !retry || attempt >= *retries {
+			log.Printf("Giving up on batch of %v: %v", len(b), err)
+			atomic.AddInt64(&failed, int64(len(b)))
+			return
+		}
+		if wait < delay {
+			wait = delay
+		}
+		log.Printf("Error sending batch (retrying in %v): %v", wait, err)
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+func sender(wg *sync.WaitGroup, u string, ch <-chan batch) {
+	defer wg.Done()
+	for b := range ch {
+		sendWithRetry(u, b)
 	}
 }
 
+// limiter paces documents to -rate per second.
+type limiter struct {
+	start time.Time
+	n     int
+}
+
+func (l *limiter) wait(n int) {
+	if *rate <= 0 {
+		return
+	}
+	l.n += n
+	due := l.start.Add(time.Duration(float64(l.n) / *rate * float64(time.Second)))
+	if d := due.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func report(start time.Time) {
+	s := atomic.LoadInt64(&sent)
+	log.Printf("Sent %v documents (%v failed), %.0f/s",
+		s, atomic.LoadInt64(&failed), float64(s)/time.Since(start).Seconds())
+}
+
 func main() {
-	u := os.Args[1]
+	flag.Parse()
+	if flag.NArg() < 1 {
+		log.Fatalf("Usage: load [flags] http://host:3133/db < docs.json")
+	}
+	u := flag.Arg(0)
 	setupDb(u)
 
-	t := time.Tick(5 * time.Second)
-	i := 0
+	start := time.Now()
+	ch := make(chan batch, *concurrency)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go sender(wg, u, ch)
+	}
+
+	t := time.NewTicker(*progress)
+	defer t.Stop()
+	lim := &limiter{start: start}
 
+	b := batch{}
 	d := json.NewDecoder(os.Stdin)
 	for {
-		kv := map[string]*json.RawMessage{}
-
+		kv := batch{}
 		err := d.Decode(&kv)
 		if err == io.EOF {
-			log.Printf("Done!")
 			break
 		}
 		maybeFatal(err)
 
 		for k, v := range kv {
-			body := []byte(*v)
-			sendOne(u, k, body)
+			b[k] = v
+		}
+		if len(b) >= *batchSize {
+			lim.wait(len(b))
+			ch <- b
+			b = batch{}
 		}
 
-		i++
 		select {
-		case <-t:
-			var k string
-			for k = range kv {
-			}
-			log.Printf("Processed %v items, latest was %v", i, k)
+		case <-t.C:
+			report(start)
 		default:
 		}
 	}
+	if len(b) > 0 {
+		ch <- b
+	}
+	close(ch)
+	wg.Wait()
+
+	report(start)
+	if failed > 0 {
+		os.Exit(1)
+	}
+	log.Printf("Done!")
 }
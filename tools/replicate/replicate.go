@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	verbose    = flag.Bool("v", false, "verbosity")
+	batchSize  = flag.Int("batch", 10000, "changes per batch")
+	compressed = flag.Bool("compress", true,
+		"transfer batches gzipped end to end")
+	checkpoint = flag.String("checkpoint", "",
+		"file to keep the replication position in")
+	since = flag.Uint64("since", 0,
+		"sequence to start from if there's no checkpoint")
+	poll = flag.Duration("poll", 0,
+		"keep replicating, checking for changes this often")
+)
+
+// The transport must not transparently decompress, or the batch
+// would be decompressed here only to be compressed again.
+var client = &http.Client{
+	Transport: &http.Transport{DisableCompression: true},
+}
+
+func init() {
+	log.SetFlags(log.Lmicroseconds)
+}
+
+func maybeFatal(err error, fmt string, args ...interface{}) {
+	if err != nil {
+		log.Fatalf(fmt, args...)
+	}
+}
+
+func vlog(s string, a ...interface{}) {
+	if *verbose {
+		log.Printf(s, a...)
+	}
+}
+
+func readCheckpoint() uint64 {
+	if *checkpoint == "" {
+		return *since
+	}
+	data, err := ioutil.ReadFile(*checkpoint)
+	if err != nil {
+		return *since
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	maybeFatal(err, "Invalid checkpoint in %v: %v", *checkpoint, err)
+	return seq
+}
+
+func writeCheckpoint(seq uint64) {
+	if *checkpoint == "" {
+		return
+	}
+	err := ioutil.WriteFile(*checkpoint, []byte(fmt.Sprintln(seq)), 0666)
+	maybeFatal(err, "Error writing checkpoint: %v", err)
+}
+
+func createTarget(u string) {
+	req, err := http.NewRequest("PUT", u, nil)
+	maybeFatal(err, "Error creating request: %v", err)
+	res, err := client.Do(req)
+	maybeFatal(err, "Error creating %v: %v", u, err)
+	res.Body.Close()
+}
+
+// replicateBatch streams one batch of changes from src into dest
+// without decoding it, returning the number of changes and the next
+// sequence.
+func replicateBatch(src, dest string, seq uint64) (int, uint64, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf(
+		"%v/_export_changes?since_seq=%d&limit=%d", src, seq, *batchSize), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if *compressed {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, 0, fmt.Errorf("HTTP error exporting: %v", res.Status)
+	}
+
+	req, err = http.NewRequest("POST", dest+"/_import_changes", res.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if enc := res.Header.Get("Content-Encoding"); enc != "" {
+		req.Header.Set("Content-Encoding", enc)
+	}
+	ires, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer ires.Body.Close()
+	if ires.StatusCode != 200 {
+		return 0, 0, fmt.Errorf("HTTP error importing: %v", ires.Status)
+	}
+
+	rv := struct {
+		Count   int    `json:"count"`
+		NextSeq uint64 `json:"next_seq"`
+	}{}
+	err = json.NewDecoder(ires.Body).Decode(&rv)
+	return rv.Count, rv.NextSeq, err
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		log.Fatalf("Usage: replicate [flags] http://src:3133/db http://dest:3133/db")
+	}
+	src := strings.TrimRight(flag.Arg(0), "/")
+	dest := strings.TrimRight(flag.Arg(1), "/")
+
+	createTarget(dest)
+
+	seq := readCheckpoint()
+	total := 0
+	for {
+		start := time.Now()
+		n, next, err := replicateBatch(src, dest, seq)
+		maybeFatal(err, "Error replicating from %v: %v", seq, err)
+		if n > 0 {
+			vlog("Replicated %v changes (%v to %v) in %v",
+				n, seq, next, time.Since(start))
+			total += n
+			seq = next
+			writeCheckpoint(seq)
+		}
+		if n < *batchSize {
+			if *poll == 0 {
+				break
+			}
+			time.Sleep(*poll)
+		}
+	}
+	log.Printf("Replicated %v changes, now at %v", total, seq)
+}
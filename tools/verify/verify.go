@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dustin/go-couchstore"
+)
+
+var (
+	verbose = flag.Bool("v", false, "report every bad document")
+	repair  = flag.String("repair", "",
+		"write the good documents to a new file at this path")
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:  %v [flags] file.couch\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+}
+
+func maybeFatal(err error, fmt string, args ...interface{}) {
+	if err != nil {
+		log.Fatalf(fmt, args...)
+	}
+}
+
+type report struct {
+	Docs       int    `json:"docs"`
+	Good       int    `json:"good"`
+	BadJSON    int    `json:"bad_json"`
+	BadKey     int    `json:"bad_key"`
+	OutOfOrder int    `json:"out_of_order"`
+	Unreadable bool   `json:"unreadable"`
+	Error      string `json:"error,omitempty"`
+	Repaired   int    `json:"repaired,omitempty"`
+}
+
+func (r report) ok() bool {
+	return r.Good == r.Docs && !r.Unreadable
+}
+
+func vlog(s string, a ...interface{}) {
+	if *verbose {
+		log.Printf(s, a...)
+	}
+}
+
+// verify walks every document, calling keep with each good one.
+// Keys that parse as times but sort before an earlier time are
+// counted out of order, though they're kept; older format databases
+// can have those legitimately.
+func verify(db *couchstore.Couchstore,
+	keep func(di *couchstore.DocInfo, doc *couchstore.Document) error) report {
+
+	r := report{}
+	var prev time.Time
+	err := db.WalkDocs("", func(d *couchstore.Couchstore,
+		di *couchstore.DocInfo, doc *couchstore.Document) error {
+
+		r.Docs++
+		k := di.ID()
+		t, err := time.Parse(time.RFC3339Nano, k)
+		if err != nil {
+			vlog("Bad key: %q", k)
+			r.BadKey++
+			return nil
+		}
+		if t.Before(prev) {
+			vlog("Out of order: %v", k)
+			r.OutOfOrder++
+		}
+		prev = t
+
+		if !json.Valid(doc.Value()) {
+			vlog("Bad JSON in %v", k)
+			r.BadJSON++
+			return nil
+		}
+		r.Good++
+		return keep(di, doc)
+	})
+	if err != nil {
+		r.Unreadable = true
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(64)
+	}
+
+	db, err := couchstore.Open(flag.Arg(0), false)
+	maybeFatal(err, "Error opening %v: %v", flag.Arg(0), err)
+	defer db.Close()
+
+	keep := func(*couchstore.DocInfo, *couchstore.Document) error {
+		return nil
+	}
+	var bulk couchstore.BulkWriter
+	if *repair != "" {
+		out, err := couchstore.Open(*repair, true)
+		maybeFatal(err, "Error creating %v: %v", *repair, err)
+		defer out.Close()
+		bulk = out.Bulk()
+		keep = func(di *couchstore.DocInfo, doc *couchstore.Document) error {
+			bulk.Set(couchstore.NewDocInfo(di.ID(), di.ContentMeta()),
+				couchstore.NewDocument(di.ID(), doc.Value()))
+			return nil
+		}
+	}
+
+	r := verify(db, keep)
+	if bulk != nil {
+		err := bulk.Commit()
+		maybeFatal(err, "Error writing %v: %v", *repair, err)
+		bulk.Close()
+		r.Repaired = r.Good
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	maybeFatal(err, "Error encoding report: %v", err)
+	fmt.Printf("%s\n", b)
+	if !r.ok() {
+		os.Exit(1)
+	}
+}
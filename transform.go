@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Transforms are applied to each reduced series, in time order, before
+// it's written, e.g. transform=delta,scale:0.001.  Several are applied
+// in the order given:
+//
+//	cumsum   the running total
+//	delta    the change from the previous value (null for the first)
+//	scale:f  multiplied by f
+//	abs      the absolute value
+//
+// Values that aren't numbers are left alone.  With groupby, each
+// group's values are a series of their own.  As results have to be
+// in order, they're held back until the query's done.
+
+type transform interface {
+	apply(v float64, st *transformState) (float64, bool)
+}
+
+// transformState is what a transform remembers of one series.
+type transformState struct {
+	sum  float64
+	prev float64
+	seen bool
+}
+
+type cumsumTransform struct{}
+
+func (cumsumTransform) apply(v float64, st *transformState) (float64, bool) {
+	st.sum += v
+	return st.sum, true
+}
+
+type deltaTransform struct{}
+
+func (deltaTransform) apply(v float64, st *transformState) (float64, bool) {
+	prev, seen := st.prev, st.seen
+	st.prev, st.seen = v, true
+	return v - prev, seen
+}
+
+type scaleTransform float64
+
+func (s scaleTransform) apply(v float64, st *transformState) (float64, bool) {
+	return v * float64(s), true
+}
+
+type absTransform struct{}
+
+func (absTransform) apply(v float64, st *transformState) (float64, bool) {
+	return math.Abs(v), true
+}
+
+// parseTransforms parses transform parameters, each of which may list
+// several, separated by commas.
+func parseTransforms(params []string) ([]transform, error) {
+	rv := []transform{}
+	for _, param := range params {
+		for _, s := range strings.Split(param, ",") {
+			switch {
+			case s == "cumsum":
+				rv = append(rv, cumsumTransform{})
+			case s == "delta":
+				rv = append(rv, deltaTransform{})
+			case s == "abs":
+				rv = append(rv, absTransform{})
+			case strings.HasPrefix(s, "scale:"):
+				f, err := strconv.ParseFloat(s[len("scale:"):], 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad scale in %q", s)
+				}
+				rv = append(rv, scaleTransform(f))
+			default:
+				return nil, fmt.Errorf("unknown transform: %q", s)
+			}
+		}
+	}
+	return rv, nil
+}
+
+// transformWriter collects results to hand on transformed, in key
+// order.
+type transformWriter struct {
+	rw         resultWriter
+	transforms []transform
+	pos        []*processOut
+}
+
+func (t *transformWriter) write(po *processOut) error {
+	t.pos = append(t.pos, po)
+	return nil
+}
+
+func (t *transformWriter) finish() error {
+	sort.SliceStable(t.pos, func(i, j int) bool {
+		return t.pos[i].key < t.pos[j].key
+	})
+	// One state per transform, for each series.
+	states := map[string][][]transformState{}
+	series := func(group string, vals []interface{}) []interface{} {
+		st := states[group]
+		for len(st) < len(vals) {
+			st = append(st, make([]transformState, len(t.transforms)))
+		}
+		states[group] = st
+		rv := make([]interface{}, len(vals))
+		for i, v := range vals {
+			rv[i] = t.apply(v, st[i])
+		}
+		return rv
+	}
+
+	for _, po := range t.pos {
+		// A copy, as the cache may hold the original.
+		out := *po
+		if po.groups != nil {
+			out.groups = map[string][]interface{}{}
+			for g, vals := range po.groups {
+				out.groups[g] = series(g, vals)
+			}
+		} else {
+			out.value = series("", po.value)
+		}
+		if err := t.rw.write(&out); err != nil {
+			return err
+		}
+	}
+	return t.rw.finish()
+}
+
+func (t *transformWriter) apply(v interface{}, st []transformState) interface{} {
+	var f float64
+	switch x := v.(type) {
+	case float64:
+		f = x
+	case int:
+		f = float64(x)
+	default:
+		return v
+	}
+	if math.IsNaN(f) {
+		return v
+	}
+	for i, tr := range t.transforms {
+		var ok bool
+		if f, ok = tr.apply(f, &st[i]); !ok {
+			return nil
+		}
+	}
+	return f
+}
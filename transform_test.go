@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		params []string
+		exp    []interface{}
+	}{
+		{nil, []interface{}{1.0, 3.0, -2.0, 6.0}},
+		{[]string{"cumsum"}, []interface{}{1.0, 4.0, 2.0, 8.0}},
+		{[]string{"delta"}, []interface{}{nil, 2.0, -5.0, 8.0}},
+		{[]string{"delta,abs"}, []interface{}{nil, 2.0, 5.0, 8.0}},
+		{[]string{"cumsum", "scale:0.5"}, []interface{}{0.5, 2.0, 1.0, 4.0}},
+	}
+	for _, test := range tests {
+		ts, err := parseTransforms(test.params)
+		if err != nil {
+			t.Fatalf("Error parsing %v: %v", test.params, err)
+		}
+		tw := &transformWriter{transforms: ts}
+		st := make([]transformState, len(ts))
+		got := []interface{}{}
+		for _, v := range []float64{1, 3, -2, 6} {
+			got = append(got, tw.apply(v, st))
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.params, got)
+		}
+	}
+
+	for _, bad := range []string{"sum", "scale:x", "cumsum,"} {
+		if _, err := parseTransforms([]string{bad}); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestTransformResults(t *testing.T) {
+	req, _ := http.NewRequest("GET",
+		"/db/_query?transform=cumsum&descending=true", nil)
+	out := &strings.Builder{}
+	rw := newResultWriter(nil, req, out)
+	cached := &processOut{key: 1000 * 1e6, value: []interface{}{1, "x"}}
+	rw.write(&processOut{key: 3000 * 1e6, value: []interface{}{3, "z"}})
+	rw.write(cached)
+	rw.write(&processOut{key: 2000 * 1e6, value: []interface{}{2, "y"}})
+	rw.finish()
+	exp := `{"3000": [6,"z"],` + "\n" + `"2000": [3,"y"],` + "\n" +
+		`"1000": [1,"x"]}`
+	if out.String() != exp {
+		t.Errorf("Expected %s, got %s", exp, out)
+	}
+	if cached.value[0] != 1 {
+		t.Errorf("Expected results to be copied, got %v", cached.value)
+	}
+}
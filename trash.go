@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Deleting a database moves its files (shards and metadata included)
+// into a directory under .trash in the root, named for the database
+// and when it was deleted.  POST /db/_undelete puts the most recent
+// (or the one given by ?deleted=) back, as long as nothing has taken
+// its name since.  Trash older than -trashTime is purged as part of
+// maintenance; with -trashTime=0, deletion is immediate.
+
+const trashDir = ".trash"
+const trashLayout = "20060102T150405.000000000Z"
+
+var trashTime = flag.Duration("trashTime", 7*24*time.Hour,
+	"How long deleted databases are kept for undeletion (0 to delete immediately)")
+
+var errNoTrash = errors.New("no deleted database by that name")
+
+type trashEntry struct {
+	DB      string    `json:"db"`
+	Deleted time.Time `json:"deleted"`
+	dir     string
+}
+
+func trashRoot() string {
+	return filepath.Join(*dbRoot, trashDir)
+}
+
+// listTrash returns what's in the trash, newest first.
+func listTrash() []trashEntry {
+	rv := []trashEntry{}
+	files, _ := ioutil.ReadDir(trashRoot())
+	for _, f := range files {
+		parts := strings.SplitN(f.Name(), "@", 2)
+		if !f.IsDir() || len(parts) != 2 {
+			continue
+		}
+		t, err := time.Parse(trashLayout, parts[1])
+		if err != nil {
+			continue
+		}
+		rv = append(rv, trashEntry{parts[0], t,
+			filepath.Join(trashRoot(), f.Name())})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Deleted.After(rv[j].Deleted)
+	})
+	return rv
+}
+
+// dbFiles are the paths, relative to the root, that make up a
+// database on disk.
+func dbFiles(dbname string) []string {
+	base := dbname + dbExt
+	return []string{base, base + metaExt, base + schemaExt, base + valuesExt,
+		base + indexExt, base + provenanceExt, dbname}
+}
+
+// moveFiles moves whichever of a database's files exist from one
+// directory to another.
+func moveFiles(dbname, from, to string) error {
+	for _, f := range dbFiles(dbname) {
+		err := os.Rename(filepath.Join(from, f), filepath.Join(to, f))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetDB drops everything cached about a database and its shards.
+func forgetDB(dbname string) {
+	shards := dbShards(dbname)
+	dbRemoveConn(dbname)
+	dropQuota(dbname)
+	dropSchema(dbname)
+	for _, s := range shards {
+		name := dbname + "/" + s
+		dbRemoveConn(name)
+		forgetShard(name)
+		fetchedShards.forget(name)
+		dropQuota(name)
+	}
+
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	for n := range metaCache {
+		if n == dbname || strings.HasPrefix(n, dbname+"/") {
+			delete(metaCache, n)
+		}
+	}
+}
+
+// dbtrash deletes a database so it can still be undeleted.
+func dbtrash(dbname string, now time.Time) error {
+	if *trashTime <= 0 || memDatabase(dbname) != nil {
+		return dbdelete(dbname)
+	}
+	if _, err := os.Stat(dbPath(dbname)); err != nil {
+		return err
+	}
+	dir := filepath.Join(trashRoot(), dbname+"@"+now.UTC().Format(trashLayout))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// Writers commit what they have into the moved files as they
+	// close.
+	forgetDB(dbname)
+	if err := moveFiles(dbname, *dbRoot, dir); err != nil {
+		return err
+	}
+	log.Printf("Moved %v to the trash", dbname)
+	return nil
+}
+
+// dbundelete restores a deleted database, the most recent unless a
+// deletion time is given.
+func dbundelete(dbname string, deleted time.Time) error {
+	for _, e := range listTrash() {
+		if e.DB != dbname || !(deleted.IsZero() || e.Deleted.Equal(deleted)) {
+			continue
+		}
+		if err := moveFiles(dbname, e.dir, *dbRoot); err != nil {
+			return err
+		}
+		forgetDB(dbname)
+		log.Printf("Restored %v deleted at %v", dbname, e.Deleted)
+		return os.RemoveAll(e.dir)
+	}
+	return errNoTrash
+}
+
+// purgeTrash removes trash older than -trashTime, along with any of
+// its shards that were archived.
+func purgeTrash(now time.Time) {
+	for _, e := range listTrash() {
+		if now.Sub(e.Deleted) < *trashTime {
+			continue
+		}
+		m := dbMeta{}
+		data, err := ioutil.ReadFile(filepath.Join(e.dir, e.DB+dbExt+metaExt))
+		if err == nil && json.Unmarshal(data, &m) == nil && archive != nil {
+			for _, s := range m.Archived {
+				err := archive.remove(archiveObjectName(e.DB + "/" + s))
+				if err != nil {
+					log.Printf("Error removing archived %v/%v: %v", e.DB, s, err)
+				}
+			}
+		}
+		if err := os.RemoveAll(e.dir); err != nil {
+			log.Printf("Error purging %v: %v", e.dir, err)
+			continue
+		}
+		log.Printf("Purged %v deleted at %v", e.DB, e.Deleted)
+	}
+}
+
+func undeleteDB(parts []string, w http.ResponseWriter, req *http.Request) {
+	var deleted time.Time
+	if d := req.FormValue("deleted"); d != "" {
+		var err error
+		if deleted, err = parseTime(d); err != nil {
+			emitError(400, w, "Bad deleted value", err.Error())
+			return
+		}
+	}
+	if _, err := os.Stat(dbPath(parts[0])); err == nil ||
+		memDatabase(parts[0]) != nil || len(federationMembers(parts[0])) > 0 {
+		emitError(409, w, "Conflict", "a database by that name exists")
+		return
+	}
+	if err := tenantCanCreate(parts[0]); err != nil {
+		emitError(403, w, "Forbidden", err.Error())
+		return
+	}
+
+	switch err := dbundelete(parts[0], deleted); err {
+	case nil:
+		mustEncode(200, w, map[string]interface{}{"ok": true})
+	case errNoTrash:
+		emitError(404, w, "not_found", err.Error())
+	default:
+		emitError(500, w, "Error undeleting DB", err.Error())
+	}
+}
+
+func getTrash(parts []string, w http.ResponseWriter, req *http.Request) {
+	if !checkAdmin(w, req) {
+		return
+	}
+	mustEncode(200, w, listTrash())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	ioutil.WriteFile(dbPath("gone"), []byte("data"), 0666)
+	ioutil.WriteFile(metaPath("gone"), []byte(`{"format": 2}`), 0666)
+	os.MkdirAll(shardDir("gone"), 0777)
+	ioutil.WriteFile(dbPath("gone/2012-08-10"), []byte("shard"), 0666)
+
+	then := time.Date(2012, 8, 10, 0, 0, 0, 0, time.UTC)
+	if err := dbtrash("gone", then); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	if _, err := os.Stat(dbPath("gone")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the database gone, got %v", err)
+	}
+	entries := listTrash()
+	if len(entries) != 1 || entries[0].DB != "gone" ||
+		!entries[0].Deleted.Equal(then) {
+		t.Fatalf("Expected one trash entry, got %+v", entries)
+	}
+
+	if err := dbundelete("other", time.Time{}); err != errNoTrash {
+		t.Errorf("Expected nothing to undelete, got %v", err)
+	}
+	if err := dbundelete("gone", time.Time{}); err != nil {
+		t.Fatalf("Error undeleting: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(dbPath("gone/2012-08-10")); string(b) != "shard" {
+		t.Errorf("Expected the shard back, got %q", b)
+	}
+	if dbFormat("gone").Version != 2 {
+		t.Errorf("Expected the metadata back, got %v", dbFormat("gone"))
+	}
+
+	dbtrash("gone", then)
+	purgeTrash(then.Add(*trashTime / 2))
+	if len(listTrash()) != 1 {
+		t.Errorf("Expected recent trash kept")
+	}
+	purgeTrash(then.Add(*trashTime))
+	if len(listTrash()) != 0 {
+		t.Errorf("Expected old trash purged, got %+v", listTrash())
+	}
+	if _, err := os.Stat(filepath.Join(dir, trashDir)); err != nil {
+		t.Errorf("Expected the trash directory left, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// On SIGUSR2, seriesly re-executes itself for a binary upgrade.  The
+// new process inherits the listening sockets, so connections keep
+// being accepted (or wait in the kernel's backlog) throughout.  It
+// doesn't serve anything until the old process has finished its
+// in-flight requests and committed every write queue, so a database
+// never has two writers.
+//
+// The new process finds what it inherited in the environment: fd 3 is
+// closed by the old process once it's done, and the listeners follow
+// in the order named in upgradeEnv.
+
+const upgradeEnv = "SERIESLY_INHERITED"
+
+const upgradeReadyFd = 3
+
+var inherited = map[string]net.Listener{}
+
+// loadInherited picks up listeners passed from an old process.
+func loadInherited() error {
+	names := os.Getenv(upgradeEnv)
+	if names == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(upgradeReadyFd+1+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		inherited[name] = l
+	}
+	return nil
+}
+
+// listen returns the named inherited listener, or a new one.
+func listen(name, addr string) (net.Listener, error) {
+	if l := inherited[name]; l != nil {
+		log.Printf("Using inherited %v listener on %v", name, l.Addr())
+		return l, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// waitForOldProcess blocks until the process that started us for an
+// upgrade has drained.
+func waitForOldProcess() {
+	if len(inherited) == 0 {
+		return
+	}
+	f := os.NewFile(upgradeReadyFd, "upgrade")
+	defer f.Close()
+	log.Printf("Waiting for the old process to drain")
+	io.Copy(io.Discard, f)
+	log.Printf("Old process finished, serving")
+}
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// startUpgrade starts a new process with our listeners, returning the
+// pipe it's waiting on.
+func startUpgrade(listeners map[string]net.Listener) (*os.File, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	ready, done, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	files := []*os.File{ready}
+	names := []string{}
+	for name, l := range listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			done.Close()
+			return nil, err
+		}
+		defer f.Close()
+		files = append(files, f)
+		names = append(names, name)
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(names, ","))
+	if err := cmd.Start(); err != nil {
+		done.Close()
+		return nil, err
+	}
+	log.Printf("Started upgraded process %v", cmd.Process.Pid)
+	return done, nil
+}
+
+// drainWriters commits everything queued and closes all writers.
+func drainWriters() {
+	dbLock.Lock()
+	names := make([]string, 0, len(dbConns))
+	for n := range dbConns {
+		names = append(names, n)
+	}
+	dbLock.Unlock()
+
+	for _, n := range names {
+		if err := dbflush(n); err != nil {
+			log.Printf("Error flushing %v: %v", n, err)
+		}
+		dbRemoveConn(n)
+	}
+}
+
+// handleUpgrades waits for SIGUSR2, then hands off to a new process
+// and exits once everything accepted here is committed.
+func handleUpgrades(s *http.Server, listeners map[string]net.Listener) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+
+	var done *os.File
+	for range sigs {
+		var err error
+		done, err = startUpgrade(listeners)
+		if err == nil {
+			break
+		}
+		log.Printf("Error starting upgrade: %v", err)
+	}
+
+	if l := listeners["memcached"]; l != nil {
+		l.Close()
+		closeMCConnections()
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		log.Printf("Error finishing requests: %v", err)
+	}
+	drainWriters()
+	done.Close()
+	log.Printf("Drained for upgrade, exiting")
+	os.Exit(0)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMCListenerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	done := make(chan bool)
+	go func() {
+		waitForMCConnections(l)
+		close(done)
+	}()
+
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected accepting to stop once the listener closed")
+	}
+}
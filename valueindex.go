@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dustin/go-couchstore"
+	"github.com/dustin/go-jsonpointer"
+	"github.com/dustin/gojson"
+)
+
+// A value index is an opt-in sidecar file holding the numbers found at
+// some pointers in each document, stored by the writer as documents
+// are written.  A query whose pointers are all indexed reads them from
+// there instead of decoding documents.
+//
+// Each entry records the sequence of the document it was taken from,
+// and is only used while that's still the document's sequence, so
+// anything the index missed (documents from before it was configured,
+// or from a writer that stopped between commits) is read from the
+// document as usual.  Documents with something other than a number at
+// an indexed pointer aren't indexed, as their values are needed as
+// they are.
+
+const valuesExt = ".values"
+
+// The pointers an index file was built for are stored in it, under a
+// key no document has.
+const valueIndexPointersKey = "\x00pointers"
+
+type valueIndexSpec struct {
+	Pointers []string `json:"pointers"`
+}
+
+// A valueEntry is what's stored for one document.
+type valueEntry struct {
+	Seq    uint64             `json:"s"`
+	Values map[string]float64 `json:"v"`
+}
+
+func valuesPath(dbname string) string {
+	return dbPath(dbname) + valuesExt
+}
+
+func (spec *valueIndexSpec) validate() error {
+	if len(spec.Pointers) == 0 {
+		return errors.New("at least one pointer is required")
+	}
+	for _, p := range spec.Pointers {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid pointer: %q", p)
+		}
+	}
+	return nil
+}
+
+// extractValues finds the numbers at the given pointers in a document.
+// ok is false if any of them holds something else, or the document
+// isn't JSON, in which FindMany just finds nothing.
+func extractValues(pointers []string, doc []byte) (map[string]float64, bool) {
+	if json.Validate(doc) != nil {
+		return nil, false
+	}
+	found, err := jsonpointer.FindMany(doc, pointers)
+	if err != nil {
+		return nil, false
+	}
+	rv := make(map[string]float64, len(found))
+	for p, raw := range found {
+		if raw == nil {
+			continue
+		}
+		var v interface{}
+		if json.Unmarshal(raw, &v) != nil {
+			return nil, false
+		}
+		switch x := v.(type) {
+		case nil:
+		case float64:
+			rv[p] = x
+		default:
+			return nil, false
+		}
+	}
+	return rv, true
+}
+
+// openValueIndex opens a database's index, along with the pointers
+// it's built for.
+func openValueIndex(dbname string) (*couchstore.Couchstore, []string, error) {
+	path := valuesPath(dbname)
+	idx, err := couchstore.Open(path, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	recordDBConn(path, idx)
+	var pointers []string
+	doc, _, err := idx.Get(valueIndexPointersKey)
+	if err == nil {
+		err = json.Unmarshal(doc.Value(), &pointers)
+	}
+	if err != nil {
+		closeDBConn(idx)
+		return nil, nil, err
+	}
+	return idx, pointers, nil
+}
+
+// A valueIndexer keeps a database's index up to date as its writer
+// commits.  Only touched by the write loop.
+type valueIndexer struct {
+	dbname   string
+	pointers []string
+	// The last sequence of the database the index has seen.
+	since uint64
+	// Values of documents written since the last flush.  nil for
+	// those to remove from the index.
+	pending map[string]map[string]float64
+}
+
+// newValueIndexer returns the indexer for a database, or nil if it
+// isn't indexed.
+func newValueIndexer(dbname string, db dbStore) *valueIndexer {
+	if _, ok := db.(*memHandle); ok {
+		return nil
+	}
+	idx, pointers, err := openValueIndex(dbname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dbLog.Warn("error opening value index", "db", dbname, "err", err)
+		}
+		return nil
+	}
+	closeDBConn(idx)
+	inf, err := db.Info()
+	if err != nil {
+		return nil
+	}
+	return &valueIndexer{dbname: dbname, pointers: pointers,
+		since: inf.LastSeq, pending: map[string]map[string]float64{}}
+}
+
+func (x *valueIndexer) add(k string, doc []byte) {
+	if x == nil {
+		return
+	}
+	vals, ok := extractValues(x.pointers, doc)
+	if !ok {
+		vals = nil
+	}
+	x.pending[k] = vals
+}
+
+func (x *valueIndexer) remove(k string) {
+	if x != nil {
+		x.pending[k] = nil
+	}
+}
+
+// flush indexes what the database has committed since the last flush,
+// now that the documents' sequences are known.
+func (x *valueIndexer) flush(db dbStore) {
+	if x == nil || len(x.pending) == 0 {
+		return
+	}
+	pending := x.pending
+	x.pending = map[string]map[string]float64{}
+	cs, ok := db.(changeSource)
+	if !ok {
+		return
+	}
+	idx, _, err := openValueIndex(x.dbname)
+	if err != nil {
+		dbLog.Error("error opening value index", "db", x.dbname, "err", err)
+		return
+	}
+	defer closeDBConn(idx)
+
+	bulk := idx.Bulk()
+	defer bulk.Close()
+	err = cs.Changes(x.since, func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		if di.Seq() > x.since {
+			x.since = di.Seq()
+		}
+		vals, ok := pending[di.ID()]
+		if !ok {
+			return nil
+		}
+		if di.Deleted() || vals == nil {
+			bulk.Delete(couchstore.NewDocInfo(di.ID(), 0))
+			return nil
+		}
+		return setValueEntry(bulk, di, vals)
+	})
+	if err == nil {
+		err = bulk.Commit()
+	}
+	if err != nil {
+		dbLog.Error("error updating value index", "db", x.dbname, "err", err)
+	}
+}
+
+// skipTo has the indexer carry on from the database's current
+// sequence, as it is after the file's been rewritten.
+func (x *valueIndexer) skipTo(db dbStore) {
+	if x == nil {
+		return
+	}
+	if inf, err := db.Info(); err == nil {
+		x.since = inf.LastSeq
+	}
+}
+
+func setValueEntry(bulk couchstore.BulkWriter, di *couchstore.DocInfo,
+	vals map[string]float64) error {
+	d, err := json.Marshal(valueEntry{di.Seq(), vals})
+	if err != nil {
+		return err
+	}
+	bulk.Set(couchstore.NewDocInfo(di.ID(), couchstore.DocIsCompressed),
+		couchstore.NewDocument(di.ID(), d))
+	return nil
+}
+
+// dbReindex rebuilds the value index from every document, for the
+// pointers now configured, or removes it if there are none.
+func dbReindex(dq *dbWriter, bulk couchstore.BulkWriter,
+	queued int) (couchstore.BulkWriter, error) {
+	if _, ok := dq.db.(*memHandle); ok {
+		return bulk, errNotOnDisk
+	}
+	bulk = commitBeforeMove(dq, bulk, queued, "reindex")
+	dq.values = nil
+
+	m, err := loadMeta(dq.dbname)
+	if err != nil {
+		return bulk, err
+	}
+	path := valuesPath(dq.dbname)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return bulk, err
+	}
+	if m.ValueIndex == nil {
+		return bulk, nil
+	}
+
+	inf, err := dq.db.Info()
+	if err != nil {
+		return bulk, err
+	}
+	idx, err := couchstore.Open(path, true)
+	if err != nil {
+		return bulk, err
+	}
+	recordDBConn(path, idx)
+	defer closeDBConn(idx)
+
+	pointers := m.ValueIndex.Pointers
+	ibulk := idx.Bulk()
+	defer ibulk.Close()
+	err = dq.db.WalkDocs("", func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo, doc *couchstore.Document) error {
+		if vals, ok := extractValues(pointers, doc.Value()); ok {
+			return setValueEntry(ibulk, di, vals)
+		}
+		return nil
+	})
+	if err == nil {
+		var d []byte
+		d, err = json.Marshal(pointers)
+		ibulk.Set(couchstore.NewDocInfo(valueIndexPointersKey, 0),
+			couchstore.NewDocument(valueIndexPointersKey, d))
+	}
+	if err == nil {
+		err = ibulk.Commit()
+	}
+	if err != nil {
+		os.Remove(path)
+		return bulk, err
+	}
+	dq.values = &valueIndexer{dbname: dq.dbname, pointers: pointers,
+		since: inf.LastSeq, pending: map[string]map[string]float64{}}
+	dbLog.Info("rebuilt value index", "db", dq.dbname, "docs", inf.DocCount)
+	return bulk, nil
+}
+
+func dbreindex(dbname string) error {
+	return dbrewrite(dbqitem{dbname: dbname, op: opReindex})
+}
+
+// indexedValues looks up the indexed values of a chunk of documents,
+// as a query's plan would fetch them from each document.  Documents
+// missing from the index, or changed since they were indexed, are
+// left out.  It's nil if the plan needs something not indexed.
+func indexedValues(dbname string, plan *extractPlan,
+	infos []*couchstore.DocInfo) map[string]map[string]interface{} {
+	if len(infos) == 0 {
+		return nil
+	}
+	idx, pointers, err := openValueIndex(dbname)
+	if err != nil {
+		return nil
+	}
+	defer closeDBConn(idx)
+
+	indexed := map[string]bool{"_id": true}
+	for _, p := range pointers {
+		indexed[p] = true
+	}
+	for _, k := range plan.keys {
+		if !indexed[k] {
+			return nil
+		}
+	}
+
+	seqs := make(map[string]uint64, len(infos))
+	first, last := infos[0].ID(), ""
+	for _, di := range infos {
+		seqs[di.ID()] = di.Seq()
+		if di.ID() < first {
+			first = di.ID()
+		}
+		if di.ID() > last {
+			last = di.ID()
+		}
+	}
+	rv := map[string]map[string]interface{}{}
+	err = idx.Walk(first, func(_ *couchstore.Couchstore,
+		di *couchstore.DocInfo) error {
+		if di.ID() > last {
+			return couchstore.StopIteration
+		}
+		seq, ok := seqs[di.ID()]
+		if !ok || seq == 0 {
+			return nil
+		}
+		doc, err := idx.GetFromDocInfo(di)
+		if err != nil {
+			return err
+		}
+		e := valueEntry{}
+		if json.Unmarshal(doc.Value(), &e) != nil || e.Seq != seq {
+			return nil
+		}
+		fetched := make(map[string]interface{}, len(e.Values))
+		for p, v := range e.Values {
+			fetched[p] = v
+		}
+		rv[di.ID()] = fetched
+		return nil
+	})
+	if err != nil {
+		queryLog.Warn("error reading value index", "db", dbname, "err", err)
+		return nil
+	}
+	return rv
+}
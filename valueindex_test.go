@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func TestExtractValues(t *testing.T) {
+	ptrs := []string{"/a", "/b/c"}
+	tests := []struct {
+		doc string
+		exp map[string]float64
+		ok  bool
+	}{
+		{`{"a": 1, "b": {"c": 2.5}}`, map[string]float64{"/a": 1, "/b/c": 2.5}, true},
+		{`{"a": 1}`, map[string]float64{"/a": 1}, true},
+		{`{"a": null}`, map[string]float64{}, true},
+		{`{"a": "1"}`, nil, false},
+		{`{"a": 1, "b": {"c": [1]}}`, nil, false},
+		{`not json`, nil, false},
+	}
+	for _, test := range tests {
+		got, ok := extractValues(ptrs, []byte(test.doc))
+		if ok != test.ok || (ok && !reflect.DeepEqual(got, test.exp)) {
+			t.Errorf("%v: expected %v/%v, got %v/%v",
+				test.doc, test.exp, test.ok, got, ok)
+		}
+	}
+}
+
+func TestValueIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seriesly-values")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = dir
+
+	const dbname = "values"
+	if err := dbcreate(dbPath(dbname)); err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	defer forgetDB(dbname)
+
+	store := func(k, doc string) {
+		if err := dbstore(dbname, k, []byte(doc)); err != nil {
+			t.Fatalf("Error storing %v: %v", k, err)
+		}
+	}
+	store("2012-08-10T00:00:00Z", `{"n": 1, "s": "x"}`)
+	store("2012-08-10T00:00:01Z", `{"n": "two"}`)
+	if err := dbflush(dbname); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	err = updateMeta(dbname, func(m *dbMeta) {
+		m.ValueIndex = &valueIndexSpec{[]string{"/n"}}
+	})
+	if err != nil {
+		t.Fatalf("Error configuring: %v", err)
+	}
+	if err := dbreindex(dbname); err != nil {
+		t.Fatalf("Error building the index: %v", err)
+	}
+
+	store("2012-08-10T00:00:02Z", `{"n": 3}`)
+	if err := dbflush(dbname); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+
+	db, err := dbopen(dbname)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	defer closeDBConn(db)
+	infos := []*couchstore.DocInfo{}
+	db.Walk("", func(_ *couchstore.Couchstore, di *couchstore.DocInfo) error {
+		infos = append(infos, di)
+		return nil
+	})
+
+	plan := newExtractPlan([]string{"/n"}, nil, nil, nil, "")
+	got := indexedValues(dbname, plan, infos)
+	exp := map[string]map[string]interface{}{
+		"2012-08-10T00:00:00Z": {"/n": 1.0},
+		"2012-08-10T00:00:02Z": {"/n": 3.0},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	// An entry for an older version of a document isn't used.
+	stale := []*couchstore.DocInfo{couchstore.NewDocInfo(infos[0].ID(), 0)}
+	if got := indexedValues(dbname, plan, stale); len(got) != 0 {
+		t.Errorf("Expected nothing for a changed document, got %v", got)
+	}
+
+	// Nor is the index for pointers it doesn't have.
+	plan = newExtractPlan([]string{"/s"}, nil, nil, nil, "")
+	if got := indexedValues(dbname, plan, infos); got != nil {
+		t.Errorf("Expected no index for /s, got %v", got)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// A view is a query saved on a database under a name.  Running it
+// takes the saved parameters, overridden by any given in the request,
+// so e.g. from and to can vary while the rest stays fixed.
+//
+// Saved values may also contain placeholders like {{host}}, filled in
+// from request parameters of the same name when the view is run.
+
+const viewMatch = "[-_a-zA-Z0-9]+"
+
+var viewPlaceholder = regexp.MustCompile(`\{\{([-_a-zA-Z0-9]+)\}\}`)
+
+func dbView(dbname, name string) (queryBody, bool) {
+	m, err := loadMeta(dbname)
+	if err != nil {
+		return queryBody{}, false
+	}
+	v, ok := m.Views[name]
+	return v, ok
+}
+
+// viewForm binds a view's placeholders and merges request parameters
+// over its own.  Parameters used to fill placeholders aren't passed on.
+func viewForm(v queryBody, override url.Values) (url.Values, error) {
+	form := url.Values{}
+	used := map[string]bool{}
+	var missing []string
+	for k, vals := range v.values() {
+		for _, val := range vals {
+			form.Add(k, viewPlaceholder.ReplaceAllStringFunc(val,
+				func(m string) string {
+					name := m[2 : len(m)-2]
+					bound, ok := override[name]
+					if !ok {
+						missing = append(missing, name)
+						return m
+					}
+					used[name] = true
+					return bound[0]
+				}))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, &paramError{"Missing view parameter",
+			strings.Join(missing, ", ")}
+	}
+	for k, vals := range override {
+		if !used[k] {
+			form[k] = vals
+		}
+	}
+	return form, nil
+}
+
+// viewPlaceholders lists the parameters a view needs bound.
+func viewPlaceholders(v queryBody) []string {
+	seen := map[string]bool{}
+	rv := []string{}
+	for _, vals := range v.values() {
+		for _, val := range vals {
+			for _, m := range viewPlaceholder.FindAllStringSubmatch(val, -1) {
+				if !seen[m[1]] {
+					seen[m[1]] = true
+					rv = append(rv, m[1])
+				}
+			}
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func listViews(parts []string, w http.ResponseWriter, req *http.Request) {
+	m, err := loadMeta(parts[0])
+	if err != nil {
+		emitError(500, w, "Error loading metadata", err.Error())
+		return
+	}
+	names := []string{}
+	for n := range m.Views {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	mustEncode(200, w, names)
+}
+
+func putView(parts []string, w http.ResponseWriter, req *http.Request) {
+	v := queryBody{}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err == nil && len(viewPlaceholders(v)) == 0 {
+		// Templated views can only be checked once they're bound.
+		_, err = parseQueryParams(v.values())
+	}
+	if err != nil {
+		emitParamError(w, err)
+		return
+	}
+
+	err = updateMeta(parts[0], func(m *dbMeta) {
+		views := map[string]queryBody{}
+		for n, old := range m.Views {
+			views[n] = old
+		}
+		views[parts[1]] = v
+		m.Views = views
+	})
+	if err != nil {
+		emitError(500, w, "Error storing view", err.Error())
+		return
+	}
+	mustEncode(201, w, map[string]interface{}{"ok": true})
+}
+
+func getView(parts []string, w http.ResponseWriter, req *http.Request) {
+	v, ok := dbView(parts[0], parts[1])
+	if !ok {
+		emitError(404, w, "not_found", "no such view")
+		return
+	}
+	if req.FormValue("definition") == "true" {
+		mustEncode(200, w, map[string]interface{}{
+			"query":      v,
+			"parameters": viewPlaceholders(v),
+		})
+		return
+	}
+	form, err := viewForm(v, req.URL.Query())
+	if err != nil {
+		emitParamError(w, err)
+		return
+	}
+	req.Form = form
+	query(parts[:1], w, req)
+}
+
+func deleteView(parts []string, w http.ResponseWriter, req *http.Request) {
+	if _, ok := dbView(parts[0], parts[1]); !ok {
+		emitError(404, w, "not_found", "no such view")
+		return
+	}
+	err := updateMeta(parts[0], func(m *dbMeta) {
+		views := map[string]queryBody{}
+		for n, old := range m.Views {
+			if n != parts[1] {
+				views[n] = old
+			}
+		}
+		m.Views = views
+	})
+	if err != nil {
+		emitError(500, w, "Error deleting view", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
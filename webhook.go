@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// With -webhooks, database lifecycle events are POSTed as JSON to
+// each of the URLs given, e.g.
+//
+//	{"event": "compacted", "db": "metrics", "time": "...",
+//	 "detail": {"took_ms": 1200}}
+//
+// so orchestration can react without polling.  Events are db_created,
+// db_deleted, compacted, retention (when a sweep deletes anything or
+// fails) and replication_error (when imported changes can't be
+// stored).  -webhookEvents limits which are sent.  Delivery happens
+// in the background and is best effort: events are dropped if too
+// many are waiting, and failed deliveries are logged, not retried.
+
+var webhookURLs = flag.String("webhooks", "",
+	"Comma separated URLs to POST database lifecycle events to")
+var webhookEvents = flag.String("webhookEvents", "",
+	"Comma separated lifecycle events to send (all if empty)")
+
+const (
+	hookCreated          = "db_created"
+	hookDeleted          = "db_deleted"
+	hookCompacted        = "compacted"
+	hookRetention        = "retention"
+	hookReplicationError = "replication_error"
+)
+
+// How many events may wait to be delivered.
+const webhookBacklog = 1000
+
+const webhookTimeout = 30 * time.Second
+
+type webhookEvent struct {
+	Event  string                 `json:"event"`
+	DB     string                 `json:"db"`
+	Time   time.Time              `json:"time"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+}
+
+var webhookQueue = make(chan webhookEvent, webhookBacklog)
+var webhookOnce = sync.Once{}
+
+func commaList(s string) []string {
+	rv := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			rv = append(rv, e)
+		}
+	}
+	return rv
+}
+
+func wantsWebhook(event string) bool {
+	if len(commaList(*webhookURLs)) == 0 {
+		return false
+	}
+	events := commaList(*webhookEvents)
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return len(events) == 0
+}
+
+// notify queues an event for the webhooks.
+func notify(event, dbname string, detail map[string]interface{}) {
+	if !wantsWebhook(event) {
+		return
+	}
+	webhookOnce.Do(func() { go webhookSender() })
+	e := webhookEvent{event, dbname, time.Now().UTC(), detail}
+	select {
+	case webhookQueue <- e:
+	default:
+		log.Printf("Too many webhook events waiting, dropping %v of %v",
+			event, dbname)
+	}
+}
+
+func webhookSender() {
+	for e := range webhookQueue {
+		deliverWebhook(e)
+	}
+}
+
+func deliverWebhook(e webhookEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding %v event of %v: %v", e.Event, e.DB, err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	for _, u := range commaList(*webhookURLs) {
+		res, err := client.Post(u, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error sending %v event of %v to %v: %v",
+				e.Event, e.DB, u, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			log.Printf("Webhook %v returned %v for %v event of %v",
+				u, res.Status, e.Event, e.DB)
+		}
+	}
+}
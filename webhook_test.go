@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+func TestWantsWebhook(t *testing.T) {
+	defer func(u, e string) { *webhookURLs, *webhookEvents = u, e }(
+		*webhookURLs, *webhookEvents)
+
+	*webhookURLs, *webhookEvents = "", ""
+	if wantsWebhook(hookCreated) {
+		t.Errorf("Expected no events without webhooks")
+	}
+	*webhookURLs = "http://a/, http://b/"
+	if !wantsWebhook(hookCreated) || !wantsWebhook(hookRetention) {
+		t.Errorf("Expected every event without a filter")
+	}
+	*webhookEvents = "compacted, db_deleted"
+	if wantsWebhook(hookCreated) || !wantsWebhook(hookDeleted) {
+		t.Errorf("Expected only the listed events")
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	got := make(chan webhookEvent, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		e := webhookEvent{}
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Errorf("Error decoding event: %v", err)
+		}
+		got <- e
+	}))
+	defer s.Close()
+	defer func(u, e string) { *webhookURLs, *webhookEvents = u, e }(
+		*webhookURLs, *webhookEvents)
+	*webhookURLs, *webhookEvents = s.URL, ""
+
+	notify(hookCompacted, "metrics", map[string]interface{}{"took_ms": 5})
+	select {
+	case e := <-got:
+		if e.Event != hookCompacted || e.DB != "metrics" ||
+			e.Detail["took_ms"] != 5.0 || e.Time.IsZero() {
+			t.Errorf("Expected a compacted event for metrics, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the webhook")
+	}
+}
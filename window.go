@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/dustin/go-couchstore"
+)
+
+// Sliding windows overlap, e.g. group=60000&slide=10000 is a one
+// minute window starting every ten seconds.  A window is keyed by its
+// start, and each document is reduced in every window covering it, so
+// windows at the edges of the data may cover only part of it.
+
+type slidingWindows struct {
+	size, slide int64
+	pending     map[int64][]*couchstore.DocInfo
+}
+
+// A window is the documents to reduce for one window start.
+type window struct {
+	start int64
+	infos []*couchstore.DocInfo
+}
+
+func newSlidingWindows(size, slide int64) *slidingWindows {
+	return &slidingWindows{size, slide, map[int64][]*couchstore.DocInfo{}}
+}
+
+// add adds the documents in the slide sized bucket starting at b to
+// each window covering it.
+func (s *slidingWindows) add(b int64, infos []*couchstore.DocInfo) {
+	for w := b - s.size + s.slide; w <= b; w += s.slide {
+		s.pending[w] = append(s.pending[w], infos...)
+	}
+}
+
+// complete removes and returns, in order, the windows ending by t.
+func (s *slidingWindows) complete(t int64) []window {
+	rv := []window{}
+	for w, infos := range s.pending {
+		if w+s.size <= t {
+			rv = append(rv, window{w, infos})
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].start < rv[j].start })
+	for _, w := range rv {
+		delete(s.pending, w.start)
+	}
+	return rv
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/go-couchstore"
+)
+
+func TestSlidingWindows(t *testing.T) {
+	s := newSlidingWindows(30, 10)
+	a := couchstore.NewDocInfo("a", 0)
+	b := couchstore.NewDocInfo("b", 0)
+	s.add(100, []*couchstore.DocInfo{a})
+	s.add(120, []*couchstore.DocInfo{b})
+
+	starts := func(ws []window) []int64 {
+		rv := []int64{}
+		for _, w := range ws {
+			rv = append(rv, w.start)
+		}
+		return rv
+	}
+	if got := starts(s.complete(120)); !reflect.DeepEqual(got, []int64{80, 90}) {
+		t.Errorf("Expected windows 80 and 90 complete, got %v", got)
+	}
+	rest := s.complete(200)
+	if got := starts(rest); !reflect.DeepEqual(got, []int64{100, 110, 120}) {
+		t.Errorf("Expected windows 100-120, got %v", got)
+	}
+	if len(rest[0].infos) != 2 || len(rest[2].infos) != 1 {
+		t.Errorf("Expected window 100 to have both docs and 120 one, got %v",
+			rest)
+	}
+}
+
+func TestSlideParam(t *testing.T) {
+	for _, slide := range []string{"0", "7", "120", "x"} {
+		form := url.Values{"group": {"60"}, "slide": {slide},
+			"ptr": {"/a"}, "reducer": {"avg"}}
+		if _, err := parseQueryParams(form); err == nil {
+			t.Errorf("Expected an error for slide=%v", slide)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// On a busy host, query goroutines can keep a writer from running
+// when its flush timer fires, so writes pile up until the queue
+// overflows.  With -pinWriters, each write loop gets an OS thread of
+// its own, whose priority can be raised with -writerNice (negative
+// values usually need privileges).  -writerProcs leaves extra
+// processors beyond those the query workers are sized for.
+//
+// How late flush timers are handled is reported as writer scheduling
+// delay, so the effect can be checked.
+
+// schedDelays tracks how long writers took to notice their timers.
+type schedDelays struct {
+	mu      sync.Mutex
+	samples int64
+	total   time.Duration
+	max     time.Duration
+}
+
+var writerDelays = &schedDelays{}
+
+func (s *schedDelays) record(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples++
+	s.total += d
+	if d > s.max {
+		s.max = d
+	}
+}
+
+func (s *schedDelays) stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	avg := time.Duration(0)
+	if s.samples > 0 {
+		avg = s.total / time.Duration(s.samples)
+	}
+	return map[string]interface{}{
+		"pinned":        *pinWriters,
+		"timer_samples": s.samples,
+		"delay_avg_ms":  float64(avg) / float64(time.Millisecond),
+		"delay_max_ms":  float64(s.max) / float64(time.Millisecond),
+	}
+}
+
+// pinWriter is called from a write loop to give it its own thread.
+// The thread exits with the loop.
+func pinWriter(dbname string) {
+	if !*pinWriters {
+		return
+	}
+	runtime.LockOSThread()
+	if *writerNice != 0 {
+		if err := setThreadNice(*writerNice); err != nil {
+			log.Printf("Error setting priority of %v writer: %v",
+				dbname, err)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"syscall"
+)
+
+// On Linux, priority is per thread.
+func setThreadNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), nice)
+}
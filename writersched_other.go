@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func setThreadNice(nice int) error {
+	return errors.New("per thread priority is only supported on linux")
+}
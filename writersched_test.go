@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedDelays(t *testing.T) {
+	s := &schedDelays{}
+	s.record(time.Millisecond)
+	s.record(3 * time.Millisecond)
+	st := s.stats()
+	if st["timer_samples"] != int64(2) || st["delay_avg_ms"] != 2.0 ||
+		st["delay_max_ms"] != 3.0 {
+		t.Errorf("Unexpected stats: %v", st)
+	}
+}